@@ -1,43 +1,61 @@
 package main
 
 import (
-	"crypto/rand"
-	"crypto/sha512"
+	"crypto/subtle"
 	"encoding/json"
-	"fmt"
+	"errors"
 	"io"
 	"log"
 	"net/http"
+	"slices"
+	"time"
 )
 
+// apiRoutes Returns the handlers of the /api/... urls, by path. Every route is documented in openapi.json.
+func (s *server) apiRoutes() map[string]http.HandlerFunc {
+	return map[string]http.HandlerFunc{
+		"/api/updatemeetup":   s.updateMeetUp,
+		"/api/getusermeetup":  s.getUserMeetUp,
+		"/api/getadminmeetup": s.getAdminMeetUp,
+		"/api/summary":        s.getSummary,
+		"/api/ics":            s.getIcs,
+		"/api/feed":           s.getFeed,
+		"/api/deletemeetup":   s.deleteMeetUp,
+		"/api/restoremeetup":  s.restoreMeetUp,
+		"/api/rotatehashes":   s.rotateHashes,
+		"/api/finalisemeetup": s.finaliseMeetUp,
+		"/api/reopenmeetup":   s.reopenMeetUp,
+		"/api/updateuser":     s.updateUser,
+		"/api/deleteuser":     s.deleteUser,
+		"/api/restoreuser":    s.restoreUser,
+		"/api/events":         s.getEvents,
+		"/api/addwebhook":     s.addWebhook,
+		"/api/getwebhooks":    s.getWebhooks,
+		"/api/deletewebhook":  s.deleteWebhook,
+		"/api/gethistory":     s.getHistory,
+		"/api/openapi.json":   getOpenApi,
+	}
+}
+
 // Routes all /api/... requests
-func apiRouter(w http.ResponseWriter, r *http.Request) {
-	switch r.URL.Path {
-	case "/api/updatemeetup":
-		updateMeetUp(w, r)
-		break
-	case "/api/getusermeetup":
-		getUserMeetUp(w, r)
-		break
-	case "/api/getadminmeetup":
-		getAdminMeetUp(w, r)
-		break
-	case "/api/deletemeetup":
-		deleteMeetUp(w, r)
-		break
-	case "/api/updateuser":
-		updateUser(w, r)
-		break
-	case "/api/deleteuser":
-		deleteUser(w, r)
-		break
-	default:
-		http.Error(w, "not found", http.StatusNotFound)
+func (s *server) apiRouter(w http.ResponseWriter, r *http.Request) {
+	if handler, found := s.api[r.URL.Path]; found {
+		handler(w, r)
+		return
+	}
+	http.Error(w, "not found", http.StatusNotFound)
+}
+
+// Handles the request for the OpenAPI document of the api.
+func getOpenApi(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if _, err := w.Write(openApiSpec); err != nil {
+		log.Printf("getOpenApi failed: error writing response. %s\n", err)
 	}
 }
 
 // Handles the json request to update a new meetup. If no adminhash is present, then a new meetup gets created.
-func updateMeetUp(w http.ResponseWriter, r *http.Request) {
+func (s *server) updateMeetUp(w http.ResponseWriter, r *http.Request) {
 	var err error
 
 	defer func() {
@@ -46,113 +64,103 @@ func updateMeetUp(w http.ResponseWriter, r *http.Request) {
 		}
 	}()
 
-	var newMeetUp MeetUp
+	// The optional fields are pointers, an update keeps the stored value when they're left out
+	type reqStruct struct {
+		MeetUp
+		Email   *string `json:"email"`
+		Expires *int64  `json:"expires"`
+	}
+	var reqJson reqStruct
 
 	// Decode the json into a MeetUp struct
-	if err = json.NewDecoder(io.LimitReader(r.Body, maxLongJsonBytesLen)).Decode(&newMeetUp); err != nil { // 4KB max json length
+	if err = json.NewDecoder(io.LimitReader(r.Body, maxLongJsonBytesLen)).Decode(&reqJson); err != nil { // 4KB max json length
 		log.Printf("updateMeetUp invalid json: %s\n", err)
-		writeJsonError(w, "invalid json")
+		writeJsonError(w, codeInvalidJson, "invalid json")
 		return
 	}
-
-	// Validate dates
-	if len(newMeetUp.Dates) == 0 {
-		writeJsonError(w, "no dates selected")
-		return
-	} else {
-		for _, date := range newMeetUp.Dates {
-			if date <= 0 {
-				writeJsonError(w, "invalid date")
-				return
-			}
-		}
+	newMeetUp := reqJson.MeetUp
+	if reqJson.Email != nil {
+		newMeetUp.Email = *reqJson.Email
 	}
-
-	for i := 0; i < len(newMeetUp.Dates); i++ {
-		if len(newMeetUp.Users) > 0 { // No users allowed when creating or updating
-			writeJsonError(w, "invalid user object.")
-			return
-		}
+	if reqJson.Expires != nil {
+		newMeetUp.Expires = *reqJson.Expires
 	}
 
-	if newMeetUp.AdminHash == "" { // If no adminhash, a new meetup is being created, therefore generate both the hashes.
-		randByteLen := 64
-
-		// Generate the user hash
-		randBytes := make([]byte, randByteLen)
-		if _, err := rand.Read(randBytes); err != nil {
-			log.Printf("updateMeetUp failed: error reading random bytes for user hash. %s\n", err)
-			writeJsonError(w, "Error reading random bytes.")
-		}
-		newMeetUp.UserHash = fmt.Sprintf("%x", sha512.Sum512(randBytes))
-
-		// Generate the admin hash
-		randBytes = make([]byte, randByteLen)
-		if _, err := rand.Read(randBytes); err != nil {
-			log.Printf("updateMeetUp failed: error reading random bytes for admin hash. %s\n", err)
-			writeJsonError(w, "Error reading random bytes.")
-		}
-		newMeetUp.AdminHash = fmt.Sprintf("%x", sha512.Sum512(randBytes))
+	if err = validateOptions(&newMeetUp); err != nil {
+		writeTxError(w, "updateMeetUp", err)
+		return
+	} else if err = validateEmail("email", newMeetUp.Email); err != nil {
+		writeTxError(w, "updateMeetUp", err)
+		return
+	} else if newMeetUp.Expires < 0 {
+		writeTxError(w, "updateMeetUp", invalidField("expires", "The expiry date is invalid."))
+		return
+	} else if len(newMeetUp.Users) > 0 { // No users allowed when creating or updating
+		writeTxError(w, "updateMeetUp", invalidField("users", "invalid user object."))
+		return
+	}
 
-		err = newMeetUp.Create()
-		if err != nil {
-			log.Printf("ajaxCreateHandler: err creating database rows: %s\n", err)
-			writeJsonError(w, "Error creating new meetup.")
+	if newMeetUp.AdminHash == "" { // If no adminhash, a new meetup is being created
+		if err = s.createMeetUp(&newMeetUp, s.clientIpHash(r)); err != nil {
+			writeTxError(w, "updateMeetUp", err)
 			return
 		}
 	} else {
 		// Check the adminhash is valid
 		if err = validateHash(newMeetUp.AdminHash); err != nil {
 			log.Printf("updateMeetUp failed: invalid admin hash. hash:%q, error:%s\n", newMeetUp.AdminHash, err)
-			writeJsonError(w, "invalid admin hash.")
+			writeJsonError(w, codeInvalidHash, "invalid admin hash.")
 			return
 		}
 
-		var currMeetUp MeetUp
+		newMeetUp, err = s.changeMeetUp(s.clientIpHash(r), readMeetUpByAdminHash(newMeetUp.AdminHash), func(currMeetUp *MeetUp) error {
+			if err := checkRevision(r, newMeetUp.Revision, *currMeetUp); err != nil {
+				return err
+			}
 
-		//Get MeetUp object by adminhash
-		if err = currMeetUp.GetByAdminHash(newMeetUp.AdminHash); err != nil {
-			if err.Error() == "no rows matching the adminhash" { // No rows found for this hash, send the user to the start page.
-				log.Printf("updateMeetUp failed: hash:%q, error:%s\n", newMeetUp.AdminHash, err)
-				writeJsonError(w, "admin hash not found.")
-			} else {
-				log.Printf("updateMeetUp failed: MeetUp.GetByAdminHash() hash:%q, error:%s\n", newMeetUp.AdminHash, err)
-				writeJsonError(w, "database error.")
+			currMeetUp.Dates = newMeetUp.Dates
+			currMeetUp.Durations = newMeetUp.Durations
+			currMeetUp.Description = newMeetUp.Description
+			if reqJson.Email != nil {
+				currMeetUp.Email = newMeetUp.Email
+			}
+			if reqJson.Expires != nil {
+				currMeetUp.Expires = newMeetUp.Expires
+			}
+			if currMeetUp.HasDate(currMeetUp.FinalDate) == false { // The final date was removed, reopen the meetup
+				currMeetUp.FinalDate = 0
 			}
+			return nil
+		})
+		if errors.Is(err, errRevisionConflict) && r.Header.Get("If-Match") != "" {
+			writeApiError(w, http.StatusPreconditionFailed, revisionConflictError)
 			return
-		}
-
-		// Update the database.
-		currMeetUp.Dates = newMeetUp.Dates
-		currMeetUp.Description = newMeetUp.Description
-
-		if err = currMeetUp.Update(); err != nil {
-			log.Printf("updateMeetUp failed: MeetUp.Update() hash:%q, error:%s\n", newMeetUp.AdminHash, err)
-			writeJsonError(w, "database error. could not update.")
+		} else if err != nil {
+			writeTxError(w, "updateMeetUp", err)
 			return
 		}
-
-		newMeetUp = currMeetUp
 	}
 
 	// Create and write json response to the client
 	type CreateResponseResult struct {
 		UserHash  string `json:"userhash"`
 		AdminHash string `json:"adminhash"`
+		Revision  int64  `json:"revision"`
 	}
 	type CreateResponse struct {
 		Result CreateResponseResult `json:"result"`
 		Error  string               `json:"error"`
 	}
 
-	successResponse := CreateResponse{Result: CreateResponseResult{UserHash: newMeetUp.UserHash, AdminHash: newMeetUp.AdminHash}, Error: ""}
+	successResponse := CreateResponse{Result: CreateResponseResult{UserHash: newMeetUp.UserHash, AdminHash: newMeetUp.AdminHash, Revision: newMeetUp.Revision}, Error: ""}
 
 	js, err := json.Marshal(successResponse)
 	if err != nil {
-		writeJsonError(w, err.Error())
+		writeJsonError(w, codeInternalError, err.Error())
 		return
 	}
 	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("ETag", revisionETag(newMeetUp.Revision))
 
 	if _, err = w.Write(js); err != nil {
 		log.Printf("updateMeetUp failed: error writing response. %s\n", err)
@@ -160,7 +168,7 @@ func updateMeetUp(w http.ResponseWriter, r *http.Request) {
 }
 
 // Handles the json request to get meetup info with a user hash.
-func getUserMeetUp(w http.ResponseWriter, r *http.Request) {
+func (s *server) getUserMeetUp(w http.ResponseWriter, r *http.Request) {
 	var err error
 
 	defer func() {
@@ -171,51 +179,61 @@ func getUserMeetUp(w http.ResponseWriter, r *http.Request) {
 
 	type reqStruct struct {
 		UserHash string `json:"userhash"`
+		Token    string `json:"token"` // Optional, the response has the name of its user
 	}
 	var reqJson reqStruct
 
 	// Decode the json
 	if err = json.NewDecoder(io.LimitReader(r.Body, maxShortJsonBytesLen)).Decode(&reqJson); err != nil {
 		log.Printf("getUserMeetUp invalid json: %s\n", err)
-		writeJsonError(w, "invalid json.")
+		writeJsonError(w, codeInvalidJson, "invalid json.")
 		return
 	}
 
 	// Check the userhash is valid
 	if err = validateHash(reqJson.UserHash); err != nil {
 		log.Printf("getUserMeetUp invalid user hash: %s\n", err)
-		writeJsonError(w, "invalid hash.")
+		writeJsonError(w, codeInvalidHash, "invalid hash.")
 		return
 	}
 
 	meetUpObj := MeetUp{}
 
-	if err = meetUpObj.GetByUserHash(reqJson.UserHash); err != nil {
-		if err.Error() == "no rows matching the userhash" {
-			writeJsonError(w, "The meetup was not found.")
+	if meetUpObj, err = s.store.GetMeetUpByUserHash(reqJson.UserHash); err != nil {
+		if errors.Is(err, ErrNotFound) {
+			writeJsonError(w, codeNotFound, "The meetup was not found.")
 		} else {
 			log.Printf("getUserMeetUp: err getting by userhash: %s\n", err)
-			writeJsonError(w, "database error.")
+			writeJsonError(w, codeDatabaseError, "database error.")
 		}
 		return
 	}
 
 	// Create and write json response to the client
 	type CreateResponseResult struct {
+		Id          int64   `json:"id"` // Stays the same when the admin replaces the hashes
 		Dates       []int64 `json:"dates"`
+		Durations   []int64 `json:"durations"`
+		Slots       []Slot  `json:"slots"`
 		Users       Users   `json:"users"`
 		Description string  `json:"description"`
+		FinalDate   int64   `json:"finaldate"`
+		UserName    string  `json:"username"` // The user with the token of the request, empty if none
 	}
 	type CreateResponse struct {
 		Result CreateResponseResult `json:"result"`
 		Error  string               `json:"error"`
 	}
 
-	successResponse := CreateResponse{Result: CreateResponseResult{Dates: meetUpObj.Dates, Users: meetUpObj.Users, Description: meetUpObj.Description}, Error: ""}
+	var userName string
+	if userObj, found := meetUpObj.Users.byToken(reqJson.Token); found {
+		userName = userObj.Name
+	}
+	successResponse := CreateResponse{Result: CreateResponseResult{UserName: userName, Id: meetUpObj.Id, Dates: meetUpObj.Dates, Durations: meetUpObj.Durations, Slots: meetUpObj.Slots(), Users: meetUpObj.Users, Description: meetUpObj.Description, FinalDate: meetUpObj.FinalDate}, Error: ""}
 
 	js, err := json.Marshal(successResponse)
 	if err != nil {
-		writeJsonError(w, err.Error())
+		writeJsonError(w, codeInternalError, err.Error())
 		return
 	}
 	w.Header().Set("Content-Type", "application/json")
@@ -226,7 +244,7 @@ func getUserMeetUp(w http.ResponseWriter, r *http.Request) {
 }
 
 // Handles the json request to get meetup info with an admin hash.
-func getAdminMeetUp(w http.ResponseWriter, r *http.Request) {
+func (s *server) getAdminMeetUp(w http.ResponseWriter, r *http.Request) {
 	var err error
 
 	defer func() {
@@ -243,28 +261,30 @@ func getAdminMeetUp(w http.ResponseWriter, r *http.Request) {
 	// Decode the json
 	if err = json.NewDecoder(io.LimitReader(r.Body, maxShortJsonBytesLen)).Decode(&reqJson); err != nil {
 		log.Printf("getAdminMeetUp invalid json: %s\n", err)
-		writeJsonError(w, "invalid json.")
+		writeJsonError(w, codeInvalidJson, "invalid json.")
 	}
 
 	// Check the adminhash is valid
 	if err = validateHash(reqJson.AdminHash); err != nil {
 		log.Printf("getAdminMeetUp invalid admin hash: %s\n", err)
-		writeJsonError(w, "invalid hash.")
+		writeJsonError(w, codeInvalidHash, "invalid hash.")
 		return
 	}
 
 	meetUpObj := MeetUp{}
 
-	if err = meetUpObj.GetByAdminHash(reqJson.AdminHash); err != nil {
-		if err.Error() == "no rows matching the adminhash" {
-			writeJsonError(w, "The meetup was not found.")
+	if meetUpObj, err = s.store.GetMeetUpByAdminHash(reqJson.AdminHash); err != nil {
+		if errors.Is(err, ErrNotFound) {
+			writeJsonError(w, codeNotFound, "The meetup was not found.")
 		} else {
 			log.Printf("getAdminMeetUp: err getting by adminhash: %s\n", err)
-			writeJsonError(w, "database error.")
+			writeJsonError(w, codeDatabaseError, "database error.")
 		}
 		return
 	}
 
+	meetUpObj.ExpiryDate = meetUpObj.Expiry(s.expireAfter.Milliseconds())
+
 	// Create and write json response to the client
 	type CreateResponse struct {
 		Result MeetUp `json:"result"`
@@ -275,18 +295,170 @@ func getAdminMeetUp(w http.ResponseWriter, r *http.Request) {
 
 	js, err := json.Marshal(&successResponse)
 	if err != nil {
-		writeJsonError(w, err.Error())
+		writeJsonError(w, codeInternalError, err.Error())
 		return
 	}
 	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("ETag", readETag(meetUpObj.Revision, &meetUpObj))
 
 	if _, err = w.Write(js); err != nil {
 		log.Printf("getAdminMeetUp failed: error writing response. %s\n", err)
 	}
 }
 
+// Handles the json request to rank the meetup options by the users' answers, with either a user or admin hash.
+func (s *server) getSummary(w http.ResponseWriter, r *http.Request) {
+	var err error
+
+	defer func() {
+		if closeErr := r.Body.Close(); closeErr != nil {
+			log.Println(closeErr)
+		}
+	}()
+
+	type reqStruct struct {
+		UserHash  string `json:"userhash"`
+		AdminHash string `json:"adminhash"`
+	}
+	var reqJson reqStruct
+
+	// Decode the json
+	if err = json.NewDecoder(io.LimitReader(r.Body, maxShortJsonBytesLen)).Decode(&reqJson); err != nil {
+		log.Printf("getSummary invalid json: %s\n", err)
+		writeJsonError(w, codeInvalidJson, "invalid json.")
+		return
+	}
+
+	meetUpObj := MeetUp{}
+
+	if reqJson.AdminHash != "" {
+		if err = validateHash(reqJson.AdminHash); err != nil {
+			log.Printf("getSummary invalid admin hash: %s\n", err)
+			writeJsonError(w, codeInvalidHash, "invalid hash.")
+			return
+		}
+		meetUpObj, err = s.store.GetMeetUpByAdminHash(reqJson.AdminHash)
+	} else {
+		if err = validateHash(reqJson.UserHash); err != nil {
+			log.Printf("getSummary invalid user hash: %s\n", err)
+			writeJsonError(w, codeInvalidHash, "invalid hash.")
+			return
+		}
+		meetUpObj, err = s.store.GetMeetUpByUserHash(reqJson.UserHash)
+	}
+	if err != nil {
+		if errors.Is(err, ErrNotFound) {
+			writeJsonError(w, codeNotFound, "The meetup was not found.")
+		} else {
+			log.Printf("getSummary: err getting meetup: %s\n", err)
+			writeJsonError(w, codeDatabaseError, "database error.")
+		}
+		return
+	}
+
+	// Create and write json response to the client
+	type CreateResponse struct {
+		Result []OptionSummary `json:"result"`
+		Error  string          `json:"error"`
+	}
+
+	successResponse := CreateResponse{Result: meetUpObj.Summary(), Error: ""}
+
+	js, err := json.Marshal(successResponse)
+	if err != nil {
+		writeJsonError(w, codeInternalError, err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+
+	if _, err = w.Write(js); err != nil {
+		log.Printf("getSummary failed: error writing response. %s\n", err)
+	}
+}
+
+// Handles the request for an iCalendar file of the meetup with the userhash in the id parameter.
+// Not a json request, errors are returned as http status codes so calendar clients understand them.
+func (s *server) getIcs(w http.ResponseWriter, r *http.Request) {
+	var err error
+
+	defer func() {
+		if closeErr := r.Body.Close(); closeErr != nil {
+			log.Println(closeErr)
+		}
+	}()
+
+	userHash := r.FormValue("id")
+	if err = validateHash(userHash); err != nil {
+		log.Printf("getIcs invalid user hash: %s\n", err)
+		http.Error(w, "invalid hash.", http.StatusBadRequest)
+		return
+	}
+
+	meetUpObj := MeetUp{}
+
+	if meetUpObj, err = s.store.GetMeetUpByUserHash(userHash); err != nil {
+		if errors.Is(err, ErrNotFound) {
+			http.Error(w, "The meetup was not found.", http.StatusNotFound)
+		} else {
+			log.Printf("getIcs: err getting by userhash: %s\n", err)
+			http.Error(w, "database error.", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	w.Header().Set("Content-Disposition", `attachment; filename="meetup.ics"`)
+	serveCalendar(w, r, meetUpObj.calendarSummary(), meetUpObj.calendarEvents(), meetUpObj.ModifiedTime())
+}
+
+// Handles the request for a user's calendar feed, for calendar clients to subscribe to. The meetup userhash is in the
+// id parameter, and the user is picked by their name in the name parameter. The edit token is not accepted, feed urls
+// end up with calendar providers. Lists the dates the user can make, and changes as the meetup does.
+func (s *server) getFeed(w http.ResponseWriter, r *http.Request) {
+	var err error
+
+	defer func() {
+		if closeErr := r.Body.Close(); closeErr != nil {
+			log.Println(closeErr)
+		}
+	}()
+
+	userHash := r.FormValue("id")
+	if err = validateHash(userHash); err != nil {
+		log.Printf("getFeed invalid user hash: %s\n", err)
+		http.Error(w, "invalid hash.", http.StatusBadRequest)
+		return
+	}
+
+	name := r.FormValue("name")
+	if name == "" {
+		http.Error(w, "no user name.", http.StatusBadRequest)
+		return
+	}
+
+	meetUpObj := MeetUp{}
+
+	if meetUpObj, err = s.store.GetMeetUpByUserHash(userHash); err != nil {
+		if errors.Is(err, ErrNotFound) {
+			http.Error(w, "The meetup was not found.", http.StatusNotFound)
+		} else {
+			log.Printf("getFeed: err getting by userhash: %s\n", err)
+			http.Error(w, "database error.", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	for _, userObj := range meetUpObj.Users {
+		if userObj.Name == name {
+			serveCalendar(w, r, meetUpObj.calendarSummary()+" - "+userObj.Name, meetUpObj.userCalendarEvents(userObj), meetUpObj.ModifiedTime())
+			return
+		}
+	}
+
+	http.Error(w, "The user was not found.", http.StatusNotFound)
+}
+
 // Handles the json request to get meetup info with an admin hash.
-func deleteMeetUp(w http.ResponseWriter, r *http.Request) {
+func (s *server) deleteMeetUp(w http.ResponseWriter, r *http.Request) {
 	var err error
 
 	defer func() {
@@ -303,23 +475,44 @@ func deleteMeetUp(w http.ResponseWriter, r *http.Request) {
 	// Decode the json
 	if err = json.NewDecoder(io.LimitReader(r.Body, maxShortJsonBytesLen)).Decode(&reqJson); err != nil {
 		log.Printf("deleteMeetUp failed: invalid json: %s\n", err)
-		writeJsonError(w, "invalid json.")
+		writeJsonError(w, codeInvalidJson, "invalid json.")
 	}
 
 	// Check the adminhash is valid
 	if err = validateHash(reqJson.AdminHash); err != nil {
 		log.Printf("deleteMeetUp failed: invalid admin hash: %s\n", err)
-		writeJsonError(w, "invalid hash.")
+		writeJsonError(w, codeInvalidHash, "invalid hash.")
 		return
 	}
 
-	// Delete MeetUp object by adminhash
-	var dbMeetUp MeetUp
-	if err = dbMeetUp.DeleteByAdminHash(reqJson.AdminHash); err != nil {
+	// Delete MeetUp object by adminhash, telling its webhooks first
+	var idMeetUp int64
+	err = s.store.WithTx(func(tx Store) error {
+		meetUpObj, err := tx.GetMeetUpByAdminHash(reqJson.AdminHash)
+		if errors.Is(err, ErrNotFound) { // Already deleted
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		if err = queueWebhooks(tx, meetUpObj.Id, webhookMeetUpDeleted, nil); err != nil {
+			return err
+		}
+		if err = auditMeetUp(tx, auditMeetUpDeleted, &meetUpObj, nil, s.clientIpHash(r)); err != nil {
+			return err
+		}
+		idMeetUp = meetUpObj.Id
+		return tx.DeleteMeetUp(meetUpObj.Id)
+	})
+	if err != nil {
 		log.Printf("deleteMeetUp failed: err deleting MeetUp: %s\n", err)
-		writeJsonError(w, "error deleting meetup")
+		writeJsonError(w, codeDatabaseError, "error deleting meetup")
 		return
 	}
+	if idMeetUp != 0 {
+		s.events.close(idMeetUp)
+	}
+	s.webhooks.notify()
 
 	w.Header().Set("Content-Type", "application/json")
 	js := []byte(`{"result":"", "error":""}`)
@@ -329,10 +522,11 @@ func deleteMeetUp(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-// Handles the json request to update a user. If the user is not present then they get added.
-func updateUser(w http.ResponseWriter, r *http.Request) {
-	var err error
+// errNotRestorable Returned when there is nothing deleted to restore, or it was deleted longer than deleteGrace ago.
+var errNotRestorable = newApiError(http.StatusNotFound, codeNotFound, "Nothing was deleted recently enough to be restored.")
 
+// Handles the json request to undo the deletion of a meetup, within deleteGrace of it.
+func (s *server) restoreMeetUp(w http.ResponseWriter, r *http.Request) {
 	defer func() {
 		if closeErr := r.Body.Close(); closeErr != nil {
 			log.Println(closeErr)
@@ -340,80 +534,191 @@ func updateUser(w http.ResponseWriter, r *http.Request) {
 	}()
 
 	type reqStruct struct {
-		UserHash string  `json:"userhash"`
-		UserName string  `json:"username"`
-		Dates    []int64 `json:"dates"`
+		AdminHash string `json:"adminhash"`
 	}
 	var reqJson reqStruct
 
 	// Decode the json
-	if err = json.NewDecoder(io.LimitReader(r.Body, maxLongJsonBytesLen)).Decode(&reqJson); err != nil {
-		log.Printf("updateUser failed: invalid json: %s\n", err)
-		writeJsonError(w, "invalid json.")
+	if err := json.NewDecoder(io.LimitReader(r.Body, maxShortJsonBytesLen)).Decode(&reqJson); err != nil {
+		log.Printf("restoreMeetUp failed: invalid json: %s\n", err)
+		writeJsonError(w, codeInvalidJson, "invalid json.")
+		return
 	}
 
-	// Check the userhash is valid
-	if err = validateHash(reqJson.UserHash); err != nil {
-		log.Printf("updateUser failed: invalid user hash: %s\n", err)
-		writeJsonError(w, "invalid hash.")
+	// Check the adminhash is valid
+	if err := validateHash(reqJson.AdminHash); err != nil {
+		log.Printf("restoreMeetUp failed: invalid admin hash: %s\n", err)
+		writeJsonError(w, codeInvalidHash, "invalid hash.")
 		return
 	}
 
-	// Check the username is not empty
-	if reqJson.UserName == "" {
-		writeJsonError(w, "The user name is empty.")
+	_, err := s.undeleteMeetUp(reqJson.AdminHash, "", s.clientIpHash(r))
+	if err != nil {
+		writeTxError(w, "restoreMeetUp", err)
 		return
 	}
 
-	meetUpObj := MeetUp{}
+	w.Header().Set("Content-Type", "application/json")
+	js := []byte(`{"result":"", "error":""}`)
 
-	if err = meetUpObj.GetByUserHash(reqJson.UserHash); err != nil {
-		if err.Error() == "no rows matching the userhash" {
-			writeJsonError(w, "user hash not found.")
-		} else {
-			log.Printf("updateUser: err getting by userhash: %s\n", err)
-			writeJsonError(w, "database error.")
+	if _, err = w.Write(js); err != nil {
+		log.Printf("restoreMeetUp failed: error writing response. %s\n", err)
+	}
+}
+
+// Handles the json request to replace the adminhash of a meetup, and its userhash if asked, so the old links stop
+// working. The users and their edit tokens are kept. The response is the one of api/updatemeetup.
+func (s *server) rotateHashes(w http.ResponseWriter, r *http.Request) {
+	defer func() {
+		if closeErr := r.Body.Close(); closeErr != nil {
+			log.Println(closeErr)
 		}
+	}()
+
+	type reqStruct struct {
+		AdminHash   string `json:"adminhash"`
+		NewUserHash bool   `json:"newuserhash"`
+		Revision    int64  `json:"revision"`
+	}
+	var reqJson reqStruct
+
+	// Decode the json
+	if err := json.NewDecoder(io.LimitReader(r.Body, maxShortJsonBytesLen)).Decode(&reqJson); err != nil {
+		log.Printf("rotateHashes failed: invalid json: %s\n", err)
+		writeJsonError(w, codeInvalidJson, "invalid json.")
 		return
 	}
 
-	// Try and update an existing user with the same name, if the user is already in the database.
-	var userPresent = false
-	for _, userObj := range meetUpObj.Users {
-		if userObj.Name == reqJson.UserName {
-			userObj.Dates = reqJson.Dates
-			if err = userObj.Update(); err != nil {
-				log.Printf("updateUser: error updating users: %s\n", err)
-				writeJsonError(w, "database error updating user.")
-				return
+	// Check the adminhash is valid
+	if err := validateHash(reqJson.AdminHash); err != nil {
+		log.Printf("rotateHashes failed: invalid admin hash: %s\n", err)
+		writeJsonError(w, codeInvalidHash, "invalid hash.")
+		return
+	}
+
+	meetUpObj, err := s.replaceHashes(r, readMeetUpByAdminHash(reqJson.AdminHash), reqJson.Revision, reqJson.NewUserHash)
+	if errors.Is(err, errRevisionConflict) && r.Header.Get("If-Match") != "" {
+		writeApiError(w, http.StatusPreconditionFailed, revisionConflictError)
+		return
+	} else if err != nil {
+		writeTxError(w, "rotateHashes", err)
+		return
+	}
+
+	type responseResult struct {
+		UserHash  string `json:"userhash"`
+		AdminHash string `json:"adminhash"`
+		Revision  int64  `json:"revision"`
+	}
+	type response struct {
+		Result responseResult `json:"result"`
+		Error  string         `json:"error"`
+	}
+
+	js, err := json.Marshal(response{Result: responseResult{UserHash: meetUpObj.UserHash, AdminHash: meetUpObj.AdminHash, Revision: meetUpObj.Revision}})
+	if err != nil {
+		writeJsonError(w, codeInternalError, err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("ETag", revisionETag(meetUpObj.Revision))
+
+	if _, err = w.Write(js); err != nil {
+		log.Printf("rotateHashes failed: error writing response. %s\n", err)
+	}
+}
+
+// Restores the meetup deleted with the admin hash, if it was deleted within deleteGrace. A userHash other than ""
+// has to be the meetup's too. A meetup that had expired gets expireAfter from now, or the janitor would delete it
+// again. Tells the meetup's webhooks, and adds the change to the audit log with the client's ipHash.
+func (s *server) undeleteMeetUp(adminHash, userHash, ipHash string) (meetUp MeetUp, err error) {
+	err = s.store.WithTx(func(tx Store) error {
+		meetUp, err = tx.GetDeletedMeetUpByAdminHash(adminHash)
+		if errors.Is(err, ErrNotFound) || (err == nil && s.pastDeleteGrace(meetUp.DeletedAt)) ||
+			(err == nil && userHash != "" && meetUp.UserHash != userHash) {
+			return errNotRestorable
+		} else if err != nil {
+			return err
+		}
+
+		if err = tx.RestoreMeetUp(meetUp.Id); err != nil {
+			return err
+		}
+		if now := time.Now(); meetUp.Expiry(s.expireAfter.Milliseconds()) <= now.UnixMilli() {
+			meetUp.Expires = now.Add(s.expireAfter).UnixMilli()
+			if err = tx.UpdateMeetUp(&meetUp); err != nil {
+				return err
 			}
-			userPresent = true
-			break
 		}
+		if err = auditMeetUp(tx, auditMeetUpRestored, nil, &meetUp, ipHash); err != nil {
+			return err
+		}
+		return queueWebhooks(tx, meetUp.Id, webhookMeetUpRestored, nil)
+	})
+	if err == nil {
+		s.webhooks.notify()
 	}
-	// Update failed, create a new user
-	if userPresent == false {
-		user := User{IdMeetUp: meetUpObj.Id, Name: reqJson.UserName, Dates: reqJson.Dates}
-		if err = user.Create(); err != nil {
-			log.Printf("updateUser: error creating users: %s\n", err)
-			writeJsonError(w, "database error creating user.")
-			return
+	return
+}
+
+// Replaces the admin hash of the meetup read with read, and its user hash too if newUserHash, when it's at the
+// revision the request asks for, see checkRevision. Returns the meetup with its new hashes. Tells the meetup's
+// /api/events subscribers, webhooks and the organiser's email digest, the streams opened with an old userhash are
+// ended. The change is added to the audit log with the client's ip hash.
+func (s *server) replaceHashes(r *http.Request, read func(tx Store) (MeetUp, error), revision int64, newUserHash bool) (meetUp MeetUp, err error) {
+	adminHash, err := generateHash()
+	if err != nil {
+		log.Printf("replaceHashes failed: error reading random bytes for admin hash. %s\n", err)
+		return meetUp, newApiError(http.StatusInternalServerError, codeInternalError, "Error reading random bytes.")
+	}
+	userHash := ""
+	if newUserHash {
+		if userHash, err = generateHash(); err != nil {
+			log.Printf("replaceHashes failed: error reading random bytes for user hash. %s\n", err)
+			return meetUp, newApiError(http.StatusInternalServerError, codeInternalError, "Error reading random bytes.")
 		}
 	}
 
-	// Finished with the database return json
-	w.Header().Set("Content-Type", "application/json")
-	js := []byte(`{"result":"", "error":""}`)
+	err = s.store.WithTx(func(tx Store) error {
+		if meetUp, err = read(tx); err != nil {
+			return err
+		}
+		if err = checkRevision(r, revision, meetUp); err != nil {
+			return err
+		}
 
-	if _, err = w.Write(js); err != nil {
-		log.Printf("updateUser, error writing response. %s\n", err)
+		meetUp.AdminHash = adminHash
+		if userHash != "" {
+			meetUp.UserHash = userHash
+		}
+		if err = tx.UpdateMeetUpHashes(&meetUp); err != nil {
+			return err
+		}
+		if err = auditMeetUp(tx, auditMeetUpRotated, &meetUp, &meetUp, s.clientIpHash(r)); err != nil {
+			return err
+		}
+		return queueWebhooks(tx, meetUp.Id, webhookMeetUpRotated, nil)
+	})
+	if err != nil {
+		return
+	}
+	if userHash != "" { // The streams were opened with the old userhash
+		s.events.close(meetUp.Id)
+	} else {
+		s.events.publish(meetUp.Id, meetUpEvent{Type: eventMeetUp, Revision: meetUp.Revision})
 	}
+	s.webhooks.notify()
+	s.mail.meetUpChanged(meetUp)
+	return
 }
 
-// Handles the json request to delete a user.
-func deleteUser(w http.ResponseWriter, r *http.Request) {
-	var err error
+// Reports whether something deleted at the time, a UNIX timestamp in milliseconds, can't be restored anymore.
+func (s *server) pastDeleteGrace(deletedAt int64) bool {
+	return deletedAt <= time.Now().Add(-s.deleteGrace).UnixMilli()
+}
 
+// Handles the json request to choose the final date of a meetup. Closes the meetup to changes by the users.
+func (s *server) finaliseMeetUp(w http.ResponseWriter, r *http.Request) {
 	defer func() {
 		if closeErr := r.Body.Close(); closeErr != nil {
 			log.Println(closeErr)
@@ -421,51 +726,756 @@ func deleteUser(w http.ResponseWriter, r *http.Request) {
 	}()
 
 	type reqStruct struct {
-		UserHash string `json:"userhash"`
-		UserName string `json:"username"`
+		AdminHash string `json:"adminhash"`
+		Date      int64  `json:"date"`
 	}
 	var reqJson reqStruct
 
 	// Decode the json
-	if err = json.NewDecoder(io.LimitReader(r.Body, maxShortJsonBytesLen)).Decode(&reqJson); err != nil {
-		log.Printf("deleteUser failed: invalid json: %s\n", err)
-		writeJsonError(w, "invalid json.")
+	if err := json.NewDecoder(io.LimitReader(r.Body, maxShortJsonBytesLen)).Decode(&reqJson); err != nil {
+		log.Printf("finaliseMeetUp failed: invalid json: %s\n", err)
+		writeJsonError(w, codeInvalidJson, "invalid json.")
+		return
 	}
 
-	// Check the userhash is valid
-	if err = validateHash(reqJson.UserHash); err != nil {
-		log.Printf("deleteUser failed: invalid user hash: %s\n", err)
-		writeJsonError(w, "invalid hash.")
+	s.setFinalDate(w, "finaliseMeetUp", s.clientIpHash(r), reqJson.AdminHash, reqJson.Date)
+}
+
+// Handles the json request to reopen a finalised meetup, so the users can change their dates again.
+func (s *server) reopenMeetUp(w http.ResponseWriter, r *http.Request) {
+	defer func() {
+		if closeErr := r.Body.Close(); closeErr != nil {
+			log.Println(closeErr)
+		}
+	}()
+
+	type reqStruct struct {
+		AdminHash string `json:"adminhash"`
+	}
+	var reqJson reqStruct
+
+	// Decode the json
+	if err := json.NewDecoder(io.LimitReader(r.Body, maxShortJsonBytesLen)).Decode(&reqJson); err != nil {
+		log.Printf("reopenMeetUp failed: invalid json: %s\n", err)
+		writeJsonError(w, codeInvalidJson, "invalid json.")
 		return
 	}
 
-	meetUpObj := MeetUp{}
+	s.setFinalDate(w, "reopenMeetUp", s.clientIpHash(r), reqJson.AdminHash, 0)
+}
 
-	if err = meetUpObj.GetByUserHash(reqJson.UserHash); err != nil {
-		if err.Error() == "no rows matching the userhash" {
-			writeJsonError(w, "user hash not found.")
-		} else {
-			log.Printf("deleteUser: err getting by userhash: %s\n", err)
-			writeJsonError(w, "database error.")
-		}
+// Sets the final date of the meetup with the admin hash, and writes the json response. A date of 0 reopens the meetup.
+// ipHash is the client's, for the audit log.
+func (s *server) setFinalDate(w http.ResponseWriter, caller, ipHash, adminHash string, date int64) {
+	var err error
+
+	// Check the adminhash is valid
+	if err = validateHash(adminHash); err != nil {
+		log.Printf("%s failed: invalid admin hash: %s\n", caller, err)
+		writeJsonError(w, codeInvalidHash, "invalid hash.")
 		return
 	}
 
-	for _, userObj := range meetUpObj.Users {
-		if userObj.Name == reqJson.UserName {
-			if err := userObj.Delete(); err != nil {
-				log.Printf("deleteUser: err deleting user: %s\n", err)
-				writeJsonError(w, "database error.")
-				return
-			}
-		}
+	_, err = s.changeMeetUp(ipHash, readMeetUpByAdminHash(adminHash), func(meetUpObj *MeetUp) error {
+		return chooseFinalDate(meetUpObj, "date", date)
+	})
+	if err != nil {
+		writeTxError(w, caller, err)
+		return
 	}
 
-	// Finished with the database return json
 	w.Header().Set("Content-Type", "application/json")
 	js := []byte(`{"result":"", "error":""}`)
 
 	if _, err = w.Write(js); err != nil {
-		log.Printf("updateUser, error writing response. %s\n", err)
+		log.Printf("%s failed: error writing response. %s\n", caller, err)
+	}
+}
+
+// Handles the json request to update a user. If the user is not present then they get added.
+// A new user gets a secret edit token, which must be sent back to update or delete that user later.
+// The meetup admin can override the token check by sending the adminhash instead.
+func (s *server) updateUser(w http.ResponseWriter, r *http.Request) {
+	var err error
+
+	defer func() {
+		if closeErr := r.Body.Close(); closeErr != nil {
+			log.Println(closeErr)
+		}
+	}()
+
+	type reqStruct struct {
+		UserHash  string  `json:"userhash"`
+		UserName  string  `json:"username"`
+		Token     string  `json:"token"`
+		AdminHash string  `json:"adminhash"`
+		Dates     []int64 `json:"dates"`
+		IfNeedBe  []int64 `json:"ifneedbe"`
+		Email     string  `json:"email"` // Optional, gets a confirmation with the edit link
+	}
+	var reqJson reqStruct
+
+	// Decode the json
+	if err = json.NewDecoder(io.LimitReader(r.Body, maxLongJsonBytesLen)).Decode(&reqJson); err != nil {
+		log.Printf("updateUser failed: invalid json: %s\n", err)
+		writeJsonError(w, codeInvalidJson, "invalid json.")
+		return
+	}
+
+	// Check the userhash is valid
+	if err = validateHash(reqJson.UserHash); err != nil {
+		log.Printf("updateUser failed: invalid user hash: %s\n", err)
+		writeJsonError(w, codeInvalidHash, "invalid hash.")
+		return
+	}
+
+	user := User{Name: reqJson.UserName, Dates: reqJson.Dates, IfNeedBe: reqJson.IfNeedBe}
+	if _, err = s.saveUser(reqJson.UserHash, &user, reqJson.Token, reqJson.AdminHash, reqJson.Email, s.clientIpHash(r)); err != nil {
+		writeTxError(w, "updateUser", err)
+		return
+	}
+
+	// Finished with the database return json
+	type CreateResponseResult struct {
+		Token string `json:"token"`
+	}
+	type CreateResponse struct {
+		Result CreateResponseResult `json:"result"`
+		Error  string               `json:"error"`
+	}
+
+	successResponse := CreateResponse{Result: CreateResponseResult{Token: user.Token}, Error: ""}
+
+	js, err := json.Marshal(successResponse)
+	if err != nil {
+		writeJsonError(w, codeInternalError, err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+
+	if _, err = w.Write(js); err != nil {
+		log.Printf("updateUser, error writing response. %s\n", err)
+	}
+}
+
+// Handles the json request to delete a user. Requires the user's edit token or the meetup adminhash.
+func (s *server) deleteUser(w http.ResponseWriter, r *http.Request) {
+	var err error
+
+	defer func() {
+		if closeErr := r.Body.Close(); closeErr != nil {
+			log.Println(closeErr)
+		}
+	}()
+
+	type reqStruct struct {
+		UserHash  string `json:"userhash"`
+		UserName  string `json:"username"`
+		Token     string `json:"token"`
+		AdminHash string `json:"adminhash"`
+	}
+	var reqJson reqStruct
+
+	// Decode the json
+	if err = json.NewDecoder(io.LimitReader(r.Body, maxShortJsonBytesLen)).Decode(&reqJson); err != nil {
+		log.Printf("deleteUser failed: invalid json: %s\n", err)
+		writeJsonError(w, codeInvalidJson, "invalid json.")
+		return
+	}
+
+	// Check the userhash is valid
+	if err = validateHash(reqJson.UserHash); err != nil {
+		log.Printf("deleteUser failed: invalid user hash: %s\n", err)
+		writeJsonError(w, codeInvalidHash, "invalid hash.")
+		return
+	}
+
+	// Deleting a user that isn't there is not an error
+	if err = s.removeUser(reqJson.UserHash, reqJson.UserName, reqJson.Token, reqJson.AdminHash, s.clientIpHash(r)); err != nil && errors.Is(err, errUserNotFound) == false {
+		writeTxError(w, "deleteUser", err)
+		return
+	}
+
+	// Finished with the database return json
+	w.Header().Set("Content-Type", "application/json")
+	js := []byte(`{"result":"", "error":""}`)
+
+	if _, err = w.Write(js); err != nil {
+		log.Printf("updateUser, error writing response. %s\n", err)
+	}
+}
+
+// Handles the json request to undo the deletion of a user, within deleteGrace of it. Needs the same edit token or
+// adminhash as deleting them did.
+func (s *server) restoreUser(w http.ResponseWriter, r *http.Request) {
+	defer func() {
+		if closeErr := r.Body.Close(); closeErr != nil {
+			log.Println(closeErr)
+		}
+	}()
+
+	type reqStruct struct {
+		UserHash  string `json:"userhash"`
+		UserName  string `json:"username"`
+		Token     string `json:"token"`
+		AdminHash string `json:"adminhash"`
+	}
+	var reqJson reqStruct
+
+	// Decode the json
+	if err := json.NewDecoder(io.LimitReader(r.Body, maxShortJsonBytesLen)).Decode(&reqJson); err != nil {
+		log.Printf("restoreUser failed: invalid json: %s\n", err)
+		writeJsonError(w, codeInvalidJson, "invalid json.")
+		return
+	}
+
+	// Check the userhash is valid
+	if err := validateHash(reqJson.UserHash); err != nil {
+		log.Printf("restoreUser failed: invalid user hash: %s\n", err)
+		writeJsonError(w, codeInvalidHash, "invalid hash.")
+		return
+	}
+
+	if err := s.undeleteUser(reqJson.UserHash, reqJson.UserName, reqJson.Token, reqJson.AdminHash, s.clientIpHash(r)); err != nil {
+		writeTxError(w, "restoreUser", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	js := []byte(`{"result":"", "error":""}`)
+
+	if _, err := w.Write(js); err != nil {
+		log.Printf("restoreUser failed: error writing response. %s\n", err)
+	}
+}
+
+// Handles the json request to add a webhook to the meetup with the adminhash. Returns the webhook with its secret,
+// which isn't sent again.
+func (s *server) addWebhook(w http.ResponseWriter, r *http.Request) {
+	defer func() {
+		if closeErr := r.Body.Close(); closeErr != nil {
+			log.Println(closeErr)
+		}
+	}()
+
+	type reqStruct struct {
+		AdminHash string `json:"adminhash"`
+		Url       string `json:"url"`
+	}
+	var reqJson reqStruct
+
+	// Decode the json
+	if err := json.NewDecoder(io.LimitReader(r.Body, maxLongJsonBytesLen)).Decode(&reqJson); err != nil {
+		log.Printf("addWebhook failed: invalid json: %s\n", err)
+		writeJsonError(w, codeInvalidJson, "invalid json.")
+		return
+	}
+
+	// Check the adminhash is valid
+	if err := validateHash(reqJson.AdminHash); err != nil {
+		log.Printf("addWebhook failed: invalid admin hash: %s\n", err)
+		writeJsonError(w, codeInvalidHash, "invalid hash.")
+		return
+	}
+
+	webhook, err := s.createWebhook(readMeetUpByAdminHash(reqJson.AdminHash), reqJson.Url)
+	if err != nil {
+		writeTxError(w, "addWebhook", err)
+		return
+	}
+	writeJsonResult(w, http.StatusOK, newWebhookResult{webhook, webhook.Secret})
+}
+
+// Handles the json request to list the webhooks of the meetup with the adminhash, without their secrets.
+func (s *server) getWebhooks(w http.ResponseWriter, r *http.Request) {
+	defer func() {
+		if closeErr := r.Body.Close(); closeErr != nil {
+			log.Println(closeErr)
+		}
+	}()
+
+	type reqStruct struct {
+		AdminHash string `json:"adminhash"`
+	}
+	var reqJson reqStruct
+
+	// Decode the json
+	if err := json.NewDecoder(io.LimitReader(r.Body, maxShortJsonBytesLen)).Decode(&reqJson); err != nil {
+		log.Printf("getWebhooks failed: invalid json: %s\n", err)
+		writeJsonError(w, codeInvalidJson, "invalid json.")
+		return
+	}
+
+	// Check the adminhash is valid
+	if err := validateHash(reqJson.AdminHash); err != nil {
+		log.Printf("getWebhooks failed: invalid admin hash: %s\n", err)
+		writeJsonError(w, codeInvalidHash, "invalid hash.")
+		return
+	}
+
+	webhooks, err := s.listWebhooks(readMeetUpByAdminHash(reqJson.AdminHash))
+	if err != nil {
+		writeTxError(w, "getWebhooks", err)
+		return
+	}
+	writeJsonResult(w, http.StatusOK, webhooks)
+}
+
+// Handles the json request to delete a webhook of the meetup with the adminhash.
+func (s *server) deleteWebhook(w http.ResponseWriter, r *http.Request) {
+	defer func() {
+		if closeErr := r.Body.Close(); closeErr != nil {
+			log.Println(closeErr)
+		}
+	}()
+
+	type reqStruct struct {
+		AdminHash string `json:"adminhash"`
+		Id        int64  `json:"id"`
+	}
+	var reqJson reqStruct
+
+	// Decode the json
+	if err := json.NewDecoder(io.LimitReader(r.Body, maxShortJsonBytesLen)).Decode(&reqJson); err != nil {
+		log.Printf("deleteWebhook failed: invalid json: %s\n", err)
+		writeJsonError(w, codeInvalidJson, "invalid json.")
+		return
+	}
+
+	// Check the adminhash is valid
+	if err := validateHash(reqJson.AdminHash); err != nil {
+		log.Printf("deleteWebhook failed: invalid admin hash: %s\n", err)
+		writeJsonError(w, codeInvalidHash, "invalid hash.")
+		return
+	}
+
+	if err := s.removeWebhook(readMeetUpByAdminHash(reqJson.AdminHash), reqJson.Id); err != nil {
+		writeTxError(w, "deleteWebhook", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	js := []byte(`{"result":"", "error":""}`)
+
+	if _, err := w.Write(js); err != nil {
+		log.Printf("deleteWebhook failed: error writing response. %s\n", err)
+	}
+}
+
+// Handles the json request for the audit log of the meetup with the adminhash, the latest change first.
+func (s *server) getHistory(w http.ResponseWriter, r *http.Request) {
+	defer func() {
+		if closeErr := r.Body.Close(); closeErr != nil {
+			log.Println(closeErr)
+		}
+	}()
+
+	type reqStruct struct {
+		AdminHash string `json:"adminhash"`
+	}
+	var reqJson reqStruct
+
+	// Decode the json
+	if err := json.NewDecoder(io.LimitReader(r.Body, maxShortJsonBytesLen)).Decode(&reqJson); err != nil {
+		log.Printf("getHistory failed: invalid json: %s\n", err)
+		writeJsonError(w, codeInvalidJson, "invalid json.")
+		return
+	}
+
+	// Check the adminhash is valid
+	if err := validateHash(reqJson.AdminHash); err != nil {
+		log.Printf("getHistory failed: invalid admin hash: %s\n", err)
+		writeJsonError(w, codeInvalidHash, "invalid hash.")
+		return
+	}
+
+	events, err := s.listHistory(readMeetUpByAdminHash(reqJson.AdminHash))
+	if err != nil {
+		writeTxError(w, "getHistory", err)
+		return
+	}
+	writeJsonResult(w, http.StatusOK, events)
+}
+
+// Checks that the request may change the user. Either the user's own edit token or the adminhash of the meetup
+// must match. Users created before edit tokens existed have no token and can be changed by anyone holding the userhash.
+func canEditUser(tx Store, meetUp MeetUp, user User, token, adminHash string) (bool, error) {
+	if isAdmin, err := isMeetUpAdmin(tx, meetUp, adminHash); err != nil || isAdmin {
+		return isAdmin, err
+	}
+	if user.Token == "" {
+		return true, nil
+	}
+	return token != "" && subtle.ConstantTimeCompare([]byte(token), []byte(user.Token)) == 1, nil
+}
+
+// byToken Returns the user with the edit token, false if there is none. Users without a token never match.
+func (u Users) byToken(token string) (User, bool) {
+	if token == "" {
+		return User{}, false
+	}
+	for _, user := range u {
+		if user.Token != "" && subtle.ConstantTimeCompare([]byte(token), []byte(user.Token)) == 1 {
+			return user, true
+		}
+	}
+	return User{}, false
+}
+
+// Reports whether adminHash is the admin hash of the meetup. The store only has the digest of the adminhash, so the
+// meetup is looked up by it.
+func isMeetUpAdmin(tx Store, meetUp MeetUp, adminHash string) (bool, error) {
+	if adminHash == "" {
+		return false, nil
+	}
+	admin, err := tx.GetMeetUpByAdminHash(adminHash)
+	if errors.Is(err, ErrNotFound) {
+		return false, nil
+	}
+	return err == nil && admin.Id == meetUp.Id, err
+}
+
+// Validates the dates and durations of a new or updated meetup, and sorts them. Returns an invalidField apiError.
+func validateOptions(m *MeetUp) error {
+	if len(m.Dates) == 0 {
+		return invalidField("dates", "no dates selected")
+	} else if len(m.Durations) != 0 && len(m.Durations) != len(m.Dates) {
+		return invalidField("durations", "invalid durations")
+	}
+
+	slots := m.Slots()
+	if err := validateSlots(slots); errors.Is(err, errSlotEnd) {
+		return invalidField("durations", err.Error())
+	} else if err != nil {
+		return invalidField("dates", err.Error())
+	}
+	m.SetSlots(slots)
+	return nil
+}
+
+// Creates a new meetup with newly generated user and admin hashes. ipHash is the client's, for the audit log.
+func (s *server) createMeetUp(m *MeetUp, ipHash string) (err error) {
+	if m.UserHash, err = generateHash(); err != nil {
+		log.Printf("createMeetUp failed: error reading random bytes for user hash. %s\n", err)
+		return newApiError(http.StatusInternalServerError, codeInternalError, "Error reading random bytes.")
+	}
+	if m.AdminHash, err = generateHash(); err != nil {
+		log.Printf("createMeetUp failed: error reading random bytes for admin hash. %s\n", err)
+		return newApiError(http.StatusInternalServerError, codeInternalError, "Error reading random bytes.")
+	}
+
+	m.EmailConfirmed = 0
+	err = s.store.WithTx(func(tx Store) error {
+		if err := tx.CreateMeetUp(m); err != nil {
+			log.Printf("createMeetUp failed: err creating database rows: %s\n", err)
+			return newApiError(http.StatusInternalServerError, codeDatabaseError, "Error creating new meetup.")
+		}
+		return auditMeetUp(tx, auditMeetUpCreated, nil, m, ipHash)
+	})
+	if err == nil {
+		s.mail.confirmOrganiser(*m, ipHash)
+	}
+	return err
+}
+
+// Returns a read for changeMeetUp of the meetup with the admin hash.
+func readMeetUpByAdminHash(adminHash string) func(tx Store) (MeetUp, error) {
+	return func(tx Store) (MeetUp, error) {
+		meetUp, err := tx.GetMeetUpByAdminHash(adminHash)
+		if errors.Is(err, ErrNotFound) {
+			return meetUp, newApiError(http.StatusNotFound, codeNotFound, "admin hash not found.")
+		}
+		return meetUp, err
+	}
+}
+
+// Reads a meetup with read, changes it with change and writes it back, in one transaction so a concurrent change isn't
+// lost. Either function can return an apiError to reject the change. Returns the changed meetup, and tells its
+// /api/events subscribers and webhooks. The change is added to the audit log with the client's ipHash, see
+// auditMeetUpChange. A changed email has to be confirmed again, it's sent the link.
+func (s *server) changeMeetUp(ipHash string, read func(tx Store) (MeetUp, error), change func(m *MeetUp) error) (meetUp MeetUp, err error) {
+	var oldEmail string
+	err = s.store.WithTx(func(tx Store) error {
+		if meetUp, err = read(tx); err != nil {
+			return err
+		}
+		old := meetUp
+		old.Dates, old.Durations = slices.Clone(meetUp.Dates), slices.Clone(meetUp.Durations)
+		oldEmail = old.Email
+		if err = change(&meetUp); err != nil {
+			return err
+		}
+		if meetUp.Email != old.Email {
+			meetUp.EmailConfirmed = 0
+		}
+
+		if err = tx.UpdateMeetUp(&meetUp); errors.Is(err, errRevisionConflict) {
+			return err
+		} else if err != nil {
+			log.Printf("changeMeetUp failed: Store.UpdateMeetUp() error:%s\n", err)
+			return newApiError(http.StatusInternalServerError, codeDatabaseError, "database error. could not update.")
+		}
+		if err = queueWebhooks(tx, meetUp.Id, webhookMeetUpEdited, nil); err != nil {
+			log.Printf("changeMeetUp failed: error queueing webhooks: %s\n", err)
+			return newApiError(http.StatusInternalServerError, codeDatabaseError, "database error. could not update.")
+		}
+		return auditMeetUpChange(tx, &old, &meetUp, ipHash)
+	})
+	if err == nil {
+		s.events.publish(meetUp.Id, meetUpEvent{Type: eventMeetUp, Revision: meetUp.Revision})
+		s.webhooks.notify()
+		s.mail.meetUpChanged(meetUp)
+		if meetUp.EmailConfirmed == 0 && meetUp.Email != oldEmail {
+			s.mail.confirmOrganiser(meetUp, ipHash)
+		}
+	}
+	return
+}
+
+// Returns errRevisionConflict if the meetup isn't at the revision the client sent, in its json or the If-Match header.
+// A revision of 0 skips the json check, as does a request without the header.
+func checkRevision(r *http.Request, revision int64, m MeetUp) error {
+	if (revision != 0 && revision != m.Revision) || ifMatch(r, m.Revision) == false {
+		return errRevisionConflict
+	}
+	return nil
+}
+
+// Sets the final date of the meetup, 0 reopens it. field is the name of the date in the request.
+func chooseFinalDate(m *MeetUp, field string, date int64) error {
+	if date != 0 && m.HasDate(date) == false {
+		return invalidField(field, "The date is not one of the meetup dates.")
+	}
+
+	m.FinalDate = date
+	return nil
+}
+
+// Adds the user to the meetup with the user hash, or updates the answers of its user with the same name. Sets the
+// Id, IdMeetUp and Token of the user. A new user gets a secret edit token, an existing one needs its token or the
+// adminhash. Returns true if the user was created. Tells the meetup's /api/events subscribers, webhooks and the
+// organiser's email digest. An email address, which isn't stored, gets a confirmation with the user's edit link. The
+// change is added to the audit log with the client's ipHash.
+func (s *server) saveUser(userHash string, user *User, token, adminHash, email, ipHash string) (created bool, err error) {
+	// Check the username is not empty
+	if user.Name == "" {
+		return false, invalidField("username", "The user name is empty.")
+	}
+	if err = validateEmail("email", email); err != nil {
+		return false, err
+	}
+
+	// A date is either yes or if need be, not both
+	for _, date := range user.IfNeedBe {
+		if slices.Contains(user.Dates, date) {
+			return false, invalidField("ifneedbe", "A date can't be both available and if need be.")
+		}
+	}
+
+	// Look up and write the user in one transaction, so concurrent requests for the same name can't both create them
+	var meetUp MeetUp
+	err = s.store.WithTx(func(tx Store) error {
+		meetUpObj, err := tx.GetMeetUpByUserHash(userHash)
+		if err != nil {
+			if errors.Is(err, ErrNotFound) {
+				return newApiError(http.StatusNotFound, codeNotFound, "user hash not found.")
+			}
+			return err
+		}
+
+		if meetUpObj.IsClosed() {
+			return newApiError(http.StatusConflict, codeMeetUpClosed, "The meetup is closed.")
+		}
+		meetUp = meetUpObj
+
+		for _, answer := range []struct {
+			field string
+			dates []int64
+		}{{"dates", user.Dates}, {"ifneedbe", user.IfNeedBe}} {
+			for _, date := range answer.dates {
+				if meetUpObj.HasDate(date) == false {
+					return invalidField(answer.field, "The date is not one of the meetup dates.")
+				}
+			}
+		}
+
+		// Try and update an existing user with the same name, if the user is already in the database.
+		for _, userObj := range meetUpObj.Users {
+			if userObj.Name == user.Name {
+				if canEdit, err := canEditUser(tx, meetUpObj, userObj, token, adminHash); err != nil {
+					return err
+				} else if canEdit == false {
+					return newApiError(http.StatusForbidden, codeForbidden, "invalid edit token.")
+				}
+
+				// Users created before edit tokens existed get one when the admin updates them. Anyone with the userhash
+				// can update them, handing the token to the first of them would lock the user out.
+				if userObj.Token == "" {
+					if isAdmin, err := isMeetUpAdmin(tx, meetUpObj, adminHash); err != nil {
+						return err
+					} else if isAdmin {
+						if userObj.Token, err = generateHash(); err != nil {
+							log.Printf("saveUser failed: error reading random bytes for token. %s\n", err)
+							return newApiError(http.StatusInternalServerError, codeInternalError, "Error reading random bytes.")
+						}
+					}
+				}
+
+				old := userObj
+				userObj.Dates = user.Dates
+				userObj.IfNeedBe = user.IfNeedBe
+				if err = tx.UpdateUser(&userObj); err != nil {
+					log.Printf("saveUser: error updating users: %s\n", err)
+					return newApiError(http.StatusInternalServerError, codeDatabaseError, "database error updating user.")
+				}
+				*user = userObj
+				if err = auditUser(tx, auditUserChanged, &old, user, ipHash); err != nil {
+					return err
+				}
+				return queueUserWebhooks(tx, webhookParticipantChanged, user)
+			}
+		}
+
+		// Not present, create a new user
+		user.IdMeetUp = meetUpObj.Id
+		if user.Token, err = generateHash(); err != nil {
+			log.Printf("saveUser failed: error reading random bytes for token. %s\n", err)
+			return newApiError(http.StatusInternalServerError, codeInternalError, "Error reading random bytes.")
+		}
+		if err = tx.CreateUser(user); errors.Is(err, errUserExists) { // Created by another request since the read
+			return newApiError(http.StatusConflict, codeNameTaken, "The user name is already taken.")
+		} else if err != nil {
+			log.Printf("saveUser: error creating users: %s\n", err)
+			return newApiError(http.StatusInternalServerError, codeDatabaseError, "database error creating user.")
+		}
+		created = true
+		if err = auditUser(tx, auditUserAdded, nil, user, ipHash); err != nil {
+			return err
+		}
+		return queueUserWebhooks(tx, webhookParticipantAdded, user)
+	})
+	if err == nil {
+		s.events.publish(user.IdMeetUp, meetUpEvent{Type: eventUser, Name: user.Name})
+		s.webhooks.notify()
+		if created {
+			s.mail.userActivity(meetUp, user.Name, activityAdded, ipHash)
+		} else {
+			s.mail.userActivity(meetUp, user.Name, activityChanged, ipHash)
+		}
+		s.mail.confirmUser(meetUp, *user, email, ipHash)
+	}
+	return created, err
+}
+
+// errUserNotFound Returned by removeUser when the meetup has no user with the name.
+var errUserNotFound = newApiError(http.StatusNotFound, codeNotFound, "The user was not found.")
+
+// Deletes the user with the name from the meetup with the user hash. Needs the user's edit token or the adminhash.
+// Tells the meetup's /api/events subscribers, webhooks and the organiser's email digest. The change is added to the
+// audit log with the client's ipHash.
+func (s *server) removeUser(userHash, name, token, adminHash, ipHash string) error {
+	var meetUp MeetUp
+	err := s.store.WithTx(func(tx Store) error {
+		meetUpObj, err := tx.GetMeetUpByUserHash(userHash)
+		if err != nil {
+			if errors.Is(err, ErrNotFound) {
+				return newApiError(http.StatusNotFound, codeNotFound, "user hash not found.")
+			}
+			return err
+		}
+
+		if meetUpObj.IsClosed() {
+			return newApiError(http.StatusConflict, codeMeetUpClosed, "The meetup is closed.")
+		}
+
+		for _, userObj := range meetUpObj.Users {
+			if userObj.Name == name {
+				if canEdit, err := canEditUser(tx, meetUpObj, userObj, token, adminHash); err != nil {
+					return err
+				} else if canEdit == false {
+					return newApiError(http.StatusForbidden, codeForbidden, "invalid edit token.")
+				}
+				meetUp = meetUpObj
+				if err = tx.DeleteUser(&userObj); err != nil {
+					return err
+				}
+				if err = auditUser(tx, auditUserRemoved, &userObj, nil, ipHash); err != nil {
+					return err
+				}
+				return queueUserWebhooks(tx, webhookParticipantRemoved, &userObj)
+			}
+		}
+		return errUserNotFound
+	})
+	if err == nil {
+		s.events.publish(meetUp.Id, meetUpEvent{Type: eventUser, Name: name})
+		s.webhooks.notify()
+		s.mail.userActivity(meetUp, name, activityRemoved, ipHash)
+	}
+	return err
+}
+
+// Restores the last deleted user with the name to the meetup with the user hash, if they were deleted within
+// deleteGrace. Needs the user's edit token or the adminhash. Tells the meetup's /api/events subscribers, webhooks and
+// the organiser's email digest. The change is added to the audit log with the client's ipHash.
+func (s *server) undeleteUser(userHash, name, token, adminHash, ipHash string) error {
+	var meetUp MeetUp
+	err := s.store.WithTx(func(tx Store) error {
+		meetUpObj, err := tx.GetMeetUpByUserHash(userHash)
+		if err != nil {
+			if errors.Is(err, ErrNotFound) {
+				return newApiError(http.StatusNotFound, codeNotFound, "user hash not found.")
+			}
+			return err
+		}
+
+		if meetUpObj.IsClosed() {
+			return newApiError(http.StatusConflict, codeMeetUpClosed, "The meetup is closed.")
+		}
+
+		deleted, err := tx.GetDeletedUsersByMeetUpId(meetUpObj.Id)
+		if err != nil {
+			return err
+		}
+		for _, userObj := range deleted {
+			if userObj.Name != name {
+				continue
+			}
+			if s.pastDeleteGrace(userObj.DeletedAt) {
+				return errNotRestorable
+			}
+			if canEdit, err := canEditUser(tx, meetUpObj, userObj, token, adminHash); err != nil {
+				return err
+			} else if canEdit == false {
+				return newApiError(http.StatusForbidden, codeForbidden, "invalid edit token.")
+			}
+
+			meetUp = meetUpObj
+			if err = tx.RestoreUser(&userObj); errors.Is(err, errUserExists) {
+				return newApiError(http.StatusConflict, codeNameTaken, "The user name was taken since.")
+			} else if err != nil {
+				return err
+			}
+			if err = auditUser(tx, auditUserRestored, nil, &userObj, ipHash); err != nil {
+				return err
+			}
+			return queueUserWebhooks(tx, webhookParticipantAdded, &userObj)
+		}
+		return errNotRestorable
+	})
+	if err == nil {
+		s.events.publish(meetUp.Id, meetUpEvent{Type: eventUser, Name: name})
+		s.webhooks.notify()
+		s.mail.userActivity(meetUp, name, activityRestored, ipHash)
+	}
+	return err
+}
+
+// Queues the webhooks of a participant event, for saveUser and removeUser.
+func queueUserWebhooks(tx Store, event string, user *User) error {
+	if err := queueWebhooks(tx, user.IdMeetUp, event, user); err != nil {
+		log.Printf("queueUserWebhooks failed: %s\n", err)
+		return newApiError(http.StatusInternalServerError, codeDatabaseError, "database error. could not update.")
 	}
+	return nil
 }
@@ -0,0 +1,798 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// The decoded form of every json api response.
+type apiTestResponse struct {
+	Result  json.RawMessage `json:"result"`
+	Error   string          `json:"error"`
+	Code    string          `json:"code"`
+	Details []errorDetail   `json:"details"`
+}
+
+// Sends a json request to an api handler and decodes the response.
+func postApiRequest(t *testing.T, handler http.HandlerFunc, url string, body interface{}) apiTestResponse {
+	js, err := json.Marshal(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	request := httptest.NewRequest("POST", url, strings.NewReader(string(js)))
+	w := httptest.NewRecorder()
+	handler(w, request)
+
+	var response apiTestResponse
+	if err = json.NewDecoder(w.Result().Body).Decode(&response); err != nil {
+		t.Fatalf("%s returned invalid json: %s\n", url, err)
+	}
+	return response
+}
+
+// Creates a meetup directly in the store for the api tests.
+func createApiTestMeetUp(t *testing.T, store Store) MeetUp {
+	var meetUp = MeetUp{
+		UserHash:    "6cf51863dcbd352c9da7fc0670a34a7173056413214ac0e22f0effd1015a7fa907399f9107fd48689d3800043ff12bbd33a24a433a6ede783bda3423c9820278",
+		AdminHash:   "a39f823a49a4fbdfc2906a4baf0dce97a216d8b5bf6b0ab83a31d04c2d84ae619a6e017368a434ecb7b09b54015d22455062ac199ec48aa5b1c0dea830c3ecb6",
+		Dates:       []int64{1550401200000, 1550487600000, 1550574000000},
+		Description: "meetUp description",
+	}
+	if err := store.CreateMeetUp(&meetUp); err != nil {
+		t.Fatalf("CreateMeetUp() failed: %s\n", err)
+	}
+	return meetUp
+}
+
+func TestUpdateMeetUp_Slots(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store Store) {
+		srv := newServer(store)
+		var tests = []struct {
+			name     string
+			request  map[string]interface{}
+			expected string
+		}{
+			{"dates only", map[string]interface{}{"description": "a", "dates": []int64{1550487600000, 1550401200000}}, ""},
+			{"slots", map[string]interface{}{"description": "a", "dates": []int64{1550404800000, 1550401200000}, "durations": []int64{3600000, 3600000}}, ""},
+			{"durations length", map[string]interface{}{"description": "a", "dates": []int64{1550401200000, 1550404800000}, "durations": []int64{3600000}}, "invalid durations"},
+			{"negative duration", map[string]interface{}{"description": "a", "dates": []int64{1550401200000}, "durations": []int64{-3600000}}, "slot ends before it starts"},
+			{"overlap", map[string]interface{}{"description": "a", "dates": []int64{1550401200000, 1550403000000}, "durations": []int64{3600000, 3600000}}, "slots overlap"},
+			{"slot inside all-day", map[string]interface{}{"description": "a", "dates": []int64{1550401200000, 1550403000000}, "durations": []int64{0, 3600000}}, "slots overlap"},
+		}
+
+		for _, test := range tests {
+			response := postApiRequest(t, srv.updateMeetUp, "/api/updatemeetup", test.request)
+			if response.Error != test.expected {
+				t.Errorf("updateMeetUp %s: error = %q, want: %q\n", test.name, response.Error, test.expected)
+				continue
+			} else if test.expected != "" {
+				continue
+			}
+
+			var result struct {
+				UserHash string `json:"userhash"`
+			}
+			if err := json.Unmarshal(response.Result, &result); err != nil {
+				t.Fatal(err)
+			}
+
+			// The options are returned sorted, with their end times
+			response = postApiRequest(t, srv.getUserMeetUp, "/api/getusermeetup", map[string]interface{}{"userhash": result.UserHash})
+			var meetUp struct {
+				Dates []int64 `json:"dates"`
+				Slots []Slot  `json:"slots"`
+			}
+			if err := json.Unmarshal(response.Result, &meetUp); err != nil {
+				t.Fatal(err)
+			}
+			if len(meetUp.Slots) != 2 || meetUp.Dates[0] != 1550401200000 || meetUp.Slots[0].Start != meetUp.Dates[0] || meetUp.Slots[0].End <= meetUp.Slots[0].Start {
+				t.Errorf("updateMeetUp %s: getusermeetup returned %+v\n", test.name, meetUp)
+			}
+		}
+	})
+}
+
+func TestUpdateMeetUp_Revision(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store Store) {
+		srv := newServer(store)
+		meetUp := createApiTestMeetUp(t, store)
+
+		// Returns the revision and the ETag of getadminmeetup, checking the ETag is the hash of the result sent
+		getAdminMeetUp := func() (int64, string) {
+			t.Helper()
+			js, _ := json.Marshal(map[string]interface{}{"adminhash": meetUp.AdminHash})
+			w := httptest.NewRecorder()
+			srv.getAdminMeetUp(w, httptest.NewRequest("POST", "/api/getadminmeetup", bytes.NewReader(js)))
+			var response struct {
+				Result json.RawMessage `json:"result"`
+			}
+			var result struct {
+				Revision int64 `json:"revision"`
+			}
+			if err := json.NewDecoder(w.Result().Body).Decode(&response); err != nil {
+				t.Fatal(err)
+			}
+			if err := json.Unmarshal(response.Result, &result); err != nil {
+				t.Fatal(err)
+			}
+			etag := w.Result().Header.Get("ETag")
+			if hash := sha256.Sum256(response.Result); etag != fmt.Sprintf(`"%d-%x"`, result.Revision, hash[:8]) {
+				t.Errorf("getadminmeetup ETag = %s, isn't the hash of the result %s\n", etag, response.Result)
+			}
+			return result.Revision, etag
+		}
+
+		// The ETag of a read starts with the revision, and changes with the users too
+		revision, etag := getAdminMeetUp()
+		if revision != 1 || strings.HasPrefix(etag, `"1-`) == false {
+			t.Fatalf("getadminmeetup revision = %d, ETag = %s, want: 1 \"1-...\"\n", revision, etag)
+		}
+		if response := postApiRequest(t, srv.updateUser, "/api/updateuser", map[string]interface{}{"userhash": meetUp.UserHash, "username": "alice"}); response.Error != "" {
+			t.Fatalf("updateUser error: %s\n", response.Error)
+		}
+		if revision, userEtag := getAdminMeetUp(); revision != 1 || userEtag == etag || strings.HasPrefix(userEtag, `"1-`) == false {
+			t.Errorf("getadminmeetup after adding a user revision = %d, ETag = %s, want: 1 and another than %s\n", revision, userEtag, etag)
+		}
+
+		var tests = []struct {
+			name       string
+			revision   int64
+			ifMatch    string
+			wantStatus int
+			wantError  string
+		}{
+			{"current revision", 1, "", http.StatusOK, ""},
+			{"stale revision", 1, "", http.StatusOK, revisionConflictError.message},
+			{"no revision", 0, "", http.StatusOK, ""},
+			{"current etag", 0, `"3"`, http.StatusOK, ""},
+			{"stale etag", 0, `"3"`, http.StatusPreconditionFailed, revisionConflictError.message},
+			{"etag in a list", 0, `"1", "4"`, http.StatusOK, ""},
+			{"any etag", 0, "*", http.StatusOK, ""},
+			{"weak etag", 0, `W/"6"`, http.StatusPreconditionFailed, revisionConflictError.message},
+		}
+
+		for _, test := range tests {
+			js, _ := json.Marshal(map[string]interface{}{"adminhash": meetUp.AdminHash, "revision": test.revision, "description": test.name, "dates": meetUp.Dates})
+			request := httptest.NewRequest("POST", "/api/updatemeetup", bytes.NewReader(js))
+			if test.ifMatch != "" {
+				request.Header.Set("If-Match", test.ifMatch)
+			}
+			w := httptest.NewRecorder()
+			srv.updateMeetUp(w, request)
+
+			var response apiTestResponse
+			if err := json.NewDecoder(w.Result().Body).Decode(&response); err != nil {
+				t.Fatal(err)
+			}
+			if w.Code != test.wantStatus || response.Error != test.wantError {
+				t.Errorf("updatemeetup %s: status %d error %q, want: %d %q\n", test.name, w.Code, response.Error, test.wantStatus, test.wantError)
+			}
+		}
+
+		// The ETag of a read matches for the writes at its revision
+		_, etag = getAdminMeetUp()
+		for i, wantStatus := range []int{http.StatusOK, http.StatusPreconditionFailed} {
+			js, _ := json.Marshal(map[string]interface{}{"adminhash": meetUp.AdminHash, "description": "read etag", "dates": meetUp.Dates})
+			request := httptest.NewRequest("POST", "/api/updatemeetup", bytes.NewReader(js))
+			request.Header.Set("If-Match", etag)
+			w := httptest.NewRecorder()
+			srv.updateMeetUp(w, request)
+			if w.Code != wantStatus {
+				t.Errorf("updatemeetup %d with the ETag of a read: status %d, want: %d\n", i+1, w.Code, wantStatus)
+			}
+		}
+
+		// 6 of the updates went through
+		if retMeetUp, err := store.GetMeetUpByAdminHash(meetUp.AdminHash); err != nil {
+			t.Fatal(err)
+		} else if retMeetUp.Revision != 7 || retMeetUp.Description != "read etag" {
+			t.Errorf("meetup revision %d description %q, want: 7 \"read etag\"\n", retMeetUp.Revision, retMeetUp.Description)
+		}
+	})
+}
+
+func TestApiErrorCodes(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store Store) {
+		srv := newServer(store)
+		meetUp := createApiTestMeetUp(t, store)
+		if response := postApiRequest(t, srv.updateUser, "/api/updateuser", map[string]interface{}{"userhash": meetUp.UserHash, "username": "alice"}); response.Error != "" {
+			t.Fatal(response.Error)
+		}
+
+		var tests = []struct {
+			name        string
+			handler     http.HandlerFunc
+			request     interface{}
+			wantCode    string
+			wantDetails []errorDetail
+		}{
+			{"invalid json", srv.getUserMeetUp, "userhash", codeInvalidJson, nil},
+			{"invalid hash", srv.getUserMeetUp, map[string]interface{}{"userhash": "abc"}, codeInvalidHash, nil},
+			{"meetup not found", srv.getUserMeetUp, map[string]interface{}{"userhash": meetUp.AdminHash}, codeNotFound, nil},
+			{"no dates", srv.updateMeetUp, map[string]interface{}{"description": "a"}, codeInvalidRequest, []errorDetail{{"dates", "no dates selected"}}},
+			{"negative duration", srv.updateMeetUp, map[string]interface{}{"dates": []int64{1550401200000}, "durations": []int64{-1}}, codeInvalidRequest, []errorDetail{{"durations", "slot ends before it starts"}}},
+			{"stale revision", srv.updateMeetUp, map[string]interface{}{"adminhash": meetUp.AdminHash, "revision": 5, "dates": meetUp.Dates}, codeRevisionConflict, nil},
+			{"not a meetup date", srv.updateUser, map[string]interface{}{"userhash": meetUp.UserHash, "username": "bob", "ifneedbe": []int64{1}}, codeInvalidRequest, []errorDetail{{"ifneedbe", "The date is not one of the meetup dates."}}},
+			{"edit token", srv.updateUser, map[string]interface{}{"userhash": meetUp.UserHash, "username": "alice"}, codeForbidden, nil},
+			{"final date", srv.finaliseMeetUp, map[string]interface{}{"adminhash": meetUp.AdminHash, "date": 1}, codeInvalidRequest, []errorDetail{{"date", "The date is not one of the meetup dates."}}},
+		}
+
+		for _, test := range tests {
+			response := postApiRequest(t, test.handler, "/api/", test.request)
+			if response.Code != test.wantCode || response.Error == "" || reflect.DeepEqual(response.Details, test.wantDetails) == false {
+				t.Errorf("%s: code %q details %+v, want: %q %+v. error: %q\n", test.name, response.Code, response.Details, test.wantCode, test.wantDetails, response.Error)
+			}
+		}
+
+		// Closed meetups reject changes to their users
+		postApiRequest(t, srv.finaliseMeetUp, "/api/finalisemeetup", map[string]interface{}{"adminhash": meetUp.AdminHash, "date": meetUp.Dates[0]})
+		if response := postApiRequest(t, srv.deleteUser, "/api/deleteuser", map[string]interface{}{"userhash": meetUp.UserHash, "username": "alice"}); response.Code != codeMeetUpClosed {
+			t.Errorf("deleteuser of a closed meetup: code %q, want: %q\n", response.Code, codeMeetUpClosed)
+		}
+	})
+}
+
+func TestGetSummary(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store Store) {
+		srv := newServer(store)
+		meetUp := createApiTestMeetUp(t, store)
+		var users = Users{
+			{IdMeetUp: meetUp.Id, Name: "alice", Dates: []int64{1550487600000}},
+			{IdMeetUp: meetUp.Id, Name: "bob", Dates: []int64{1550401200000}, IfNeedBe: []int64{1550487600000}},
+		}
+		for _, user := range users {
+			if err := store.CreateUser(&user); err != nil {
+				t.Fatalf("CreateUser() failed: %s\n", err)
+			}
+		}
+
+		// Both hashes give the same answer
+		for _, request := range []map[string]interface{}{{"userhash": meetUp.UserHash}, {"adminhash": meetUp.AdminHash}} {
+			response := postApiRequest(t, srv.getSummary, "/api/summary", request)
+			if response.Error != "" {
+				t.Fatalf("getSummary(%v) failed: %s\n", request, response.Error)
+			}
+
+			var summaries []OptionSummary
+			if err := json.Unmarshal(response.Result, &summaries); err != nil {
+				t.Fatal(err)
+			}
+			if len(summaries) != 3 || summaries[0].Start != 1550487600000 || summaries[0].Yes != 1 || summaries[0].IfNeedBe != 1 || len(summaries[2].Missing) != 2 {
+				t.Errorf("getSummary(%v) = %+v\n", request, summaries)
+			}
+		}
+
+		response := postApiRequest(t, srv.getSummary, "/api/summary", map[string]interface{}{"userhash": meetUp.AdminHash})
+		if response.Error != "The meetup was not found." {
+			t.Errorf("getSummary with an unknown hash: error = %q\n", response.Error)
+		}
+	})
+}
+
+func TestGetIcs(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store Store) {
+		srv := newServer(store)
+		meetUp := createApiTestMeetUp(t, store)
+
+		var tests = []struct {
+			id         string
+			statusCode int
+		}{
+			{meetUp.UserHash, http.StatusOK},
+			{meetUp.AdminHash, http.StatusNotFound},
+			{"abc", http.StatusBadRequest},
+		}
+
+		for _, test := range tests {
+			w := httptest.NewRecorder()
+			srv.getIcs(w, httptest.NewRequest("GET", "/api/ics?id="+test.id, nil))
+
+			response := w.Result()
+			if response.StatusCode != test.statusCode {
+				t.Errorf("getIcs(%q) status code = %d, want: %d", test.id, response.StatusCode, test.statusCode)
+			} else if test.statusCode == http.StatusOK {
+				if response.Header.Get("Content-Type") != "text/calendar; charset=utf-8" {
+					t.Error("Content-Type header was wrong")
+				}
+				if _, events := parseCalendar(t, w.Body.String()); len(events) != len(meetUp.Dates) {
+					t.Errorf("getIcs(%q) returned %d events, want: %d", test.id, len(events), len(meetUp.Dates))
+				}
+			}
+		}
+	})
+}
+
+func TestGetFeed(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store Store) {
+		srv := newServer(store)
+		meetUp := createApiTestMeetUp(t, store)
+		var user = User{IdMeetUp: meetUp.Id, Name: "alice smith", Token: "8d9d7c59eec27a7aee55536582e45afb18f072c282edd22474a0db0676d74299", Dates: []int64{1550401200000}, IfNeedBe: []int64{1550574000000}}
+		if err := store.CreateUser(&user); err != nil {
+			t.Fatalf("CreateUser() failed: %s\n", err)
+		}
+
+		var tests = []struct {
+			query      string
+			statusCode int
+		}{
+			{"id=" + meetUp.UserHash + "&name=alice+smith", http.StatusOK},
+			{"id=" + meetUp.UserHash + "&token=" + user.Token, http.StatusBadRequest},
+			{"id=" + meetUp.UserHash + "&name=bob", http.StatusNotFound},
+			{"id=" + meetUp.UserHash, http.StatusBadRequest},
+			{"id=" + meetUp.AdminHash + "&name=alice+smith", http.StatusNotFound},
+		}
+
+		for _, test := range tests {
+			w := httptest.NewRecorder()
+			srv.getFeed(w, httptest.NewRequest("GET", "/api/feed?"+test.query, nil))
+
+			response := w.Result()
+			if response.StatusCode != test.statusCode {
+				t.Errorf("getFeed(%q) status code = %d, want: %d", test.query, response.StatusCode, test.statusCode)
+			} else if test.statusCode == http.StatusOK {
+				if response.Header.Get("Content-Type") != "text/calendar; charset=utf-8" || response.Header.Get("ETag") == "" || response.Header.Get("Last-Modified") == "" {
+					t.Errorf("getFeed(%q) headers were wrong: %v", test.query, response.Header)
+				}
+				if _, events := parseCalendar(t, w.Body.String()); len(events) != 2 {
+					t.Errorf("getFeed(%q) returned %d events, want: 2", test.query, len(events))
+				}
+			}
+		}
+
+		// Polling clients get a 304 until the meetup changes
+		url := "/api/feed?id=" + meetUp.UserHash + "&name=alice+smith"
+		w := httptest.NewRecorder()
+		srv.getFeed(w, httptest.NewRequest("GET", url, nil))
+		etag := w.Result().Header.Get("ETag")
+
+		request := httptest.NewRequest("GET", url, nil)
+		request.Header.Set("If-None-Match", etag)
+		w = httptest.NewRecorder()
+		srv.getFeed(w, request)
+		if w.Result().StatusCode != http.StatusNotModified {
+			t.Errorf("getFeed with a matching If-None-Match status code = %d, want: %d", w.Result().StatusCode, http.StatusNotModified)
+		}
+
+		user.Dates = []int64{1550487600000}
+		if err := store.UpdateUser(&user); err != nil {
+			t.Fatalf("UpdateUser() failed: %s\n", err)
+		}
+		w = httptest.NewRecorder()
+		srv.getFeed(w, request)
+		if w.Result().StatusCode != http.StatusOK || w.Result().Header.Get("ETag") == etag {
+			t.Errorf("getFeed after a change status code = %d, ETag %s", w.Result().StatusCode, w.Result().Header.Get("ETag"))
+		}
+	})
+}
+
+func TestFinaliseMeetUp(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store Store) {
+		srv := newServer(store)
+		meetUp := createApiTestMeetUp(t, store)
+		userRequest := map[string]interface{}{"userhash": meetUp.UserHash, "username": "alice", "adminhash": meetUp.AdminHash, "dates": []int64{1550401200000}}
+
+		response := postApiRequest(t, srv.finaliseMeetUp, "/api/finalisemeetup", map[string]interface{}{"adminhash": meetUp.AdminHash, "date": 1550401200001})
+		if response.Error != "The date is not one of the meetup dates." {
+			t.Errorf("finaliseMeetUp with an invalid date: error = %q\n", response.Error)
+		}
+		response = postApiRequest(t, srv.finaliseMeetUp, "/api/finalisemeetup", map[string]interface{}{"adminhash": meetUp.UserHash, "date": 1550487600000})
+		if response.Error != "admin hash not found." {
+			t.Errorf("finaliseMeetUp with the user hash: error = %q\n", response.Error)
+		}
+		response = postApiRequest(t, srv.finaliseMeetUp, "/api/finalisemeetup", map[string]interface{}{"adminhash": meetUp.AdminHash, "date": 1550487600000})
+		if response.Error != "" {
+			t.Fatalf("finaliseMeetUp failed: %s\n", response.Error)
+		}
+
+		// The decision is reported, and the users can't be changed
+		response = postApiRequest(t, srv.getUserMeetUp, "/api/getusermeetup", map[string]interface{}{"userhash": meetUp.UserHash})
+		var result struct {
+			FinalDate int64 `json:"finaldate"`
+		}
+		if err := json.Unmarshal(response.Result, &result); err != nil {
+			t.Fatal(err)
+		}
+		if result.FinalDate != 1550487600000 {
+			t.Errorf("getUserMeetUp finaldate = %d, want: %d\n", result.FinalDate, 1550487600000)
+		}
+		if response = postApiRequest(t, srv.updateUser, "/api/updateuser", userRequest); response.Error != "The meetup is closed." {
+			t.Errorf("updateUser on a closed meetup: error = %q\n", response.Error)
+		}
+		if response = postApiRequest(t, srv.deleteUser, "/api/deleteuser", userRequest); response.Error != "The meetup is closed." {
+			t.Errorf("deleteUser on a closed meetup: error = %q\n", response.Error)
+		}
+
+		// Reopened, the users can be changed again
+		if response = postApiRequest(t, srv.reopenMeetUp, "/api/reopenmeetup", map[string]interface{}{"adminhash": meetUp.AdminHash}); response.Error != "" {
+			t.Fatalf("reopenMeetUp failed: %s\n", response.Error)
+		}
+		if response = postApiRequest(t, srv.updateUser, "/api/updateuser", userRequest); response.Error != "" {
+			t.Errorf("updateUser on a reopened meetup: error = %q\n", response.Error)
+		}
+	})
+}
+
+func TestUpdateUser_EditToken(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store Store) {
+		srv := newServer(store)
+		meetUp := createApiTestMeetUp(t, store)
+
+		// Creating a user returns their edit token
+		response := postApiRequest(t, srv.updateUser, "/api/updateuser", map[string]interface{}{
+			"userhash": meetUp.UserHash, "username": "alice", "dates": []int64{1550401200000},
+		})
+		if response.Error != "" {
+			t.Fatalf("updateUser create failed: %s\n", response.Error)
+		}
+		var result struct {
+			Token string `json:"token"`
+		}
+		if err := json.Unmarshal(response.Result, &result); err != nil {
+			t.Fatal(err)
+		}
+		if validateHash(result.Token) != nil {
+			t.Fatalf("updateUser returned an invalid token: %q\n", result.Token)
+		}
+
+		var tests = []struct {
+			name     string
+			request  map[string]interface{}
+			expected string
+		}{
+			{"no token", map[string]interface{}{"userhash": meetUp.UserHash, "username": "alice", "dates": []int64{}}, "invalid edit token."},
+			{"wrong token", map[string]interface{}{"userhash": meetUp.UserHash, "username": "alice", "token": meetUp.AdminHash, "dates": []int64{}}, "invalid edit token."},
+			{"wrong adminhash", map[string]interface{}{"userhash": meetUp.UserHash, "username": "alice", "adminhash": meetUp.UserHash, "dates": []int64{}}, "invalid edit token."},
+			{"own token", map[string]interface{}{"userhash": meetUp.UserHash, "username": "alice", "token": result.Token, "dates": []int64{1550487600000}}, ""},
+			{"admin override", map[string]interface{}{"userhash": meetUp.UserHash, "username": "alice", "adminhash": meetUp.AdminHash, "dates": []int64{1550574000000}, "ifneedbe": []int64{1550401200000}}, ""},
+			{"yes and if need be", map[string]interface{}{"userhash": meetUp.UserHash, "username": "alice", "token": result.Token, "dates": []int64{1550401200000}, "ifneedbe": []int64{1550401200000}}, "A date can't be both available and if need be."},
+			{"not a meetup date", map[string]interface{}{"userhash": meetUp.UserHash, "username": "alice", "token": result.Token, "ifneedbe": []int64{1550401200001}}, "The date is not one of the meetup dates."},
+		}
+
+		for _, test := range tests {
+			response = postApiRequest(t, srv.updateUser, "/api/updateuser", test.request)
+			if response.Error != test.expected {
+				t.Errorf("updateUser %s: error = %q, want: %q\n", test.name, response.Error, test.expected)
+			}
+		}
+
+		dbMeetUp, err := store.GetMeetUpByUserHash(meetUp.UserHash)
+		if err != nil {
+			t.Fatalf("GetMeetUpByUserHash() failed: %s\n", err)
+		}
+		if len(dbMeetUp.Users) != 1 || len(dbMeetUp.Users[0].Dates) != 1 || dbMeetUp.Users[0].Dates[0] != 1550574000000 || dbMeetUp.Users[0].Availability(1550401200000) != AvailableIfNeedBe {
+			t.Errorf("user rows were not updated as expected: %+v\n", dbMeetUp.Users)
+		}
+		if dbMeetUp.Users[0].Token != result.Token {
+			t.Errorf("the edit token changed on update")
+		}
+	})
+}
+
+// A user created before edit tokens can be updated by anyone with the userhash, and only gets a token from the admin.
+func TestUpdateUser_LegacyUser(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store Store) {
+		srv := newServer(store)
+		meetUp := createApiTestMeetUp(t, store)
+		if err := store.CreateUser(&User{IdMeetUp: meetUp.Id, Name: "legacy", Dates: meetUp.Dates[:1]}); err != nil {
+			t.Fatal(err)
+		}
+
+		// Returns the token of the update, and the one stored
+		update := func(request map[string]interface{}) (string, string) {
+			t.Helper()
+			response := postApiRequest(t, srv.updateUser, "/api/updateuser", request)
+			if response.Error != "" {
+				t.Fatalf("updateUser error: %s\n", response.Error)
+			}
+			var result struct {
+				Token string `json:"token"`
+			}
+			if err := json.Unmarshal(response.Result, &result); err != nil {
+				t.Fatal(err)
+			}
+			dbMeetUp, err := store.GetMeetUpByUserHash(meetUp.UserHash)
+			if err != nil || len(dbMeetUp.Users) != 1 {
+				t.Fatalf("GetMeetUpByUserHash() = %+v, %v\n", dbMeetUp.Users, err)
+			}
+			return result.Token, dbMeetUp.Users[0].Token
+		}
+
+		for i := 0; i < 2; i++ {
+			if token, stored := update(map[string]interface{}{"userhash": meetUp.UserHash, "username": "legacy"}); token != "" || stored != "" {
+				t.Errorf("an update without the adminhash returned the token %q and stored %q, want none\n", token, stored)
+			}
+		}
+
+		token, stored := update(map[string]interface{}{"userhash": meetUp.UserHash, "username": "legacy", "adminhash": meetUp.AdminHash})
+		if validateHash(token) != nil || stored != token {
+			t.Errorf("the admin's update returned the token %q and stored %q\n", token, stored)
+		}
+		response := postApiRequest(t, srv.updateUser, "/api/updateuser", map[string]interface{}{"userhash": meetUp.UserHash, "username": "legacy"})
+		if response.Code != codeForbidden {
+			t.Errorf("an update without the token after the admin's got %+v\n", response)
+		}
+	})
+}
+
+// Concurrent first submissions for the same name create one user. The others are turned away, as the name is then
+// either taken or needs the first user's edit token.
+func TestUpdateUser_Concurrent(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store Store) {
+		srv := newServer(store)
+		meetUp := createApiTestMeetUp(t, store)
+		js, err := json.Marshal(map[string]interface{}{"userhash": meetUp.UserHash, "username": "alice", "dates": []int64{1550401200000}})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		const requests = 10
+		recorders := make([]*httptest.ResponseRecorder, requests)
+		var wg sync.WaitGroup
+		for i := range recorders {
+			recorders[i] = httptest.NewRecorder()
+			wg.Add(1)
+			go func(w *httptest.ResponseRecorder) {
+				defer wg.Done()
+				srv.updateUser(w, httptest.NewRequest("POST", "/api/updateuser", bytes.NewReader(js)))
+			}(recorders[i])
+		}
+		wg.Wait()
+
+		var created int
+		for _, w := range recorders {
+			var response apiTestResponse
+			if err = json.NewDecoder(w.Result().Body).Decode(&response); err != nil {
+				t.Fatalf("/api/updateuser returned invalid json: %s\n", err)
+			}
+			switch response.Error {
+			case "":
+				created++
+			case "invalid edit token.", "The user name is already taken.":
+			default:
+				t.Errorf("updateUser error = %q", response.Error)
+			}
+		}
+		if created != 1 {
+			t.Errorf("%d requests succeeded, want: 1", created)
+		}
+
+		dbMeetUp, err := store.GetMeetUpByUserHash(meetUp.UserHash)
+		if err != nil {
+			t.Fatalf("GetMeetUpByUserHash() failed: %s\n", err)
+		}
+		if len(dbMeetUp.Users) != 1 {
+			t.Errorf("%d users were created, want: 1: %+v", len(dbMeetUp.Users), dbMeetUp.Users)
+		}
+	})
+}
+
+func TestDeleteUser_EditToken(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store Store) {
+		srv := newServer(store)
+		meetUp := createApiTestMeetUp(t, store)
+		var users = Users{
+			{IdMeetUp: meetUp.Id, Name: "alice", Token: "8d9d7c59eec27a7aee55536582e45afb18f072c282edd22474a0db0676d74299", Dates: []int64{1550401200000}},
+			{IdMeetUp: meetUp.Id, Name: "bob", Token: "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855", Dates: []int64{1550401200000}},
+			{IdMeetUp: meetUp.Id, Name: "legacy", Dates: []int64{1550401200000}},
+		}
+		for _, user := range users {
+			if err := store.CreateUser(&user); err != nil {
+				t.Fatalf("CreateUser() failed: %s\n", err)
+			}
+		}
+
+		var tests = []struct {
+			name     string
+			request  map[string]interface{}
+			expected string
+		}{
+			{"other user's token", map[string]interface{}{"userhash": meetUp.UserHash, "username": "alice", "token": users[1].Token}, "invalid edit token."},
+			{"own token", map[string]interface{}{"userhash": meetUp.UserHash, "username": "alice", "token": users[0].Token}, ""},
+			{"admin override", map[string]interface{}{"userhash": meetUp.UserHash, "username": "bob", "adminhash": meetUp.AdminHash}, ""},
+			{"user without a token", map[string]interface{}{"userhash": meetUp.UserHash, "username": "legacy"}, ""},
+		}
+
+		for _, test := range tests {
+			response := postApiRequest(t, srv.deleteUser, "/api/deleteuser", test.request)
+			if response.Error != test.expected {
+				t.Errorf("deleteUser %s: error = %q, want: %q\n", test.name, response.Error, test.expected)
+			}
+		}
+
+		dbMeetUp, err := store.GetMeetUpByUserHash(meetUp.UserHash)
+		if err != nil {
+			t.Fatalf("GetMeetUpByUserHash() failed: %s\n", err)
+		}
+		if len(dbMeetUp.Users) != 0 {
+			t.Errorf("users were not deleted: %+v\n", dbMeetUp.Users)
+		}
+	})
+}
+
+func TestRestoreMeetUp(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store Store) {
+		srv := newServer(store)
+		meetUp := createApiTestMeetUp(t, store)
+		request := map[string]interface{}{"adminhash": meetUp.AdminHash}
+
+		if response := postApiRequest(t, srv.restoreMeetUp, "/api/restoremeetup", request); response.Code != codeNotFound {
+			t.Errorf("restoring a meetup that isn't deleted got %+v\n", response)
+		}
+
+		if response := postApiRequest(t, srv.deleteMeetUp, "/api/deletemeetup", request); response.Error != "" {
+			t.Fatalf("deleteMeetUp error: %s\n", response.Error)
+		}
+		if response := postApiRequest(t, srv.getUserMeetUp, "/api/getusermeetup", map[string]interface{}{"userhash": meetUp.UserHash}); response.Code != codeNotFound {
+			t.Errorf("getUserMeetUp() of a deleted meetup got %+v\n", response)
+		}
+		if response := postApiRequest(t, srv.restoreMeetUp, "/api/restoremeetup", request); response.Error != "" {
+			t.Fatalf("restoreMeetUp error: %s\n", response.Error)
+		}
+		if response := postApiRequest(t, srv.getUserMeetUp, "/api/getusermeetup", map[string]interface{}{"userhash": meetUp.UserHash}); response.Error != "" {
+			t.Errorf("getUserMeetUp() of the restored meetup: %s\n", response.Error)
+		}
+
+		// Once the grace has passed it's gone
+		srv.deleteGrace = 0
+		if response := postApiRequest(t, srv.deleteMeetUp, "/api/deletemeetup", request); response.Error != "" {
+			t.Fatalf("deleteMeetUp error: %s\n", response.Error)
+		}
+		if response := postApiRequest(t, srv.restoreMeetUp, "/api/restoremeetup", request); response.Code != codeNotFound {
+			t.Errorf("restoring after the grace got %+v\n", response)
+		}
+	})
+}
+
+func TestRotateHashes(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store Store) {
+		srv := newServer(store)
+		meetUp := createApiTestMeetUp(t, store)
+
+		response := postApiRequest(t, srv.updateUser, "/api/updateuser", map[string]interface{}{"userhash": meetUp.UserHash, "username": "alice", "dates": meetUp.Dates[:1]})
+		if response.Error != "" {
+			t.Fatalf("updateUser error: %s\n", response.Error)
+		}
+		var user struct {
+			Token string `json:"token"`
+		}
+		if err := json.Unmarshal(response.Result, &user); err != nil {
+			t.Fatal(err)
+		}
+
+		// Rotates the hashes, and returns the new ones
+		rotate := func(adminHash string, newUserHash bool) (hashes struct {
+			UserHash  string `json:"userhash"`
+			AdminHash string `json:"adminhash"`
+			Revision  int64  `json:"revision"`
+		}) {
+			t.Helper()
+			response := postApiRequest(t, srv.rotateHashes, "/api/rotatehashes", map[string]interface{}{"adminhash": adminHash, "newuserhash": newUserHash})
+			if response.Error != "" {
+				t.Fatalf("rotateHashes error: %s\n", response.Error)
+			}
+			if err := json.Unmarshal(response.Result, &hashes); err != nil {
+				t.Fatal(err)
+			}
+			return
+		}
+
+		// Just the adminhash
+		hashes := rotate(meetUp.AdminHash, false)
+		if hashes.UserHash != meetUp.UserHash || hashes.AdminHash == meetUp.AdminHash || validateHash(hashes.AdminHash) != nil || hashes.Revision != 2 {
+			t.Errorf("rotating the adminhash returned %+v\n", hashes)
+		}
+		if response := postApiRequest(t, srv.getAdminMeetUp, "/api/getadminmeetup", map[string]interface{}{"adminhash": meetUp.AdminHash}); response.Code != codeNotFound {
+			t.Errorf("getAdminMeetUp() of the old adminhash got %+v\n", response)
+		}
+		if response := postApiRequest(t, srv.getAdminMeetUp, "/api/getadminmeetup", map[string]interface{}{"adminhash": hashes.AdminHash}); response.Error != "" {
+			t.Errorf("getAdminMeetUp() of the new adminhash: %s\n", response.Error)
+		}
+		if response := postApiRequest(t, srv.rotateHashes, "/api/rotatehashes", map[string]interface{}{"adminhash": meetUp.AdminHash}); response.Code != codeNotFound {
+			t.Errorf("rotating the old adminhash got %+v\n", response)
+		}
+		if response := postApiRequest(t, srv.rotateHashes, "/api/rotatehashes", map[string]interface{}{"adminhash": hashes.AdminHash, "revision": 1}); response.Code != codeRevisionConflict {
+			t.Errorf("rotating a stale revision got %+v\n", response)
+		}
+
+		// And the userhash, keeping the users and their edit tokens
+		oldUserHash := hashes.UserHash
+		hashes = rotate(hashes.AdminHash, true)
+		if hashes.UserHash == oldUserHash || validateHash(hashes.UserHash) != nil {
+			t.Errorf("rotating the userhash returned %+v\n", hashes)
+		}
+		if response := postApiRequest(t, srv.getUserMeetUp, "/api/getusermeetup", map[string]interface{}{"userhash": oldUserHash}); response.Code != codeNotFound {
+			t.Errorf("getUserMeetUp() of the old userhash got %+v\n", response)
+		}
+		var result struct{ Id int64 }
+		response = postApiRequest(t, srv.getUserMeetUp, "/api/getusermeetup", map[string]interface{}{"userhash": hashes.UserHash})
+		if _ = json.Unmarshal(response.Result, &result); result.Id != meetUp.Id {
+			t.Errorf("getUserMeetUp() of the new userhash has the id %d, want: %d\n", result.Id, meetUp.Id)
+		}
+		response = postApiRequest(t, srv.updateUser, "/api/updateuser", map[string]interface{}{"userhash": hashes.UserHash, "username": "alice", "token": user.Token, "dates": meetUp.Dates[1:2]})
+		if response.Error != "" {
+			t.Errorf("updateUser() with the new userhash and the old token: %s\n", response.Error)
+		}
+		if retMeetUp, err := store.GetMeetUpByUserHash(hashes.UserHash); err != nil {
+			t.Fatal(err)
+		} else if len(retMeetUp.Users) != 1 || retMeetUp.Users[0].Name != "alice" || reflect.DeepEqual(retMeetUp.Users[0].Dates, meetUp.Dates[1:2]) == false {
+			t.Errorf("the meetup has the users %+v after the rotations\n", retMeetUp.Users)
+		}
+
+		events, err := store.GetMeetUpEvents(meetUp.Id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if events[1].Action != auditMeetUpRotated || events[2].Action != auditMeetUpRotated {
+			t.Errorf("the audit log is %+v, want two %s entries before the last change\n", events, auditMeetUpRotated)
+		}
+	})
+}
+
+func TestRestoreUser(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store Store) {
+		srv := newServer(store)
+		meetUp := createApiTestMeetUp(t, store)
+		var user = User{IdMeetUp: meetUp.Id, Name: "alice", Token: "8d9d7c59eec27a7aee55536582e45afb18f072c282edd22474a0db0676d74299", Dates: []int64{1550401200000}}
+		if err := store.CreateUser(&user); err != nil {
+			t.Fatalf("CreateUser() failed: %s\n", err)
+		}
+		request := map[string]interface{}{"userhash": meetUp.UserHash, "username": "alice", "token": user.Token}
+		if response := postApiRequest(t, srv.deleteUser, "/api/deleteuser", request); response.Error != "" {
+			t.Fatalf("deleteUser error: %s\n", response.Error)
+		}
+
+		var tests = []struct {
+			name    string
+			request map[string]interface{}
+			code    string
+		}{
+			{"unknown name", map[string]interface{}{"userhash": meetUp.UserHash, "username": "bob", "adminhash": meetUp.AdminHash}, codeNotFound},
+			{"wrong token", map[string]interface{}{"userhash": meetUp.UserHash, "username": "alice", "token": meetUp.AdminHash}, codeForbidden},
+			{"own token", request, ""},
+			{"not deleted", request, codeNotFound},
+		}
+		for _, test := range tests {
+			if response := postApiRequest(t, srv.restoreUser, "/api/restoreuser", test.request); response.Code != test.code {
+				t.Errorf("restoreUser %s: got %+v, want code %q\n", test.name, response, test.code)
+			}
+		}
+
+		dbMeetUp, err := store.GetMeetUpByUserHash(meetUp.UserHash)
+		if err != nil {
+			t.Fatalf("GetMeetUpByUserHash() failed: %s\n", err)
+		}
+		if len(dbMeetUp.Users) != 1 || dbMeetUp.Users[0].Token != user.Token || len(dbMeetUp.Users[0].Dates) != 1 {
+			t.Errorf("restored users = %+v, want alice with her token and dates\n", dbMeetUp.Users)
+		}
+
+		// The name was taken since the delete
+		if response := postApiRequest(t, srv.deleteUser, "/api/deleteuser", request); response.Error != "" {
+			t.Fatalf("deleteUser error: %s\n", response.Error)
+		}
+		if response := postApiRequest(t, srv.updateUser, "/api/updateuser", map[string]interface{}{"userhash": meetUp.UserHash, "username": "alice"}); response.Error != "" {
+			t.Fatalf("updateUser error: %s\n", response.Error)
+		}
+		if response := postApiRequest(t, srv.restoreUser, "/api/restoreuser", request); response.Code != codeNameTaken {
+			t.Errorf("restoring a taken name got %+v\n", response)
+		}
+
+		// Once the grace has passed they're gone
+		srv.deleteGrace = 0
+		request["adminhash"] = meetUp.AdminHash
+		if response := postApiRequest(t, srv.deleteUser, "/api/deleteuser", request); response.Error != "" {
+			t.Fatalf("deleteUser error: %s\n", response.Error)
+		}
+		if response := postApiRequest(t, srv.restoreUser, "/api/restoreuser", request); response.Code != codeNotFound {
+			t.Errorf("restoring after the grace got %+v\n", response)
+		}
+	})
+}
@@ -0,0 +1,534 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// The v2 json api. Meetups and their participants are resources under /api/v2/meetups, addressed by the user hash of
+// the meetup and the name of the participant. Changes to a meetup need its admin hash, changes to a participant their
+// edit token or the admin hash, sent as an "Authorization: Bearer <hash>" header. Failures respond with a 4xx or 5xx
+// status code.
+
+// apiV2Routes Returns the handlers of the v2 api, by ServeMux pattern. Every route is documented in openapi.json.
+func (s *server) apiV2Routes() map[string]http.HandlerFunc {
+	return map[string]http.HandlerFunc{
+		"POST /api/v2/meetups":                                  s.createMeetUpV2,
+		"GET /api/v2/meetups/{userhash}":                        s.getMeetUpV2,
+		"PUT /api/v2/meetups/{userhash}":                        s.replaceMeetUpV2,
+		"PATCH /api/v2/meetups/{userhash}":                      s.patchMeetUpV2,
+		"DELETE /api/v2/meetups/{userhash}":                     s.deleteMeetUpV2,
+		"POST /api/v2/meetups/{userhash}/restore":               s.restoreMeetUpV2,
+		"POST /api/v2/meetups/{userhash}/rotate":                s.rotateMeetUpV2,
+		"GET /api/v2/meetups/{userhash}/participants/{name}":    s.getParticipantV2,
+		"PUT /api/v2/meetups/{userhash}/participants/{name}":    s.putParticipantV2,
+		"DELETE /api/v2/meetups/{userhash}/participants/{name}": s.deleteParticipantV2,
+		"GET /api/v2/meetups/{userhash}/webhooks":               s.getWebhooksV2,
+		"POST /api/v2/meetups/{userhash}/webhooks":              s.addWebhookV2,
+		"DELETE /api/v2/meetups/{userhash}/webhooks/{id}":       s.deleteWebhookV2,
+		"GET /api/v2/meetups/{userhash}/history":                s.getHistoryV2,
+	}
+}
+
+// apiV2Router Returns the handler for all /api/v2/... requests. A known path with the wrong method gets 405.
+func (s *server) apiV2Router() http.Handler {
+	mux := http.NewServeMux()
+	for pattern, handler := range s.apiV2Routes() {
+		mux.HandleFunc(pattern, handler)
+	}
+	return mux
+}
+
+// meetUpV2 The json of a meetup resource. Leaves out the admin hash, which anyone with the user hash can read.
+type meetUpV2 struct {
+	UserHash    string  `json:"userhash"`
+	Description string  `json:"description"`
+	Dates       []int64 `json:"dates"`
+	Durations   []int64 `json:"durations"`
+	Slots       []Slot  `json:"slots"`
+	FinalDate   int64   `json:"finaldate"`
+	Revision    int64   `json:"revision"`
+	Users       Users   `json:"users"`
+}
+
+func newMeetUpV2(m MeetUp) meetUpV2 {
+	return meetUpV2{m.UserHash, m.Description, m.Dates, m.Durations, m.Slots(), m.FinalDate, m.Revision, m.Users}
+}
+
+// Returns the json error to the client for err. An apiError gets its status, a stale revision 412 if the request
+// had an If-Match header and 409 otherwise, anything else is logged and is a 500 database error.
+func writeV2Error(w http.ResponseWriter, r *http.Request, caller string, err error) {
+	var clientErr apiError
+	if errors.As(err, &clientErr) {
+		if clientErr.status == http.StatusUnauthorized {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+		}
+		writeApiError(w, clientErr.status, clientErr)
+		return
+	} else if errors.Is(err, errRevisionConflict) {
+		status := http.StatusConflict
+		if r.Header.Get("If-Match") != "" {
+			status = http.StatusPreconditionFailed
+		}
+		writeApiError(w, status, revisionConflictError)
+		return
+	}
+
+	log.Printf("%s failed: %s\n", caller, err)
+	writeApiError(w, http.StatusInternalServerError, newApiError(http.StatusInternalServerError, codeDatabaseError, "database error."))
+}
+
+// Decodes the json body of a request into v, at most limit bytes of it.
+func decodeV2Json(r *http.Request, limit int64, v interface{}) error {
+	defer func() {
+		if closeErr := r.Body.Close(); closeErr != nil {
+			log.Println(closeErr)
+		}
+	}()
+
+	if err := json.NewDecoder(io.LimitReader(r.Body, limit)).Decode(v); err != nil {
+		return newApiError(http.StatusBadRequest, codeInvalidJson, "invalid json.")
+	}
+	return nil
+}
+
+// Returns the hash from the Authorization: Bearer header of the request, "" without one.
+func bearerToken(r *http.Request) string {
+	scheme, token, found := strings.Cut(r.Header.Get("Authorization"), " ")
+	if found == false || strings.EqualFold(scheme, "Bearer") == false {
+		return ""
+	}
+	return strings.TrimSpace(token)
+}
+
+// Returns a read for changeMeetUp of the meetup with the userhash path value. Fails unless the request has the
+// meetup's admin hash.
+func readMeetUpAsAdmin(r *http.Request) func(tx Store) (MeetUp, error) {
+	return func(tx Store) (MeetUp, error) {
+		meetUp, err := readMeetUpV2(tx, r)
+		if err != nil {
+			return meetUp, err
+		}
+
+		adminHash := bearerToken(r)
+		if adminHash == "" {
+			return meetUp, newApiError(http.StatusUnauthorized, codeUnauthorized, "The admin hash is required.")
+		}
+		if isAdmin, err := isMeetUpAdmin(tx, meetUp, adminHash); err != nil {
+			return meetUp, err
+		} else if isAdmin == false {
+			return meetUp, newApiError(http.StatusForbidden, codeForbidden, "invalid admin hash.")
+		}
+		meetUp.AdminHash = adminHash
+		return meetUp, nil
+	}
+}
+
+// Reads the meetup with the userhash path value of the request.
+func readMeetUpV2(store Store, r *http.Request) (MeetUp, error) {
+	userHash := r.PathValue("userhash")
+	if validateHash(userHash) != nil {
+		return MeetUp{}, newApiError(http.StatusNotFound, codeNotFound, "The meetup was not found.")
+	}
+
+	meetUp, err := store.GetMeetUpByUserHash(userHash)
+	if errors.Is(err, ErrNotFound) {
+		return meetUp, newApiError(http.StatusNotFound, codeNotFound, "The meetup was not found.")
+	}
+	return meetUp, err
+}
+
+// Handles POST /api/v2/meetups, creates a meetup. Responds 201 with its hashes, and its url as the Location.
+func (s *server) createMeetUpV2(w http.ResponseWriter, r *http.Request) {
+	var reqJson struct {
+		Description string  `json:"description"`
+		Email       string  `json:"email"`
+		Dates       []int64 `json:"dates"`
+		Durations   []int64 `json:"durations"`
+	}
+	if err := decodeV2Json(r, maxLongJsonBytesLen, &reqJson); err != nil {
+		writeV2Error(w, r, "createMeetUpV2", err)
+		return
+	}
+
+	meetUp := MeetUp{Description: reqJson.Description, Email: reqJson.Email, Dates: reqJson.Dates, Durations: reqJson.Durations}
+	if err := validateEmail("email", meetUp.Email); err != nil {
+		writeV2Error(w, r, "createMeetUpV2", err)
+		return
+	}
+	if err := validateOptions(&meetUp); err != nil {
+		writeV2Error(w, r, "createMeetUpV2", err)
+		return
+	}
+	if err := s.createMeetUp(&meetUp, s.clientIpHash(r)); err != nil {
+		writeV2Error(w, r, "createMeetUpV2", err)
+		return
+	}
+
+	type createResult struct {
+		UserHash  string `json:"userhash"`
+		AdminHash string `json:"adminhash"`
+		Revision  int64  `json:"revision"`
+	}
+	w.Header().Set("Location", "/api/v2/meetups/"+meetUp.UserHash)
+	w.Header().Set("ETag", revisionETag(meetUp.Revision))
+	writeJsonResult(w, http.StatusCreated, createResult{meetUp.UserHash, meetUp.AdminHash, meetUp.Revision})
+}
+
+// Handles GET /api/v2/meetups/{userhash}, returns the meetup with its participants.
+func (s *server) getMeetUpV2(w http.ResponseWriter, r *http.Request) {
+	meetUp, err := readMeetUpV2(s.store, r)
+	if err != nil {
+		writeV2Error(w, r, "getMeetUpV2", err)
+		return
+	}
+
+	result := newMeetUpV2(meetUp)
+	w.Header().Set("ETag", readETag(meetUp.Revision, result))
+	writeJsonResult(w, http.StatusOK, result)
+}
+
+// Handles PUT /api/v2/meetups/{userhash}, replaces the description and options of the meetup. Removing the final date
+// reopens it. The email and expires aren't sent back by the reads, so they are kept when they're left out.
+func (s *server) replaceMeetUpV2(w http.ResponseWriter, r *http.Request) {
+	var reqJson struct {
+		Description string  `json:"description"`
+		Email       *string `json:"email"`
+		Expires     *int64  `json:"expires"`
+		Dates       []int64 `json:"dates"`
+		Durations   []int64 `json:"durations"`
+		Revision    int64   `json:"revision"`
+	}
+	if err := decodeV2Json(r, maxLongJsonBytesLen, &reqJson); err != nil {
+		writeV2Error(w, r, "replaceMeetUpV2", err)
+		return
+	}
+	if reqJson.Email != nil {
+		if err := validateEmail("email", *reqJson.Email); err != nil {
+			writeV2Error(w, r, "replaceMeetUpV2", err)
+			return
+		}
+	}
+	if reqJson.Expires != nil && *reqJson.Expires < 0 {
+		writeV2Error(w, r, "replaceMeetUpV2", invalidField("expires", "The expiry date is invalid."))
+		return
+	}
+
+	meetUp, err := s.changeMeetUp(s.clientIpHash(r), readMeetUpAsAdmin(r), func(m *MeetUp) error {
+		if err := checkRevision(r, reqJson.Revision, *m); err != nil {
+			return err
+		}
+
+		m.Description = reqJson.Description
+		if reqJson.Email != nil {
+			m.Email = *reqJson.Email
+		}
+		if reqJson.Expires != nil {
+			m.Expires = *reqJson.Expires
+		}
+		return setOptionsV2(m, reqJson.Dates, reqJson.Durations)
+	})
+	if err != nil {
+		writeV2Error(w, r, "replaceMeetUpV2", err)
+		return
+	}
+
+	result := newMeetUpV2(meetUp)
+	w.Header().Set("ETag", readETag(meetUp.Revision, result))
+	writeJsonResult(w, http.StatusOK, result)
+}
+
+// Handles PATCH /api/v2/meetups/{userhash}, changes the fields of the meetup that are in the json. Sending dates
+// without durations makes them all-day options. A finaldate closes the meetup, 0 reopens it. An expires of 0 expires
+// the meetup after its last date again.
+func (s *server) patchMeetUpV2(w http.ResponseWriter, r *http.Request) {
+	var reqJson struct {
+		Description *string  `json:"description"`
+		Email       *string  `json:"email"`
+		Expires     *int64   `json:"expires"`
+		Dates       *[]int64 `json:"dates"`
+		Durations   *[]int64 `json:"durations"`
+		FinalDate   *int64   `json:"finaldate"`
+		Revision    int64    `json:"revision"`
+	}
+	if err := decodeV2Json(r, maxLongJsonBytesLen, &reqJson); err != nil {
+		writeV2Error(w, r, "patchMeetUpV2", err)
+		return
+	}
+
+	meetUp, err := s.changeMeetUp(s.clientIpHash(r), readMeetUpAsAdmin(r), func(m *MeetUp) error {
+		if err := checkRevision(r, reqJson.Revision, *m); err != nil {
+			return err
+		}
+
+		if reqJson.Description != nil {
+			m.Description = *reqJson.Description
+		}
+		if reqJson.Email != nil {
+			if err := validateEmail("email", *reqJson.Email); err != nil {
+				return err
+			}
+			m.Email = *reqJson.Email
+		}
+		if reqJson.Expires != nil {
+			if *reqJson.Expires < 0 {
+				return invalidField("expires", "The expiry date is invalid.")
+			}
+			m.Expires = *reqJson.Expires
+		}
+		if reqJson.Dates != nil || reqJson.Durations != nil {
+			dates, durations := m.Dates, m.Durations
+			if reqJson.Dates != nil {
+				dates, durations = *reqJson.Dates, nil
+			}
+			if reqJson.Durations != nil {
+				durations = *reqJson.Durations
+			}
+			if err := setOptionsV2(m, dates, durations); err != nil {
+				return err
+			}
+		}
+		if reqJson.FinalDate != nil {
+			return chooseFinalDate(m, "finaldate", *reqJson.FinalDate)
+		}
+		return nil
+	})
+	if err != nil {
+		writeV2Error(w, r, "patchMeetUpV2", err)
+		return
+	}
+
+	result := newMeetUpV2(meetUp)
+	w.Header().Set("ETag", readETag(meetUp.Revision, result))
+	writeJsonResult(w, http.StatusOK, result)
+}
+
+// Sets the options of the meetup, and reopens it if the final date is no longer one of them.
+func setOptionsV2(m *MeetUp, dates, durations []int64) error {
+	m.Dates, m.Durations = dates, durations
+	if err := validateOptions(m); err != nil {
+		return err
+	}
+
+	if m.HasDate(m.FinalDate) == false {
+		m.FinalDate = 0
+	}
+	return nil
+}
+
+// Handles DELETE /api/v2/meetups/{userhash}, deletes the meetup and its participants. Responds 204.
+func (s *server) deleteMeetUpV2(w http.ResponseWriter, r *http.Request) {
+	var idMeetUp int64
+	err := s.store.WithTx(func(tx Store) error {
+		meetUp, err := readMeetUpAsAdmin(r)(tx)
+		if err != nil {
+			return err
+		}
+		if err = checkRevision(r, 0, meetUp); err != nil {
+			return err
+		}
+		if err = queueWebhooks(tx, meetUp.Id, webhookMeetUpDeleted, nil); err != nil {
+			return err
+		}
+		if err = auditMeetUp(tx, auditMeetUpDeleted, &meetUp, nil, s.clientIpHash(r)); err != nil {
+			return err
+		}
+		idMeetUp = meetUp.Id
+		return tx.DeleteMeetUp(meetUp.Id)
+	})
+	if err != nil {
+		writeV2Error(w, r, "deleteMeetUpV2", err)
+		return
+	}
+	s.events.close(idMeetUp)
+	s.webhooks.notify()
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Handles POST /api/v2/meetups/{userhash}/restore, undoes the deletion of the meetup within deleteGrace of it. Needs
+// the admin hash it had. Responds 204.
+func (s *server) restoreMeetUpV2(w http.ResponseWriter, r *http.Request) {
+	userHash, adminHash := r.PathValue("userhash"), bearerToken(r)
+	if adminHash == "" {
+		writeV2Error(w, r, "restoreMeetUpV2", newApiError(http.StatusUnauthorized, codeUnauthorized, "The admin hash is required."))
+		return
+	}
+	if validateHash(userHash) != nil || validateHash(adminHash) != nil {
+		writeV2Error(w, r, "restoreMeetUpV2", errNotRestorable)
+		return
+	}
+
+	if _, err := s.undeleteMeetUp(adminHash, userHash, s.clientIpHash(r)); err != nil {
+		writeV2Error(w, r, "restoreMeetUpV2", err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Handles POST /api/v2/meetups/{userhash}/rotate, replaces the admin hash of the meetup, and its user hash if
+// newuserhash is true, so the old links stop working. Responds with the new hashes, and the meetup's url as the
+// Location.
+func (s *server) rotateMeetUpV2(w http.ResponseWriter, r *http.Request) {
+	var reqJson struct {
+		NewUserHash bool  `json:"newuserhash"`
+		Revision    int64 `json:"revision"`
+	}
+	if err := decodeV2Json(r, maxShortJsonBytesLen, &reqJson); err != nil {
+		writeV2Error(w, r, "rotateMeetUpV2", err)
+		return
+	}
+
+	meetUp, err := s.replaceHashes(r, readMeetUpAsAdmin(r), reqJson.Revision, reqJson.NewUserHash)
+	if err != nil {
+		writeV2Error(w, r, "rotateMeetUpV2", err)
+		return
+	}
+
+	type rotateResult struct {
+		UserHash  string `json:"userhash"`
+		AdminHash string `json:"adminhash"`
+		Revision  int64  `json:"revision"`
+	}
+	w.Header().Set("Location", "/api/v2/meetups/"+meetUp.UserHash)
+	w.Header().Set("ETag", revisionETag(meetUp.Revision))
+	writeJsonResult(w, http.StatusOK, rotateResult{meetUp.UserHash, meetUp.AdminHash, meetUp.Revision})
+}
+
+// Handles GET /api/v2/meetups/{userhash}/participants/{name}, returns the participant's answers.
+func (s *server) getParticipantV2(w http.ResponseWriter, r *http.Request) {
+	meetUp, err := readMeetUpV2(s.store, r)
+	if err != nil {
+		writeV2Error(w, r, "getParticipantV2", err)
+		return
+	}
+
+	for _, user := range meetUp.Users {
+		if user.Name == r.PathValue("name") {
+			writeJsonResult(w, http.StatusOK, &user)
+			return
+		}
+	}
+	writeV2Error(w, r, "getParticipantV2", errUserNotFound)
+}
+
+// Handles PUT /api/v2/meetups/{userhash}/participants/{name}, adds the participant or replaces their answers.
+// Responds 201 with the participant's new edit token when they are added, 200 when they are changed.
+func (s *server) putParticipantV2(w http.ResponseWriter, r *http.Request) {
+	var reqJson struct {
+		Dates    []int64 `json:"dates"`
+		IfNeedBe []int64 `json:"ifneedbe"`
+		Email    string  `json:"email"`
+	}
+	if err := decodeV2Json(r, maxLongJsonBytesLen, &reqJson); err != nil {
+		writeV2Error(w, r, "putParticipantV2", err)
+		return
+	}
+
+	userHash := r.PathValue("userhash")
+	if validateHash(userHash) != nil {
+		writeV2Error(w, r, "putParticipantV2", newApiError(http.StatusNotFound, codeNotFound, "The meetup was not found."))
+		return
+	}
+
+	// The bearer token is either the participant's edit token or the admin hash
+	user := User{Name: r.PathValue("name"), Dates: reqJson.Dates, IfNeedBe: reqJson.IfNeedBe}
+	created, err := s.saveUser(userHash, &user, bearerToken(r), bearerToken(r), reqJson.Email, s.clientIpHash(r))
+	if err != nil {
+		writeV2Error(w, r, "putParticipantV2", err)
+		return
+	}
+
+	type participantResult struct {
+		Name     string  `json:"name"`
+		Dates    []int64 `json:"dates"`
+		IfNeedBe []int64 `json:"ifneedbe"`
+		Token    string  `json:"token"`
+	}
+	status := http.StatusOK
+	if created {
+		status = http.StatusCreated
+		w.Header().Set("Location", "/api/v2/meetups/"+userHash+"/participants/"+url.PathEscape(user.Name))
+	}
+	writeJsonResult(w, status, participantResult{user.Name, user.Dates, user.IfNeedBe, user.Token})
+}
+
+// Handles DELETE /api/v2/meetups/{userhash}/participants/{name}, removes the participant. Responds 204.
+func (s *server) deleteParticipantV2(w http.ResponseWriter, r *http.Request) {
+	userHash := r.PathValue("userhash")
+	if validateHash(userHash) != nil {
+		writeV2Error(w, r, "deleteParticipantV2", newApiError(http.StatusNotFound, codeNotFound, "The meetup was not found."))
+		return
+	}
+
+	if err := s.removeUser(userHash, r.PathValue("name"), bearerToken(r), bearerToken(r), s.clientIpHash(r)); err != nil {
+		writeV2Error(w, r, "deleteParticipantV2", err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Handles GET /api/v2/meetups/{userhash}/webhooks, lists the meetup's webhooks without their secrets.
+func (s *server) getWebhooksV2(w http.ResponseWriter, r *http.Request) {
+	webhooks, err := s.listWebhooks(readMeetUpAsAdmin(r))
+	if err != nil {
+		writeV2Error(w, r, "getWebhooksV2", err)
+		return
+	}
+	writeJsonResult(w, http.StatusOK, webhooks)
+}
+
+// Handles POST /api/v2/meetups/{userhash}/webhooks, adds a webhook. Responds 201 with it and its secret, which isn't
+// sent again, and its url as the Location.
+func (s *server) addWebhookV2(w http.ResponseWriter, r *http.Request) {
+	var reqJson struct {
+		Url string `json:"url"`
+	}
+	if err := decodeV2Json(r, maxLongJsonBytesLen, &reqJson); err != nil {
+		writeV2Error(w, r, "addWebhookV2", err)
+		return
+	}
+
+	webhook, err := s.createWebhook(readMeetUpAsAdmin(r), reqJson.Url)
+	if err != nil {
+		writeV2Error(w, r, "addWebhookV2", err)
+		return
+	}
+
+	w.Header().Set("Location", "/api/v2/meetups/"+r.PathValue("userhash")+"/webhooks/"+strconv.FormatInt(webhook.Id, 10))
+	writeJsonResult(w, http.StatusCreated, newWebhookResult{webhook, webhook.Secret})
+}
+
+// Handles DELETE /api/v2/meetups/{userhash}/webhooks/{id}, removes the webhook. Responds 204.
+func (s *server) deleteWebhookV2(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		writeV2Error(w, r, "deleteWebhookV2", errWebhookNotFound)
+		return
+	}
+
+	if err = s.removeWebhook(readMeetUpAsAdmin(r), id); err != nil {
+		writeV2Error(w, r, "deleteWebhookV2", err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Handles GET /api/v2/meetups/{userhash}/history, returns the meetup's audit log, the latest change first.
+func (s *server) getHistoryV2(w http.ResponseWriter, r *http.Request) {
+	events, err := s.listHistory(readMeetUpAsAdmin(r))
+	if err != nil {
+		writeV2Error(w, r, "getHistoryV2", err)
+		return
+	}
+	writeJsonResult(w, http.StatusOK, events)
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+// Sends a request to the v2 api through the server routes, with the hash as a bearer token unless it's empty.
+// Returns the response and its decoded json, which is empty for a response without a body.
+func v2Request(t *testing.T, handler http.Handler, method, target, hash string, body interface{}) (*http.Response, apiTestResponse) {
+	var reqBody bytes.Buffer
+	if body != nil {
+		if err := json.NewEncoder(&reqBody).Encode(body); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	request := httptest.NewRequest(method, target, &reqBody)
+	if hash != "" {
+		request.Header.Set("Authorization", "Bearer "+hash)
+	}
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, request)
+
+	var response apiTestResponse
+	if w.Body.Len() > 0 && w.Result().Header.Get("Content-Type") == "application/json" {
+		if err := json.NewDecoder(w.Result().Body).Decode(&response); err != nil {
+			t.Fatalf("%s %s returned invalid json: %s\n", method, target, err)
+		}
+	}
+	return w.Result(), response
+}
+
+func TestApiV2_MeetUp(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store Store) {
+		handler, err := newServer(store).routes()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// Create
+		resp, response := v2Request(t, handler, "POST", "/api/v2/meetups", "", map[string]interface{}{"description": "a", "dates": []int64{1550487600000, 1550401200000}})
+		if resp.StatusCode != http.StatusCreated {
+			t.Fatalf("create status = %d, want: %d. error: %q\n", resp.StatusCode, http.StatusCreated, response.Error)
+		}
+		var created struct {
+			UserHash  string `json:"userhash"`
+			AdminHash string `json:"adminhash"`
+		}
+		if err := json.Unmarshal(response.Result, &created); err != nil {
+			t.Fatal(err)
+		}
+		meetUpUrl := "/api/v2/meetups/" + created.UserHash
+		if location := resp.Header.Get("Location"); location != meetUpUrl {
+			t.Errorf("create Location = %q, want: %q\n", location, meetUpUrl)
+		}
+
+		var tests = []struct {
+			name       string
+			method     string
+			target     string
+			hash       string
+			body       interface{}
+			wantStatus int
+		}{
+			{"create without dates", "POST", "/api/v2/meetups", "", map[string]interface{}{"description": "a"}, http.StatusBadRequest},
+			{"create invalid json", "POST", "/api/v2/meetups", "", "not an object", http.StatusBadRequest},
+			{"get", "GET", meetUpUrl, "", nil, http.StatusOK},
+			{"get unknown", "GET", "/api/v2/meetups/" + created.AdminHash, "", nil, http.StatusNotFound},
+			{"get invalid hash", "GET", "/api/v2/meetups/abc", "", nil, http.StatusNotFound},
+			{"wrong method", "POST", meetUpUrl, "", nil, http.StatusMethodNotAllowed},
+			{"put without admin hash", "PUT", meetUpUrl, "", map[string]interface{}{"dates": []int64{1550401200000}}, http.StatusUnauthorized},
+			{"put with user hash", "PUT", meetUpUrl, created.UserHash, map[string]interface{}{"dates": []int64{1550401200000}}, http.StatusForbidden},
+			{"put", "PUT", meetUpUrl, created.AdminHash, map[string]interface{}{"description": "b", "dates": []int64{1550401200000, 1550487600000}}, http.StatusOK},
+			{"put stale revision", "PUT", meetUpUrl, created.AdminHash, map[string]interface{}{"dates": []int64{1550401200000}, "revision": 1}, http.StatusConflict},
+			{"put overlapping slots", "PUT", meetUpUrl, created.AdminHash, map[string]interface{}{"dates": []int64{1550401200000, 1550403000000}, "durations": []int64{3600000, 3600000}}, http.StatusBadRequest},
+			{"patch final date", "PATCH", meetUpUrl, created.AdminHash, map[string]interface{}{"finaldate": 1550487600000}, http.StatusOK},
+			{"patch unknown final date", "PATCH", meetUpUrl, created.AdminHash, map[string]interface{}{"finaldate": 1}, http.StatusBadRequest},
+		}
+
+		for _, test := range tests {
+			resp, response := v2Request(t, handler, test.method, test.target, test.hash, test.body)
+			if resp.StatusCode != test.wantStatus {
+				t.Errorf("%s: status = %d, want: %d. error: %q\n", test.name, resp.StatusCode, test.wantStatus, response.Error)
+			}
+		}
+
+		// The changes were made, and the admin hash isn't in the meetup json
+		resp, response = v2Request(t, handler, "GET", meetUpUrl, "", nil)
+		var meetUp map[string]interface{}
+		if err := json.Unmarshal(response.Result, &meetUp); err != nil {
+			t.Fatal(err)
+		}
+		if meetUp["description"] != "b" || meetUp["finaldate"] != float64(1550487600000) || meetUp["revision"] != float64(3) {
+			t.Errorf("get returned %v\n", meetUp)
+		} else if _, found := meetUp["adminhash"]; found {
+			t.Errorf("get returned the admin hash\n")
+		} else if etag := resp.Header.Get("ETag"); strings.HasPrefix(etag, `"3-`) == false {
+			t.Errorf("get ETag = %s, want: \"3-...\"\n", etag)
+		}
+
+		// Delete
+		if resp, _ = v2Request(t, handler, "DELETE", meetUpUrl, created.AdminHash, nil); resp.StatusCode != http.StatusNoContent {
+			t.Errorf("delete status = %d, want: %d\n", resp.StatusCode, http.StatusNoContent)
+		}
+		if resp, _ = v2Request(t, handler, "GET", meetUpUrl, "", nil); resp.StatusCode != http.StatusNotFound {
+			t.Errorf("get after delete status = %d, want: %d\n", resp.StatusCode, http.StatusNotFound)
+		}
+	})
+}
+
+func TestApiV2_RotateAndRestore(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store Store) {
+		handler, err := newServer(store).routes()
+		if err != nil {
+			t.Fatal(err)
+		}
+		dates := []int64{1550401200000, 1550487600000}
+		_, response := v2Request(t, handler, "POST", "/api/v2/meetups", "", map[string]interface{}{"email": "admin@example.com", "dates": dates})
+		var hashes struct {
+			UserHash  string `json:"userhash"`
+			AdminHash string `json:"adminhash"`
+		}
+		if err := json.Unmarshal(response.Result, &hashes); err != nil {
+			t.Fatal(err)
+		}
+		meetUpUrl := "/api/v2/meetups/" + hashes.UserHash
+
+		// A put keeps the email and expires it leaves out
+		for _, body := range []map[string]interface{}{{"dates": dates, "expires": 1550574000000}, {"description": "b", "dates": dates}} {
+			if resp, response := v2Request(t, handler, "PUT", meetUpUrl, hashes.AdminHash, body); resp.StatusCode != http.StatusOK {
+				t.Fatalf("put %v status = %d, error: %q\n", body, resp.StatusCode, response.Error)
+			}
+		}
+		if meetUp, err := store.GetMeetUpByUserHash(hashes.UserHash); err != nil || meetUp.Email != "admin@example.com" || meetUp.Expires != 1550574000000 || meetUp.Description != "b" {
+			t.Errorf("after the puts the meetup is %+v, %v\n", meetUp, err)
+		}
+
+		// Rotating the hashes moves the meetup to a new url, the old admin hash stops working
+		resp, response := v2Request(t, handler, "POST", meetUpUrl+"/rotate", hashes.AdminHash, map[string]interface{}{"newuserhash": true})
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("rotate status = %d, error: %q\n", resp.StatusCode, response.Error)
+		}
+		oldHashes := hashes
+		if err := json.Unmarshal(response.Result, &hashes); err != nil {
+			t.Fatal(err)
+		}
+		if hashes.UserHash == oldHashes.UserHash || hashes.AdminHash == oldHashes.AdminHash || resp.Header.Get("Location") != "/api/v2/meetups/"+hashes.UserHash {
+			t.Errorf("rotate returned %+v, Location %q\n", hashes, resp.Header.Get("Location"))
+		}
+		oldUrl, meetUpUrl := meetUpUrl, "/api/v2/meetups/"+hashes.UserHash
+		if resp, _ = v2Request(t, handler, "GET", oldUrl, "", nil); resp.StatusCode != http.StatusNotFound {
+			t.Errorf("get of the old url status = %d, want: %d\n", resp.StatusCode, http.StatusNotFound)
+		}
+		if resp, _ = v2Request(t, handler, "PATCH", meetUpUrl, oldHashes.AdminHash, map[string]interface{}{"description": "c"}); resp.StatusCode != http.StatusForbidden {
+			t.Errorf("patch with the old admin hash status = %d, want: %d\n", resp.StatusCode, http.StatusForbidden)
+		}
+
+		// Restoring needs the url and the admin hash of the deleted meetup
+		if resp, _ = v2Request(t, handler, "DELETE", meetUpUrl, hashes.AdminHash, nil); resp.StatusCode != http.StatusNoContent {
+			t.Fatalf("delete status = %d, want: %d\n", resp.StatusCode, http.StatusNoContent)
+		}
+		var tests = []struct {
+			name       string
+			target     string
+			hash       string
+			wantStatus int
+		}{
+			{"without admin hash", meetUpUrl, "", http.StatusUnauthorized},
+			{"with the old admin hash", meetUpUrl, oldHashes.AdminHash, http.StatusNotFound},
+			{"at the old url", oldUrl, hashes.AdminHash, http.StatusNotFound},
+			{"restore", meetUpUrl, hashes.AdminHash, http.StatusNoContent},
+			{"restore again", meetUpUrl, hashes.AdminHash, http.StatusNotFound},
+		}
+		for _, test := range tests {
+			if resp, response = v2Request(t, handler, "POST", test.target+"/restore", test.hash, nil); resp.StatusCode != test.wantStatus {
+				t.Errorf("%s: status = %d, want: %d. error: %q\n", test.name, resp.StatusCode, test.wantStatus, response.Error)
+			}
+		}
+		if resp, _ = v2Request(t, handler, "GET", meetUpUrl, "", nil); resp.StatusCode != http.StatusOK {
+			t.Errorf("get after the restore status = %d, want: %d\n", resp.StatusCode, http.StatusOK)
+		}
+	})
+}
+
+func TestApiV2_Participants(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store Store) {
+		handler, err := newServer(store).routes()
+		if err != nil {
+			t.Fatal(err)
+		}
+		meetUp := createApiTestMeetUp(t, store)
+		participantUrl := "/api/v2/meetups/" + meetUp.UserHash + "/participants/" + url.PathEscape("Jane Doe")
+
+		// Adding a participant returns their edit token
+		resp, response := v2Request(t, handler, "PUT", participantUrl, "", map[string]interface{}{"dates": []int64{1550401200000}})
+		if resp.StatusCode != http.StatusCreated {
+			t.Fatalf("add status = %d, want: %d. error: %q\n", resp.StatusCode, http.StatusCreated, response.Error)
+		} else if location := resp.Header.Get("Location"); location != participantUrl {
+			t.Errorf("add Location = %q, want: %q\n", location, participantUrl)
+		}
+		var participant struct {
+			Token string `json:"token"`
+		}
+		if err := json.Unmarshal(response.Result, &participant); err != nil {
+			t.Fatal(err)
+		}
+
+		var tests = []struct {
+			name       string
+			method     string
+			target     string
+			hash       string
+			body       interface{}
+			wantStatus int
+		}{
+			{"get", "GET", participantUrl, "", nil, http.StatusOK},
+			{"get unknown", "GET", participantUrl + "x", "", nil, http.StatusNotFound},
+			{"change without token", "PUT", participantUrl, "", map[string]interface{}{"dates": []int64{1550487600000}}, http.StatusForbidden},
+			{"change with token", "PUT", participantUrl, participant.Token, map[string]interface{}{"dates": []int64{1550487600000}}, http.StatusOK},
+			{"change with admin hash", "PUT", participantUrl, meetUp.AdminHash, map[string]interface{}{"ifneedbe": []int64{1550487600000}}, http.StatusOK},
+			{"both yes and if need be", "PUT", participantUrl, participant.Token, map[string]interface{}{"dates": []int64{1550487600000}, "ifneedbe": []int64{1550487600000}}, http.StatusBadRequest},
+			{"not a meetup date", "PUT", participantUrl, participant.Token, map[string]interface{}{"dates": []int64{1}}, http.StatusBadRequest},
+			{"unknown meetup", "PUT", "/api/v2/meetups/" + meetUp.AdminHash + "/participants/a", "", map[string]interface{}{}, http.StatusNotFound},
+			{"delete without token", "DELETE", participantUrl, "", nil, http.StatusForbidden},
+			{"delete", "DELETE", participantUrl, participant.Token, nil, http.StatusNoContent},
+			{"delete again", "DELETE", participantUrl, participant.Token, nil, http.StatusNotFound},
+			{"close the meetup", "PATCH", "/api/v2/meetups/" + meetUp.UserHash, meetUp.AdminHash, map[string]interface{}{"finaldate": 1550401200000}, http.StatusOK},
+			{"add to a closed meetup", "PUT", participantUrl, "", map[string]interface{}{}, http.StatusConflict},
+		}
+
+		for _, test := range tests {
+			resp, response := v2Request(t, handler, test.method, test.target, test.hash, test.body)
+			if resp.StatusCode != test.wantStatus {
+				t.Errorf("%s: status = %d, want: %d. error: %q\n", test.name, resp.StatusCode, test.wantStatus, response.Error)
+			}
+		}
+
+		// The v1 api still works alongside
+		js, _ := json.Marshal(map[string]interface{}{"userhash": meetUp.UserHash})
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("POST", "/api/getusermeetup", bytes.NewReader(js)))
+		if response := (apiTestResponse{}); json.NewDecoder(w.Body).Decode(&response) != nil || w.Code != http.StatusOK || response.Error != "" {
+			t.Errorf("v1 getusermeetup: status %d error %q\n", w.Code, response.Error)
+		}
+	})
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"log"
+	"net"
+	"net/http"
+	"slices"
+)
+
+// The actions of a meetup's audit log, the Action of a MeetUpEvent.
+const (
+	auditMeetUpCreated   = "meetup.created"
+	auditMeetUpEdited    = "meetup.edited"
+	auditMeetUpFinalised = "meetup.finalised" // A final date was chosen, or another one instead
+	auditMeetUpReopened  = "meetup.reopened"  // The final date was cleared
+	auditMeetUpDeleted   = "meetup.deleted"
+	auditMeetUpRestored  = "meetup.restored"
+	auditMeetUpRotated   = "meetup.rotated" // Its adminhash, and maybe its userhash, were replaced
+	auditUserAdded       = "participant.added"
+	auditUserChanged     = "participant.changed"
+	auditUserRemoved     = "participant.removed"
+	auditUserRestored    = "participant.restored"
+)
+
+const auditKeyLen = 32     // The length of a random audit key
+const ipHashHexLength = 32 // The hex digits of an IP hash that are kept, half of the HMAC-SHA256
+
+// newAuditKey Returns a random key for the IP hashes, until the server is given the one derived from its token key.
+func newAuditKey() []byte {
+	key := make([]byte, auditKeyLen)
+	if _, err := rand.Read(key); err != nil {
+		log.Fatalf("newAuditKey failed: error reading random bytes. %s\n", err)
+	}
+	return key
+}
+
+// clientIpHash Returns the hash of the IP address the request came from, for the audit log. The hash is keyed with
+// the server's auditKey, so the entries of one client can be told apart from others without storing the address.
+func (s *server) clientIpHash(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+
+	mac := hmac.New(sha256.New, s.auditKey)
+	mac.Write([]byte(host))
+	return hex.EncodeToString(mac.Sum(nil))[:ipHashHexLength]
+}
+
+// auditMeetUp Appends a meetup action to its audit log, in the transaction of the change. old is the meetup before
+// the change and new after it, nil when it was created or deleted.
+func auditMeetUp(tx Store, action string, old, new *MeetUp, ipHash string) error {
+	e := MeetUpEvent{Action: action, IpHash: ipHash}
+	if old != nil {
+		e.IdMeetUp, e.OldDates = old.Id, old.Dates
+	}
+	if new != nil {
+		e.IdMeetUp, e.NewDates = new.Id, new.Dates
+	}
+	return auditEvent(tx, e)
+}
+
+// auditMeetUpChange Appends the change of a meetup from old to new to its audit log, in the transaction of the change.
+// A changed final date is logged as meetup.finalised or meetup.reopened with the final dates, before and after, as
+// its dates. Any other change is logged as meetup.edited.
+func auditMeetUpChange(tx Store, old, new *MeetUp, ipHash string) error {
+	if old.FinalDate != new.FinalDate {
+		e := MeetUpEvent{IdMeetUp: new.Id, Action: auditMeetUpFinalised, IpHash: ipHash, OldDates: finalDates(old), NewDates: finalDates(new)}
+		if new.FinalDate == 0 {
+			e.Action = auditMeetUpReopened
+		}
+		if err := auditEvent(tx, e); err != nil {
+			return err
+		}
+
+		if slices.Equal(old.Dates, new.Dates) && slices.Equal(old.Durations, new.Durations) && old.Description == new.Description &&
+			old.Email == new.Email && old.Expires == new.Expires { // Only the final date changed
+			return nil
+		}
+	}
+	return auditMeetUp(tx, auditMeetUpEdited, old, new, ipHash)
+}
+
+// Returns the final date of m as a list of dates for its audit entries, empty while it's open.
+func finalDates(m *MeetUp) []int64 {
+	if m.FinalDate == 0 {
+		return nil
+	}
+	return []int64{m.FinalDate}
+}
+
+// auditUser Appends a participant action to the audit log of their meetup, in the transaction of the change. old is
+// the participant before the change and new after it, nil when they were added or removed.
+func auditUser(tx Store, action string, old, new *User, ipHash string) error {
+	e := MeetUpEvent{Action: action, IpHash: ipHash}
+	if old != nil {
+		e.IdMeetUp, e.Name, e.OldDates, e.OldIfNeedBe = old.IdMeetUp, old.Name, old.Dates, old.IfNeedBe
+	}
+	if new != nil {
+		e.IdMeetUp, e.Name, e.NewDates, e.NewIfNeedBe = new.IdMeetUp, new.Name, new.Dates, new.IfNeedBe
+	}
+	return auditEvent(tx, e)
+}
+
+// Writes the entry, returning an apiError if it fails.
+func auditEvent(tx Store, e MeetUpEvent) error {
+	if err := tx.CreateMeetUpEvent(&e); err != nil {
+		log.Printf("auditEvent failed: %s\n", err)
+		return newApiError(http.StatusInternalServerError, codeDatabaseError, "database error. could not update.")
+	}
+	return nil
+}
+
+// Returns the audit log of the meetup of read, the latest first.
+func (s *server) listHistory(read func(tx Store) (MeetUp, error)) (events []MeetUpEvent, err error) {
+	err = s.store.WithTx(func(tx Store) error {
+		meetUp, err := read(tx)
+		if err != nil {
+			return err
+		}
+
+		events, err = tx.GetMeetUpEvents(meetUp.Id)
+		return err
+	})
+	return
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestAuditLog(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store Store) {
+		srv := newServer(store)
+		dates := []int64{1550401200000, 1550487600000, 1550574000000}
+
+		response := postApiRequest(t, srv.updateMeetUp, "/api/updatemeetup", map[string]interface{}{"description": "a", "dates": dates})
+		var meetUp struct{ UserHash, AdminHash string }
+		if err := json.Unmarshal(response.Result, &meetUp); err != nil || response.Error != "" {
+			t.Fatalf("updateMeetUp() = %+v, %v\n", response, err)
+		}
+
+		response = postApiRequest(t, srv.updateUser, "/api/updateuser", map[string]interface{}{"userhash": meetUp.UserHash, "username": "alice", "dates": dates[:1]})
+		var user struct{ Token string }
+		if err := json.Unmarshal(response.Result, &user); err != nil || response.Error != "" {
+			t.Fatalf("updateUser() = %+v, %v\n", response, err)
+		}
+		for _, test := range []struct {
+			name    string
+			handler http.HandlerFunc
+			url     string
+			request map[string]interface{}
+		}{
+			{"change", srv.updateUser, "/api/updateuser", map[string]interface{}{"userhash": meetUp.UserHash, "username": "alice", "token": user.Token, "dates": dates[1:2], "ifneedbe": dates[:1]}},
+			{"rejected change", srv.updateUser, "/api/updateuser", map[string]interface{}{"userhash": meetUp.UserHash, "username": "alice", "dates": dates}},
+			{"edit", srv.updateMeetUp, "/api/updatemeetup", map[string]interface{}{"adminhash": meetUp.AdminHash, "description": "b", "dates": dates[:2]}},
+			{"finalise", srv.finaliseMeetUp, "/api/finalisemeetup", map[string]interface{}{"adminhash": meetUp.AdminHash, "date": dates[1]}},
+			{"reopen", srv.reopenMeetUp, "/api/reopenmeetup", map[string]interface{}{"adminhash": meetUp.AdminHash}},
+			{"finalise another", srv.finaliseMeetUp, "/api/finalisemeetup", map[string]interface{}{"adminhash": meetUp.AdminHash, "date": dates[0]}},
+			{"edit that reopens", srv.updateMeetUp, "/api/updatemeetup", map[string]interface{}{"adminhash": meetUp.AdminHash, "description": "b", "dates": dates[1:2]}},
+			{"remove from another client", func(w http.ResponseWriter, r *http.Request) {
+				r.RemoteAddr = "198.51.100.7:54321"
+				srv.deleteUser(w, r)
+			}, "/api/deleteuser", map[string]interface{}{"userhash": meetUp.UserHash, "username": "alice", "adminhash": meetUp.AdminHash}},
+		} {
+			response = postApiRequest(t, test.handler, test.url, test.request)
+			if rejected := test.name == "rejected change"; (response.Error != "") != rejected {
+				t.Fatalf("%s: error %q\n", test.name, response.Error)
+			}
+		}
+
+		response = postApiRequest(t, srv.getHistory, "/api/gethistory", map[string]interface{}{"adminhash": meetUp.AdminHash})
+		var history []MeetUpEvent
+		if err := json.Unmarshal(response.Result, &history); err != nil || response.Error != "" {
+			t.Fatalf("getHistory() = %+v, %v\n", response, err)
+		}
+
+		// The latest first, and nothing for the rejected change. Finalising and reopening have the final dates.
+		var want = []MeetUpEvent{
+			{Action: auditUserRemoved, Name: "alice", OldDates: dates[1:2], NewDates: []int64{}, OldIfNeedBe: []int64{}, NewIfNeedBe: []int64{}},
+			{Action: auditMeetUpEdited, OldDates: dates[:2], NewDates: dates[1:2], OldIfNeedBe: []int64{}, NewIfNeedBe: []int64{}},
+			{Action: auditMeetUpReopened, OldDates: dates[:1], NewDates: []int64{}, OldIfNeedBe: []int64{}, NewIfNeedBe: []int64{}},
+			{Action: auditMeetUpFinalised, OldDates: []int64{}, NewDates: dates[:1], OldIfNeedBe: []int64{}, NewIfNeedBe: []int64{}},
+			{Action: auditMeetUpReopened, OldDates: dates[1:2], NewDates: []int64{}, OldIfNeedBe: []int64{}, NewIfNeedBe: []int64{}},
+			{Action: auditMeetUpFinalised, OldDates: []int64{}, NewDates: dates[1:2], OldIfNeedBe: []int64{}, NewIfNeedBe: []int64{}},
+			{Action: auditMeetUpEdited, OldDates: dates, NewDates: dates[:2], OldIfNeedBe: []int64{}, NewIfNeedBe: []int64{}},
+			{Action: auditUserChanged, Name: "alice", OldDates: dates[:1], NewDates: dates[1:2], OldIfNeedBe: []int64{}, NewIfNeedBe: dates[:1]},
+			{Action: auditUserAdded, Name: "alice", OldDates: []int64{}, NewDates: dates[:1], OldIfNeedBe: []int64{}, NewIfNeedBe: []int64{}},
+			{Action: auditMeetUpCreated, OldDates: []int64{}, NewDates: dates, OldIfNeedBe: []int64{}, NewIfNeedBe: []int64{}},
+		}
+		if len(history) != len(want) {
+			t.Fatalf("getHistory() = %+v, want %d entries\n", history, len(want))
+		}
+		for i, entry := range history {
+			if entry.Created == 0 || (i > 0 && entry.Id >= history[i-1].Id) {
+				t.Errorf("entry %d has id %d, created %d\n", i, entry.Id, entry.Created)
+			}
+			entry.Id, entry.Created, entry.IpHash = 0, 0, ""
+			if reflect.DeepEqual(entry, want[i]) == false {
+				t.Errorf("entry %d = %+v, want: %+v\n", i, entry, want[i])
+			}
+		}
+
+		// The client is only kept as a hash, the same for the same address
+		ipHash := history[1].IpHash
+		if len(ipHash) != ipHashHexLength || strings.Contains(ipHash, "192.0.2.1") {
+			t.Errorf("iphash = %q\n", ipHash)
+		}
+		for _, entry := range history[2:] {
+			if entry.IpHash != ipHash {
+				t.Errorf("%s iphash = %q, want: %q\n", entry.Action, entry.IpHash, ipHash)
+			}
+		}
+		if history[0].IpHash == ipHash || history[0].IpHash == "" {
+			t.Errorf("another client has the iphash %q\n", history[0].IpHash)
+		}
+
+		// Only the admin can read it
+		if response = postApiRequest(t, srv.getHistory, "/api/gethistory", map[string]interface{}{"adminhash": meetUp.UserHash}); response.Code != codeNotFound {
+			t.Errorf("getHistory() with the userhash got %+v\n", response)
+		}
+	})
+}
@@ -1,124 +1,304 @@
 package main
 
 import (
-	"errors"
-	"fmt"
+	"database/sql"
+	"encoding/json"
 	_ "github.com/mattn/go-sqlite3"
+	"time"
 )
 
-func (m *MeetUp) Create() error {
-	datesBlob := convertDatesToBlob(m.Dates)
+func (s *sqlStore) CreateMeetUp(m *MeetUp) error {
+	m.Modified = time.Now().UnixMilli()
+	m.Created = m.Modified
+	m.Revision = 1
 
-	result, err := preparedStmts["insertMeetup"].Exec(m.UserHash, m.AdminHash, datesBlob, m.Description)
+	sealedUserHash, err := s.tokens.seal(m.UserHash)
 	if err != nil {
 		return err
 	}
 
-	m.Id, err = result.LastInsertId()
+	return s.withTx(func(tx sqlTx) error {
+		err := tx.stmt("insertMeetup").QueryRow(tx.tokens.digest(m.UserHash), tx.tokens.digest(m.AdminHash), sealedUserHash, m.Description, m.Email, m.Created, m.Modified, m.Expires).Scan(&m.Id)
+		if err != nil {
+			return err
+		}
+
+		return m.writeOptions(tx)
+	})
+}
+func (s *sqlStore) ReadMeetUp(id int64) (m MeetUp, err error) {
+	err = s.withTx(func(tx sqlTx) error {
+		return m.readRow(tx, "selectMeetup", id, ErrNotFound)
+	})
+	return
+}
+func (s *sqlStore) UpdateMeetUp(m *MeetUp) error {
+	m.Modified = time.Now().UnixMilli()
+
+	err := s.withTx(func(tx sqlTx) error {
+		result, err := tx.stmt("updateMeetup").Exec(m.Description, m.Email, m.EmailConfirmed, m.FinalDate, m.Modified, m.Expires, m.Id, m.Revision)
+		if err != nil {
+			return err
+		}
+		if rowCount, err := result.RowsAffected(); err != nil {
+			return err
+		} else if rowCount == 0 {
+			return errRevisionConflict
+		}
+
+		return m.writeOptions(tx)
+	})
 	if err != nil {
 		return err
 	}
 
+	m.Revision++
 	return nil
 }
-func (m *MeetUp) Read(id int64) (retErr error) {
-	rows, retErr := preparedStmts["selectMeetup"].Query(id)
-	if retErr != nil {
-		return
-	}
-	defer func() {
-		if closeErr := rows.Close(); closeErr != nil {
-			retErr = fmt.Errorf("%s unable to close rows %s", retErr, closeErr)
-		}
-	}()
+func (s *sqlStore) UpdateMeetUpHashes(m *MeetUp) error {
+	m.Modified = time.Now().UnixMilli()
 
-	if rows.Next() {
-		var datesBlob []byte
-		retErr = rows.Scan(&m.Id, &m.UserHash, &m.AdminHash, &datesBlob, &m.Description)
-		if retErr != nil {
-			return
-		}
-		m.Dates = convertBlobToDates(datesBlob)
-	} else {
-		retErr = errors.New("no rows")
-		return
+	sealedUserHash, err := s.tokens.seal(m.UserHash)
+	if err != nil {
+		return err
 	}
 
-	return nil
-}
-func (m *MeetUp) Update() error {
-	datesBlob := convertDatesToBlob(m.Dates)
-	_, err := preparedStmts["updateMeetup"].Exec(datesBlob, m.Description, m.Id)
+	err = s.withTx(func(tx sqlTx) error {
+		result, err := tx.stmt("updateMeetupHashes").Exec(tx.tokens.digest(m.UserHash), tx.tokens.digest(m.AdminHash), sealedUserHash, m.Modified, m.Id, m.Revision)
+		if err != nil {
+			return err
+		}
+		if rowCount, err := result.RowsAffected(); err != nil {
+			return err
+		} else if rowCount == 0 {
+			return errRevisionConflict
+		}
+		return nil
+	})
 	if err != nil {
 		return err
 	}
 
+	m.Revision++
 	return nil
 }
-func (m *MeetUp) Delete() error {
-	if _, err := preparedStmts["deleteMeetup"].Exec(m.Id); err != nil {
+func (s *sqlStore) DeleteMeetUp(id int64) error {
+	return s.withTx(func(tx sqlTx) error {
+		_, err := tx.stmt("deleteMeetup").Exec(time.Now().UnixMilli(), id)
 		return err
-	}
+	})
+}
+func (s *sqlStore) ConfirmMeetUpEmail(id int64, email string, confirmed int64) error {
+	return s.withTx(func(tx sqlTx) error {
+		_, err := tx.stmt("confirmMeetupEmail").Exec(confirmed, id, email)
+		return err
+	})
+}
+func (s *sqlStore) RestoreMeetUp(id int64) error {
+	return s.withTx(func(tx sqlTx) error {
+		_, err := tx.stmt("restoreMeetup").Exec(time.Now().UnixMilli(), id)
+		return err
+	})
+}
 
-	return nil
+func (s *sqlStore) CreateUser(u *User) error {
+	return s.withTx(func(tx sqlTx) error {
+		err := tx.stmt("insertUser").QueryRow(u.IdMeetUp, u.Name, u.Token).Scan(&u.Id)
+		if s.dialect.isUniqueViolation(err) {
+			return errUserExists
+		} else if err != nil {
+			return err
+		}
+
+		if err = u.writeAvailability(tx); err != nil {
+			return err
+		}
+		return touchMeetUp(tx, u.IdMeetUp)
+	})
 }
+func (s *sqlStore) ReadUser(id int64) (u User, err error) {
+	err = s.withTx(func(tx sqlTx) error {
+		err := tx.stmt("selectUser").QueryRow(id).Scan(&u.Id, &u.IdMeetUp, &u.Name, &u.Token)
+		if err == sql.ErrNoRows {
+			return ErrNotFound
+		} else if err != nil {
+			return err
+		}
 
-func (u *User) Create() error {
-	datesBlob := convertDatesToBlob(u.Dates)
+		return u.readAvailability(tx)
+	})
+	return
+}
+func (s *sqlStore) UpdateUser(u *User) error {
+	return s.withTx(func(tx sqlTx) error {
+		_, err := tx.stmt("updateUser").Exec(u.Name, u.Token, u.Id)
+		if s.dialect.isUniqueViolation(err) {
+			return errUserExists
+		} else if err != nil {
+			return err
+		}
 
-	result, err := preparedStmts["insertUser"].Exec(u.IdMeetUp, u.Name, datesBlob)
-	if err != nil {
-		return err
-	}
+		if err = u.writeAvailability(tx); err != nil {
+			return err
+		}
+		return touchMeetUp(tx, u.IdMeetUp)
+	})
+}
+func (s *sqlStore) DeleteUser(u *User) error {
+	u.DeletedAt = time.Now().UnixMilli()
 
-	id, err := result.LastInsertId()
-	if err != nil {
-		return err
-	}
+	return s.withTx(func(tx sqlTx) error {
+		_, err := tx.stmt("deleteUser").Exec(u.DeletedAt, u.Id)
+		if err != nil {
+			return err
+		}
 
-	u.Id = id
-	return nil
+		return touchMeetUp(tx, u.IdMeetUp)
+	})
 }
-func (u *User) Read(id int64) (retErr error) {
-	rows, retErr := preparedStmts["selectUser"].Query(id)
-	if retErr != nil {
-		return
-	}
-	defer func() {
-		if closeErr := rows.Close(); closeErr != nil {
-			retErr = fmt.Errorf("%s unable to close rows %s", retErr, closeErr)
+func (s *sqlStore) GetDeletedUsersByMeetUpId(idMeetUp int64) (users Users, err error) {
+	err = s.withTx(func(tx sqlTx) error {
+		return users.readDeleted(tx, idMeetUp)
+	})
+	return
+}
+func (s *sqlStore) RestoreUser(u *User) error {
+	return s.withTx(func(tx sqlTx) error {
+		_, err := tx.stmt("restoreUser").Exec(u.Id)
+		if s.dialect.isUniqueViolation(err) {
+			return errUserExists
+		} else if err != nil {
+			return err
 		}
-	}()
 
-	if rows.Next() {
-		var datesBlob []byte
-		retErr = rows.Scan(&u.Id, &u.IdMeetUp, &u.Name, &datesBlob)
+		u.DeletedAt = 0
+		return touchMeetUp(tx, u.IdMeetUp)
+	})
+}
+
+func (s *sqlStore) CreateWebhook(w *Webhook) error {
+	return s.withTx(func(tx sqlTx) error {
+		return tx.stmt("insertWebhook").QueryRow(w.IdMeetUp, w.Url, w.Secret, w.Created).Scan(&w.Id)
+	})
+}
+func (s *sqlStore) GetWebhooksByMeetUpId(idMeetUp int64) (webhooks []Webhook, err error) {
+	err = s.withTx(func(tx sqlTx) (retErr error) {
+		rows, retErr := tx.stmt("selectWebhooksByMeetUpid").Query(idMeetUp)
 		if retErr != nil {
 			return
 		}
-		u.Dates = convertBlobToDates(datesBlob)
-	} else {
-		retErr = errors.New("no rows")
-		return
-	}
+		defer closeRows(rows, &retErr)
 
-	return nil
+		webhooks = make([]Webhook, 0)
+		for rows.Next() {
+			var w Webhook
+			if retErr = rows.Scan(&w.Id, &w.IdMeetUp, &w.Url, &w.Secret, &w.Created); retErr != nil {
+				return
+			}
+			webhooks = append(webhooks, w)
+		}
+		return rows.Err()
+	})
+	return
+}
+func (s *sqlStore) DeleteWebhook(idMeetUp, id int64) error {
+	return s.withTx(func(tx sqlTx) error {
+		result, err := tx.stmt("deleteWebhook").Exec(id, idMeetUp)
+		if err != nil {
+			return err
+		}
+		if rowCount, err := result.RowsAffected(); err != nil {
+			return err
+		} else if rowCount == 0 {
+			return ErrNotFound
+		}
+		return nil
+	})
 }
-func (u *User) Update() error {
-	datesBlob := convertDatesToBlob(u.Dates)
 
-	_, err := preparedStmts["updateUser"].Exec(u.Name, datesBlob, u.Id)
-	if err != nil {
-		return err
-	}
+func (s *sqlStore) QueueDelivery(d *WebhookDelivery) error {
+	return s.withTx(func(tx sqlTx) error {
+		return tx.stmt("insertDelivery").QueryRow(d.Url, d.Secret, string(d.Payload), d.Attempts, d.NextAttempt, d.LastError).Scan(&d.Id)
+	})
+}
+func (s *sqlStore) GetDueDeliveries(now int64, limit int) (deliveries []WebhookDelivery, err error) {
+	err = s.withTx(func(tx sqlTx) (retErr error) {
+		rows, retErr := tx.stmt("selectDueDeliveries").Query(now, limit)
+		if retErr != nil {
+			return
+		}
+		defer closeRows(rows, &retErr)
 
-	return nil
+		deliveries = make([]WebhookDelivery, 0)
+		for rows.Next() {
+			var d WebhookDelivery
+			if retErr = rows.Scan(&d.Id, &d.Url, &d.Secret, &d.Payload, &d.Attempts, &d.NextAttempt, &d.LastError); retErr != nil {
+				return
+			}
+			deliveries = append(deliveries, d)
+		}
+		return rows.Err()
+	})
+	return
 }
-func (u *User) Delete() error {
-	_, err := preparedStmts["deleteUser"].Exec(u.Id)
-	if err != nil {
+func (s *sqlStore) UpdateDelivery(d *WebhookDelivery) error {
+	return s.withTx(func(tx sqlTx) error {
+		_, err := tx.stmt("updateDelivery").Exec(d.Attempts, d.NextAttempt, d.LastError, d.Id)
+		return err
+	})
+}
+func (s *sqlStore) DeleteDelivery(id int64) error {
+	return s.withTx(func(tx sqlTx) error {
+		_, err := tx.stmt("deleteDelivery").Exec(id)
 		return err
+	})
+}
+
+func (s *sqlStore) CreateMeetUpEvent(e *MeetUpEvent) error {
+	e.Created = time.Now().UnixMilli()
+
+	var dates [4][]byte
+	for i, list := range [][]int64{e.OldDates, e.NewDates, e.OldIfNeedBe, e.NewIfNeedBe} {
+		var err error
+		if dates[i], err = json.Marshal(nonNilDates(list)); err != nil {
+			return err
+		}
 	}
+	return s.withTx(func(tx sqlTx) error {
+		return tx.stmt("insertMeetupEvent").QueryRow(e.IdMeetUp, e.Action, e.Name, string(dates[0]), string(dates[1]), string(dates[2]), string(dates[3]), e.Created, e.IpHash).Scan(&e.Id)
+	})
+}
+func (s *sqlStore) GetMeetUpEvents(idMeetUp int64) (events []MeetUpEvent, err error) {
+	err = s.withTx(func(tx sqlTx) (retErr error) {
+		rows, retErr := tx.stmt("selectMeetupEvents").Query(idMeetUp)
+		if retErr != nil {
+			return
+		}
+		defer closeRows(rows, &retErr)
 
-	return nil
+		events = make([]MeetUpEvent, 0)
+		for rows.Next() {
+			var e MeetUpEvent
+			var dates [4]string
+			if retErr = rows.Scan(&e.Id, &e.IdMeetUp, &e.Action, &e.Name, &dates[0], &dates[1], &dates[2], &dates[3], &e.Created, &e.IpHash); retErr != nil {
+				return
+			}
+			for i, list := range []*[]int64{&e.OldDates, &e.NewDates, &e.OldIfNeedBe, &e.NewIfNeedBe} {
+				if retErr = json.Unmarshal([]byte(dates[i]), list); retErr != nil {
+					return
+				}
+			}
+			events = append(events, e)
+		}
+		return rows.Err()
+	})
+	return
+}
+
+// Returns dates, or an empty list if it's nil, so it's stored and sent as [] rather than null.
+func nonNilDates(dates []int64) []int64 {
+	if dates == nil {
+		return make([]int64, 0)
+	}
+	return dates
 }
@@ -1,11 +1,12 @@
 package main
 
 import (
-	"database/sql"
+	"errors"
 	"io/ioutil"
 	"os"
 	"reflect"
 	"testing"
+	"time"
 )
 
 // Creates a temporary database file
@@ -18,238 +19,568 @@ func MakeTestFile(t *testing.T) string {
 	return file.Name()
 }
 
-// Creates a database file, a connection, all the needed database tables, foreign keys etc.
-func CreateTestDb(t *testing.T) string {
-	var err error
+// Opens a store on a new database file, with all the needed database tables, foreign keys etc.
+// The store is closed and the file removed when the test finishes.
+func CreateTestStore(t *testing.T) *sqlStore {
 	testDbName := MakeTestFile(t)
+	t.Cleanup(func() { os.Remove(testDbName) })
 
-	if db, err = sql.Open("sqlite3", "file:"+testDbName+"?_foreign_keys=1"); err != nil {
+	store, err := openSqliteStore("file:"+testDbName+"?_foreign_keys=1&_txlock=immediate", newTestTokenCipher(t))
+	if err != nil {
 		t.Fatal("Failed to open database:", err)
 	}
+	t.Cleanup(func() { store.Close() })
 
-	file, err := os.Open("dbSource.sql")
-	if err != nil {
-		t.Fatal(err)
-	}
+	return store
+}
 
-	fileBytes, err := ioutil.ReadAll(file)
-	if err != nil {
-		t.Fatal(err)
-	}
+// Tests Store.ReadMeetUp too
+func TestMeetUp_Create(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store Store) {
+		var tests = []MeetUp{
+			{UserHash: "abc", AdminHash: "def", Dates: []int64{1550401200000, 1550487600000, 1550574000000, 1550660400000, 1550746800000, 1550833200000, 1550919600000, 1551006000000}, Description: "meetUp description", Email: "admin@example.com"},
+			{Id: -1, UserHash: "abc", AdminHash: "def", Dates: []int64{}, Description: "meetUp description"},
+		}
 
-	if _, err = db.Exec(string(fileBytes)); err != nil {
-		t.Fatal("Failed to create database tables:", err)
-	}
+		for _, meetUp := range tests {
+			if err := store.CreateMeetUp(&meetUp); err != nil {
+				t.Errorf("meetUp create failed: %s\n", err)
+			} else if meetUp.Id <= 0 {
+				t.Fatal("no id returned for inserted meetup row")
+			} else {
+				retMeetUp, err := store.ReadMeetUp(meetUp.Id)
+				if err != nil {
+					t.Fatalf("couldn't read row back from meetup table: %s\n", err)
+				}
+				meetUp.AdminHash = "" // Only its digest is stored
+
+				if retMeetUp.Id != meetUp.Id || compareMeetUpObjects(retMeetUp, meetUp) == false {
+					t.Errorf("returned row from DB was different to the one inserted. inserted: %+v, returned: %+v\n", meetUp, retMeetUp)
+				}
+
+				if err := store.DeleteMeetUp(retMeetUp.Id); err != nil {
+					t.Fatalf("delete failed: %s\n", err)
+				}
+			}
+		}
+	})
+}
+
+func TestMeetUp_Update(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store Store) {
+		var meetUp = MeetUp{UserHash: "abc", AdminHash: "def", Dates: []int64{1550401200000, 1550487600000, 1550574000000, 1550660400000, 1550746800000, 1550833200000, 1550919600000, 1551006000000}, Description: "meetUp description"}
 
-	// Prepare all the sql statements for later use
-	prepareDatabaseStatements()
+		if err := store.CreateMeetUp(&meetUp); err != nil {
+			t.Fatalf("create failed: %s\n", err)
+		}
+		created := meetUp.Created
+
+		meetUp.Dates = []int64{1550401200000, 1550487600000}
+		meetUp.Durations = []int64{3600000, 0}
+		meetUp.Description = "rst"
+		meetUp.Email = "admin@example.com"
+		meetUp.Expires = 1560000000000
+		meetUp.FinalDate = 1550487600000
+		if err := store.UpdateMeetUp(&meetUp); err != nil {
+			t.Fatalf("update failed: %s\n", err)
+		}
+
+		retMeetUp, err := store.ReadMeetUp(meetUp.Id)
+		if err != nil {
+			t.Fatalf("couldn't read row back from meetup table: %s\n", err)
+		}
+		meetUp.AdminHash = "" // Only its digest is stored
+
+		if retMeetUp.Id != meetUp.Id || compareMeetUpObjects(retMeetUp, meetUp) == false {
+			t.Errorf("returned row from DB was different to the one updated. updated: %+v, returned: %+v\n", meetUp, retMeetUp)
+		}
+		if created == 0 || retMeetUp.Created != created || retMeetUp.Modified < created {
+			t.Errorf("Created = %d, Modified = %d after the update, want Created: %d\n", retMeetUp.Created, retMeetUp.Modified, created)
+		}
 
-	return testDbName
+		if err := store.DeleteMeetUp(retMeetUp.Id); err != nil {
+			t.Fatalf("delete failed: %s\n", err)
+		}
+	})
 }
 
-// Destroys the test database, closes the prepared statements etc
-func DestroyTestDb(testDbName string) {
-	defer os.Remove(testDbName)
-	defer db.Close()
-	defer closeDatabaseStatements()
+func TestMeetUp_UpdateRevision(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store Store) {
+		var meetUp = MeetUp{UserHash: "abc", AdminHash: "def", Dates: []int64{1550401200000}, Description: "meetUp description"}
+		if err := store.CreateMeetUp(&meetUp); err != nil {
+			t.Fatalf("create failed: %s\n", err)
+		} else if meetUp.Revision != 1 {
+			t.Errorf("created meetup revision = %d, want: 1\n", meetUp.Revision)
+		}
+
+		stale := meetUp
+		if err := store.UpdateMeetUp(&meetUp); err != nil {
+			t.Fatalf("update failed: %s\n", err)
+		} else if meetUp.Revision != 2 {
+			t.Errorf("updated meetup revision = %d, want: 2\n", meetUp.Revision)
+		}
+
+		// An update of the meetup as it was before the last one is rejected, and changes nothing
+		stale.Description = "stale"
+		if err := store.UpdateMeetUp(&stale); err != errRevisionConflict || errors.Is(err, ErrConflict) == false {
+			t.Errorf("stale update error = %v, want: %v\n", err, errRevisionConflict)
+		}
+
+		retMeetUp, err := store.ReadMeetUp(meetUp.Id)
+		if err != nil {
+			t.Fatalf("couldn't read row back from meetup table: %s\n", err)
+		}
+		if retMeetUp.Revision != 2 || retMeetUp.Description != meetUp.Description {
+			t.Errorf("read back revision %d description %q, want: 2 %q\n", retMeetUp.Revision, retMeetUp.Description, meetUp.Description)
+		}
+
+		if err := store.DeleteMeetUp(meetUp.Id); err != nil {
+			t.Fatalf("delete failed: %s\n", err)
+		}
+		if err := store.UpdateMeetUp(&meetUp); err != errRevisionConflict {
+			t.Errorf("update of a deleted meetup error = %v, want: %v\n", err, errRevisionConflict)
+		}
+	})
 }
 
-// Tests the MeetUp.Read method too
-func TestMeetUp_Create(t *testing.T) {
-	testDbName := CreateTestDb(t)
-	defer DestroyTestDb(testDbName)
+func TestMeetUp_UpdateHashes(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store Store) {
+		var meetUp = MeetUp{UserHash: "abc", AdminHash: "def", Dates: []int64{1550401200000, 1550487600000}, Description: "meetUp description"}
+		if err := store.CreateMeetUp(&meetUp); err != nil {
+			t.Fatalf("create failed: %s\n", err)
+		}
+		user := User{IdMeetUp: meetUp.Id, Name: "alice", Dates: []int64{1550401200000}}
+		if err := store.CreateUser(&user); err != nil {
+			t.Fatalf("create user failed: %s\n", err)
+		}
 
-	var tests = []MeetUp{
-		{UserHash: "abc", AdminHash: "def", Dates: []int64{1550401200000, 1550487600000, 1550574000000, 1550660400000, 1550746800000, 1550833200000, 1550919600000, 1551006000000}, Description: "meetUp description"},
-		{Id: -1, UserHash: "abc", AdminHash: "def", Dates: []int64{}, Description: "meetUp description"},
-	}
+		stale := meetUp
+		meetUp.UserHash, meetUp.AdminHash = "ghi", "jkl"
+		meetUp.Description = "not written"
+		if err := store.UpdateMeetUpHashes(&meetUp); err != nil {
+			t.Fatalf("UpdateMeetUpHashes failed: %s\n", err)
+		} else if meetUp.Revision != 2 {
+			t.Errorf("meetup revision = %d, want: 2\n", meetUp.Revision)
+		}
+
+		// Only the new hashes find it, with the rest as it was
+		if _, err := store.GetMeetUpByUserHash("abc"); errors.Is(err, ErrNotFound) == false {
+			t.Errorf("GetMeetUpByUserHash() of the old userhash error = %v, want: %v\n", err, ErrNotFound)
+		}
+		if _, err := store.GetMeetUpByAdminHash("def"); errors.Is(err, ErrNotFound) == false {
+			t.Errorf("GetMeetUpByAdminHash() of the old adminhash error = %v, want: %v\n", err, ErrNotFound)
+		}
+		retMeetUp, err := store.GetMeetUpByAdminHash("jkl")
+		if err != nil {
+			t.Fatalf("GetMeetUpByAdminHash() of the new adminhash failed: %s\n", err)
+		}
+		if retMeetUp.Id != meetUp.Id || retMeetUp.UserHash != "ghi" || retMeetUp.Revision != 2 || retMeetUp.Description != "meetUp description" || reflect.DeepEqual(retMeetUp.Dates, stale.Dates) == false {
+			t.Errorf("read back %+v after the hashes were replaced\n", retMeetUp)
+		}
+		if len(retMeetUp.Users) != 1 || retMeetUp.Users[0].Name != "alice" {
+			t.Errorf("the meetup has the users %+v, want: alice\n", retMeetUp.Users)
+		}
+
+		stale.UserHash, stale.AdminHash = "mno", "pqr"
+		if err := store.UpdateMeetUpHashes(&stale); err != errRevisionConflict {
+			t.Errorf("stale UpdateMeetUpHashes error = %v, want: %v\n", err, errRevisionConflict)
+		}
+	})
+}
+
+func TestMeetUp_Delete(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store Store) {
+		var meetUp = MeetUp{UserHash: "abc", AdminHash: "def", Dates: []int64{1550401200000, 1550487600000, 1550574000000, 1550660400000, 1550746800000, 1550833200000, 1550919600000, 1551006000000}, Description: "meetUp description"}
+
+		if err := store.CreateMeetUp(&meetUp); err != nil {
+			t.Fatalf("create failed: %s\n", err)
+		}
+
+		if _, err := store.ReadMeetUp(meetUp.Id); err != nil {
+			t.Fatalf("couldn't read row back from meetup table: %s\n", err)
+		}
+
+		if err := store.DeleteMeetUp(meetUp.Id); err != nil {
+			t.Fatalf("delete failed: %s\n", err)
+		}
 
-	for _, meetUp := range tests {
-		if err := meetUp.Create(); err != nil {
+		if _, err := store.ReadMeetUp(meetUp.Id); errors.Is(err, ErrNotFound) == false {
+			t.Fatalf("couldn't read row back from meetup table: %s\n", err)
+		}
+	})
+}
+
+// Tests Store.ReadUser too
+func TestUser_Create(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store Store) {
+		var meetUp = MeetUp{UserHash: "abc", AdminHash: "def", Dates: []int64{1550401200000, 1550487600000, 1550574000000, 1550660400000, 1550746800000, 1550833200000, 1550919600000, 1551006000000}, Description: "meetUp description"}
+		if err := store.CreateMeetUp(&meetUp); err != nil {
 			t.Errorf("meetUp create failed: %s\n", err)
-		} else if meetUp.Id <= 0 {
-			t.Fatal("no id returned for inserted meetup row")
-		} else {
-			retMeetUp := MeetUp{}
-			if err = retMeetUp.Read(meetUp.Id); err != nil {
-				t.Fatalf("couldn't read row back from meetup table: %s\n", err)
-			}
+		}
 
-			if retMeetUp.Id != meetUp.Id || compareMeetUpObjects(retMeetUp, meetUp) == false {
-				t.Errorf("returned row from DB was different to the one inserted. inserted: %+v, returned: %+v\n", meetUp, retMeetUp)
-			}
+		var tests = []User{
+			{Name: "bob", Dates: []int64{1550401200000, 1550487600000, 1550574000000}},
+			{Name: "alice", Dates: []int64{1550401200000}, IfNeedBe: []int64{1550487600000, 1550574000000}},
+			{Id: -1, Name: "harry", Dates: []int64{}},
+		}
 
-			if err := retMeetUp.Delete(); err != nil {
-				t.Fatalf("delete failed: %s\n", err)
+		for _, user := range tests {
+			user.IdMeetUp = meetUp.Id
+
+			if err := store.CreateUser(&user); err != nil {
+				t.Errorf("user create failed: %s\n", err)
+			} else if user.Id <= 0 {
+				t.Fatal("no id returned for inserted user row")
+			} else {
+				retUser, err := store.ReadUser(user.Id)
+				if err != nil {
+					t.Fatalf("couldn't read row back from user table: %s\n", err)
+				}
+
+				if retUser.Id != user.Id || retUser.IdMeetUp != user.IdMeetUp || compareUserObjects(retUser, user) == false {
+					t.Errorf("returned row from DB was different to the one inserted. inserted: %+v, returned: %+v\n", user, retUser)
+				}
+
+				if err := store.DeleteUser(&retUser); err != nil {
+					t.Fatalf("delete failed: %s\n", err)
+				}
 			}
 		}
-	}
+
+		if err := store.DeleteMeetUp(meetUp.Id); err != nil {
+			t.Fatalf("delete failed: %s\n", err)
+		}
+	})
 }
 
-func TestMeetUp_Update(t *testing.T) {
-	testDbName := CreateTestDb(t)
-	defer DestroyTestDb(testDbName)
+func TestUser_Update(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store Store) {
+		var meetUp = MeetUp{UserHash: "abc", AdminHash: "def", Dates: []int64{1550401200000, 1550487600000, 1550574000000, 1550660400000, 1550746800000, 1550833200000, 1550919600000, 1551006000000}, Description: "meetUp description"}
+		if err := store.CreateMeetUp(&meetUp); err != nil {
+			t.Fatalf("create failed: %s\n", err)
+		}
 
-	var meetUp = MeetUp{UserHash: "abc", AdminHash: "def", Dates: []int64{1550401200000, 1550487600000, 1550574000000, 1550660400000, 1550746800000, 1550833200000, 1550919600000, 1551006000000}, Description: "meetUp description"}
+		var user = User{IdMeetUp: meetUp.Id, Name: "bob", Dates: []int64{1550401200000, 1550487600000, 1550574000000}}
+		if err := store.CreateUser(&user); err != nil {
+			t.Fatalf("create failed: %s\n", err)
+		}
 
-	if err := meetUp.Create(); err != nil {
-		t.Fatalf("create failed: %s\n", err)
-	}
+		var newName = "harry"
+		var newAvailable = []int64{1550487600000}
+		user.Name = newName
+		user.Dates = newAvailable
+		user.IfNeedBe = []int64{1550401200000}
 
-	meetUp.Dates = []int64{1550401200000}
-	meetUp.Description = "rst"
-	if err := meetUp.Update(); err != nil {
-		t.Fatalf("update failed: %s\n", err)
-	}
+		if err := store.UpdateUser(&user); err != nil {
+			t.Fatalf("update failed: %s\n", err)
+		}
 
-	retMeetUp := MeetUp{}
-	if err := retMeetUp.Read(meetUp.Id); err != nil {
-		t.Fatalf("couldn't read row back from meetup table: %s\n", err)
-	}
+		retUser, err := store.ReadUser(user.Id)
+		if err != nil {
+			t.Fatalf("couldn't read row back from user table: %s\n", err)
+		}
 
-	if retMeetUp.Id != meetUp.Id || compareMeetUpObjects(retMeetUp, meetUp) == false {
-		t.Errorf("returned row from DB was different to the one updated. updated: %+v, returned: %+v\n", meetUp, retMeetUp)
-	}
+		if retUser.Id != user.Id || retUser.Name != newName || retUser.IdMeetUp != user.IdMeetUp || compareUserObjects(retUser, user) == false {
+			t.Errorf("returned row from DB was different to the one updated. updated: %+v, returned: %+v\n", user, retUser)
+		}
 
-	if err := retMeetUp.Delete(); err != nil {
-		t.Fatalf("delete failed: %s\n", err)
-	}
+		if err := store.DeleteMeetUp(meetUp.Id); err != nil {
+			t.Fatalf("delete failed: %s\n", err)
+		}
+	})
 }
 
-func TestMeetUp_Delete(t *testing.T) {
-	testDbName := CreateTestDb(t)
-	defer DestroyTestDb(testDbName)
+func TestUser_Delete(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store Store) {
+		var meetUp = MeetUp{UserHash: "abc", AdminHash: "def", Dates: []int64{1550401200000, 1550487600000, 1550574000000, 1550660400000, 1550746800000, 1550833200000, 1550919600000, 1551006000000}, Description: "meetUp description"}
+		if err := store.CreateMeetUp(&meetUp); err != nil {
+			t.Fatalf("create failed: %s\n", err)
+		}
 
-	var meetUp = MeetUp{UserHash: "abc", AdminHash: "def", Dates: []int64{1550401200000, 1550487600000, 1550574000000, 1550660400000, 1550746800000, 1550833200000, 1550919600000, 1551006000000}, Description: "meetUp description"}
+		var user = User{IdMeetUp: meetUp.Id, Name: "bob", Dates: []int64{1550401200000, 1550487600000, 1550574000000}}
+		if err := store.CreateUser(&user); err != nil {
+			t.Fatalf("create failed: %s\n", err)
+		}
 
-	if err := meetUp.Create(); err != nil {
-		t.Fatalf("create failed: %s\n", err)
-	}
+		if _, err := store.ReadUser(user.Id); err != nil {
+			t.Fatalf("couldn't read row back from user table: %s\n", err)
+		}
 
-	retMeetUp := MeetUp{}
-	if err := retMeetUp.Read(meetUp.Id); err != nil {
-		t.Fatalf("couldn't read row back from meetup table: %s\n", err)
-	}
+		if err := store.DeleteUser(&user); err != nil {
+			t.Fatalf("delete failed: %s\n", err)
+		}
 
-	if err := meetUp.Delete(); err != nil {
-		t.Fatalf("delete failed: %s\n", err)
-	}
+		if _, err := store.ReadUser(user.Id); errors.Is(err, ErrNotFound) == false {
+			t.Fatalf("couldn't read row back from date table: %s\n", err)
+		}
 
-	retMeetUp = MeetUp{}
-	if err := retMeetUp.Read(meetUp.Id); err.Error() != "no rows" {
-		t.Fatalf("couldn't read row back from meetup table: %s\n", err)
-	}
+		if err := store.DeleteMeetUp(meetUp.Id); err != nil {
+			t.Fatalf("delete failed: %s\n", err)
+		}
+	})
 }
 
-// Tests the User.Read method too
-func TestUser_Create(t *testing.T) {
-	testDbName := CreateTestDb(t)
-	defer DestroyTestDb(testDbName)
+func TestMeetUp_Restore(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store Store) {
+		var meetUp = MeetUp{UserHash: "abc", AdminHash: "def", Dates: []int64{1550401200000, 1550487600000}, Description: "meetUp description"}
+		if err := store.CreateMeetUp(&meetUp); err != nil {
+			t.Fatalf("create failed: %s\n", err)
+		}
+		var user = User{IdMeetUp: meetUp.Id, Name: "bob", Dates: []int64{1550401200000}}
+		if err := store.CreateUser(&user); err != nil {
+			t.Fatalf("create failed: %s\n", err)
+		}
 
-	var meetUp = MeetUp{UserHash: "abc", AdminHash: "def", Dates: []int64{1550401200000, 1550487600000, 1550574000000, 1550660400000, 1550746800000, 1550833200000, 1550919600000, 1551006000000}, Description: "meetUp description"}
-	if err := meetUp.Create(); err != nil {
-		t.Errorf("meetUp create failed: %s\n", err)
-	}
+		if _, err := store.GetDeletedMeetUpByAdminHash(meetUp.AdminHash); errors.Is(err, ErrNotFound) == false {
+			t.Errorf("GetDeletedMeetUpByAdminHash() of a meetup that isn't deleted = %v, want: ErrNotFound\n", err)
+		}
+		if err := store.DeleteMeetUp(meetUp.Id); err != nil {
+			t.Fatalf("delete failed: %s\n", err)
+		}
+		if _, err := store.GetMeetUpByAdminHash(meetUp.AdminHash); errors.Is(err, ErrNotFound) == false {
+			t.Errorf("GetMeetUpByAdminHash() of a deleted meetup = %v, want: ErrNotFound\n", err)
+		}
 
-	var tests = []User{
-		{Name: "bob", Dates: []int64{1550401200000, 1550487600000, 1550574000000}},
-		{Id: -1, Name: "harry", Dates: []int64{}},
-	}
+		deleted, err := store.GetDeletedMeetUpByAdminHash(meetUp.AdminHash)
+		if err != nil {
+			t.Fatalf("GetDeletedMeetUpByAdminHash() failed: %s\n", err)
+		}
+		if deleted.Id != meetUp.Id || deleted.DeletedAt == 0 || len(deleted.Users) != 1 {
+			t.Errorf("GetDeletedMeetUpByAdminHash() = %+v\n", deleted)
+		}
 
-	for _, user := range tests {
-		user.IdMeetUp = meetUp.Id
-
-		if err := user.Create(); err != nil {
-			t.Errorf("user create failed: %s\n", err)
-		} else if user.Id <= 0 {
-			t.Fatal("no id returned for inserted user row")
-		} else {
-			retUser := User{}
-			if err = retUser.Read(user.Id); err != nil {
-				t.Fatalf("couldn't read row back from user table: %s\n", err)
-			}
+		if err = store.RestoreMeetUp(meetUp.Id); err != nil {
+			t.Fatalf("restore failed: %s\n", err)
+		}
+		restored, err := store.GetMeetUpByUserHash(meetUp.UserHash)
+		if err != nil {
+			t.Fatalf("couldn't read back the restored meetup: %s\n", err)
+		}
+		if restored.DeletedAt != 0 || len(restored.Users) != 1 || len(restored.Users[0].Dates) != 1 {
+			t.Errorf("restored meetup = %+v, want it with bob's answers\n", restored)
+		}
+	})
+}
 
-			if retUser.Id != user.Id || retUser.IdMeetUp != user.IdMeetUp || retUser.Name != user.Name || reflect.DeepEqual(retUser.Dates, user.Dates) == false {
-				t.Errorf("returned row from DB was different to the one inserted. inserted: %+v, returned: %+v\n", user, retUser)
-			}
+func TestUser_Restore(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store Store) {
+		var meetUp = MeetUp{UserHash: "abc", AdminHash: "def", Dates: []int64{1550401200000, 1550487600000}, Description: "meetUp description"}
+		if err := store.CreateMeetUp(&meetUp); err != nil {
+			t.Fatalf("create failed: %s\n", err)
+		}
+		var user = User{IdMeetUp: meetUp.Id, Name: "bob", Dates: []int64{1550401200000}, IfNeedBe: []int64{1550487600000}}
+		if err := store.CreateUser(&user); err != nil {
+			t.Fatalf("create failed: %s\n", err)
+		}
+		if err := store.DeleteUser(&user); err != nil || user.DeletedAt == 0 {
+			t.Fatalf("DeleteUser() = %v, DeletedAt %d\n", err, user.DeletedAt)
+		}
 
-			if err := retUser.Delete(); err != nil {
-				t.Fatalf("delete failed: %s\n", err)
-			}
+		deleted, err := store.GetDeletedUsersByMeetUpId(meetUp.Id)
+		if err != nil || len(deleted) != 1 {
+			t.Fatalf("GetDeletedUsersByMeetUpId() = %+v, %v\n", deleted, err)
+		}
+		if deleted[0].Id != user.Id || deleted[0].DeletedAt != user.DeletedAt || len(deleted[0].Dates) != 1 || len(deleted[0].IfNeedBe) != 1 {
+			t.Errorf("deleted user = %+v, want: %+v\n", deleted[0], user)
 		}
-	}
 
-	if err := meetUp.Delete(); err != nil {
-		t.Fatalf("delete failed: %s\n", err)
-	}
+		// The name is free again, until the new user is deleted too
+		var newUser = User{IdMeetUp: meetUp.Id, Name: "bob"}
+		if err = store.CreateUser(&newUser); err != nil {
+			t.Fatalf("create after delete failed: %s\n", err)
+		}
+		if err = store.RestoreUser(&user); err != errUserExists {
+			t.Errorf("RestoreUser() of a taken name = %v, want: %v\n", err, errUserExists)
+		}
+		if err = store.DeleteUser(&newUser); err != nil {
+			t.Fatalf("delete failed: %s\n", err)
+		}
+		if err = store.RestoreUser(&user); err != nil {
+			t.Fatalf("restore failed: %s\n", err)
+		}
+
+		users, err := store.GetUsersByMeetUpId(meetUp.Id)
+		if err != nil || len(users) != 1 || users[0].Id != user.Id {
+			t.Errorf("GetUsersByMeetUpId() after restore = %+v, %v\n", users, err)
+		}
+		if deleted, err = store.GetDeletedUsersByMeetUpId(meetUp.Id); err != nil || len(deleted) != 1 || deleted[0].Id != newUser.Id {
+			t.Errorf("GetDeletedUsersByMeetUpId() after restore = %+v, %v\n", deleted, err)
+		}
+	})
 }
 
-func TestUser_Update(t *testing.T) {
-	testDbName := CreateTestDb(t)
-	defer DestroyTestDb(testDbName)
+func TestStore_PurgeDeleted(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store Store) {
+		var kept = MeetUp{UserHash: "abc", AdminHash: "def", Dates: []int64{1550401200000}}
+		var deleted = MeetUp{UserHash: "ghi", AdminHash: "jkl", Dates: []int64{1550401200000}}
+		for _, m := range []*MeetUp{&kept, &deleted} {
+			if err := store.CreateMeetUp(m); err != nil {
+				t.Fatalf("create failed: %s\n", err)
+			}
+			for _, name := range []string{"alice", "bob"} {
+				if err := store.CreateUser(&User{IdMeetUp: m.Id, Name: name}); err != nil {
+					t.Fatalf("create failed: %s\n", err)
+				}
+			}
+		}
+		users, err := store.GetUsersByMeetUpId(kept.Id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = store.DeleteUser(&users[0]); err != nil {
+			t.Fatalf("delete failed: %s\n", err)
+		}
+		if err = store.DeleteMeetUp(deleted.Id); err != nil {
+			t.Fatalf("delete failed: %s\n", err)
+		}
 
-	var meetUp = MeetUp{UserHash: "abc", AdminHash: "def", Dates: []int64{1550401200000, 1550487600000, 1550574000000, 1550660400000, 1550746800000, 1550833200000, 1550919600000, 1551006000000}, Description: "meetUp description"}
-	if err := meetUp.Create(); err != nil {
-		t.Fatalf("create failed: %s\n", err)
-	}
+		// Nothing was deleted before the cutoff
+		if meetUps, users, err := store.PurgeDeleted(users[0].DeletedAt - 1); err != nil || meetUps != 0 || users != 0 {
+			t.Errorf("PurgeDeleted() before the deletes = %d, %d, %v, want: 0, 0, nil\n", meetUps, users, err)
+		}
 
-	var user = User{IdMeetUp: meetUp.Id, Name: "bob", Dates: []int64{1550401200000, 1550487600000, 1550574000000}}
-	if err := user.Create(); err != nil {
-		t.Fatalf("create failed: %s\n", err)
-	}
+		meetUps, userCount, err := store.PurgeDeleted(time.Now().UnixMilli())
+		if err != nil || meetUps != 1 || userCount != 3 {
+			t.Errorf("PurgeDeleted() = %d, %d, %v, want: 1, 3, nil\n", meetUps, userCount, err)
+		}
+		if _, err = store.GetDeletedMeetUpByAdminHash(deleted.AdminHash); errors.Is(err, ErrNotFound) == false {
+			t.Errorf("the purged meetup can still be restored: %v\n", err)
+		}
+		if restorable, err := store.GetDeletedUsersByMeetUpId(kept.Id); err != nil || len(restorable) != 0 {
+			t.Errorf("GetDeletedUsersByMeetUpId() after purge = %+v, %v\n", restorable, err)
+		}
+		if users, err = store.GetUsersByMeetUpId(kept.Id); err != nil || len(users) != 1 {
+			t.Errorf("the kept meetup has the users %+v, %v\n", users, err)
+		}
+	})
+}
 
-	var newName = "harry"
-	var newAvailable = []int64{1550487600000}
-	user.Name = newName
-	user.Dates = newAvailable
+func TestWebhook_CRUD(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store Store) {
+		var meetUp = MeetUp{UserHash: "abc", AdminHash: "def", Dates: []int64{1550401200000}, Description: "meetUp description"}
+		if err := store.CreateMeetUp(&meetUp); err != nil {
+			t.Fatalf("create failed: %s\n", err)
+		}
 
-	if err := user.Update(); err != nil {
-		t.Fatalf("update failed: %s\n", err)
-	}
+		var webhook = Webhook{IdMeetUp: meetUp.Id, Url: "https://example.com/hook", Secret: "secret", Created: 1550401200000}
+		if err := store.CreateWebhook(&webhook); err != nil {
+			t.Fatalf("create failed: %s\n", err)
+		}
 
-	retUser := User{}
-	if err := retUser.Read(user.Id); err != nil {
-		t.Fatalf("couldn't read row back from user table: %s\n", err)
-	}
+		webhooks, err := store.GetWebhooksByMeetUpId(meetUp.Id)
+		if err != nil {
+			t.Fatalf("couldn't read rows back from webhook table: %s\n", err)
+		} else if len(webhooks) != 1 || webhooks[0] != webhook {
+			t.Errorf("returned rows from DB were different to the one created. created: %+v, returned: %+v\n", webhook, webhooks)
+		}
 
-	if retUser.Id != user.Id || retUser.Name != newName || retUser.IdMeetUp != user.IdMeetUp || reflect.DeepEqual(retUser.Dates, user.Dates) == false {
-		t.Errorf("returned row from DB was different to the one updated. updated: %+v, returned: %+v\n", user, retUser)
-	}
+		if err = store.DeleteWebhook(meetUp.Id+1, webhook.Id); errors.Is(err, ErrNotFound) == false {
+			t.Errorf("DeleteWebhook() of another meetup's webhook = %v, want: ErrNotFound\n", err)
+		}
+		if err = store.DeleteWebhook(meetUp.Id, webhook.Id); err != nil {
+			t.Fatalf("delete failed: %s\n", err)
+		}
+		if webhooks, err = store.GetWebhooksByMeetUpId(meetUp.Id); err != nil || len(webhooks) != 0 {
+			t.Errorf("GetWebhooksByMeetUpId() after delete = %v, %v\n", webhooks, err)
+		}
 
-	if err := meetUp.Delete(); err != nil {
-		t.Fatalf("delete failed: %s\n", err)
-	}
+		// Purging the meetup deletes its webhooks
+		if err = store.CreateWebhook(&webhook); err != nil {
+			t.Fatalf("create failed: %s\n", err)
+		}
+		if err = store.DeleteMeetUp(meetUp.Id); err != nil {
+			t.Fatalf("delete failed: %s\n", err)
+		}
+		if _, _, err = store.PurgeDeleted(time.Now().UnixMilli()); err != nil {
+			t.Fatalf("purge failed: %s\n", err)
+		}
+		if err = store.DeleteWebhook(meetUp.Id, webhook.Id); errors.Is(err, ErrNotFound) == false {
+			t.Errorf("DeleteWebhook() after purging the meetup = %v, want: ErrNotFound\n", err)
+		}
+	})
 }
 
-func TestUser_Delete(t *testing.T) {
-	testDbName := CreateTestDb(t)
-	defer DestroyTestDb(testDbName)
+func TestMeetUpEvent_CRUD(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store Store) {
+		var meetUp = MeetUp{UserHash: "abc", AdminHash: "def", Dates: []int64{1550401200000}, Description: "meetUp description"}
+		if err := store.CreateMeetUp(&meetUp); err != nil {
+			t.Fatalf("create failed: %s\n", err)
+		}
 
-	var meetUp = MeetUp{UserHash: "abc", AdminHash: "def", Dates: []int64{1550401200000, 1550487600000, 1550574000000, 1550660400000, 1550746800000, 1550833200000, 1550919600000, 1551006000000}, Description: "meetUp description"}
-	if err := meetUp.Create(); err != nil {
-		t.Fatalf("create failed: %s\n", err)
-	}
+		var events = []MeetUpEvent{
+			{IdMeetUp: meetUp.Id, Action: auditMeetUpCreated, NewDates: []int64{1550401200000}, IpHash: "a"},
+			{IdMeetUp: meetUp.Id, Action: auditUserChanged, Name: "alice", OldDates: []int64{1550401200000}, NewIfNeedBe: []int64{1550401200000}, IpHash: "b"},
+		}
+		for i := range events {
+			if err := store.CreateMeetUpEvent(&events[i]); err != nil {
+				t.Fatalf("create failed: %s\n", err)
+			} else if events[i].Id == 0 || events[i].Created == 0 {
+				t.Errorf("CreateMeetUpEvent() didn't set the id and created: %+v\n", events[i])
+			}
+		}
 
-	var user = User{IdMeetUp: meetUp.Id, Name: "bob", Dates: []int64{1550401200000, 1550487600000, 1550574000000}}
-	if err := user.Create(); err != nil {
-		t.Fatalf("create failed: %s\n", err)
-	}
+		// The latest first, with the missing dates as empty lists
+		got, err := store.GetMeetUpEvents(meetUp.Id)
+		if err != nil || len(got) != 2 {
+			t.Fatalf("GetMeetUpEvents() = %v, %v\n", got, err)
+		}
+		for i, want := range []MeetUpEvent{events[1], events[0]} {
+			for _, dates := range []*[]int64{&want.OldDates, &want.NewDates, &want.OldIfNeedBe, &want.NewIfNeedBe} {
+				if *dates == nil {
+					*dates = []int64{}
+				}
+			}
+			if reflect.DeepEqual(got[i], want) == false {
+				t.Errorf("GetMeetUpEvents()[%d] = %+v, want: %+v\n", i, got[i], want)
+			}
+		}
 
-	retUser := User{}
-	if err := retUser.Read(user.Id); err != nil {
-		t.Fatalf("couldn't read row back from user table: %s\n", err)
-	}
+		// Purging the meetup deletes its log
+		if err = store.DeleteMeetUp(meetUp.Id); err != nil {
+			t.Fatalf("delete failed: %s\n", err)
+		}
+		if _, _, err = store.PurgeDeleted(time.Now().UnixMilli()); err != nil {
+			t.Fatalf("purge failed: %s\n", err)
+		}
+		if got, err = store.GetMeetUpEvents(meetUp.Id); err != nil || len(got) != 0 {
+			t.Errorf("GetMeetUpEvents() after purging the meetup = %v, %v\n", got, err)
+		}
+	})
+}
 
-	if err := user.Delete(); err != nil {
-		t.Fatalf("delete failed: %s\n", err)
-	}
+func TestWebhookDelivery_Queue(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store Store) {
+		var deliveries = []WebhookDelivery{
+			{Url: "https://example.com/a", Secret: "a", Payload: []byte(`{"event":"a"}`), NextAttempt: 300},
+			{Url: "https://example.com/b", Secret: "b", Payload: []byte(`{"event":"b"}`), NextAttempt: 100},
+			{Url: "https://example.com/c", Secret: "c", Payload: []byte(`{"event":"c"}`), NextAttempt: 200},
+		}
+		for i := range deliveries {
+			if err := store.QueueDelivery(&deliveries[i]); err != nil {
+				t.Fatalf("queue failed: %s\n", err)
+			}
+		}
 
-	retUser = User{}
-	if err := retUser.Read(user.Id); err.Error() != "no rows" {
-		t.Fatalf("couldn't read row back from date table: %s\n", err)
-	}
+		// Only those due, the oldest first
+		due, err := store.GetDueDeliveries(200, 10)
+		if err != nil {
+			t.Fatalf("couldn't read rows back from webhook_delivery table: %s\n", err)
+		} else if len(due) != 2 || reflect.DeepEqual(due[0], deliveries[1]) == false || reflect.DeepEqual(due[1], deliveries[2]) == false {
+			t.Errorf("GetDueDeliveries() = %+v, want: %+v\n", due, deliveries[1:])
+		}
+		if due, err = store.GetDueDeliveries(300, 1); err != nil || len(due) != 1 || due[0].Id != deliveries[1].Id {
+			t.Errorf("GetDueDeliveries() with a limit of 1 = %+v, %v\n", due, err)
+		}
 
-	if err := meetUp.Delete(); err != nil {
-		t.Fatalf("delete failed: %s\n", err)
-	}
+		deliveries[1].Attempts, deliveries[1].NextAttempt, deliveries[1].LastError = 1, 400, "failed"
+		if err = store.UpdateDelivery(&deliveries[1]); err != nil {
+			t.Fatalf("update failed: %s\n", err)
+		}
+		if err = store.DeleteDelivery(deliveries[2].Id); err != nil {
+			t.Fatalf("delete failed: %s\n", err)
+		}
+		if due, err = store.GetDueDeliveries(400, 10); err != nil || len(due) != 2 || reflect.DeepEqual(due[1], deliveries[1]) == false {
+			t.Errorf("GetDueDeliveries() after the update and delete = %+v, %v\n", due, err)
+		}
+	})
 }
@@ -5,201 +5,772 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
-	_ "github.com/mattn/go-sqlite3"
+	"github.com/mattn/go-sqlite3"
 	"log"
+	"mycode/catherder/migrations"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
 )
 
 // extra database functions that don't live in crud,
-// database struct definitions, custom sql etc.
+// database struct definitions, the sqlite store, custom sql etc.
 
 type User struct {
-	Id       int64
-	IdMeetUp int64
-	Name     string  `json:"name"`
-	Dates    []int64 `json:"dates"` // dates the user is available for. This is a UNIX timestamp in milliseconds, as per ecma script defines it. "The number of milliseconds between 1 January 1970 00:00:00 UTC and the given date."
+	Id        int64
+	IdMeetUp  int64
+	Name      string  `json:"name"`
+	Token     string  // secret edit token, only given to the user that created the row. Never sent in the Users json.
+	Dates     []int64 `json:"dates"`    // dates the user is available for. This is a UNIX timestamp in milliseconds, as per ecma script defines it. "The number of milliseconds between 1 January 1970 00:00:00 UTC and the given date."
+	IfNeedBe  []int64 `json:"ifneedbe"` // dates the user could make if they have to. Any meetup date in neither Dates nor IfNeedBe is a no.
+	DeletedAt int64   // When the user was deleted, UNIX timestamp in milliseconds. 0 if they aren't.
 }
 type Users []User
 type MeetUp struct {
-	Id          int64
-	UserHash    string  `json:"userhash"`
-	AdminHash   string  `json:"adminhash"`
-	Dates       []int64 `json:"dates"` // This is a UNIX timestamp in milliseconds, as per ecma script defines it. "The number of milliseconds between 1 January 1970 00:00:00 UTC and the given date."
-	Description string  `json:"description"`
-	Users       Users   `json:"users"`
+	Id             int64
+	UserHash       string  `json:"userhash"`  // Stored as its digest and encrypted, see tokenCipher
+	AdminHash      string  `json:"adminhash"` // Only stored as its digest. Empty unless the meetup was read by it, or it was just created or replaced.
+	Dates          []int64 `json:"dates"`     // This is a UNIX timestamp in milliseconds, as per ecma script defines it. "The number of milliseconds between 1 January 1970 00:00:00 UTC and the given date."
+	Durations      []int64 `json:"durations"` // The length of the time slot starting at the same index in Dates, in milliseconds. 0 or missing is an all-day slot.
+	Description    string  `json:"description"`
+	Email          string  `json:"email"`    // The organiser's address for the digest of user changes, empty for none. Only sent to the admin.
+	EmailConfirmed int64   `json:"-"`        // When the organiser confirmed Email, UNIX timestamp in milliseconds. 0 until they do, the digest waits for it.
+	FinalDate      int64   `json:"-"`        // The date chosen by the admin, one of Dates. 0 while the meetup is still open. Only set by /api/finalisemeetup.
+	Created        int64   `json:"-"`        // When the meetup was created, UNIX timestamp in milliseconds. 0 if unknown.
+	DeletedAt      int64   `json:"-"`        // When the meetup was deleted, UNIX timestamp in milliseconds. 0 if it isn't.
+	Modified       int64   `json:"-"`        // When the meetup or any of its users last changed, UNIX timestamp in milliseconds. 0 if unknown.
+	Expires        int64   `json:"expires"`  // When the janitor deletes the meetup, UNIX timestamp in milliseconds. 0 for the default, a number of days after the last date.
+	ExpiryDate     int64   `json:"-"`        // When the meetup expires, Expires or the default. Not stored, only set for /api/getadminmeetup.
+	Revision       int64   `json:"revision"` // Counts the updates of the meetup row, starting at 1. An update must have the current one.
+	Users          Users   `json:"users"`
 }
 
-// Prepared statements that functions can use.
-// They get closed at the termination of the program in closeDatabaseStatements()
-var preparedStmts = make(map[string]*sql.Stmt)
-
-// prepares all the required statements for later use.
-// log.Fatal on error
-func prepareDatabaseStatements() {
-	// A map of sql statements that get prepared in prepareDatabaseStatements()
-	var prepStmtInit = map[string]string{
-		"insertMeetup":            `INSERT INTO meetup(userhash, adminhash, dates, description) values(?,?,?,?)`,
-		"selectMeetup":            `SELECT idmeetup, userhash, adminhash, dates, description FROM meetup WHERE idmeetup = ?`,
-		"updateMeetup":            `UPDATE meetup SET dates = ?, description = ? WHERE idmeetup = ?`,
-		"deleteMeetup":            `DELETE from meetup WHERE idmeetup = ?`,
-		"selectMeetupByUserhash":  `SELECT idmeetup, userhash, adminhash, dates, description FROM meetup WHERE userhash = ?`,
-		"selectMeetupByAdminhash": `SELECT idmeetup, userhash, adminhash, dates, description FROM meetup WHERE adminhash = ?`,
-		"deleteMeetupByAdminhash": `DELETE from meetup WHERE adminhash = ?`,
-
-		"insertUser":            `INSERT INTO "user"(idmeetup, name, dates) values(?,?,?)`,
-		"selectUser":            `SELECT iduser,idmeetup,name,dates FROM "user" WHERE iduser = ?`,
-		"updateUser":            `UPDATE "user" SET name = ?, dates = ? WHERE iduser = ?`,
-		"deleteUser":            `DELETE from "user" WHERE iduser = ?`,
-		"selectUsersByMeetUpid": `SELECT * FROM "user" WHERE idmeetup = ?`,
-	}
+// Webhook A url that gets a signed POST when its meetup changes.
+type Webhook struct {
+	Id       int64  `json:"id"`
+	IdMeetUp int64  `json:"-"`
+	Url      string `json:"url"`
+	Secret   string `json:"-"`       // Key of the HMAC-SHA256 signature of the payloads. Only given to the admin when created.
+	Created  int64  `json:"created"` // UNIX timestamp in milliseconds
+}
 
-	for key, val := range prepStmtInit {
-		stmt, err := db.Prepare(val)
+// WebhookDelivery A payload waiting to be POSTed to a webhook url. Keeps its own url and secret, so it outlives the
+// webhook and its meetup.
+type WebhookDelivery struct {
+	Id          int64
+	Url         string
+	Secret      string
+	Payload     []byte // The json body
+	Attempts    int    // The failed attempts so far
+	NextAttempt int64  // When it is due, UNIX timestamp in milliseconds
+	LastError   string // Why the last attempt failed
+}
 
-		if err != nil {
-			log.Fatalf("prepareDatabaseStatements failed on key %q, val %q, error (%s)", key, val, err)
-		}
-		preparedStmts[key] = stmt
-	}
+// MeetUpEvent An entry of a meetup's audit log. The dates are the participant's answers, or the meetup's options for
+// the meetup actions.
+type MeetUpEvent struct {
+	Id          int64   `json:"id"`
+	IdMeetUp    int64   `json:"-"`
+	Action      string  `json:"action"` // One of the audit actions
+	Name        string  `json:"name"`   // The participant, empty for the meetup actions
+	OldDates    []int64 `json:"olddates"`
+	NewDates    []int64 `json:"newdates"`
+	OldIfNeedBe []int64 `json:"oldifneedbe"`
+	NewIfNeedBe []int64 `json:"newifneedbe"`
+	Created     int64   `json:"created"` // UNIX timestamp in milliseconds
+	IpHash      string  `json:"iphash"`  // The keyed hash of the client's IP address, empty for the janitor
 }
 
-// Closes all prepared statements, logs any errors.
-// Called by defer in main() on program termination.
-func closeDatabaseStatements() {
-	for key := range preparedStmts {
-		if err := preparedStmts[key].Close(); err != nil {
-			log.Println(err)
-		}
-	}
+// Slot A meetup option with a start and end time, both UNIX timestamps in milliseconds.
+type Slot struct {
+	Start  int64 `json:"start"`
+	End    int64 `json:"end"`
+	AllDay bool  `json:"allday"`
 }
 
+const dayMilliseconds = 86400000 // The length of an all-day slot
+
+// Availability A user's answer for one meetup option.
+type Availability string
+
+const (
+	AvailableYes      Availability = "yes"
+	AvailableIfNeedBe Availability = "ifneedbe"
+	AvailableNo       Availability = "no"
+)
+
 // MarshalJSON Set json output format and fields
 func (m *MeetUp) MarshalJSON() ([]byte, error) {
 	return json.Marshal(&struct {
 		UserHash    string  `json:"userhash"`
 		AdminHash   string  `json:"adminhash"`
 		Dates       []int64 `json:"dates"`
+		Durations   []int64 `json:"durations"`
+		Slots       []Slot  `json:"slots"`
 		Description string  `json:"description"`
+		Email       string  `json:"email"`
+		FinalDate   int64   `json:"finaldate"`
+		Expires     int64   `json:"expires"`
+		ExpiryDate  int64   `json:"expirydate"`
+		Revision    int64   `json:"revision"`
 		Users       Users   `json:"users"`
 	}{
 		m.UserHash,
 		m.AdminHash,
 		m.Dates,
+		m.Durations,
+		m.Slots(),
 		m.Description,
+		m.Email,
+		m.FinalDate,
+		m.Expires,
+		m.ExpiryDate,
+		m.Revision,
 		m.Users,
 	})
 }
 
+// Slots Returns the meetup options as slots, in the same order as Dates.
+func (m *MeetUp) Slots() []Slot {
+	slots := make([]Slot, len(m.Dates))
+	for i, start := range m.Dates {
+		var duration int64
+		if i < len(m.Durations) {
+			duration = m.Durations[i]
+		}
+
+		if duration == 0 {
+			slots[i] = Slot{Start: start, End: start + dayMilliseconds, AllDay: true}
+		} else {
+			slots[i] = Slot{Start: start, End: start + duration}
+		}
+	}
+	return slots
+}
+
+// ModifiedTime Returns when the meetup or its users last changed. The zero time if unknown.
+func (m *MeetUp) ModifiedTime() time.Time {
+	if m.Modified == 0 {
+		return time.Time{}
+	}
+	return time.UnixMilli(m.Modified)
+}
+
+// Expiry Returns when the meetup expires, in UNIX milliseconds: Expires if it's set, otherwise defaultAfter
+// milliseconds after its last date. A meetup without dates expires defaultAfter after its last change.
+func (m *MeetUp) Expiry(defaultAfter int64) int64 {
+	if m.Expires != 0 {
+		return m.Expires
+	}
+	if len(m.Dates) == 0 {
+		return m.Modified + defaultAfter
+	}
+	return slices.Max(m.Dates) + defaultAfter
+}
+
+// IsClosed Returns true once the admin has chosen the final date. Users can't be changed in a closed meetup.
+func (m *MeetUp) IsClosed() bool {
+	return m.FinalDate != 0
+}
+
+// HasDate Returns true if date is the start of one of the meetup options.
+func (m *MeetUp) HasDate(date int64) bool {
+	for _, d := range m.Dates {
+		if d == date {
+			return true
+		}
+	}
+	return false
+}
+
+// SetSlots Sets the meetup Dates and Durations from slots.
+func (m *MeetUp) SetSlots(slots []Slot) {
+	m.Dates = make([]int64, len(slots))
+	m.Durations = make([]int64, len(slots))
+	for i, slot := range slots {
+		m.Dates[i] = slot.Start
+		if slot.AllDay == false {
+			m.Durations[i] = slot.End - slot.Start
+		}
+	}
+}
+
 // MarshalJSON Set json output format and fields
 func (u *User) MarshalJSON() ([]byte, error) {
 	return json.Marshal(&struct {
-		Name  string  `json:"name"`
-		Dates []int64 `json:"dates"`
+		Name     string  `json:"name"`
+		Dates    []int64 `json:"dates"`
+		IfNeedBe []int64 `json:"ifneedbe"`
 	}{
 		u.Name,
 		u.Dates,
+		u.IfNeedBe,
 	})
 }
 
-// DeleteByAdminHash Deletes a meetup by its admin hash. Deletes get cascaded to the other tables.
-func (m *MeetUp) DeleteByAdminHash(adminHash string) error {
-	if _, err := preparedStmts["deleteMeetupByAdminhash"].Exec(adminHash); err != nil {
-		return err
+// Availability Returns the user's answer for the meetup option starting at date.
+func (u *User) Availability(date int64) Availability {
+	for _, d := range u.Dates {
+		if d == date {
+			return AvailableYes
+		}
+	}
+	for _, d := range u.IfNeedBe {
+		if d == date {
+			return AvailableIfNeedBe
+		}
+	}
+	return AvailableNo
+}
+
+// sqlStore The Store backed by a sql database, sqlite or PostgreSQL. The statements are written with ? placeholders
+// and in sql both understand, the dialect converts them for the database.
+type sqlStore struct {
+	db      *sql.DB
+	dialect sqlDialect
+	tokens  *tokenCipher         // Turns the meetup hashes into the digests and sealed userhash that are stored
+	stmts   map[string]*sql.Stmt // Prepared statements, closed by Close()
+	tx      *sql.Tx              // Set for the Store given to a WithTx function, all its calls run in the transaction
+}
+
+// sqlDialect What a sqlStore needs to know about its database.
+type sqlDialect struct {
+	migrations        *migrations.Dialect
+	rebind            func(query string) string // Converts the ? placeholders for the database
+	isUniqueViolation func(err error) bool      // Reports whether err is from a UNIQUE constraint
+}
+
+// The sqlite dialect. Its databases are opened with the options of sqliteDsn.
+var sqliteDialect = sqlDialect{
+	migrations: migrations.SQLite,
+	rebind:     func(query string) string { return query },
+	isUniqueViolation: func(err error) bool {
+		var sqliteErr sqlite3.Error
+		return errors.As(err, &sqliteErr) && sqliteErr.ExtendedCode == sqlite3.ErrConstraintUnique
+	},
+}
+
+// openSqliteStore Opens the sqlite database at dsn, brings its schema up to date and prepares the statements. The
+// meetup hashes are stored with tokens.
+func openSqliteStore(dsn string, tokens *tokenCipher) (*sqlStore, error) {
+	db, err := sql.Open("sqlite3", sqliteDsn(dsn))
+	if err != nil {
+		return nil, err
+	}
+
+	return newSqlStore(db, sqliteDialect, tokens)
+}
+
+// sqliteDsn Sets the options the store relies on in dsn, whatever it had for them. Without _foreign_keys deleting a
+// meetup leaves its users and options behind, and without _txlock=immediate concurrent transactions fail with
+// "database is locked" when they write instead of waiting for each other.
+func sqliteDsn(dsn string) string {
+	name, rawQuery, _ := strings.Cut(dsn, "?")
+	query, err := url.ParseQuery(rawQuery)
+	if err != nil {
+		return dsn // sqlite3 reports it when connecting
+	}
+	query.Del("_fk")
+	query.Set("_foreign_keys", "1")
+	query.Set("_txlock", "immediate")
+	return name + "?" + query.Encode()
+}
+
+// newSqlStore Brings the schema of db up to date with the dialect's migrations, and prepares the statements.
+// Closes db on error.
+func newSqlStore(db *sql.DB, dialect sqlDialect, tokens *tokenCipher) (*sqlStore, error) {
+	// Create the schema, or bring a database created by an older version up to date
+	from, to, err := dialect.migrations.Migrate(db, tokens.migrationEnv())
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	if from != to {
+		log.Printf("Migrated the database from version %d to %d", from, to)
+	}
+
+	s := &sqlStore{db: db, dialect: dialect, tokens: tokens, stmts: make(map[string]*sql.Stmt)}
+	if err = s.prepareStatements(); err != nil {
+		s.Close()
+		return nil, err
 	}
+	return s, nil
+}
+
+// prepares all the required statements for later use.
+func (s *sqlStore) prepareStatements() error {
+	// A map of sql statements that get prepared
+	var prepStmtInit = map[string]string{
+		"insertMeetup":            `INSERT INTO meetup(userdigest, admindigest, usersealed, description, email, created, lastmodified, expires) values(?,?,?,?,?,?,?,?) RETURNING idmeetup`,
+		"selectMeetup":            `SELECT idmeetup, usersealed, description, email, emailconfirmed, finaldate, created, lastmodified, expires, revision, deleted_at FROM meetup WHERE idmeetup = ? AND deleted_at = 0`,
+		"updateMeetup":            `UPDATE meetup SET description = ?, email = ?, emailconfirmed = ?, finaldate = ?, lastmodified = ?, expires = ?, revision = revision + 1 WHERE idmeetup = ? AND revision = ? AND deleted_at = 0`,
+		"updateMeetupHashes":      `UPDATE meetup SET userdigest = ?, admindigest = ?, usersealed = ?, lastmodified = ?, revision = revision + 1 WHERE idmeetup = ? AND revision = ? AND deleted_at = 0`,
+		"confirmMeetupEmail":      `UPDATE meetup SET emailconfirmed = ? WHERE idmeetup = ? AND email = ? AND emailconfirmed = 0 AND deleted_at = 0`,
+		"touchMeetup":             `UPDATE meetup SET lastmodified = ? WHERE idmeetup = ?`,
+		"deleteMeetup":            `UPDATE meetup SET deleted_at = ? WHERE idmeetup = ? AND deleted_at = 0`,
+		"restoreMeetup":           `UPDATE meetup SET deleted_at = 0, lastmodified = ? WHERE idmeetup = ?`,
+		"purgeDeletedMeetups":     `DELETE from meetup WHERE deleted_at <> 0 AND deleted_at <= ?`,
+		"selectMeetupByUserhash":  `SELECT idmeetup, usersealed, description, email, emailconfirmed, finaldate, created, lastmodified, expires, revision, deleted_at FROM meetup WHERE userdigest = ? AND deleted_at = 0`,
+		"selectMeetupByAdminhash": `SELECT idmeetup, usersealed, description, email, emailconfirmed, finaldate, created, lastmodified, expires, revision, deleted_at FROM meetup WHERE admindigest = ? AND deleted_at = 0`,
+		"selectDeletedMeetup":     `SELECT idmeetup, usersealed, description, email, emailconfirmed, finaldate, created, lastmodified, expires, revision, deleted_at FROM meetup WHERE admindigest = ? AND deleted_at <> 0`,
+		"deleteMeetupByAdminhash": `UPDATE meetup SET deleted_at = ? WHERE admindigest = ? AND deleted_at = 0`,
+		"selectExpiredMeetups":    `SELECT idmeetup FROM meetup m WHERE CASE WHEN expires <> 0 THEN expires ELSE COALESCE((SELECT MAX(date) FROM meetup_option o WHERE o.idmeetup = m.idmeetup), lastmodified) + ? END <= ? AND deleted_at = 0 ORDER BY idmeetup`,
+
+		"insertOption":            `INSERT INTO meetup_option(idmeetup, date, duration) values(?,?,?) ON CONFLICT DO NOTHING`,
+		"selectOptionsByMeetUpid": `SELECT idoption, date, duration FROM meetup_option WHERE idmeetup = ? ORDER BY date`,
+		"updateOption":            `UPDATE meetup_option SET duration = ? WHERE idoption = ?`,
+		"deleteOption":            `DELETE from meetup_option WHERE idoption = ?`,
+
+		"insertUser":            `INSERT INTO "user"(idmeetup, name, token) values(?,?,?) RETURNING iduser`,
+		"selectUser":            `SELECT iduser,idmeetup,name,token FROM "user" WHERE iduser = ? AND deleted_at = 0`,
+		"updateUser":            `UPDATE "user" SET name = ?, token = ? WHERE iduser = ?`,
+		"deleteUser":            `UPDATE "user" SET deleted_at = ? WHERE iduser = ? AND deleted_at = 0`,
+		"restoreUser":           `UPDATE "user" SET deleted_at = 0 WHERE iduser = ?`,
+		"selectUsersByMeetUpid": `SELECT iduser,idmeetup,name,token FROM "user" WHERE idmeetup = ? AND deleted_at = 0 ORDER BY iduser`,
+		"selectDeletedUsers":    `SELECT iduser,idmeetup,name,token,deleted_at FROM "user" WHERE idmeetup = ? AND deleted_at <> 0 ORDER BY deleted_at DESC, iduser DESC`,
+		"purgeDeletedUsers":     `DELETE from "user" WHERE (deleted_at <> 0 AND deleted_at <= ?) OR idmeetup IN (SELECT idmeetup FROM meetup WHERE deleted_at <> 0 AND deleted_at <= ?)`,
+
+		"insertWebhook":            `INSERT INTO webhook(idmeetup, url, secret, created) values(?,?,?,?) RETURNING idwebhook`,
+		"selectWebhooksByMeetUpid": `SELECT idwebhook, idmeetup, url, secret, created FROM webhook WHERE idmeetup = ? ORDER BY idwebhook`,
+		"deleteWebhook":            `DELETE from webhook WHERE idwebhook = ? AND idmeetup = ?`,
 
+		"insertMeetupEvent":  `INSERT INTO meetup_event(idmeetup, action, name, olddates, newdates, oldifneedbe, newifneedbe, created, iphash) values(?,?,?,?,?,?,?,?,?) RETURNING idevent`,
+		"selectMeetupEvents": `SELECT idevent, idmeetup, action, name, olddates, newdates, oldifneedbe, newifneedbe, created, iphash FROM meetup_event WHERE idmeetup = ? ORDER BY idevent DESC`,
+
+		"insertDelivery":      `INSERT INTO webhook_delivery(url, secret, payload, attempts, nextattempt, lasterror) values(?,?,?,?,?,?) RETURNING iddelivery`,
+		"selectDueDeliveries": `SELECT iddelivery, url, secret, payload, attempts, nextattempt, lasterror FROM webhook_delivery WHERE nextattempt <= ? ORDER BY nextattempt, iddelivery LIMIT ?`,
+		"updateDelivery":      `UPDATE webhook_delivery SET attempts = ?, nextattempt = ?, lasterror = ? WHERE iddelivery = ?`,
+		"deleteDelivery":      `DELETE from webhook_delivery WHERE iddelivery = ?`,
+
+		"insertAvailability":           `INSERT INTO user_availability(iduser, idoption, availability) SELECT CAST(? AS BIGINT), idoption, CAST(? AS TEXT) FROM meetup_option WHERE idmeetup = ? AND date = ? ON CONFLICT DO NOTHING`,
+		"deleteAvailabilityByUserid":   `DELETE from user_availability WHERE iduser = ?`,
+		"selectAvailabilityByUserid":   `SELECT a.iduser, o.date, a.availability FROM user_availability a JOIN meetup_option o ON o.idoption = a.idoption WHERE a.iduser = ? ORDER BY o.date`,
+		"selectAvailabilityByMeetUpid": `SELECT a.iduser, o.date, a.availability FROM user_availability a JOIN meetup_option o ON o.idoption = a.idoption WHERE o.idmeetup = ? ORDER BY o.date`,
+	}
+
+	for key, val := range prepStmtInit {
+		stmt, err := s.db.Prepare(s.dialect.rebind(val))
+		if err != nil {
+			return fmt.Errorf("prepareStatements failed on key %q, val %q, error (%s)", key, val, err)
+		}
+		s.stmts[key] = stmt
+	}
 	return nil
 }
 
-// GetByUserHash Selects a MeetUp row by the user hash
-// Also gets all sub objects of the MeetUp row from the date, admin and user tables.
-func (m *MeetUp) GetByUserHash(userHash string) (retErr error) {
-	rows, retErr := preparedStmts["selectMeetupByUserhash"].Query(userHash)
+// Close Closes all prepared statements and the database, logs any errors. Does nothing for the Store of a transaction.
+func (s *sqlStore) Close() error {
+	if s.tx != nil {
+		return nil
+	}
+
+	for key := range s.stmts {
+		if err := s.stmts[key].Close(); err != nil {
+			log.Println(err)
+		}
+	}
+	return s.db.Close()
+}
+
+// sqlTx A transaction of a sqlStore, with access to the store's prepared statements and tokenCipher.
+type sqlTx struct {
+	*sql.Tx
+	stmts  map[string]*sql.Stmt
+	tokens *tokenCipher
+}
+
+// stmt Returns the prepared statement key, bound to the transaction.
+func (tx sqlTx) stmt(key string) *sql.Stmt {
+	return tx.Stmt(tx.stmts[key])
+}
+
+// WithTx Runs fn with a Store whose calls all run in one transaction.
+func (s *sqlStore) WithTx(fn func(tx Store) error) error {
+	return s.withTx(func(tx sqlTx) error {
+		return fn(&sqlStore{db: s.db, dialect: s.dialect, tokens: s.tokens, stmts: s.stmts, tx: tx.Tx})
+	})
+}
+
+// withTx Runs fn in a transaction. The transaction is committed if fn returns nil, rolled back otherwise.
+// In the Store of a transaction fn runs in that transaction, which its WithTx commits or rolls back.
+func (s *sqlStore) withTx(fn func(tx sqlTx) error) (retErr error) {
+	if s.tx != nil {
+		return fn(sqlTx{s.tx, s.stmts, s.tokens})
+	}
+
+	tx, retErr := s.db.Begin()
 	if retErr != nil {
 		return
 	}
 	defer func() {
-		if closeErr := rows.Close(); closeErr != nil {
-			retErr = fmt.Errorf("%s unable to close rows %s", retErr, closeErr)
+		if retErr != nil {
+			if rollbackErr := tx.Rollback(); rollbackErr != nil {
+				retErr = fmt.Errorf("%s unable to rollback %s", retErr, rollbackErr)
+			}
 		}
 	}()
 
-	if rows.Next() {
-		var datesBlob []byte
-		retErr = rows.Scan(&m.Id, &m.UserHash, &m.AdminHash, &datesBlob, &m.Description)
-		if retErr != nil {
-			return
-		}
-		m.Dates = convertBlobToDates(datesBlob)
-	} else {
-		retErr = errors.New("no rows matching the userhash")
+	if retErr = fn(sqlTx{tx, s.stmts, s.tokens}); retErr != nil {
 		return
 	}
+	return tx.Commit()
+}
 
-	// Read all users with meetup id
-	retErr = m.Users.GetAllByMeetUpId(m.Id)
+// closeRows Closes rows, adding any error to retErr. Called by defer after a query.
+func closeRows(rows *sql.Rows, retErr *error) {
+	if closeErr := rows.Close(); closeErr != nil {
+		*retErr = fmt.Errorf("%s unable to close rows %s", *retErr, closeErr)
+	}
+}
+
+// meetUpOption A meetup_option row.
+type meetUpOption struct {
+	id, date, duration int64
+}
+
+// Selects the option rows of a meetup, ordered by date.
+func selectOptions(tx sqlTx, idMeetUp int64) (options []meetUpOption, retErr error) {
+	rows, retErr := tx.stmt("selectOptionsByMeetUpid").Query(idMeetUp)
 	if retErr != nil {
 		return
 	}
+	defer closeRows(rows, &retErr)
+
+	for rows.Next() {
+		var option meetUpOption
+		if retErr = rows.Scan(&option.id, &option.date, &option.duration); retErr != nil {
+			return
+		}
+		options = append(options, option)
+	}
+	return options, rows.Err()
+}
+
+// readRow Selects a meetup row with the prepared statement stmtKey, and its options. Returns notFound if no row
+// matches arg. The userhash is decrypted, the adminhash is left empty, only its digest is stored.
+func (m *MeetUp) readRow(tx sqlTx, stmtKey string, arg interface{}, notFound error) error {
+	var sealedUserHash string
+	err := tx.stmt(stmtKey).QueryRow(arg).Scan(&m.Id, &sealedUserHash, &m.Description, &m.Email, &m.EmailConfirmed, &m.FinalDate, &m.Created, &m.Modified, &m.Expires, &m.Revision, &m.DeletedAt)
+	if err == sql.ErrNoRows {
+		return notFound
+	} else if err != nil {
+		return err
+	}
+	if m.UserHash, err = tx.tokens.open(sealedUserHash); err != nil {
+		return fmt.Errorf("meetup %d: %w", m.Id, err)
+	}
 
+	options, err := selectOptions(tx, m.Id)
+	if err != nil {
+		return err
+	}
+	m.Dates = make([]int64, len(options))
+	m.Durations = make([]int64, len(options))
+	for i, option := range options {
+		m.Dates[i] = option.date
+		m.Durations[i] = option.duration
+	}
 	return nil
 }
 
-// GetByAdminHash Selects a MeetUp row by the admin hash
-// Also gets all sub objects of the MeetUp row from the date, admin and user tables.
-func (m *MeetUp) GetByAdminHash(adminHash string) (retErr error) {
-	rows, retErr := preparedStmts["selectMeetupByAdminhash"].Query(adminHash)
+// insertOptions Inserts an option row for each of the meetup dates, skipping dates that already have one.
+// Returns how many rows were inserted.
+func (m *MeetUp) insertOptions(tx sqlTx) (inserted int64, err error) {
+	for i, date := range m.Dates {
+		var duration int64
+		if i < len(m.Durations) {
+			duration = m.Durations[i]
+		}
+
+		result, err := tx.stmt("insertOption").Exec(m.Id, date, duration)
+		if err != nil {
+			return inserted, err
+		}
+		rowCount, err := result.RowsAffected()
+		if err != nil {
+			return inserted, err
+		}
+		inserted += rowCount
+	}
+	return inserted, nil
+}
+
+// writeOptions Makes the option rows of the meetup match its Dates and Durations. Options that are kept keep the
+// users' availability for them, removing an option deletes it.
+func (m *MeetUp) writeOptions(tx sqlTx) error {
+	options, err := selectOptions(tx, m.Id)
+	if err != nil {
+		return err
+	}
+
+	for _, option := range options {
+		i := slices.Index(m.Dates, option.date)
+		if i < 0 {
+			_, err = tx.stmt("deleteOption").Exec(option.id)
+		} else if duration := m.duration(i); duration != option.duration {
+			_, err = tx.stmt("updateOption").Exec(duration, option.id)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = m.insertOptions(tx)
+	return err
+}
+
+// Returns the duration of the slot at index i of Dates, 0 for an all-day slot.
+func (m *MeetUp) duration(i int) int64 {
+	if i < len(m.Durations) {
+		return m.Durations[i]
+	}
+	return 0
+}
+
+// readAvailability Sets Dates and IfNeedBe from the user_availability rows of the user.
+func (u *User) readAvailability(tx sqlTx) (retErr error) {
+	rows, retErr := tx.stmt("selectAvailabilityByUserid").Query(u.Id)
 	if retErr != nil {
 		return
 	}
-	defer func() {
-		if closeErr := rows.Close(); closeErr != nil {
-			retErr = fmt.Errorf("%s unable to close rows %s", retErr, closeErr)
+	defer closeRows(rows, &retErr)
+
+	var users = Users{*u}
+	if retErr = users.scanAvailability(rows); retErr != nil {
+		return
+	}
+	*u = users[0]
+	return nil
+}
+
+// insertAvailability Inserts an availability row for each of the user's dates that is a meetup option. A date in
+// both Dates and IfNeedBe is a yes. Returns how many rows were inserted.
+func (u *User) insertAvailability(tx sqlTx) (inserted int64, err error) {
+	for _, answer := range []struct {
+		availability Availability
+		dates        []int64
+	}{{AvailableYes, u.Dates}, {AvailableIfNeedBe, u.IfNeedBe}} {
+		for _, date := range answer.dates {
+			result, err := tx.stmt("insertAvailability").Exec(u.Id, answer.availability, u.IdMeetUp, date)
+			if err != nil {
+				return inserted, err
+			}
+			rowCount, err := result.RowsAffected()
+			if err != nil {
+				return inserted, err
+			}
+			inserted += rowCount
 		}
-	}()
+	}
+	return inserted, nil
+}
+
+// writeAvailability Replaces the user_availability rows of the user with its Dates and IfNeedBe.
+func (u *User) writeAvailability(tx sqlTx) error {
+	if _, err := tx.stmt("deleteAvailabilityByUserid").Exec(u.Id); err != nil {
+		return err
+	}
+
+	_, err := u.insertAvailability(tx)
+	return err
+}
+
+// touchMeetUp Sets the last modified time of the meetup to now, after one of its users changes.
+func touchMeetUp(tx sqlTx, idMeetUp int64) error {
+	if _, err := tx.stmt("touchMeetup").Exec(time.Now().UnixMilli(), idMeetUp); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// GetMeetUpByUserHash Selects a MeetUp row by the user hash
+// Also gets all sub objects of the MeetUp row from the option, user and availability tables.
+func (s *sqlStore) GetMeetUpByUserHash(userHash string) (m MeetUp, err error) {
+	err = s.withTx(func(tx sqlTx) error {
+		if err := m.readRow(tx, "selectMeetupByUserhash", tx.tokens.digest(userHash), fmt.Errorf("%w matching the userhash", ErrNotFound)); err != nil {
+			return err
+		}
+
+		// Read all users with meetup id
+		return m.Users.readAll(tx, m.Id)
+	})
+	return
+}
+
+// GetMeetUpByAdminHash Selects a MeetUp row by the admin hash
+// Also gets all sub objects of the MeetUp row from the option, user and availability tables.
+func (s *sqlStore) GetMeetUpByAdminHash(adminHash string) (m MeetUp, err error) {
+	err = s.withTx(func(tx sqlTx) error {
+		if err := m.readRow(tx, "selectMeetupByAdminhash", tx.tokens.digest(adminHash), fmt.Errorf("%w matching the adminhash", ErrNotFound)); err != nil {
+			return err
+		}
+		m.AdminHash = adminHash
+
+		// Read all users with meetupid
+		return m.Users.readAll(tx, m.Id)
+	})
+	return
+}
+
+// DeleteMeetUpByAdminHash Soft deletes a meetup by its admin hash, see DeleteMeetUp.
+func (s *sqlStore) DeleteMeetUpByAdminHash(adminHash string) error {
+	return s.withTx(func(tx sqlTx) error {
+		_, err := tx.stmt("deleteMeetupByAdminhash").Exec(time.Now().UnixMilli(), tx.tokens.digest(adminHash))
+		return err
+	})
+}
+
+// GetDeletedMeetUpByAdminHash Selects a soft deleted MeetUp row by the admin hash, with its users.
+func (s *sqlStore) GetDeletedMeetUpByAdminHash(adminHash string) (m MeetUp, err error) {
+	err = s.withTx(func(tx sqlTx) error {
+		if err := m.readRow(tx, "selectDeletedMeetup", tx.tokens.digest(adminHash), fmt.Errorf("%w: no deleted meetup matches the adminhash", ErrNotFound)); err != nil {
+			return err
+		}
+		m.AdminHash = adminHash
+		return m.Users.readAll(tx, m.Id)
+	})
+	return
+}
+
+// PurgeDeleted Deletes the meetups and users that were soft deleted at or before the time for good, with the users of
+// the meetups. Returns how many meetups and users were deleted.
+func (s *sqlStore) PurgeDeleted(before int64) (meetUps, users int, err error) {
+	err = s.withTx(func(tx sqlTx) error {
+		result, err := tx.stmt("purgeDeletedUsers").Exec(before, before)
+		if err != nil {
+			return err
+		}
+		userCount, err := result.RowsAffected()
+		if err != nil {
+			return err
+		}
+
+		if result, err = tx.stmt("purgeDeletedMeetups").Exec(before); err != nil {
+			return err
+		}
+		meetUpCount, err := result.RowsAffected()
+		meetUps, users = int(meetUpCount), int(userCount)
+		return err
+	})
+	return
+}
+
+// GetExpiredMeetUpIds Selects the ids of the meetups that expired by now. A meetup without an expiry set expires
+// defaultAfter milliseconds after its last date, see MeetUp.Expiry.
+func (s *sqlStore) GetExpiredMeetUpIds(now, defaultAfter int64) (ids []int64, err error) {
+	err = s.withTx(func(tx sqlTx) (retErr error) {
+		rows, retErr := tx.stmt("selectExpiredMeetups").Query(defaultAfter, now)
+		if retErr != nil {
+			return
+		}
+		defer closeRows(rows, &retErr)
+
+		ids = make([]int64, 0)
+		for rows.Next() {
+			var id int64
+			if retErr = rows.Scan(&id); retErr != nil {
+				return
+			}
+			ids = append(ids, id)
+		}
+		return rows.Err()
+	})
+	return
+}
+
+// GetUsersByMeetUpId Selects all User rows with meetup id
+func (s *sqlStore) GetUsersByMeetUpId(idMeetUp int64) (users Users, err error) {
+	err = s.withTx(func(tx sqlTx) error {
+		return users.readAll(tx, idMeetUp)
+	})
+	return
+}
+
+// Selects all User rows with meetup id, and their availability.
+func (u *Users) readAll(tx sqlTx, idMeetUp int64) (retErr error) {
+	rows, retErr := tx.stmt("selectUsersByMeetUpid").Query(idMeetUp)
+	if retErr != nil {
+		return
+	}
+	defer closeRows(rows, &retErr)
 
-	if rows.Next() {
-		var datesBlob []byte
-		retErr = rows.Scan(&m.Id, &m.UserHash, &m.AdminHash, &datesBlob, &m.Description)
+	*u = make(Users, 0)
+	for rows.Next() {
+		var user = User{}
+		retErr = rows.Scan(&user.Id, &user.IdMeetUp, &user.Name, &user.Token)
 		if retErr != nil {
 			return
 		}
-		m.Dates = convertBlobToDates(datesBlob)
-	} else {
-		retErr = errors.New("no rows matching the adminhash")
+		*u = append(*u, user)
+	}
+	if retErr = rows.Err(); retErr != nil {
 		return
 	}
 
-	// Read all users with meetupid
-	retErr = m.Users.GetAllByMeetUpId(m.Id)
+	availabilityRows, retErr := tx.stmt("selectAvailabilityByMeetUpid").Query(idMeetUp)
 	if retErr != nil {
 		return
 	}
+	defer closeRows(availabilityRows, &retErr)
 
-	return nil
+	return u.scanAvailability(availabilityRows)
 }
 
-// GetAllByMeetUpId Selects all User rows with meetup id
-func (u *Users) GetAllByMeetUpId(idMeetUp int64) (retErr error) {
-	rows, retErr := preparedStmts["selectUsersByMeetUpid"].Query(idMeetUp)
+// readDeleted Selects the soft deleted users of the meetup with their answers, the last deleted first.
+func (u *Users) readDeleted(tx sqlTx, idMeetUp int64) (retErr error) {
+	rows, retErr := tx.stmt("selectDeletedUsers").Query(idMeetUp)
 	if retErr != nil {
 		return
 	}
-	defer func() {
-		if closeErr := rows.Close(); closeErr != nil {
-			retErr = fmt.Errorf("%s unable to close rows %s", retErr, closeErr)
-		}
-	}()
+	defer closeRows(rows, &retErr)
 
 	*u = make(Users, 0)
 	for rows.Next() {
 		var user = User{}
-		var datesBlob []byte
-		retErr = rows.Scan(&user.Id, &user.IdMeetUp, &user.Name, &datesBlob)
-		if retErr != nil {
+		if retErr = rows.Scan(&user.Id, &user.IdMeetUp, &user.Name, &user.Token, &user.DeletedAt); retErr != nil {
 			return
 		}
-		user.Dates = convertBlobToDates(datesBlob)
 		*u = append(*u, user)
 	}
+	if retErr = rows.Err(); retErr != nil {
+		return
+	}
 
-	return nil
+	availabilityRows, retErr := tx.stmt("selectAvailabilityByMeetUpid").Query(idMeetUp)
+	if retErr != nil {
+		return
+	}
+	defer closeRows(availabilityRows, &retErr)
+
+	return u.scanAvailability(availabilityRows)
+}
+
+// Sets the Dates and IfNeedBe of the users from rows of (iduser, date, availability).
+func (u Users) scanAvailability(rows *sql.Rows) error {
+	for i := range u {
+		u[i].Dates = make([]int64, 0)
+		u[i].IfNeedBe = make([]int64, 0)
+	}
+
+	for rows.Next() {
+		var idUser, date int64
+		var availability Availability
+		if err := rows.Scan(&idUser, &date, &availability); err != nil {
+			return err
+		}
+
+		for i := range u {
+			if u[i].Id != idUser {
+				continue
+			}
+			if availability == AvailableIfNeedBe {
+				u[i].IfNeedBe = append(u[i].IfNeedBe, date)
+			} else {
+				u[i].Dates = append(u[i].Dates, date)
+			}
+		}
+	}
+	return rows.Err()
 }
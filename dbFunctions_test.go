@@ -10,117 +10,157 @@ import (
 	"errors"
 )
 
-func TestMeetUp_DeleteByAdminHash(t *testing.T) {
-	testDbName := CreateTestDb(t)
-	defer DestroyTestDb(testDbName)
-
-	var meetUpObj = MeetUp{
-		UserHash:    "8d9d7c59eec27a7aee55536582e45afb18f072c282edd22474a0db0676d74299",
-		AdminHash:   "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855",
-		Dates:       []int64{1550401200000, 1550487600000, 1550574000000, 1550660400000, 1550746800000, 1550833200000, 1550919600000, 1551006000000},
-		Users:       Users{},
-		Description: "ljkas;ldfjk;asldkjf",
-	}
+func TestStore_DeleteMeetUpByAdminHash(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store Store) {
+		var meetUpObj = MeetUp{
+			UserHash:    "8d9d7c59eec27a7aee55536582e45afb18f072c282edd22474a0db0676d74299",
+			AdminHash:   "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855",
+			Dates:       []int64{1550401200000, 1550487600000, 1550574000000, 1550660400000, 1550746800000, 1550833200000, 1550919600000, 1551006000000},
+			Users:       Users{},
+			Description: "ljkas;ldfjk;asldkjf",
+		}
 
-	if err := meetUpObj.Create(); err != nil {
-		t.Fatalf("MeetUp.Create() failed: %s\n", err)
-	}
+		if err := store.CreateMeetUp(&meetUpObj); err != nil {
+			t.Fatalf("CreateMeetUp() failed: %s\n", err)
+		}
 
-	if err := meetUpObj.DeleteByAdminHash(meetUpObj.AdminHash); err != nil {
-		t.Fatalf("DeleteByAdminHash() failed: %s\n", err)
-		return
-	}
+		if err := store.DeleteMeetUpByAdminHash(meetUpObj.AdminHash); err != nil {
+			t.Fatalf("DeleteMeetUpByAdminHash() failed: %s\n", err)
+			return
+		}
 
-	if err := meetUpObj.GetByUserHash(meetUpObj.UserHash); err.Error() != "no rows matching the userhash" {
-		t.Fatalf("GetByUserHash() failed: %s\n", err)
-	}
+		if _, err := store.GetMeetUpByUserHash(meetUpObj.UserHash); errors.Is(err, ErrNotFound) == false {
+			t.Fatalf("GetMeetUpByUserHash() failed: %s\n", err)
+		}
+	})
 }
 
-func TestMeetUp_GetByUserHash(t *testing.T) {
-	testDbName := CreateTestDb(t)
-	defer DestroyTestDb(testDbName)
-
-	var meetUpObj = MeetUp{
-		UserHash:  "6cf51863dcbd352c9da7fc0670a34a7173056413214ac0e22f0effd1015a7fa907399f9107fd48689d3800043ff12bbd33a24a433a6ede783bda3423c9820278",
-		AdminHash: "a39f823a49a4fbdfc2906a4baf0dce97a216d8b5bf6b0ab83a31d04c2d84ae619a6e017368a434ecb7b09b54015d22455062ac199ec48aa5b1c0dea830c3ecb6",
-		Dates:     []int64{1550401200000, 1550487600000, 1550574000000, 1550660400000, 1550746800000, 1550833200000, 1550919600000, 1551006000000},
-		Users: Users{
-			{Name: "user1", Dates: []int64{1550401200000, 1550487600000, 1550574000000}},
-			{Name: "user2", Dates: []int64{1550401200000, 1550574000000}},
-			{Name: "user3", Dates: []int64{1550574000000}},
-		},
-		Description: "ljkas;ldfjk;asldkjf",
-	}
+func TestStore_GetMeetUpByUserHash(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store Store) {
+		var meetUpObj = MeetUp{
+			UserHash:  "6cf51863dcbd352c9da7fc0670a34a7173056413214ac0e22f0effd1015a7fa907399f9107fd48689d3800043ff12bbd33a24a433a6ede783bda3423c9820278",
+			AdminHash: "a39f823a49a4fbdfc2906a4baf0dce97a216d8b5bf6b0ab83a31d04c2d84ae619a6e017368a434ecb7b09b54015d22455062ac199ec48aa5b1c0dea830c3ecb6",
+			Dates:     []int64{1550401200000, 1550487600000, 1550574000000, 1550660400000, 1550746800000, 1550833200000, 1550919600000, 1551006000000},
+			Users: Users{
+				{Name: "user1", Dates: []int64{1550401200000, 1550487600000, 1550574000000}},
+				{Name: "user2", Dates: []int64{1550401200000, 1550574000000}, IfNeedBe: []int64{1550487600000}},
+				{Name: "user3", Dates: []int64{1550574000000}},
+			},
+			Description: "ljkas;ldfjk;asldkjf",
+		}
 
-	if err := meetUpObj.Create(); err != nil {
-		t.Fatalf("MeetUp.Create() failed: %s\n", err)
-	}
-	for _, user := range meetUpObj.Users {
-		user.IdMeetUp = meetUpObj.Id
-		if err := user.Create(); err != nil {
-			t.Fatalf("User.Create() failed: %s\n", err)
+		if err := store.CreateMeetUp(&meetUpObj); err != nil {
+			t.Fatalf("CreateMeetUp() failed: %s\n", err)
+		}
+		for _, user := range meetUpObj.Users {
+			user.IdMeetUp = meetUpObj.Id
+			if err := store.CreateUser(&user); err != nil {
+				t.Fatalf("CreateUser() failed: %s\n", err)
+			}
 		}
-	}
 
-	var dbMeetUp = MeetUp{}
-	if err := dbMeetUp.GetByUserHash(meetUpObj.UserHash); err != nil && err.Error() != "no rows matching the userhash" {
-		t.Errorf("GetByUserHash() failed: %s\n", err)
-	}
+		dbMeetUp, err := store.GetMeetUpByUserHash(meetUpObj.UserHash)
+		if err != nil {
+			t.Errorf("GetMeetUpByUserHash() failed: %s\n", err)
+		}
 
-	if err := validateMeetUpObject(dbMeetUp); err != nil {
-		t.Errorf("MeetUp validation failed: %s\n", err)
-	}
+		if err := validateMeetUpObject(dbMeetUp); err != nil {
+			t.Errorf("MeetUp validation failed: %s\n", err)
+		}
 
-	if compareMeetUpObjects(meetUpObj, dbMeetUp) == false {
-		t.Errorf("MeetUp objects were different.")
-	}
+		// Only the digest of the adminhash is stored
+		if dbMeetUp.AdminHash != "" {
+			t.Errorf("GetMeetUpByUserHash() has the adminhash %q\n", dbMeetUp.AdminHash)
+		}
+		meetUpObj.AdminHash = ""
+		if compareMeetUpObjects(meetUpObj, dbMeetUp) == false {
+			t.Errorf("MeetUp objects were different.")
+		}
 
-	if err := meetUpObj.Delete(); err != nil {
-		t.Fatalf("delete failed: %s\n", err)
-	}
+		if err := store.DeleteMeetUp(meetUpObj.Id); err != nil {
+			t.Fatalf("delete failed: %s\n", err)
+		}
+	})
 }
 
-func TestMeetUp_GetByAdminHash(t *testing.T) {
-	testDbName := CreateTestDb(t)
-	defer DestroyTestDb(testDbName)
+func TestStore_GetMeetUpByAdminHash(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store Store) {
+		var meetUpObj = MeetUp{
+			UserHash:  "6cf51863dcbd352c9da7fc0670a34a7173056413214ac0e22f0effd1015a7fa907399f9107fd48689d3800043ff12bbd33a24a433a6ede783bda3423c9820278",
+			AdminHash: "a39f823a49a4fbdfc2906a4baf0dce97a216d8b5bf6b0ab83a31d04c2d84ae619a6e017368a434ecb7b09b54015d22455062ac199ec48aa5b1c0dea830c3ecb6",
+			Dates:     []int64{1550401200000, 1550487600000, 1550574000000, 1550660400000, 1550746800000, 1550833200000, 1550919600000, 1551006000000},
+			Users: Users{
+				{Name: "user1", Dates: []int64{1550401200000, 1550487600000, 1550574000000}},
+				{Name: "user2", Dates: []int64{1550401200000, 1550574000000}, IfNeedBe: []int64{1550487600000}},
+				{Name: "user3", Dates: []int64{1550574000000}},
+			},
+			Description: "ljkas;ldfjk;asldkjf",
+		}
 
-	var meetUpObj = MeetUp{
-		UserHash:  "6cf51863dcbd352c9da7fc0670a34a7173056413214ac0e22f0effd1015a7fa907399f9107fd48689d3800043ff12bbd33a24a433a6ede783bda3423c9820278",
-		AdminHash: "a39f823a49a4fbdfc2906a4baf0dce97a216d8b5bf6b0ab83a31d04c2d84ae619a6e017368a434ecb7b09b54015d22455062ac199ec48aa5b1c0dea830c3ecb6",
-		Dates:     []int64{1550401200000, 1550487600000, 1550574000000, 1550660400000, 1550746800000, 1550833200000, 1550919600000, 1551006000000},
-		Users: Users{
-			{Name: "user1", Dates: []int64{1550401200000, 1550487600000, 1550574000000}},
-			{Name: "user2", Dates: []int64{1550401200000, 1550574000000}},
-			{Name: "user3", Dates: []int64{1550574000000}},
-		},
-		Description: "ljkas;ldfjk;asldkjf",
-	}
+		if err := store.CreateMeetUp(&meetUpObj); err != nil {
+			t.Fatalf("Create() failed: %s\n", err)
+		}
+		for _, user := range meetUpObj.Users {
+			user.IdMeetUp = meetUpObj.Id
+			if err := store.CreateUser(&user); err != nil {
+				t.Fatalf("CreateUser() failed: %s\n", err)
+			}
+		}
 
-	if err := meetUpObj.Create(); err != nil {
-		t.Fatalf("Create() failed: %s\n", err)
-	}
-	for _, user := range meetUpObj.Users {
-		user.IdMeetUp = meetUpObj.Id
-		if err := user.Create(); err != nil {
-			t.Fatalf("User.Create() failed: %s\n", err)
+		dbMeetUp, err := store.GetMeetUpByAdminHash(meetUpObj.AdminHash)
+		if err != nil {
+			t.Errorf("GetMeetUpByAdminHash() failed: %s\n", err)
+		}
+
+		if err := validateMeetUpObject(dbMeetUp); err != nil {
+			t.Errorf("MeetUp validation failed: %s\n", err)
 		}
-	}
 
-	var dbMeetUp = MeetUp{}
-	if err := dbMeetUp.GetByAdminHash(meetUpObj.AdminHash); err != nil && err.Error() != "no rows matching the adminhash" {
-		t.Errorf("GetByAdminHash() failed: %s\n", err)
+		if compareMeetUpObjects(meetUpObj, dbMeetUp) == false {
+			t.Errorf("MeetUp objects were different.")
+		}
+
+		if err := store.DeleteMeetUp(meetUpObj.Id); err != nil {
+			t.Fatalf("delete failed: %s\n", err)
+		}
+	})
+}
+
+func TestMeetUp_Slots(t *testing.T) {
+	var meetUp = MeetUp{Dates: []int64{1550401200000, 1550487600000, 1550574000000}, Durations: []int64{0, 3600000}}
+
+	expected := []Slot{
+		{Start: 1550401200000, End: 1550487600000, AllDay: true},
+		{Start: 1550487600000, End: 1550491200000},
+		{Start: 1550574000000, End: 1550660400000, AllDay: true},
+	}
+	if slots := meetUp.Slots(); reflect.DeepEqual(slots, expected) == false {
+		t.Fatalf("Slots() = %+v, want: %+v", slots, expected)
 	}
 
-	if err := validateMeetUpObject(dbMeetUp); err != nil {
-		t.Errorf("MeetUp validation failed: %s\n", err)
+	var newMeetUp MeetUp
+	newMeetUp.SetSlots(expected)
+	if reflect.DeepEqual(newMeetUp.Dates, meetUp.Dates) == false || reflect.DeepEqual(newMeetUp.Durations, []int64{0, 3600000, 0}) == false {
+		t.Errorf("SetSlots() set dates %v and durations %v", newMeetUp.Dates, newMeetUp.Durations)
 	}
+}
 
-	if compareMeetUpObjects(meetUpObj, dbMeetUp) == false {
-		t.Errorf("MeetUp objects were different.")
+func TestUser_Availability(t *testing.T) {
+	var user = User{Name: "bob", Dates: []int64{1550401200000}, IfNeedBe: []int64{1550487600000}}
+
+	var tests = []struct {
+		date     int64
+		expected Availability
+	}{
+		{1550401200000, AvailableYes},
+		{1550487600000, AvailableIfNeedBe},
+		{1550574000000, AvailableNo},
 	}
 
-	if err := meetUpObj.Delete(); err != nil {
-		t.Fatalf("delete failed: %s\n", err)
+	for _, test := range tests {
+		if availability := user.Availability(test.date); availability != test.expected {
+			t.Errorf("Availability(%d) = %q, want: %q", test.date, availability, test.expected)
+		}
 	}
 }
 
@@ -144,7 +184,7 @@ func TestMeetUp_MarshalJSON(t *testing.T) {
 // Helper functions to compare some of the properties of various database objects.
 // The IDs don't get compared as one of the passed objects usually doesn't have any
 func compareMeetUpObjects(obj1, obj2 MeetUp) bool {
-	if obj1.UserHash != obj2.UserHash || obj1.AdminHash != obj2.AdminHash || reflect.DeepEqual(obj1.Dates, obj2.Dates) == false || obj1.Description != obj2.Description {
+	if obj1.UserHash != obj2.UserHash || obj1.AdminHash != obj2.AdminHash || reflect.DeepEqual(obj1.Dates, obj2.Dates) == false || reflect.DeepEqual(obj1.Slots(), obj2.Slots()) == false || obj1.Description != obj2.Description || obj1.Email != obj2.Email || obj1.Expires != obj2.Expires || obj1.FinalDate != obj2.FinalDate || obj1.Revision != obj2.Revision {
 		return false
 	}
 	if compareUsersObject(obj1.Users, obj2.Users) == false {
@@ -164,19 +204,27 @@ func compareUsersObject(obj1, obj2 Users) bool {
 	return true
 }
 func compareUserObjects(obj1, obj2 User) bool {
-	if obj1.Name != obj2.Name || reflect.DeepEqual(obj1.Dates, obj2.Dates) == false {
+	if obj1.Name != obj2.Name || reflect.DeepEqual(obj1.Dates, obj2.Dates) == false || sameDates(obj1.IfNeedBe, obj2.IfNeedBe) == false {
 		return false
 	}
 	return true
 }
 
+// Compares two date slices, treating nil and empty slices as equal.
+func sameDates(dates1, dates2 []int64) bool {
+	if len(dates1) == 0 && len(dates2) == 0 {
+		return true
+	}
+	return reflect.DeepEqual(dates1, dates2)
+}
+
 // Helper functions to validate that a meetup object and its children have realistic IDs, and that the IDs match.
 func validateMeetUpObject(meetUp MeetUp) error {
 	if meetUp.Id <= 0 {
 		return errors.New("invalid meetup id")
 	} else if validateHash(meetUp.UserHash) != nil {
 		return errors.New("invalid user hash")
-	} else if validateHash(meetUp.AdminHash) != nil {
+	} else if meetUp.AdminHash != "" && validateHash(meetUp.AdminHash) != nil {
 		return errors.New("invalid admin hash")
 	} else if err := validateUsersObject(meetUp.Id, meetUp.Users); err != nil {
 		return err
@@ -203,3 +251,42 @@ func validateUserObject(meetUpId int64, user User) error {
 		return nil
 	}
 }
+
+func TestMeetUp_UpdateKeepsAvailability(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store Store) {
+		var meetUp = MeetUp{UserHash: "abc", AdminHash: "def", Dates: []int64{1550401200000, 1550487600000, 1550574000000}, Description: "meetUp description"}
+		if err := store.CreateMeetUp(&meetUp); err != nil {
+			t.Fatalf("create failed: %s\n", err)
+		}
+		var user = User{IdMeetUp: meetUp.Id, Name: "bob", Dates: []int64{1550401200000, 1550487600000}, IfNeedBe: []int64{1550574000000}}
+		if err := store.CreateUser(&user); err != nil {
+			t.Fatalf("create failed: %s\n", err)
+		}
+
+		// Removing an option removes the users' answers for it, the other answers are kept
+		meetUp.Dates = []int64{1550487600000, 1550574000000, 1550660400000}
+		meetUp.Durations = []int64{3600000, 0, 0}
+		if err := store.UpdateMeetUp(&meetUp); err != nil {
+			t.Fatalf("update failed: %s\n", err)
+		}
+
+		users, err := store.GetUsersByMeetUpId(meetUp.Id)
+		if err != nil {
+			t.Fatalf("GetUsersByMeetUpId() failed: %s\n", err)
+		}
+		var expected = User{Name: "bob", Dates: []int64{1550487600000}, IfNeedBe: []int64{1550574000000}}
+		if len(users) != 1 || compareUserObjects(users[0], expected) == false {
+			t.Errorf("users after the update = %+v, want: %+v", users, expected)
+		}
+
+		// The kept option is updated in place, not replaced
+		if dbStore, ok := store.(*sqlStore); ok {
+			var count int
+			if err := dbStore.db.QueryRow(dbStore.dialect.rebind(`SELECT count(*) FROM user_availability a JOIN meetup_option o ON o.idoption = a.idoption WHERE o.date = ?`), 1550487600000).Scan(&count); err != nil {
+				t.Fatal(err)
+			} else if count != 1 {
+				t.Errorf("%d users are available on the kept option, want: 1", count)
+			}
+		}
+	})
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// The types of meetUpEvent, also the event names in the /api/events stream.
+const (
+	eventMeetUp = "meetup" // The meetup's options or final date changed
+	eventUser   = "user"   // A user was added, changed their answers or was deleted
+)
+
+// eventsHeartbeat How often an idle /api/events stream gets a comment line, so proxies don't close it.
+const eventsHeartbeat = 30 * time.Second
+
+// eventBufferLen How many events a subscriber can fall behind before newer ones are dropped. An event only tells the
+// client to reload, so a dropped one is covered by those still waiting.
+const eventBufferLen = 8
+
+// meetUpEvent A change to a meetup, sent to the clients watching it.
+type meetUpEvent struct {
+	Type     string `json:"type"`               // eventMeetUp or eventUser
+	Revision int64  `json:"revision,omitempty"` // The new revision, for eventMeetUp
+	Name     string `json:"name,omitempty"`     // The user's name, for eventUser
+}
+
+// eventHub Passes meetup changes to their subscribers. In-process only, it sees the changes made through this server.
+type eventHub struct {
+	mu          sync.Mutex
+	subscribers map[int64]map[chan meetUpEvent]struct{} // By meetup id
+}
+
+// newEventHub Returns a hub without subscribers.
+func newEventHub() *eventHub {
+	return &eventHub{subscribers: make(map[int64]map[chan meetUpEvent]struct{})}
+}
+
+// subscribe Returns a channel receiving the events of the meetup with the id, and the function to unsubscribe it.
+func (h *eventHub) subscribe(idMeetUp int64) (<-chan meetUpEvent, func()) {
+	ch := make(chan meetUpEvent, eventBufferLen)
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.subscribers[idMeetUp] == nil {
+		h.subscribers[idMeetUp] = make(map[chan meetUpEvent]struct{})
+	}
+	h.subscribers[idMeetUp][ch] = struct{}{}
+
+	return ch, func() {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		delete(h.subscribers[idMeetUp], ch)
+		if len(h.subscribers[idMeetUp]) == 0 {
+			delete(h.subscribers, idMeetUp)
+		}
+	}
+}
+
+// publish Sends the event to the subscribers of the meetup with the id. Never blocks, a subscriber with a full buffer
+// misses the event.
+func (h *eventHub) publish(idMeetUp int64, event meetUpEvent) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for ch := range h.subscribers[idMeetUp] {
+		select {
+		case ch <- event:
+		default:
+		}
+	}
+}
+
+// close Closes the channels of the subscribers of the meetup with the id, which ends their streams. For when the
+// meetup was deleted, or the userhash they subscribed with was replaced and a client has to subscribe again with the
+// new one.
+func (h *eventHub) close(idMeetUp int64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for ch := range h.subscribers[idMeetUp] {
+		close(ch)
+	}
+	delete(h.subscribers, idMeetUp)
+}
+
+// Handles the request for the Server-Sent Events stream of the meetup with the userhash in the id parameter. Sends an
+// event whenever the meetup or its users change, until the client disconnects, or the meetup is deleted or its userhash
+// replaced. Not a json request, errors are returned as http status codes.
+func (s *server) getEvents(w http.ResponseWriter, r *http.Request) {
+	userHash := r.FormValue("id")
+	if err := validateHash(userHash); err != nil {
+		log.Printf("getEvents invalid user hash: %s\n", err)
+		http.Error(w, "invalid hash.", http.StatusBadRequest)
+		return
+	}
+
+	meetUpObj, err := s.store.GetMeetUpByUserHash(userHash)
+	if err != nil {
+		if errors.Is(err, ErrNotFound) {
+			http.Error(w, "The meetup was not found.", http.StatusNotFound)
+		} else {
+			log.Printf("getEvents: err getting by userhash: %s\n", err)
+			http.Error(w, "database error.", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	rc := http.NewResponseController(w)
+	events, unsubscribe := s.events.subscribe(meetUpObj.Id)
+	defer unsubscribe()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no") // Stops nginx from buffering the stream
+	w.WriteHeader(http.StatusOK)
+	if err = rc.Flush(); err != nil {
+		log.Printf("getEvents failed: error flushing response. %s\n", err)
+		return
+	}
+
+	heartbeat := time.NewTicker(s.heartbeat)
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-heartbeat.C:
+			_, err = fmt.Fprint(w, ": heartbeat\n\n")
+		case event, ok := <-events:
+			if !ok { // The userhash was replaced
+				return
+			}
+			js, _ := json.Marshal(event)
+			_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event.Type, js)
+		}
+		if err == nil {
+			err = rc.Flush()
+		}
+		if err != nil { // The client is gone
+			return
+		}
+	}
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEventHub(t *testing.T) {
+	hub := newEventHub()
+	events, unsubscribe := hub.subscribe(1)
+	other, unsubscribeOther := hub.subscribe(2)
+	defer unsubscribeOther()
+
+	hub.publish(1, meetUpEvent{Type: eventUser, Name: "alice"})
+	if event := <-events; event.Type != eventUser || event.Name != "alice" {
+		t.Errorf("subscriber got %+v\n", event)
+	}
+	if len(other) != 0 {
+		t.Errorf("the subscriber of another meetup got an event\n")
+	}
+
+	// A subscriber that doesn't keep up misses events, without blocking the publisher
+	for i := 0; i < eventBufferLen+2; i++ {
+		hub.publish(1, meetUpEvent{Type: eventMeetUp})
+	}
+	if len(events) != eventBufferLen {
+		t.Errorf("%d events are buffered, want: %d\n", len(events), eventBufferLen)
+	}
+
+	unsubscribe()
+	if count := hub.subscriberCount(1); count != 0 {
+		t.Errorf("subscriberCount() = %d after unsubscribe, want: 0\n", count)
+	}
+	hub.publish(1, meetUpEvent{Type: eventMeetUp})
+
+	// Closing the meetup's subscribers closes their channels, unsubscribing after is harmless
+	events, unsubscribe = hub.subscribe(1)
+	hub.close(1)
+	if _, ok := <-events; ok {
+		t.Errorf("the channel of a closed subscriber is still open\n")
+	}
+	if count := hub.subscriberCount(1); count != 0 {
+		t.Errorf("subscriberCount() = %d after close, want: 0\n", count)
+	}
+	if len(other) != 0 || hub.subscriberCount(2) != 1 {
+		t.Errorf("closing a meetup's subscribers changed those of another meetup\n")
+	}
+	unsubscribe()
+}
+
+// subscriberCount Returns the number of subscribers of the meetup with the id.
+func (h *eventHub) subscriberCount(idMeetUp int64) int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return len(h.subscribers[idMeetUp])
+}
+
+func TestGetEvents(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store Store) {
+		srv := newServer(store)
+		srv.heartbeat = 10 * time.Millisecond
+		meetUp := createApiTestMeetUp(t, store)
+
+		handler, err := srv.routes()
+		if err != nil {
+			t.Fatal(err)
+		}
+		ts := httptest.NewServer(handler)
+		defer ts.Close()
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		request, err := http.NewRequestWithContext(ctx, "GET", ts.URL+"/api/events?id="+meetUp.UserHash, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := http.DefaultClient.Do(request)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		if contentType := resp.Header.Get("Content-Type"); contentType != "text/event-stream" {
+			t.Errorf("Content-Type = %q, want: text/event-stream\n", contentType)
+		}
+
+		// Waits for a line starting with prefix in the stream
+		lines := bufio.NewScanner(resp.Body)
+		waitFor := func(prefix string) string {
+			t.Helper()
+			for lines.Scan() {
+				if strings.HasPrefix(lines.Text(), prefix) {
+					return lines.Text()
+				}
+			}
+			t.Fatalf("the stream ended before %q\n", prefix)
+			return ""
+		}
+
+		waitFor(": heartbeat")
+
+		response := postApiRequest(t, srv.updateUser, "/api/updateuser", map[string]interface{}{"userhash": meetUp.UserHash, "username": "alice"})
+		if response.Error != "" {
+			t.Fatalf("updateUser error: %s\n", response.Error)
+		}
+		if line := waitFor("event: "); line != "event: user" {
+			t.Errorf("got %q, want: event: user\n", line)
+		}
+		if line := waitFor("data: "); line != `data: {"type":"user","name":"alice"}` {
+			t.Errorf("got %q\n", line)
+		}
+
+		response = postApiRequest(t, srv.finaliseMeetUp, "/api/finalisemeetup", map[string]interface{}{"adminhash": meetUp.AdminHash, "date": meetUp.Dates[0]})
+		if response.Error != "" {
+			t.Fatalf("finaliseMeetUp error: %s\n", response.Error)
+		}
+		if line := waitFor("event: "); line != "event: meetup" {
+			t.Errorf("got %q, want: event: meetup\n", line)
+		}
+
+		// Disconnecting unsubscribes
+		cancel()
+		deadline := time.Now().Add(5 * time.Second)
+		for srv.events.subscriberCount(meetUp.Id) != 0 {
+			if time.Now().After(deadline) {
+				t.Fatal("getEvents didn't unsubscribe after the client disconnected")
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+
+		// Replacing the userhash ends the stream
+		ctx, cancel = context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if request, err = http.NewRequestWithContext(ctx, "GET", ts.URL+"/api/events?id="+meetUp.UserHash, nil); err != nil {
+			t.Fatal(err)
+		}
+		if resp, err = http.DefaultClient.Do(request); err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		lines = bufio.NewScanner(resp.Body)
+		waitFor(": heartbeat")
+		response = postApiRequest(t, srv.rotateHashes, "/api/rotatehashes", map[string]interface{}{"adminhash": meetUp.AdminHash, "newuserhash": true})
+		if response.Error != "" {
+			t.Fatalf("rotateHashes error: %s\n", response.Error)
+		}
+		for lines.Scan() {
+		}
+		if err = lines.Err(); err != nil {
+			t.Errorf("the stream didn't end after the userhash was replaced: %s\n", err)
+		}
+	})
+}
+
+func TestGetEvents_Errors(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store Store) {
+		srv := newServer(store)
+		meetUp := createApiTestMeetUp(t, store)
+
+		for _, test := range []struct {
+			id         string
+			wantStatus int
+		}{
+			{"abc", http.StatusBadRequest},
+			{meetUp.AdminHash, http.StatusNotFound},
+		} {
+			w := httptest.NewRecorder()
+			srv.getEvents(w, httptest.NewRequest("GET", "/api/events?id="+test.id, nil))
+			if w.Code != test.wantStatus {
+				t.Errorf("id %s: status = %d, want: %d\n", test.id, w.Code, test.wantStatus)
+			}
+		}
+	})
+}
+
+// Deleting a meetup, by the v1 or v2 api or when it expires, ends its event streams
+func TestDeleteMeetUp_ClosesEvents(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store Store) {
+		srv := newServer(store)
+		handler, err := srv.routes()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, test := range []struct {
+			name   string
+			delete func(meetUp MeetUp)
+		}{
+			{"v1", func(meetUp MeetUp) {
+				if response := postApiRequest(t, srv.deleteMeetUp, "/api/deletemeetup", map[string]interface{}{"adminhash": meetUp.AdminHash}); response.Error != "" {
+					t.Fatalf("deleteMeetUp error: %s\n", response.Error)
+				}
+			}},
+			{"v2", func(meetUp MeetUp) {
+				if resp, response := v2Request(t, handler, "DELETE", "/api/v2/meetups/"+meetUp.UserHash, meetUp.AdminHash, nil); resp.StatusCode != http.StatusNoContent {
+					t.Fatalf("delete status = %d, error: %q\n", resp.StatusCode, response.Error)
+				}
+			}},
+			{"expired", func(meetUp MeetUp) {
+				meetUp.Expires = time.Now().Add(-time.Hour).UnixMilli()
+				if err := store.UpdateMeetUp(&meetUp); err != nil {
+					t.Fatal(err)
+				}
+				if meetUps, _, err := srv.purgeExpired(); err != nil || meetUps != 1 {
+					t.Fatalf("purgeExpired() = %d, %v, want: 1\n", meetUps, err)
+				}
+			}},
+		} {
+			meetUp := createApiTestMeetUp(t, store)
+			events, unsubscribe := srv.events.subscribe(meetUp.Id)
+			test.delete(meetUp)
+			select {
+			case _, ok := <-events:
+				if ok {
+					t.Errorf("%s: the stream got an event instead of ending\n", test.name)
+				}
+			case <-time.After(5 * time.Second):
+				t.Errorf("%s: the stream didn't end after the meetup was deleted\n", test.name)
+			}
+			unsubscribe()
+		}
+	})
+}
@@ -2,4 +2,7 @@ module mycode/catherder
 
 go 1.24
 
-require github.com/mattn/go-sqlite3 v1.14.30
+require (
+	github.com/lib/pq v1.12.3
+	github.com/mattn/go-sqlite3 v1.14.30
+)
@@ -1,13 +1,18 @@
 package main
 
 import (
-	"encoding/binary"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/sha512"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"log"
 	"net/http"
 	"regexp"
+	"sort"
 	"strconv"
+	"strings"
 )
 
 // Extra helper functions that don't fit anywhere specifically
@@ -28,49 +33,188 @@ func validateHash(hash string) error {
 	return nil
 }
 
-// Returns a json error to the client
-func writeJsonError(w http.ResponseWriter, errString string) {
-	outMap := map[string]string{
-		"result": "",
-		"error":  errString,
+// The errors of validateSlots.
+var (
+	errSlotDate     = errors.New("invalid date")
+	errSlotEnd      = errors.New("slot ends before it starts")
+	errSlotsOverlap = errors.New("slots overlap")
+)
+
+// Sorts the slots by start time, and validates that none of them overlap.
+func validateSlots(slots []Slot) error {
+	sort.Slice(slots, func(i, j int) bool {
+		return slots[i].Start < slots[j].Start
+	})
+
+	for i, slot := range slots {
+		if slot.Start <= 0 {
+			return errSlotDate
+		} else if slot.End <= slot.Start {
+			return errSlotEnd
+		} else if i > 0 && slots[i-1].End > slot.Start {
+			return errSlotsOverlap
+		}
+	}
+	return nil
+}
+
+// Generates a new random hexadecimal sha512 hash, used for the meetup and participant secrets.
+func generateHash() (string, error) {
+	randBytes := make([]byte, 64)
+	if _, err := rand.Read(randBytes); err != nil {
+		return "", err
 	}
-	js, err := json.Marshal(outMap)
+	return fmt.Sprintf("%x", sha512.Sum512(randBytes)), nil
+}
+
+// The codes of the json errors. Unlike the messages they don't change, clients can match on them.
+const (
+	codeInvalidJson      = "invalid_json"
+	codeInvalidHash      = "invalid_hash"
+	codeInvalidRequest   = "invalid_request" // A field of the request is invalid, the details say which
+	codeNotFound         = "not_found"
+	codeUnauthorized     = "unauthorized"
+	codeForbidden        = "forbidden"
+	codeMeetUpClosed     = "meetup_closed"
+	codeNameTaken        = "name_taken"
+	codeRevisionConflict = "revision_conflict"
+	codeDatabaseError    = "database_error"
+	codeInternalError    = "internal_error"
+)
+
+// Returns a json error to the client
+func writeJsonError(w http.ResponseWriter, code, errString string) {
+	writeApiError(w, http.StatusOK, newApiError(http.StatusOK, code, errString))
+}
+
+// Returns the json error e to the client, with the http status code status.
+func writeApiError(w http.ResponseWriter, status int, e apiError) {
+	js, err := json.Marshal(struct {
+		Result  string        `json:"result"`
+		Error   string        `json:"error"`
+		Code    string        `json:"code"`
+		Details []errorDetail `json:"details,omitempty"`
+	}{"", e.message, e.code, e.details})
 	if err != nil {
-		log.Printf("writeJsonError json marshalling failed: %s\n", err)
+		log.Printf("writeApiError json marshalling failed: %s\n", err)
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
 	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
 
 	if _, err = w.Write(js); err != nil {
-		log.Printf("writeJsonError failed writing the response: %s\n", err)
+		log.Printf("writeApiError failed writing the response: %s\n", err)
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 }
 
-// convert dates []int64 to a []byte (sqlite blob type).
-func convertDatesToBlob(intSlice []int64) []byte {
-	var blobBytes []byte
+// Returns a json result to the client, with the http status code status.
+func writeJsonResult(w http.ResponseWriter, status int, result interface{}) {
+	js, err := json.Marshal(struct {
+		Result interface{} `json:"result"`
+		Error  string      `json:"error"`
+	}{result, ""})
+	if err != nil {
+		log.Printf("writeJsonResult json marshalling failed: %s\n", err)
+		writeApiError(w, http.StatusInternalServerError, newApiError(http.StatusInternalServerError, codeInternalError, err.Error()))
+		return
+	}
 
-	for _, date := range intSlice {
-		buf := make([]byte, binary.MaxVarintLen64)
-		binary.PutVarint(buf, date)
-		blobBytes = append(blobBytes, buf...)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+
+	if _, err = w.Write(js); err != nil {
+		log.Printf("writeJsonResult failed writing the response: %s\n", err)
 	}
+}
 
-	return blobBytes
+// apiError An error whose message is for the client. Handlers return it from a transaction, to roll it back and send
+// the message.
+type apiError struct {
+	status  int    // The http status code of the v2 api response, the v1 api always responds with 200
+	code    string // One of the code constants
+	message string
+	details []errorDetail // Optional
 }
 
-// convert blob []byte to date []int64
-func convertBlobToDates(blobBytes []byte) []int64 {
-	var intSlice = make([]int64, 0)
+// errorDetail Which field of the request is invalid, and why.
+type errorDetail struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
 
-	for i := 0; i < len(blobBytes); i += binary.MaxVarintLen64 {
-		outInt, _ := binary.Varint(blobBytes[i : i+binary.MaxVarintLen64])
-		intSlice = append(intSlice, outInt)
+func newApiError(status int, code, message string) apiError {
+	return apiError{status: status, code: code, message: message}
+}
+
+// Returns the apiError for an invalid field of the request.
+func invalidField(field, message string) apiError {
+	return apiError{http.StatusBadRequest, codeInvalidRequest, message, []errorDetail{{field, message}}}
+}
+
+func (e apiError) Error() string {
+	return e.message
+}
+
+// Is Lets errors.Is match an apiError by its code and message.
+func (e apiError) Is(target error) bool {
+	t, ok := target.(apiError)
+	return ok && t.code == e.code && t.message == e.message
+}
+
+// The error sent to the client when the meetup it sent an update for has changed since it read it.
+var revisionConflictError = newApiError(http.StatusConflict, codeRevisionConflict, "The meetup was changed since it was loaded, reload it and try again.")
+
+// Returns a json error to the client for the error of a transaction. An apiError is sent as is, a revision conflict
+// gets revisionConflictError, anything else is logged and sent as a database error.
+func writeTxError(w http.ResponseWriter, caller string, err error) {
+	var clientErr apiError
+	if errors.As(err, &clientErr) {
+		writeApiError(w, http.StatusOK, clientErr)
+		return
+	} else if errors.Is(err, errRevisionConflict) {
+		writeApiError(w, http.StatusOK, revisionConflictError)
+		return
 	}
 
-	return intSlice
+	log.Printf("%s failed: %s\n", caller, err)
+	writeJsonError(w, codeDatabaseError, "database error.")
+}
+
+// Returns the ETag header value for a meetup revision, sent by the writes.
+func revisionETag(revision int64) string {
+	return fmt.Sprintf(`"%d"`, revision)
+}
+
+// Returns the ETag header value for a read of the meetup at the revision, result being the json it sends. Changes of
+// the users don't bump the revision, so a hash of result follows the revision: the ETag changes with the users too.
+func readETag(revision int64, result interface{}) string {
+	js, err := json.Marshal(result)
+	if err != nil {
+		return revisionETag(revision)
+	}
+	hash := sha256.Sum256(js)
+	return fmt.Sprintf(`"%d-%x"`, revision, hash[:8])
+}
+
+// Returns whether the If-Match header of the request allows a change to the meetup at the revision. It matches the
+// revision's ETag, or the ETag of a read at the revision whatever the users were then. A request without the header,
+// or with *, always matches. Weak etags never match.
+func ifMatch(r *http.Request, revision int64) bool {
+	header := r.Header.Get("If-Match")
+	if header == "" {
+		return true
+	}
+
+	etag := revisionETag(revision)
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "*" || tag == etag || strings.HasPrefix(tag, strings.TrimSuffix(etag, `"`)+"-") {
+			return true
+		}
+	}
+	return false
 }
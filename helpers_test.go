@@ -2,6 +2,9 @@ package main
 
 import (
 	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
 	"testing"
 )
 
@@ -31,22 +34,57 @@ func TestValidateHash(t *testing.T) {
 	}
 }
 
-/*
-func TestWriteJsonError(t *testing.T) {
-	// TODO test
+func TestValidateSlots(t *testing.T) {
+	var input = []struct {
+		slots    []Slot
+		expected error
+	}{
+		{[]Slot{{Start: 1550401200000, End: 1550404800000}, {Start: 1550404800000, End: 1550408400000}}, nil},
+		{[]Slot{{Start: 1550487600000, End: 1550574000000, AllDay: true}, {Start: 1550401200000, End: 1550404800000}}, nil},
+		{[]Slot{{Start: 1550401200000, End: 1550404800000}, {Start: 1550403000000, End: 1550406600000}}, errors.New("slots overlap")},
+		{[]Slot{{Start: 1550401200000, End: 1550487600000, AllDay: true}, {Start: 1550401200000, End: 1550487600000, AllDay: true}}, errors.New("slots overlap")},
+		{[]Slot{{Start: 1550401200000, End: 1550401200000}}, errors.New("slot ends before it starts")},
+		{[]Slot{{Start: 1550401200000, End: 1550397600000}}, errors.New("slot ends before it starts")},
+		{[]Slot{{Start: 0, End: 3600000}}, errors.New("invalid date")},
+	}
+
+	for _, test := range input {
+		err := validateSlots(test.slots)
+
+		if (err == nil) != (test.expected == nil) || (err != nil && err.Error() != test.expected.Error()) {
+			t.Errorf(`validateSlots(%+v) = %v, want: %v`, test.slots, err, test.expected)
+		}
+	}
 
+	// The slots get sorted by their start
+	slots := []Slot{{Start: 1550487600000, End: 1550491200000}, {Start: 1550401200000, End: 1550404800000}}
+	if err := validateSlots(slots); err != nil || slots[0].Start != 1550401200000 {
+		t.Errorf("validateSlots() did not sort the slots: %+v", slots)
+	}
+}
+
+func TestWriteJsonError(t *testing.T) {
 	w := httptest.NewRecorder()
-	writeJsonError(w, "abc")
+	writeApiError(w, http.StatusBadRequest, invalidField("dates", "no dates selected"))
 
 	response := w.Result()
-	body, _ := ioutil.ReadAll(response.Body)
-
-	if response.StatusCode != 200 {
-		t.Error("http status code was not 200")
+	if response.StatusCode != http.StatusBadRequest {
+		t.Errorf("http status code = %d, want: %d", response.StatusCode, http.StatusBadRequest)
 	}
 	if response.Header.Get("Content-Type") != "application/json" {
 		t.Error("Content-Type header was wrong")
 	}
-	fmt.Println(string(body))
+
+	body, _ := io.ReadAll(response.Body)
+	if want := `{"result":"","error":"no dates selected","code":"invalid_request","details":[{"field":"dates","message":"no dates selected"}]}`; string(body) != want {
+		t.Errorf("body = %s, want: %s", body, want)
+	}
+
+	// Without details the field is left out, and the v1 api responds with 200
+	w = httptest.NewRecorder()
+	writeJsonError(w, codeInvalidHash, "invalid hash.")
+	body, _ = io.ReadAll(w.Result().Body)
+	if want := `{"result":"","error":"invalid hash.","code":"invalid_hash"}`; w.Code != http.StatusOK || string(body) != want {
+		t.Errorf("status %d body = %s, want: 200 %s", w.Code, body, want)
+	}
 }
-*/
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// Writes meetups as RFC 5545 iCalendar files.
+
+const icsMaxLineLen = 75 // Maximum octets in a content line, not counting the CRLF
+const icsTimeFormat = "20060102T150405Z"
+const icsRefreshInterval = "PT1H" // How often subscribed calendar clients should poll for changes
+
+// icsEvent A single VEVENT of a calendar.
+type icsEvent struct {
+	Uid         string
+	Slot        Slot
+	Summary     string
+	Description string
+	Tentative   bool
+}
+
+// Returns the first line of the meetup description, used as the event and calendar name.
+func (m *MeetUp) calendarSummary() string {
+	summary, _, _ := strings.Cut(strings.TrimSpace(m.Description), "\n")
+	if summary = strings.TrimSpace(summary); summary == "" {
+		summary = "Meet up"
+	}
+	return summary
+}
+
+// Returns the events of a meetup. Before the admin chooses a final date every option is a tentative event,
+// afterwards there is only the confirmed final date.
+func (m *MeetUp) calendarEvents() []icsEvent {
+	summary := m.calendarSummary()
+	events := make([]icsEvent, 0, len(m.Dates))
+	for _, slot := range m.Slots() {
+		if m.IsClosed() && slot.Start != m.FinalDate {
+			continue
+		}
+		events = append(events, icsEvent{
+			Uid:         icsUid(m.UserHash, slot.Start),
+			Slot:        slot,
+			Summary:     summary,
+			Description: m.Description,
+			Tentative:   m.IsClosed() == false,
+		})
+	}
+	return events
+}
+
+// Returns the events of the options the user can make, yes or if need be. Once the meetup is finalised there is
+// only the final date, confirmed if the user said yes to it.
+func (m *MeetUp) userCalendarEvents(user User) []icsEvent {
+	events := make([]icsEvent, 0, len(user.Dates)+len(user.IfNeedBe))
+	for _, event := range m.calendarEvents() {
+		switch user.Availability(event.Slot.Start) {
+		case AvailableYes:
+			events = append(events, event)
+		case AvailableIfNeedBe:
+			event.Summary += " (if need be)"
+			event.Tentative = true
+			events = append(events, event)
+		}
+	}
+	return events
+}
+
+// Generates a stable UID for the meetup option starting at date, so calendar clients update the same event on
+// every import. The userhash is hashed so it can't be read back from a shared calendar file.
+func icsUid(userHash string, date int64) string {
+	return fmt.Sprintf("%x", sha256.Sum256([]byte(fmt.Sprintf("%s:%d", userHash, date))))[:32] + "@catherder"
+}
+
+// writeCalendar Writes a VCALENDAR with the events to w. stamp is used as the DTSTAMP of every event.
+func writeCalendar(w io.Writer, name string, events []icsEvent, stamp time.Time) error {
+	bw := bufio.NewWriter(w)
+
+	lines := []string{
+		"BEGIN:VCALENDAR",
+		"VERSION:2.0",
+		"PRODID:-//catherder//catherder//EN",
+		"CALSCALE:GREGORIAN",
+		"METHOD:PUBLISH",
+		"X-WR-CALNAME:" + icsEscape(name),
+		"REFRESH-INTERVAL;VALUE=DURATION:" + icsRefreshInterval,
+		"X-PUBLISHED-TTL:" + icsRefreshInterval,
+	}
+	for _, event := range events {
+		status := "CONFIRMED"
+		if event.Tentative {
+			status = "TENTATIVE"
+		}
+		lines = append(lines,
+			"BEGIN:VEVENT",
+			"UID:"+event.Uid,
+			"DTSTAMP:"+stamp.UTC().Format(icsTimeFormat),
+			"DTSTART:"+time.UnixMilli(event.Slot.Start).UTC().Format(icsTimeFormat),
+			"DTEND:"+time.UnixMilli(event.Slot.End).UTC().Format(icsTimeFormat),
+			"SUMMARY:"+icsEscape(event.Summary),
+			"DESCRIPTION:"+icsEscape(event.Description),
+			"STATUS:"+status,
+			"TRANSP:OPAQUE",
+			"END:VEVENT",
+		)
+	}
+	lines = append(lines, "END:VCALENDAR")
+
+	for _, line := range lines {
+		if _, err := bw.WriteString(icsFold(line)); err != nil {
+			return err
+		}
+	}
+	return bw.Flush()
+}
+
+// serveCalendar Writes a calendar response with ETag and Last-Modified headers, so calendar clients polling a feed
+// get a 304 Not Modified response until the meetup changes. modified is the zero time if unknown.
+func serveCalendar(w http.ResponseWriter, r *http.Request, name string, events []icsEvent, modified time.Time) {
+	stamp := modified
+	if stamp.IsZero() {
+		stamp = time.Now()
+	}
+
+	var buf bytes.Buffer
+	if err := writeCalendar(&buf, name, events, stamp); err != nil {
+		log.Printf("serveCalendar: err writing calendar: %s\n", err)
+		http.Error(w, "error writing calendar.", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/calendar; charset=utf-8")
+	w.Header().Set("Cache-Control", "private, no-cache")
+	hash := sha256.Sum256(buf.Bytes())
+	w.Header().Set("ETag", fmt.Sprintf(`"%x"`, hash[:16]))
+
+	// Handles the If-None-Match and If-Modified-Since request headers, and HEAD requests
+	http.ServeContent(w, r, "", modified, bytes.NewReader(buf.Bytes()))
+}
+
+// Escapes a TEXT property value.
+func icsEscape(text string) string {
+	return strings.NewReplacer(`\`, `\\`, ";", `\;`, ",", `\,`, "\r\n", `\n`, "\n", `\n`, "\r", `\n`).Replace(text)
+}
+
+// Folds a content line into lines of at most icsMaxLineLen octets, without splitting a UTF-8 character,
+// and terminates it with CRLF. Continuation lines start with a single space.
+func icsFold(line string) string {
+	var sb strings.Builder
+	lineLen := 0
+
+	for _, r := range line {
+		runeLen := utf8.RuneLen(r)
+		if lineLen+runeLen > icsMaxLineLen {
+			sb.WriteString("\r\n ")
+			lineLen = 1
+		}
+		sb.WriteRune(r)
+		lineLen += runeLen
+	}
+	sb.WriteString("\r\n")
+
+	return sb.String()
+}
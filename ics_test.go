@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Parses an iCalendar file, undoing the line folding and text escaping. Returns the calendar properties,
+// and the properties of each VEVENT. Fails the test on lines that are too long or not CRLF terminated.
+func parseCalendar(t *testing.T, ics string) (map[string]string, []map[string]string) {
+	if strings.HasSuffix(ics, "\r\n") == false {
+		t.Fatal("calendar does not end with CRLF")
+	}
+
+	// Unfold the lines
+	var lines []string
+	for _, line := range strings.Split(strings.TrimSuffix(ics, "\r\n"), "\r\n") {
+		if len(line) > icsMaxLineLen {
+			t.Errorf("line is %d octets long: %q", len(line), line)
+		}
+		if strings.Contains(line, "\n") {
+			t.Errorf("line contains a bare LF: %q", line)
+		}
+		if strings.HasPrefix(line, " ") && len(lines) > 0 {
+			lines[len(lines)-1] += line[1:]
+		} else {
+			lines = append(lines, line)
+		}
+	}
+
+	unescaper := strings.NewReplacer(`\\`, `\`, `\;`, ";", `\,`, ",", `\n`, "\n", `\N`, "\n")
+	calendar := make(map[string]string)
+	var events []map[string]string
+	var current map[string]string
+
+	for _, line := range lines {
+		name, value, found := strings.Cut(line, ":")
+		if found == false {
+			t.Fatalf("invalid content line: %q", line)
+		}
+		name, _, _ = strings.Cut(name, ";") // Drop any parameters
+		value = unescaper.Replace(value)
+
+		switch {
+		case name == "BEGIN" && value == "VEVENT":
+			current = make(map[string]string)
+		case name == "END" && value == "VEVENT":
+			events = append(events, current)
+			current = nil
+		case current != nil:
+			current[name] = value
+		default:
+			calendar[name] = value
+		}
+	}
+
+	if calendar["BEGIN"] != "VCALENDAR" || calendar["END"] != "VCALENDAR" || calendar["VERSION"] != "2.0" || calendar["PRODID"] == "" {
+		t.Errorf("invalid calendar properties: %v", calendar)
+	}
+	return calendar, events
+}
+
+func TestWriteCalendar(t *testing.T) {
+	var meetUp = MeetUp{
+		UserHash:    "6cf51863dcbd352c9da7fc0670a34a7173056413214ac0e22f0effd1015a7fa907399f9107fd48689d3800043ff12bbd33a24a433a6ede783bda3423c9820278",
+		Dates:       []int64{1550401200000, 1550487600000},
+		Durations:   []int64{0, 5400000},
+		Description: "Team lunch; bring snacks, drinks \\ cake\nA long second line to make sure the description gets folded: ünïcödé ünïcödé ünïcödé ünïcödé ünïcödé ünïcödé",
+	}
+	stamp := time.Date(2019, 2, 1, 10, 0, 0, 0, time.UTC)
+
+	var buf bytes.Buffer
+	if err := writeCalendar(&buf, meetUp.calendarSummary(), meetUp.calendarEvents(), stamp); err != nil {
+		t.Fatalf("writeCalendar() failed: %s", err)
+	}
+
+	calendar, events := parseCalendar(t, buf.String())
+	if calendar["X-WR-CALNAME"] != "Team lunch; bring snacks, drinks \\ cake" {
+		t.Errorf("calendar name = %q", calendar["X-WR-CALNAME"])
+	}
+	if len(events) != 2 {
+		t.Fatalf("calendar has %d events, want: 2", len(events))
+	}
+
+	var expected = []struct {
+		start, end string
+	}{
+		{"20190217T110000Z", "20190218T110000Z"},
+		{"20190218T110000Z", "20190218T123000Z"},
+	}
+	for i, event := range events {
+		if event["DTSTART"] != expected[i].start || event["DTEND"] != expected[i].end {
+			t.Errorf("event %d runs from %s to %s, want: %s to %s", i, event["DTSTART"], event["DTEND"], expected[i].start, expected[i].end)
+		}
+		if event["DESCRIPTION"] != meetUp.Description {
+			t.Errorf("event %d description = %q, want: %q", i, event["DESCRIPTION"], meetUp.Description)
+		}
+		if event["STATUS"] != "TENTATIVE" || event["DTSTAMP"] != "20190201T100000Z" || strings.HasSuffix(event["UID"], "@catherder") == false {
+			t.Errorf("event %d has invalid properties: %v", i, event)
+		}
+		if strings.Contains(event["UID"], meetUp.UserHash[:16]) {
+			t.Errorf("event %d UID contains the user hash", i)
+		}
+	}
+	if events[0]["UID"] == events[1]["UID"] {
+		t.Error("events have the same UID")
+	}
+
+	// A finalised meetup only has the final date, confirmed
+	meetUp.FinalDate = 1550487600000
+	buf.Reset()
+	if err := writeCalendar(&buf, meetUp.calendarSummary(), meetUp.calendarEvents(), stamp); err != nil {
+		t.Fatalf("writeCalendar() failed: %s", err)
+	}
+	_, finalEvents := parseCalendar(t, buf.String())
+	if len(finalEvents) != 1 || finalEvents[0]["STATUS"] != "CONFIRMED" || finalEvents[0]["UID"] != events[1]["UID"] {
+		t.Errorf("finalised calendar events = %v", finalEvents)
+	}
+}
+
+func TestIcsFold(t *testing.T) {
+	var input = []string{
+		"",
+		"SUMMARY:short",
+		"DESCRIPTION:" + strings.Repeat("a", 200),
+		"DESCRIPTION:" + strings.Repeat("€", 100), // 3 octet characters must not be split
+	}
+
+	for _, line := range input {
+		folded := icsFold(line)
+		for _, physical := range strings.Split(strings.TrimSuffix(folded, "\r\n"), "\r\n") {
+			if len(physical) > icsMaxLineLen {
+				t.Errorf("icsFold(%q) has a %d octet line", line, len(physical))
+			}
+		}
+		if unfolded := strings.ReplaceAll(strings.TrimSuffix(folded, "\r\n"), "\r\n ", ""); unfolded != line {
+			t.Errorf("icsFold(%q) unfolds to %q", line, unfolded)
+		}
+	}
+}
+
+func TestMeetUp_UserCalendarEvents(t *testing.T) {
+	var meetUp = MeetUp{
+		UserHash:    "6cf51863dcbd352c9da7fc0670a34a7173056413214ac0e22f0effd1015a7fa907399f9107fd48689d3800043ff12bbd33a24a433a6ede783bda3423c9820278",
+		Dates:       []int64{1550401200000, 1550487600000, 1550574000000},
+		Description: "lunch",
+	}
+	var user = User{Name: "bob", Dates: []int64{1550401200000}, IfNeedBe: []int64{1550574000000}}
+
+	events := meetUp.userCalendarEvents(user)
+	if len(events) != 2 || events[0].Slot.Start != 1550401200000 || events[1].Slot.Start != 1550574000000 || events[1].Summary != "lunch (if need be)" {
+		t.Errorf("userCalendarEvents() = %+v", events)
+	}
+
+	// Finalised on a date the user can't make
+	meetUp.FinalDate = 1550487600000
+	if events = meetUp.userCalendarEvents(user); len(events) != 0 {
+		t.Errorf("userCalendarEvents() for a missed final date = %+v", events)
+	}
+
+	// Finalised on a date the user said yes to
+	meetUp.FinalDate = 1550401200000
+	if events = meetUp.userCalendarEvents(user); len(events) != 1 || events[0].Tentative {
+		t.Errorf("userCalendarEvents() for the final date = %+v", events)
+	}
+}
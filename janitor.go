@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+)
+
+// defaultExpireAfter How long after its last date a meetup without its own expiry is deleted.
+const defaultExpireAfter = 30 * 24 * time.Hour
+
+// defaultDeleteGrace How long a deleted meetup or user can be restored.
+const defaultDeleteGrace = 7 * 24 * time.Hour
+
+// janitorInterval How often the janitor looks for expired meetups.
+const janitorInterval = time.Hour
+
+// runJanitor Deletes the expired meetups, and purges what was deleted more than deleteGrace ago, every
+// janitorInterval until ctx is done.
+func (s *server) runJanitor(ctx context.Context) {
+	ticker := time.NewTicker(janitorInterval)
+	defer ticker.Stop()
+
+	for {
+		if meetUps, users, err := s.purgeExpired(); err != nil {
+			log.Printf("janitor: error deleting expired meetups: %s\n", err)
+		} else if meetUps > 0 {
+			log.Printf("janitor: deleted %d expired meetups with %d users\n", meetUps, users)
+		}
+		if meetUps, users, err := s.store.PurgeDeleted(time.Now().Add(-s.deleteGrace).UnixMilli()); err != nil {
+			log.Printf("janitor: error purging deleted meetups: %s\n", err)
+		} else if meetUps > 0 || users > 0 {
+			log.Printf("janitor: purged %d deleted meetups and %d users\n", meetUps, users)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// purgeExpired Deletes the meetups that have expired, with their users, queues their meetup.deleted webhooks and ends
+// their event streams. Like any deleted meetup, they can be restored until deleteGrace has passed. Returns how many
+// meetups and users were deleted.
+func (s *server) purgeExpired() (meetUps, users int, err error) {
+	ids, err := s.store.GetExpiredMeetUpIds(time.Now().UnixMilli(), s.expireAfter.Milliseconds())
+	if err != nil {
+		return 0, 0, err
+	}
+
+	for _, id := range ids {
+		var deleted bool
+		var userCount int
+		err = s.store.WithTx(func(tx Store) error {
+			// Check again in the transaction, in case the meetup changed since
+			meetUp, err := tx.ReadMeetUp(id)
+			if errors.Is(err, ErrNotFound) || (err == nil && meetUp.Expiry(s.expireAfter.Milliseconds()) > time.Now().UnixMilli()) {
+				return nil
+			} else if err != nil {
+				return err
+			}
+
+			meetUpUsers, err := tx.GetUsersByMeetUpId(id)
+			if err != nil {
+				return err
+			}
+			if err = queueWebhooks(tx, id, webhookMeetUpDeleted, nil); err != nil {
+				return err
+			}
+			if err = auditMeetUp(tx, auditMeetUpDeleted, &meetUp, nil, ""); err != nil {
+				return err
+			}
+			if err = tx.DeleteMeetUp(id); err != nil {
+				return err
+			}
+			deleted, userCount = true, len(meetUpUsers)
+			return nil
+		})
+		if err != nil {
+			return meetUps, users, err
+		}
+		if deleted {
+			s.events.close(id)
+			meetUps++
+			users += userCount
+		}
+	}
+
+	if meetUps > 0 {
+		s.webhooks.notify()
+	}
+	return meetUps, users, nil
+}
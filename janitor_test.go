@@ -0,0 +1,122 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestPurgeExpired(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store Store) {
+		srv := newServer(store)
+		srv.expireAfter = 24 * time.Hour
+		now := time.Now()
+		day := 24 * time.Hour
+
+		var tests = []struct {
+			meetUp  MeetUp
+			users   []string
+			expired bool
+		}{
+			{MeetUp{UserHash: "a", AdminHash: "a", Dates: []int64{now.Add(-3 * day).UnixMilli(), now.Add(-2 * day).UnixMilli()}}, []string{"alice", "bob"}, true},
+			{MeetUp{UserHash: "b", AdminHash: "b", Dates: []int64{now.Add(-3 * day).UnixMilli(), now.Add(-time.Hour).UnixMilli()}}, []string{"carol"}, false},
+			{MeetUp{UserHash: "c", AdminHash: "c", Dates: []int64{now.Add(-3 * day).UnixMilli()}, Expires: now.Add(time.Hour).UnixMilli()}, nil, false},
+			{MeetUp{UserHash: "d", AdminHash: "d", Dates: []int64{now.Add(day).UnixMilli()}, Expires: now.Add(-time.Hour).UnixMilli()}, []string{"dave"}, true},
+		}
+		for i := range tests {
+			if err := store.CreateMeetUp(&tests[i].meetUp); err != nil {
+				t.Fatal(err)
+			}
+			for _, name := range tests[i].users {
+				if err := store.CreateUser(&User{IdMeetUp: tests[i].meetUp.Id, Name: name}); err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+		if err := store.CreateWebhook(&Webhook{IdMeetUp: tests[0].meetUp.Id, Url: "http://127.0.0.1/hook", Secret: "s"}); err != nil {
+			t.Fatal(err)
+		}
+
+		meetUps, users, err := srv.purgeExpired()
+		if err != nil || meetUps != 2 || users != 3 {
+			t.Errorf("purgeExpired() = %d, %d, %v, want: 2, 3, nil\n", meetUps, users, err)
+		}
+		for _, test := range tests {
+			_, err := store.ReadMeetUp(test.meetUp.Id)
+			if test.expired && err == nil {
+				t.Errorf("meetup %s wasn't deleted\n", test.meetUp.UserHash)
+			} else if !test.expired && err != nil {
+				t.Errorf("meetup %s: ReadMeetUp() error %v, want it kept\n", test.meetUp.UserHash, err)
+			}
+
+			// Until deleteGrace has passed, an expired meetup can be restored
+			if _, err = store.GetDeletedMeetUpByAdminHash(test.meetUp.AdminHash); test.expired && err != nil {
+				t.Errorf("meetup %s can't be restored: %v\n", test.meetUp.UserHash, err)
+			}
+		}
+
+		// The webhooks of a deleted meetup are told
+		deliveries, err := store.GetDueDeliveries(time.Now().UnixMilli(), 10)
+		if err != nil || len(deliveries) != 1 {
+			t.Fatalf("GetDueDeliveries() = %v, %v, want the meetup.deleted delivery\n", deliveries, err)
+		}
+		var payload webhookPayload
+		if err = json.Unmarshal(deliveries[0].Payload, &payload); err != nil || payload.Event != webhookMeetUpDeleted {
+			t.Errorf("the delivery is %s\n", deliveries[0].Payload)
+		}
+
+		if meetUps, users, err = srv.purgeExpired(); err != nil || meetUps != 0 || users != 0 {
+			t.Errorf("purgeExpired() again = %d, %d, %v, want: 0, 0, nil\n", meetUps, users, err)
+		}
+
+		// A restored meetup gets expireAfter from now, instead of being deleted again
+		if _, err = srv.undeleteMeetUp(tests[0].meetUp.AdminHash, "", ""); err != nil {
+			t.Fatalf("undeleteMeetUp() of the expired meetup failed: %s\n", err)
+		}
+		if meetUps, _, err = srv.purgeExpired(); err != nil || meetUps != 0 {
+			t.Errorf("purgeExpired() after the restore = %d, %v, want: 0, nil\n", meetUps, err)
+		}
+		if meetUp, err := store.ReadMeetUp(tests[0].meetUp.Id); err != nil || meetUp.Expires < now.Add(srv.expireAfter).UnixMilli() {
+			t.Errorf("the restored meetup is %+v, %v, want it kept until a day from now\n", meetUp, err)
+		}
+	})
+}
+
+func TestGetAdminMeetUp_Expiry(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store Store) {
+		srv := newServer(store)
+		meetUp := createApiTestMeetUp(t, store)
+
+		var result struct {
+			Expires    int64 `json:"expires"`
+			ExpiryDate int64 `json:"expirydate"`
+		}
+		getExpiry := func() {
+			t.Helper()
+			response := postApiRequest(t, srv.getAdminMeetUp, "/api/getadminmeetup", map[string]interface{}{"adminhash": meetUp.AdminHash})
+			if err := json.Unmarshal(response.Result, &result); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		// By default the expiry is after the last date
+		getExpiry()
+		if want := meetUp.Dates[2] + defaultExpireAfter.Milliseconds(); result.Expires != 0 || result.ExpiryDate != want {
+			t.Errorf("expires, expirydate = %d, %d, want: 0, %d\n", result.Expires, result.ExpiryDate, want)
+		}
+
+		request := map[string]interface{}{"adminhash": meetUp.AdminHash, "dates": meetUp.Dates, "expires": -1}
+		if response := postApiRequest(t, srv.updateMeetUp, "/api/updatemeetup", request); response.Code != codeInvalidRequest {
+			t.Errorf("a negative expires got %+v\n", response)
+		}
+
+		request["expires"] = int64(1600000000000)
+		if response := postApiRequest(t, srv.updateMeetUp, "/api/updatemeetup", request); response.Error != "" {
+			t.Fatalf("updateMeetUp error: %s\n", response.Error)
+		}
+		getExpiry()
+		if result.Expires != 1600000000000 || result.ExpiryDate != 1600000000000 {
+			t.Errorf("expires, expirydate = %d, %d, want both: 1600000000000\n", result.Expires, result.ExpiryDate)
+		}
+	})
+}
@@ -0,0 +1,376 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"mime"
+	"mime/quotedprintable"
+	"net/mail"
+	"net/smtp"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+)
+
+const maxEmailLen = 254 // The longest email address, as limited by SMTP
+
+// The most emails sent within mailLimitWindow to an address that didn't ask for them, the participants' confirmations
+// and the requests to confirm an organiser's address. Per address, per meetup, per client that caused them, and in all.
+// Meetups are free to create, so only the last two stop one client from mailing many addresses.
+const (
+	mailLimitWindow      = time.Hour
+	maxMailsPerRecipient = 5
+	maxMailsPerMeetUp    = 20
+	maxMailsPerClient    = 10
+	maxMails             = 200
+)
+
+// The activity of a participant in the admin's digest.
+const (
+	activityAdded    = "added their answers"
+	activityChanged  = "changed their answers"
+	activityRemoved  = "was removed"
+	activityRestored = "was restored"
+)
+
+// Mail A plain text email.
+type Mail struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// Mailer Sends emails.
+type Mailer interface {
+	Send(m Mail) error
+}
+
+// smtpMailer The Mailer sending through an SMTP server. Uses STARTTLS when the server offers it.
+type smtpMailer struct {
+	addr string    // host:port of the server
+	from string    // The sender address
+	auth smtp.Auth // nil to send without logging in
+}
+
+// smtpPasswordEnv The environment variable with the SMTP password, when it isn't read from a file.
+const smtpPasswordEnv = "CATHERDER_SMTP_PASSWORD"
+
+// loadSmtpPassword Returns the SMTP password from the file at path without its trailing newline, or from the
+// smtpPasswordEnv environment variable if path is empty. Unlike a flag, neither shows in the process list.
+func loadSmtpPassword(path string) (string, error) {
+	if path == "" {
+		return os.Getenv(smtpPasswordEnv), nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(data), "\r\n"), nil
+}
+
+// newSmtpMailer Returns a Mailer sending from the address through the SMTP server at addr, host:port. Logs in with
+// PLAIN auth when user isn't empty, which needs TLS unless the server is on localhost.
+func newSmtpMailer(addr, from, user, password string) *smtpMailer {
+	mailer := &smtpMailer{addr: addr, from: from}
+	if user != "" {
+		host, _, _ := strings.Cut(addr, ":")
+		mailer.auth = smtp.PlainAuth("", user, password, host)
+	}
+	return mailer
+}
+
+// Send Sends m as a utf-8 text/plain email.
+func (s *smtpMailer) Send(m Mail) error {
+	msg, err := s.message(m)
+	if err != nil {
+		return err
+	}
+	return smtp.SendMail(s.addr, s.auth, s.from, []string{m.To}, msg)
+}
+
+// message Returns m with its headers, as it's sent. The body is quoted-printable, so any line length is fine.
+func (s *smtpMailer) message(m Mail) ([]byte, error) {
+	var buf bytes.Buffer
+	for _, header := range [][2]string{
+		{"From", (&mail.Address{Address: s.from}).String()},
+		{"To", (&mail.Address{Address: m.To}).String()},
+		{"Subject", mime.QEncoding.Encode("utf-8", stripNewlines(m.Subject))},
+		{"Date", time.Now().Format(time.RFC1123Z)},
+		{"MIME-Version", "1.0"},
+		{"Content-Type", "text/plain; charset=utf-8"},
+		{"Content-Transfer-Encoding", "quoted-printable"},
+	} {
+		fmt.Fprintf(&buf, "%s: %s\r\n", header[0], header[1])
+	}
+	buf.WriteString("\r\n")
+
+	body := quotedprintable.NewWriter(&buf)
+	if _, err := body.Write([]byte(m.Body)); err != nil {
+		return nil, err
+	}
+	if err := body.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Replaces the line breaks in a header value with spaces, so user input can't add headers.
+func stripNewlines(s string) string {
+	return strings.NewReplacer("\r\n", " ", "\r", " ", "\n", " ").Replace(s)
+}
+
+// Validates an optional email address, a bare address without a name. Returns an invalidField apiError for field.
+func validateEmail(field, email string) error {
+	if email == "" {
+		return nil
+	}
+	if len(email) > maxEmailLen {
+		return invalidField(field, "The email address is too long.")
+	}
+	if address, err := mail.ParseAddress(email); err != nil || address.Address != email {
+		return invalidField(field, "The email address is invalid.")
+	}
+	return nil
+}
+
+// mailNotifier Emails the organisers a digest of the changes to their meetup's participants, and the participants
+// a confirmation with their edit link. An organiser's address is only sent the digest once they confirmed it. The
+// methods of a nil mailNotifier do nothing, a server without one sends no email. The emails are sent in the
+// background, errors are logged.
+type mailNotifier struct {
+	mailer      Mailer
+	baseUrl     string        // The scheme and host the links in the emails start with, without a trailing slash
+	digestDelay time.Duration // How long a digest collects activity before it's sent
+	confirmKey  []byte        // Keys the codes of the links confirming an organiser's address
+	templates   map[string]*template.Template
+	limiter     mailLimiter
+
+	mu      sync.Mutex
+	digests map[int64]*mailDigest // The digests waiting to be sent, by meetup id
+}
+
+// mailLimiter Counts the emails sent to each address, for each meetup and client, and in all, see maxMailsPerRecipient.
+type mailLimiter struct {
+	mu        sync.Mutex
+	sent      map[string][]time.Time // When the emails within mailLimitWindow were sent, by "to:", "meetup:", "client:" or "all"
+	lastSweep time.Time
+}
+
+// allow Reports whether an email to the address for the meetup, caused by the client with the IP hash, is within the
+// limits, and counts it if it is.
+func (l *mailLimiter) allow(to string, idMeetUp int64, ipHash string) bool {
+	now := time.Now()
+	limits := map[string]int{
+		"to:" + strings.ToLower(to):                 maxMailsPerRecipient,
+		"meetup:" + strconv.FormatInt(idMeetUp, 10): maxMailsPerMeetUp,
+		"client:" + ipHash:                          maxMailsPerClient,
+		"all":                                       maxMails,
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.sent == nil {
+		l.sent = make(map[string][]time.Time)
+	}
+	if now.Sub(l.lastSweep) > mailLimitWindow { // Forget the addresses and meetups without recent emails
+		for key := range l.sent {
+			l.prune(key, now)
+		}
+		l.lastSweep = now
+	}
+
+	for key, limit := range limits {
+		if len(l.prune(key, now)) >= limit {
+			return false
+		}
+	}
+	for key := range limits {
+		l.sent[key] = append(l.sent[key], now)
+	}
+	return true
+}
+
+// prune Drops the times of the key from before mailLimitWindow, and returns those left.
+func (l *mailLimiter) prune(key string, now time.Time) []time.Time {
+	times := l.sent[key]
+	for len(times) > 0 && now.Sub(times[0]) >= mailLimitWindow {
+		times = times[1:]
+	}
+	if len(times) == 0 {
+		delete(l.sent, key)
+		return nil
+	}
+	l.sent[key] = times
+	return times
+}
+
+// mailDigest The participant activity of a meetup that isn't emailed yet.
+type mailDigest struct {
+	meetUp   MeetUp // At the latest activity, for its email and userhash
+	activity []userActivity
+}
+
+// userActivity A line of the admin's digest.
+type userActivity struct {
+	Name   string
+	Action string // activityAdded, activityChanged, activityRemoved or activityRestored
+}
+
+// newMailNotifier Returns a notifier sending with mailer. The emails are the templates/mail/*.gotxt templates, each
+// defining a "subject" and a "body". confirmKey keys the links confirming the organisers' addresses, they stop
+// working when it changes.
+func newMailNotifier(mailer Mailer, baseUrl string, digestDelay time.Duration, confirmKey []byte) (*mailNotifier, error) {
+	n := &mailNotifier{
+		mailer:      mailer,
+		baseUrl:     strings.TrimSuffix(baseUrl, "/"),
+		digestDelay: digestDelay,
+		confirmKey:  confirmKey,
+		templates:   make(map[string]*template.Template),
+		digests:     make(map[int64]*mailDigest),
+	}
+
+	for _, name := range []string{"digest", "confirm", "organiser"} {
+		t, err := template.ParseFS(res, "templates/mail/"+name+".gotxt")
+		if err != nil {
+			return nil, err
+		}
+		n.templates[name] = t
+	}
+	return n, nil
+}
+
+// userActivity Adds the activity to the digest of the meetup, if it has an email. The first activity starts the
+// digest, which is sent digestDelay later with all the activity since. An address that isn't confirmed gets the
+// request to confirm it again instead, counted against the client with the IP hash.
+func (n *mailNotifier) userActivity(m MeetUp, name, action, ipHash string) {
+	if n == nil || m.Email == "" {
+		return
+	} else if m.EmailConfirmed == 0 {
+		n.confirmOrganiser(m, ipHash)
+		return
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	digest, ok := n.digests[m.Id]
+	if !ok {
+		digest = &mailDigest{}
+		n.digests[m.Id] = digest
+		time.AfterFunc(n.digestDelay, func() { n.sendDigest(m.Id) })
+	}
+	digest.meetUp = m
+	digest.activity = append(digest.activity, userActivity{name, action})
+}
+
+// meetUpChanged Updates the pending digest of the meetup to the changed m, so it links to the current userhash after
+// the admin replaced the hashes, and goes to the address the meetup has when it's sent.
+func (n *mailNotifier) meetUpChanged(m MeetUp) {
+	if n == nil {
+		return
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if digest, ok := n.digests[m.Id]; ok {
+		digest.meetUp = m
+	}
+}
+
+// sendDigest Sends the digest of the meetup with the id. It has no edit link, the server only has the digest of the
+// adminhash.
+func (n *mailNotifier) sendDigest(idMeetUp int64) {
+	n.mu.Lock()
+	digest := n.digests[idMeetUp]
+	delete(n.digests, idMeetUp)
+	n.mu.Unlock()
+
+	if digest == nil || digest.meetUp.Email == "" || digest.meetUp.EmailConfirmed == 0 {
+		return
+	}
+	n.send("digest", digest.meetUp.Email, struct {
+		Description string
+		Activity    []userActivity
+		ViewLink    string
+	}{
+		digest.meetUp.Description,
+		digest.activity,
+		n.baseUrl + "/view?id=" + url.QueryEscape(digest.meetUp.UserHash),
+	})
+}
+
+// confirmUser Emails the user a confirmation of their answers, with the link to change them later. Like
+// confirmOrganiser it only has what the server wrote, not the user's name or the description, as the address may not
+// be theirs. The link has the user's token, the page finds their name with it. Nothing is sent if email is empty, or
+// the limits of mailLimiter are reached for the client with the IP hash.
+func (n *mailNotifier) confirmUser(m MeetUp, user User, email, ipHash string) {
+	if n == nil || email == "" || n.overLimit("confirm", email, m.Id, ipHash) {
+		return
+	}
+
+	query := url.Values{"id": {m.UserHash}, "token": {user.Token}}
+	n.send("confirm", email, struct {
+		SiteUrl  string
+		EditLink string
+	}{n.baseUrl, n.baseUrl + "/view?" + query.Encode()})
+}
+
+// confirmOrganiser Emails the organiser's address the link that confirms it. It only has what the server wrote, not
+// the description, as whoever saved the address may not own it. Nothing is sent if the meetup has no email, or the
+// limits of mailLimiter are reached for the client with the IP hash.
+func (n *mailNotifier) confirmOrganiser(m MeetUp, ipHash string) {
+	if n == nil || m.Email == "" || n.overLimit("organiser", m.Email, m.Id, ipHash) {
+		return
+	}
+
+	query := url.Values{"meetup": {strconv.FormatInt(m.Id, 10)}, "code": {n.emailCode(m.Id, m.Email)}}
+	n.send("organiser", m.Email, struct {
+		SiteUrl     string
+		ConfirmLink string
+	}{n.baseUrl, n.baseUrl + "/confirm?" + query.Encode()})
+}
+
+// emailCode Returns the code of the link confirming the address as the email of the meetup with the id, the hex
+// HMAC-SHA256 of both. A link stops working when the address changes.
+func (n *mailNotifier) emailCode(idMeetUp int64, email string) string {
+	mac := hmac.New(sha256.New, n.confirmKey)
+	fmt.Fprintf(mac, "%d:%s", idMeetUp, strings.ToLower(email))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Reports whether the limits of mailLimiter stop the email, and logs it if they do.
+func (n *mailNotifier) overLimit(name, to string, idMeetUp int64, ipHash string) bool {
+	if n.limiter.allow(to, idMeetUp, ipHash) {
+		return false
+	}
+	log.Printf("mailNotifier: not sending the %s email of meetup %d, a limit of mailLimiter is reached\n", name, idMeetUp)
+	return true
+}
+
+// send Executes the template with data and sends the email to the address, in the background.
+func (n *mailNotifier) send(name, to string, data interface{}) {
+	var subject, body bytes.Buffer
+	t := n.templates[name]
+	if err := t.ExecuteTemplate(&subject, "subject", data); err != nil {
+		log.Printf("mailNotifier: error executing the %s subject: %s\n", name, err)
+		return
+	}
+	if err := t.ExecuteTemplate(&body, "body", data); err != nil {
+		log.Printf("mailNotifier: error executing the %s body: %s\n", name, err)
+		return
+	}
+
+	go func() {
+		if err := n.mailer.Send(Mail{To: to, Subject: strings.TrimSpace(subject.String()), Body: body.String()}); err != nil {
+			log.Printf("mailNotifier: error sending the %s email: %s\n", name, err)
+		}
+	}()
+}
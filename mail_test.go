@@ -0,0 +1,525 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"mime/quotedprintable"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/mail"
+	"net/textproto"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeSmtpServer A local SMTP server that accepts every email, for the mailer tests.
+type fakeSmtpServer struct {
+	addr     string
+	messages chan fakeEmail
+}
+
+// fakeEmail An email received by a fakeSmtpServer, decoded.
+type fakeEmail struct {
+	from    string
+	to      []string
+	header  mail.Header
+	subject string
+	body    string
+}
+
+// Starts a fakeSmtpServer on a free localhost port, closed when the test ends.
+func newFakeSmtpServer(t *testing.T) *fakeSmtpServer {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = ln.Close() })
+
+	s := &fakeSmtpServer{addr: ln.Addr().String(), messages: make(chan fakeEmail, 16)}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	return s
+}
+
+// Speaks enough SMTP for net/smtp.SendMail on one connection.
+func (s *fakeSmtpServer) serve(conn net.Conn) {
+	text := textproto.NewConn(conn)
+	defer text.Close()
+
+	var email fakeEmail
+	_ = text.PrintfLine("220 localhost fake SMTP")
+	for {
+		line, err := text.ReadLine()
+		if err != nil {
+			return
+		}
+
+		verb, arg, _ := strings.Cut(line, " ")
+		switch strings.ToUpper(verb) {
+		case "EHLO", "HELO", "RSET", "NOOP":
+			_ = text.PrintfLine("250 OK")
+		case "MAIL":
+			email = fakeEmail{from: strings.Trim(strings.TrimPrefix(arg, "FROM:"), "<>")}
+			_ = text.PrintfLine("250 OK")
+		case "RCPT":
+			email.to = append(email.to, strings.Trim(strings.TrimPrefix(arg, "TO:"), "<>"))
+			_ = text.PrintfLine("250 OK")
+		case "DATA":
+			_ = text.PrintfLine("354 Go ahead")
+			data, err := text.ReadDotBytes()
+			if err != nil {
+				return
+			}
+			if err = email.decode(data); err != nil {
+				_ = text.PrintfLine("554 %s", err)
+				continue
+			}
+			s.messages <- email
+			_ = text.PrintfLine("250 OK")
+		case "QUIT":
+			_ = text.PrintfLine("221 Bye")
+			return
+		default:
+			_ = text.PrintfLine("502 Not implemented")
+		}
+	}
+}
+
+// Decodes the headers, subject and quoted-printable body of the email data.
+func (e *fakeEmail) decode(data []byte) error {
+	msg, err := mail.ReadMessage(strings.NewReader(string(data)))
+	if err != nil {
+		return err
+	}
+	e.header = msg.Header
+
+	if e.subject, err = new(mime.WordDecoder).DecodeHeader(msg.Header.Get("Subject")); err != nil {
+		return err
+	}
+	body, err := io.ReadAll(quotedprintable.NewReader(msg.Body))
+	e.body = string(body)
+	return err
+}
+
+// Waits for the next email the server receives.
+func (s *fakeSmtpServer) wait(t *testing.T) fakeEmail {
+	t.Helper()
+	select {
+	case email := <-s.messages:
+		return email
+	case <-time.After(5 * time.Second):
+		t.Fatal("no email was received")
+		return fakeEmail{}
+	}
+}
+
+// Fails if the server receives an email in the next moment.
+func (s *fakeSmtpServer) expectNone(t *testing.T) {
+	t.Helper()
+	select {
+	case email := <-s.messages:
+		t.Errorf("unexpected email to %v: %q\n", email.to, email.subject)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+// Returns a notifier sending to a new fakeSmtpServer.
+func newTestMailNotifier(t *testing.T, digestDelay time.Duration) (*mailNotifier, *fakeSmtpServer) {
+	smtpServer := newFakeSmtpServer(t)
+	notifier, err := newMailNotifier(newSmtpMailer(smtpServer.addr, "catherder@example.com", "", ""), "https://example.com/", digestDelay, []byte("confirm key"))
+	if err != nil {
+		t.Fatalf("newMailNotifier() failed: %s\n", err)
+	}
+	return notifier, smtpServer
+}
+
+func TestValidateEmail(t *testing.T) {
+	for _, test := range []struct {
+		email string
+		valid bool
+	}{
+		{"", true},
+		{"alice@example.com", true},
+		{"alice.o'brien+meetups@mail.example.com", true},
+		{"alice", false},
+		{"Alice <alice@example.com>", false},
+		{"alice@example.com\r\nBcc: eve@example.com", false},
+		{strings.Repeat("a", 250) + "@example.com", false},
+	} {
+		if err := validateEmail("email", test.email); (err == nil) != test.valid {
+			t.Errorf("validateEmail(%q) = %v, want valid: %t\n", test.email, err, test.valid)
+		}
+	}
+}
+
+func TestLoadSmtpPassword(t *testing.T) {
+	t.Setenv(smtpPasswordEnv, "from the environment")
+	if password, err := loadSmtpPassword(""); err != nil || password != "from the environment" {
+		t.Errorf("loadSmtpPassword() without a file = %q, %v\n", password, err)
+	}
+
+	path := filepath.Join(t.TempDir(), "smtp-password")
+	if err := os.WriteFile(path, []byte(" secret \n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if password, err := loadSmtpPassword(path); err != nil || password != " secret " {
+		t.Errorf("loadSmtpPassword() of the file = %q, %v, want: \" secret \"\n", password, err)
+	}
+	if _, err := loadSmtpPassword(path + ".missing"); err == nil {
+		t.Errorf("loadSmtpPassword() of a missing file succeeded\n")
+	}
+}
+
+func TestSmtpMailer_Send(t *testing.T) {
+	smtpServer := newFakeSmtpServer(t)
+	mailer := newSmtpMailer(smtpServer.addr, "catherder@example.com", "", "")
+
+	err := mailer.Send(Mail{
+		To:      "alice@example.com",
+		Subject: "Café\r\nBcc: eve@example.com",
+		Body:    "Hello,\n" + strings.Repeat("long line ", 20) + "\n",
+	})
+	if err != nil {
+		t.Fatalf("Send() failed: %s\n", err)
+	}
+
+	email := smtpServer.wait(t)
+	if email.from != "catherder@example.com" || len(email.to) != 1 || email.to[0] != "alice@example.com" {
+		t.Errorf("sent from %q to %v\n", email.from, email.to)
+	}
+	if email.subject != "Café Bcc: eve@example.com" || email.header.Get("Bcc") != "" {
+		t.Errorf("the subject %q added a header\n", email.subject)
+	}
+	if contentType := email.header.Get("Content-Type"); contentType != "text/plain; charset=utf-8" {
+		t.Errorf("Content-Type = %q\n", contentType)
+	}
+	if want := "Hello,\n" + strings.Repeat("long line ", 20) + "\n"; email.body != want {
+		t.Errorf("body = %q, want: %q\n", email.body, want)
+	}
+}
+
+func TestMailNotifier_Digest(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store Store) {
+		srv := newServer(store)
+		var smtpServer *fakeSmtpServer
+		srv.mail, smtpServer = newTestMailNotifier(t, time.Hour)
+
+		meetUp := createApiTestMeetUp(t, store)
+		meetUp.Email, meetUp.EmailConfirmed = "admin@example.com", 1550401200000
+		if err := store.UpdateMeetUp(&meetUp); err != nil {
+			t.Fatal(err)
+		}
+
+		var tokens = make(map[string]string)
+		for _, name := range []string{"alice", "bob", "alice"} {
+			response := postApiRequest(t, srv.updateUser, "/api/updateuser", map[string]interface{}{"userhash": meetUp.UserHash, "username": name, "token": tokens[name]})
+			if response.Error != "" {
+				t.Fatalf("updateUser error: %s\n", response.Error)
+			}
+			var result struct{ Token string }
+			_ = json.Unmarshal(response.Result, &result)
+			tokens[name] = result.Token
+		}
+		if response := postApiRequest(t, srv.deleteUser, "/api/deleteuser", map[string]interface{}{"userhash": meetUp.UserHash, "username": "bob", "token": tokens["bob"]}); response.Error != "" {
+			t.Fatalf("deleteUser error: %s\n", response.Error)
+		}
+
+		// The activity is collected until the digest is due. Replacing the userhash meanwhile changes its link.
+		smtpServer.expectNone(t)
+		oldUserHash := meetUp.UserHash
+		response := postApiRequest(t, srv.rotateHashes, "/api/rotatehashes", map[string]interface{}{"adminhash": meetUp.AdminHash, "newuserhash": true})
+		if response.Error != "" {
+			t.Fatalf("rotateHashes error: %s\n", response.Error)
+		}
+		_ = json.Unmarshal(response.Result, &meetUp)
+		srv.mail.sendDigest(meetUp.Id)
+
+		email := smtpServer.wait(t)
+		if len(email.to) != 1 || email.to[0] != "admin@example.com" {
+			t.Errorf("the digest was sent to %v\n", email.to)
+		}
+		for _, want := range []string{
+			"alice added their answers\n  - bob added their answers\n  - alice changed their answers\n  - bob was removed\n",
+			"https://example.com/view?id=" + meetUp.UserHash,
+		} {
+			if strings.Contains(email.body, want) == false {
+				t.Errorf("the digest doesn't contain %q:\n%s\n", want, email.body)
+			}
+		}
+		if strings.Contains(email.body, oldUserHash) {
+			t.Errorf("the digest links to the replaced userhash:\n%s\n", email.body)
+		}
+		// The server only has the digest of the adminhash
+		if strings.Contains(email.body, meetUp.AdminHash) {
+			t.Errorf("the digest contains the adminhash:\n%s\n", email.body)
+		}
+
+		// The next activity starts a new digest, sent after the delay
+		srv.mail.digestDelay = 10 * time.Millisecond
+		if response := postApiRequest(t, srv.updateUser, "/api/updateuser", map[string]interface{}{"userhash": meetUp.UserHash, "username": "carol"}); response.Error != "" {
+			t.Fatalf("updateUser error: %s\n", response.Error)
+		}
+		if email = smtpServer.wait(t); strings.Contains(email.body, "carol added their answers") == false || strings.Contains(email.body, "alice") {
+			t.Errorf("the second digest is:\n%s\n", email.body)
+		}
+
+		// A meetup without an email gets no digest
+		meetUp.Email = ""
+		if err := store.UpdateMeetUp(&meetUp); err != nil {
+			t.Fatal(err)
+		}
+		if response := postApiRequest(t, srv.updateUser, "/api/updateuser", map[string]interface{}{"userhash": meetUp.UserHash, "username": "dave"}); response.Error != "" {
+			t.Fatalf("updateUser error: %s\n", response.Error)
+		}
+		smtpServer.expectNone(t)
+	})
+}
+
+func TestMailNotifier_Confirm(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store Store) {
+		srv := newServer(store)
+		var smtpServer *fakeSmtpServer
+		srv.mail, smtpServer = newTestMailNotifier(t, time.Hour)
+		meetUp := createApiTestMeetUp(t, store)
+
+		response := postApiRequest(t, srv.updateUser, "/api/updateuser", map[string]interface{}{"userhash": meetUp.UserHash, "username": "alice", "email": "nope"})
+		if response.Code != codeInvalidRequest || len(response.Details) != 1 || response.Details[0].Field != "email" {
+			t.Errorf("an invalid email got %+v\n", response)
+		}
+
+		response = postApiRequest(t, srv.updateUser, "/api/updateuser", map[string]interface{}{"userhash": meetUp.UserHash, "username": "alice o'brien", "email": "alice@example.com"})
+		if response.Error != "" {
+			t.Fatalf("updateUser error: %s\n", response.Error)
+		}
+		var result struct{ Token string }
+		_ = json.Unmarshal(response.Result, &result)
+
+		email := smtpServer.wait(t)
+		if len(email.to) != 1 || email.to[0] != "alice@example.com" {
+			t.Errorf("the confirmation was sent to %v\n", email.to)
+		}
+		query := url.Values{"id": {meetUp.UserHash}, "token": {result.Token}}
+		if want := "https://example.com/view?" + query.Encode(); strings.Contains(email.body, want) == false {
+			t.Errorf("the confirmation doesn't contain the edit link %q:\n%s\n", want, email.body)
+		}
+		// Whoever gave the address may not own it, none of their text is in the email
+		if strings.Contains(email.body, "brien") || strings.Contains(email.body, meetUp.Description) {
+			t.Errorf("the confirmation has the name or the description:\n%s\n", email.body)
+		}
+
+		// The page of the link finds the user's name with the token
+		var users struct{ UserName string }
+		for token, want := range map[string]string{result.Token: "alice o'brien", "": "", "abc": ""} {
+			response = postApiRequest(t, srv.getUserMeetUp, "/api/getusermeetup", map[string]interface{}{"userhash": meetUp.UserHash, "token": token})
+			if _ = json.Unmarshal(response.Result, &users); response.Error != "" || users.UserName != want {
+				t.Errorf("getUserMeetUp() with the token %q has the username %q, %q, want: %q\n", token, users.UserName, response.Error, want)
+			}
+		}
+	})
+}
+
+func TestMailNotifier_ConfirmOrganiser(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store Store) {
+		srv := newServer(store)
+		var smtpServer *fakeSmtpServer
+		srv.mail, smtpServer = newTestMailNotifier(t, time.Hour)
+		handler, err := srv.routes()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// Saving the address sends the link, without what the caller wrote
+		response := postApiRequest(t, srv.updateMeetUp, "/api/updatemeetup", map[string]interface{}{"description": "Buy cheap pills", "email": "admin@example.com", "dates": []int64{1550401200000}})
+		if response.Error != "" {
+			t.Fatalf("updateMeetUp error: %s\n", response.Error)
+		}
+		var hashes struct{ UserHash, AdminHash string }
+		_ = json.Unmarshal(response.Result, &hashes)
+		email := smtpServer.wait(t)
+		if len(email.to) != 1 || email.to[0] != "admin@example.com" || strings.Contains(email.body, "pills") {
+			t.Errorf("the confirmation request to %v is:\n%s\n", email.to, email.body)
+		}
+		_, rawLink, _ := strings.Cut(email.body, "https://example.com/confirm?")
+		link, err := url.ParseQuery(strings.TrimSpace(strings.SplitN(rawLink, "\n", 2)[0]))
+		if err != nil || link.Get("code") == "" {
+			t.Fatalf("the confirmation request has no link:\n%s\n", email.body)
+		}
+
+		// Unconfirmed, the answers send the request again instead of a digest
+		postApiRequest(t, srv.updateUser, "/api/updateuser", map[string]interface{}{"userhash": hashes.UserHash, "username": "alice"})
+		if email = smtpServer.wait(t); strings.Contains(email.body, "/confirm?") == false {
+			t.Errorf("the email to an unconfirmed address is:\n%s\n", email.body)
+		}
+
+		// Returns the confirmed time of the meetup after a request to the page, and the page
+		confirm := func(method string, form url.Values) (int64, string) {
+			t.Helper()
+			var request *http.Request
+			if method == http.MethodGet {
+				request = httptest.NewRequest(method, "/confirm?"+form.Encode(), nil)
+			} else {
+				request = httptest.NewRequest(method, "/confirm", strings.NewReader(form.Encode()))
+				request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			}
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, request)
+			if w.Code != http.StatusOK {
+				t.Fatalf("%s /confirm status = %d\n", method, w.Code)
+			}
+			meetUp, err := store.GetMeetUpByUserHash(hashes.UserHash)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return meetUp.EmailConfirmed, w.Body.String()
+		}
+
+		if confirmed, page := confirm(http.MethodGet, link); confirmed != 0 || strings.Contains(page, `<form method="post"`) == false {
+			t.Errorf("opening the link confirmed %d, the page is:\n%s\n", confirmed, page)
+		}
+		if confirmed, _ := confirm(http.MethodPost, url.Values{"meetup": {link.Get("meetup")}, "code": {strings.Repeat("0", 64)}}); confirmed != 0 {
+			t.Errorf("a wrong code confirmed the address\n")
+		}
+		before, err := store.GetMeetUpByUserHash(hashes.UserHash)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if confirmed, page := confirm(http.MethodPost, link); confirmed == 0 || strings.Contains(page, "is confirmed") == false {
+			t.Errorf("the link didn't confirm the address, the page is:\n%s\n", page)
+		}
+		if after, err := store.GetMeetUpByUserHash(hashes.UserHash); err != nil || after.Revision != before.Revision || after.Modified != before.Modified {
+			t.Errorf("confirming changed the revision %d to %d, modified %d to %d\n", before.Revision, after.Revision, before.Modified, after.Modified)
+		}
+
+		// Confirmed, the answers go in the digest. A new address has to be confirmed again.
+		postApiRequest(t, srv.updateUser, "/api/updateuser", map[string]interface{}{"userhash": hashes.UserHash, "username": "bob"})
+		smtpServer.expectNone(t)
+		response = postApiRequest(t, srv.updateMeetUp, "/api/updatemeetup", map[string]interface{}{"adminhash": hashes.AdminHash, "email": "other@example.com", "dates": []int64{1550401200000}})
+		if response.Error != "" {
+			t.Fatalf("updateMeetUp error: %s\n", response.Error)
+		}
+		if email = smtpServer.wait(t); len(email.to) != 1 || email.to[0] != "other@example.com" {
+			t.Errorf("the new address got no confirmation request, but %v did\n", email.to)
+		}
+		if confirmed, _ := confirm(http.MethodPost, link); confirmed != 0 {
+			t.Errorf("the link of the old address confirmed the new one\n")
+		}
+	})
+}
+
+func TestMailLimiter(t *testing.T) {
+	var limiter mailLimiter
+	for i := 0; i < maxMailsPerRecipient; i++ {
+		if limiter.allow("alice@example.com", 1, fmt.Sprint("client", i)) == false {
+			t.Fatalf("email %d to the address wasn't allowed\n", i+1)
+		}
+	}
+	if limiter.allow("Alice@Example.com", 2, "other") {
+		t.Errorf("an email over the limit of the address was allowed\n")
+	}
+
+	for i := maxMailsPerRecipient; i < maxMailsPerMeetUp; i++ {
+		if limiter.allow(fmt.Sprintf("user%d@example.com", i), 1, fmt.Sprint("client", i)) == false {
+			t.Fatalf("email %d of the meetup wasn't allowed\n", i+1)
+		}
+	}
+	if limiter.allow("bob@example.com", 1, "other") {
+		t.Errorf("an email over the limit of the meetup was allowed\n")
+	} else if limiter.allow("bob@example.com", 3, "other") == false {
+		t.Errorf("the limit of one meetup stopped the email of another\n")
+	}
+
+	// A client creating a meetup for each email is stopped too
+	for i := 1; i < maxMailsPerClient; i++ {
+		if limiter.allow(fmt.Sprintf("spam%d@example.com", i), int64(100+i), "other") == false {
+			t.Fatalf("email %d of the client wasn't allowed\n", i+1)
+		}
+	}
+	if limiter.allow("carol@example.com", 200, "other") {
+		t.Errorf("an email over the limit of the client was allowed\n")
+	}
+
+	// And so are many clients
+	sent := len(limiter.sent["all"])
+	for i := sent; i < maxMails; i++ {
+		if limiter.allow(fmt.Sprintf("many%d@example.com", i), int64(1000+i), fmt.Sprint("many", i)) == false {
+			t.Fatalf("email %d of all wasn't allowed\n", i+1)
+		}
+	}
+	if limiter.allow("dave@example.com", 5000, "new") {
+		t.Errorf("an email over the limit of all was allowed\n")
+	}
+
+	// The old emails don't count
+	for key, times := range limiter.sent {
+		for i := range times {
+			times[i] = times[i].Add(-mailLimitWindow)
+		}
+		limiter.sent[key] = times
+	}
+	if limiter.allow("alice@example.com", 1, "other") == false {
+		t.Errorf("an email after the window wasn't allowed\n")
+	}
+}
+
+func TestUpdateMeetUp_Email(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store Store) {
+		srv := newServer(store)
+		meetUp := createApiTestMeetUp(t, store)
+
+		request := map[string]interface{}{"adminhash": meetUp.AdminHash, "dates": meetUp.Dates, "email": "Admin <admin@example.com>"}
+		if response := postApiRequest(t, srv.updateMeetUp, "/api/updatemeetup", request); response.Code != codeInvalidRequest {
+			t.Errorf("an invalid email got %+v\n", response)
+		}
+
+		request["email"] = "admin@example.com"
+		if response := postApiRequest(t, srv.updateMeetUp, "/api/updatemeetup", request); response.Error != "" {
+			t.Fatalf("updateMeetUp error: %s\n", response.Error)
+		}
+
+		// Only the admin can read it
+		var result struct{ Email *string }
+		response := postApiRequest(t, srv.getAdminMeetUp, "/api/getadminmeetup", map[string]interface{}{"adminhash": meetUp.AdminHash})
+		if _ = json.Unmarshal(response.Result, &result); result.Email == nil || *result.Email != "admin@example.com" {
+			t.Errorf("getAdminMeetUp() email = %v, want: admin@example.com\n", result.Email)
+		}
+		result.Email = nil
+		response = postApiRequest(t, srv.getUserMeetUp, "/api/getusermeetup", map[string]interface{}{"userhash": meetUp.UserHash})
+		if _ = json.Unmarshal(response.Result, &result); result.Email != nil {
+			t.Errorf("getUserMeetUp() has the email %q\n", *result.Email)
+		}
+
+		// An update that leaves out the email and the expiry keeps them, an empty email removes it
+		request["expires"] = int64(1600000000000)
+		if response := postApiRequest(t, srv.updateMeetUp, "/api/updatemeetup", request); response.Error != "" {
+			t.Fatalf("updateMeetUp error: %s\n", response.Error)
+		}
+		request = map[string]interface{}{"adminhash": meetUp.AdminHash, "dates": meetUp.Dates, "description": "changed"}
+		if response := postApiRequest(t, srv.updateMeetUp, "/api/updatemeetup", request); response.Error != "" {
+			t.Fatalf("updateMeetUp error: %s\n", response.Error)
+		}
+		if m, err := store.GetMeetUpByAdminHash(meetUp.AdminHash); err != nil || m.Description != "changed" || m.Email != "admin@example.com" || m.Expires != 1600000000000 {
+			t.Errorf("after an update without them email, expires = %q, %d, want: admin@example.com, 1600000000000\n", m.Email, m.Expires)
+		}
+		request["email"] = ""
+		if response := postApiRequest(t, srv.updateMeetUp, "/api/updatemeetup", request); response.Error != "" {
+			t.Fatalf("updateMeetUp error: %s\n", response.Error)
+		}
+		if m, err := store.GetMeetUpByAdminHash(meetUp.AdminHash); err != nil || m.Email != "" || m.Expires != 1600000000000 {
+			t.Errorf("after an update with an empty email, email, expires = %q, %d, want: \"\", 1600000000000\n", m.Email, m.Expires)
+		}
+	})
+}
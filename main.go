@@ -1,19 +1,16 @@
 package main
 
 import (
-	"database/sql"
+	"context"
 	"embed"
 	"flag"
 	_ "github.com/mattn/go-sqlite3"
 	"html/template"
-	"io/fs"
 	"log"
 	"net/http"
-	"os"
+	"time"
 )
 
-var db *sql.DB
-
 const maxLongJsonBytesLen = 4096 // Limit create/update JSON requests to this many bytes
 const maxShortJsonBytesLen = 512 // Limit the other JSON requests to this many bytes
 
@@ -21,12 +18,16 @@ var (
 	//go:embed all:served
 	served embed.FS
 
+	//go:embed openapi.json
+	openApiSpec []byte // Describes the /api/ routes, served at /api/openapi.json
+
 	//go:embed templates
 	res   embed.FS
 	pages = map[string]string{
-		"/index": "templates/index.gohtml",
-		"/edit":  "templates/edit.gohtml",
-		"/view":  "templates/view.gohtml",
+		"/index":   "templates/index.gohtml",
+		"/edit":    "templates/edit.gohtml",
+		"/view":    "templates/view.gohtml",
+		"/confirm": "templates/confirm.gohtml",
 	}
 )
 
@@ -34,68 +35,71 @@ func main() {
 	port := flag.String("port", "443", "-port=<port> The port to listen for https requests on.")
 	certPath := flag.String("cert", "./cert.pem", "-cert=<path> The path of the ssl certificate.")
 	keyPath := flag.String("key", "./key.pem", "-key=<path> The path of the ssl key.")
+	dsn := flag.String("db", "file:data.sqlite", "-db=<dsn> The database. A postgres:// url for PostgreSQL, otherwise a sqlite file.")
+	smtpAddr := flag.String("smtp", "", "-smtp=<host:port> The SMTP server for email notifications. No email is sent if empty.")
+	smtpUser := flag.String("smtp-user", "", "-smtp-user=<user> The SMTP login, if the server needs one.")
+	smtpPasswordPath := flag.String("smtp-password-file", "", "-smtp-password-file=<path> The file with the SMTP password. The "+smtpPasswordEnv+" environment variable if empty.")
+	mailFrom := flag.String("mail-from", "", "-mail-from=<address> The sender address of the emails.")
+	baseUrl := flag.String("url", "", "-url=<url> The url the site is reached at, like https://example.com, for the links in the emails.")
+	digestDelay := flag.Duration("digest-delay", 15*time.Minute, "-digest-delay=<duration> How long the organiser's email digest collects changes before it's sent.")
+	expireDays := flag.Int("expire-days", int(defaultExpireAfter/(24*time.Hour)), "-expire-days=<days> How many days after its last date a meetup is deleted, unless its admin chose when.")
+	deleteGrace := flag.Duration("delete-grace", defaultDeleteGrace, "-delete-grace=<duration> How long a deleted meetup or participant can be restored, before it's deleted for good.")
+	tokenKeyPath := flag.String("token-key", "", "-token-key=<path> Required. The file of the key the meetup hashes are stored with, created if it doesn't exist. Keep it outside the data directory and its backups, like /etc/catherder/token.key, and back it up apart from them: the meetups can't be opened without it.")
 	flag.Parse()
 
-	var err error
-
-	// Check the database file is present, open it
-	if _, err = os.Stat("./data.sqlite"); err == nil {
-		if db, err = sql.Open("sqlite3", "file:data.sqlite?_foreign_keys=true"); err != nil {
-			log.Fatal(err)
-		}
-	} else if os.IsNotExist(err) {
-		//log.Fatal(err)
-		if db, err = sql.Open("sqlite3", "file:data.sqlite?_foreign_keys=true"); err != nil {
-			log.Fatal(err)
-		} else {
-			if _, err = db.Exec(`
-			PRAGMA foreign_keys = ON;
-
-			CREATE TABLE IF NOT EXISTS meetup
-			(
-				idmeetup    INTEGER PRIMARY KEY ASC,
-				userhash    TEXT    NOT NULL,
-				adminhash   TEXT    NOT NULL,
-				dates       BLOB    NOT NULL,
-				description TEXT    NOT NULL
-			);
-			
-			CREATE TABLE IF NOT EXISTS "user"
-			(
-				iduser   INTEGER PRIMARY KEY ASC NOT NULL,
-				idmeetup INTEGER                 NOT NULL,
-				name     TEXT                    NOT NULL,
-				dates    BLOB                    NOT NULL,
-				FOREIGN KEY (idmeetup) REFERENCES meetup (idmeetup) ON DELETE CASCADE
-			);
-			
-			CREATE INDEX IF NOT EXISTS "user.fk_user_meetup_idx" ON "user" ("idmeetup");
-			`); err != nil {
-				log.Fatal(err)
-			}
-		}
+	// Open the database, sqlite creates the file if it isn't present. There's no default for the token key, so it isn't
+	// created next to the database and copied with it.
+	if *tokenKeyPath == "" {
+		log.Fatal("-token-key is required, the path of the key the meetup hashes are stored with. Keep it outside the data directory.")
+	}
+	tokenKey, err := loadTokenKey(*tokenKeyPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+	tokens, err := newTokenCipher(tokenKey)
+	if err != nil {
+		log.Fatal(err)
+	}
+	store, err := openStore(*dsn, tokens)
+	if err != nil {
+		log.Fatal(err)
 	}
 
 	defer func() {
-		if closeErr := db.Close(); closeErr != nil {
+		if closeErr := store.Close(); closeErr != nil {
 			log.Println(closeErr)
 		}
 	}()
 
-	// Prepare all the sql statements for later use
-	prepareDatabaseStatements()
-	defer closeDatabaseStatements()
+	// Send the webhooks and purge the expired meetups in the background
+	srv := newServer(store)
+	srv.expireAfter = time.Duration(*expireDays) * 24 * time.Hour
+	srv.deleteGrace = *deleteGrace
+	srv.auditKey = deriveKey(tokenKey, "catherder audit")
+	go srv.webhooks.run(context.Background())
+	go srv.runJanitor(context.Background())
+
+	// Email the organisers and participants, if there's an SMTP server
+	if *smtpAddr != "" {
+		if *mailFrom == "" || *baseUrl == "" {
+			log.Fatal("-smtp needs -mail-from and -url")
+		}
+		smtpPassword, err := loadSmtpPassword(*smtpPasswordPath)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if srv.mail, err = newMailNotifier(newSmtpMailer(*smtpAddr, *mailFrom, *smtpUser, smtpPassword), *baseUrl, *digestDelay, deriveKey(tokenKey, "catherder email")); err != nil {
+			log.Fatal(err)
+		}
+	}
 
 	// Serve https traffic
-	servedDir, err := fs.Sub(served, "served")
+	handler, err := srv.routes()
 	if err != nil {
 		log.Fatal(err)
 	}
-	http.Handle("/served/", http.StripPrefix("/served/", http.FileServer(http.FS(servedDir))))
-	http.HandleFunc("/api/", apiRouter) // JSON request/response handlers
-	http.HandleFunc("/", defaultRouter) // All non /served/ or /api/ requests
 	log.Printf("Server starting up, listening at: :%s", *port)
-	log.Fatal(http.ListenAndServeTLS(":"+*port, *certPath, *keyPath, nil))
+	log.Fatal(http.ListenAndServeTLS(":"+*port, *certPath, *keyPath, handler))
 }
 
 // templateJobber Parses a cached template file
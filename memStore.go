@@ -0,0 +1,584 @@
+package main
+
+import (
+	"cmp"
+	"fmt"
+	"maps"
+	"slices"
+	"sync"
+	"time"
+)
+
+// memStore A Store that keeps everything in memory, for tests. Follows the same rules as the sqlite store.
+type memStore struct {
+	txMu   sync.Mutex // Held by WithTx, transactions run one at a time
+	mu     sync.Mutex
+	lastId int64
+	memRows
+}
+
+// memRows The tables of a memStore.
+type memRows struct {
+	meetUps    map[int64]*memMeetUp
+	users      map[int64]*memUser
+	webhooks   map[int64]Webhook
+	deliveries map[int64]WebhookDelivery
+	events     map[int64]MeetUpEvent
+}
+
+// A meetup and its options, ordered by date.
+type memMeetUp struct {
+	MeetUp
+	options []meetUpOption
+}
+
+// A user and their answers, by option date.
+type memUser struct {
+	User
+	answers map[int64]Availability
+}
+
+// newMemStore Returns an empty memStore.
+func newMemStore() *memStore {
+	return &memStore{memRows: memRows{
+		meetUps:    make(map[int64]*memMeetUp),
+		users:      make(map[int64]*memUser),
+		webhooks:   make(map[int64]Webhook),
+		deliveries: make(map[int64]WebhookDelivery),
+		events:     make(map[int64]MeetUpEvent),
+	}}
+}
+
+// Returns the next row id. Ids are shared by all rows, like they'd be unique per table.
+func (s *memStore) nextId() int64 {
+	s.lastId++
+	return s.lastId
+}
+
+func (s *memStore) CreateMeetUp(m *MeetUp) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	m.Id = s.nextId()
+	m.Modified = time.Now().UnixMilli()
+	m.Created = m.Modified
+	m.Revision = 1
+	row := &memMeetUp{MeetUp: MeetUp{UserHash: m.UserHash, AdminHash: m.AdminHash}}
+	s.meetUps[m.Id] = row
+	s.writeMeetUp(row, m)
+	return nil
+}
+func (s *memStore) ReadMeetUp(id int64) (MeetUp, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	row, ok := s.meetUps[id]
+	if !ok || row.DeletedAt != 0 {
+		return MeetUp{}, ErrNotFound
+	}
+	return row.read(), nil
+}
+func (s *memStore) UpdateMeetUp(m *MeetUp) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	row, ok := s.meetUps[m.Id]
+	if !ok || row.Revision != m.Revision || row.DeletedAt != 0 {
+		return errRevisionConflict
+	}
+
+	m.Created = row.Created
+	m.Modified = time.Now().UnixMilli()
+	m.Revision++
+	s.writeMeetUp(row, m)
+	return nil
+}
+func (s *memStore) UpdateMeetUpHashes(m *MeetUp) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	row, ok := s.meetUps[m.Id]
+	if !ok || row.Revision != m.Revision || row.DeletedAt != 0 {
+		return errRevisionConflict
+	}
+
+	row.UserHash, row.AdminHash = m.UserHash, m.AdminHash
+	row.Modified = time.Now().UnixMilli()
+	row.Revision++
+	m.Modified, m.Revision = row.Modified, row.Revision
+	return nil
+}
+func (s *memStore) DeleteMeetUp(id int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if row, ok := s.meetUps[id]; ok && row.DeletedAt == 0 {
+		row.DeletedAt = time.Now().UnixMilli()
+	}
+	return nil
+}
+func (s *memStore) ConfirmMeetUpEmail(id int64, email string, confirmed int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if row, ok := s.meetUps[id]; ok && row.DeletedAt == 0 && row.Email == email && row.EmailConfirmed == 0 {
+		row.EmailConfirmed = confirmed
+	}
+	return nil
+}
+func (s *memStore) RestoreMeetUp(id int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if row, ok := s.meetUps[id]; ok {
+		row.DeletedAt = 0
+		row.Modified = time.Now().UnixMilli()
+	}
+	return nil
+}
+
+func (s *memStore) GetMeetUpByUserHash(userHash string) (MeetUp, error) {
+	return s.getMeetUp(func(m *memMeetUp) bool { return m.UserHash == userHash && m.DeletedAt == 0 }, fmt.Errorf("%w matching the userhash", ErrNotFound))
+}
+func (s *memStore) GetMeetUpByAdminHash(adminHash string) (MeetUp, error) {
+	m, err := s.getMeetUp(func(m *memMeetUp) bool { return m.AdminHash == adminHash && m.DeletedAt == 0 }, fmt.Errorf("%w matching the adminhash", ErrNotFound))
+	if err == nil {
+		m.AdminHash = adminHash
+	}
+	return m, err
+}
+func (s *memStore) GetDeletedMeetUpByAdminHash(adminHash string) (MeetUp, error) {
+	m, err := s.getMeetUp(func(m *memMeetUp) bool { return m.AdminHash == adminHash && m.DeletedAt != 0 }, fmt.Errorf("%w: no deleted meetup matches the adminhash", ErrNotFound))
+	if err == nil {
+		m.AdminHash = adminHash
+	}
+	return m, err
+}
+func (s *memStore) PurgeDeleted(before int64) (meetUps, users int, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for id, row := range s.users {
+		meetUp, ok := s.meetUps[row.IdMeetUp]
+		if (row.DeletedAt != 0 && row.DeletedAt <= before) || (ok && meetUp.DeletedAt != 0 && meetUp.DeletedAt <= before) {
+			delete(s.users, id)
+			users++
+		}
+	}
+	for id, row := range s.meetUps {
+		if row.DeletedAt != 0 && row.DeletedAt <= before {
+			s.purgeMeetUp(id)
+			meetUps++
+		}
+	}
+	return meetUps, users, nil
+}
+func (s *memStore) GetExpiredMeetUpIds(now, defaultAfter int64) ([]int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ids := make([]int64, 0)
+	for id, row := range s.meetUps {
+		if m := row.read(); m.DeletedAt == 0 && m.Expiry(defaultAfter) <= now {
+			ids = append(ids, id)
+		}
+	}
+	slices.Sort(ids)
+	return ids, nil
+}
+func (s *memStore) DeleteMeetUpByAdminHash(adminHash string) error {
+	s.mu.Lock()
+	var ids []int64
+	for id, m := range s.meetUps {
+		if m.AdminHash == adminHash && m.DeletedAt == 0 {
+			ids = append(ids, id)
+		}
+	}
+	s.mu.Unlock()
+
+	for _, id := range ids {
+		if err := s.DeleteMeetUp(id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *memStore) CreateUser(u *User) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.nameTaken(u) {
+		return errUserExists
+	}
+	u.Id = s.nextId()
+	row := &memUser{}
+	s.users[u.Id] = row
+	s.writeUser(row, u)
+	return nil
+}
+func (s *memStore) ReadUser(id int64) (User, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	row, ok := s.users[id]
+	if !ok || row.DeletedAt != 0 {
+		return User{}, ErrNotFound
+	}
+	return s.readUser(row), nil
+}
+func (s *memStore) UpdateUser(u *User) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.nameTaken(u) {
+		return errUserExists
+	}
+	if row, ok := s.users[u.Id]; ok {
+		s.writeUser(row, u)
+	}
+	return nil
+}
+func (s *memStore) DeleteUser(u *User) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	u.DeletedAt = time.Now().UnixMilli()
+	if row, ok := s.users[u.Id]; ok && row.DeletedAt == 0 {
+		row.DeletedAt = u.DeletedAt
+	}
+	s.touch(u.IdMeetUp)
+	return nil
+}
+func (s *memStore) RestoreUser(u *User) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.nameTaken(u) {
+		return errUserExists
+	}
+	if row, ok := s.users[u.Id]; ok {
+		row.DeletedAt = 0
+	}
+	u.DeletedAt = 0
+	s.touch(u.IdMeetUp)
+	return nil
+}
+func (s *memStore) GetUsersByMeetUpId(idMeetUp int64) (Users, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.readUsers(idMeetUp), nil
+}
+func (s *memStore) GetDeletedUsersByMeetUpId(idMeetUp int64) (Users, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	users := make(Users, 0)
+	for _, row := range s.users {
+		if row.IdMeetUp == idMeetUp && row.DeletedAt != 0 {
+			users = append(users, s.readUser(row))
+		}
+	}
+	slices.SortFunc(users, func(a, b User) int { return cmp.Or(cmp.Compare(b.DeletedAt, a.DeletedAt), cmp.Compare(b.Id, a.Id)) })
+	return users, nil
+}
+
+func (s *memStore) CreateWebhook(w *Webhook) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	w.Id = s.nextId()
+	s.webhooks[w.Id] = *w
+	return nil
+}
+func (s *memStore) GetWebhooksByMeetUpId(idMeetUp int64) ([]Webhook, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	webhooks := make([]Webhook, 0)
+	for _, w := range s.webhooks {
+		if w.IdMeetUp == idMeetUp {
+			webhooks = append(webhooks, w)
+		}
+	}
+	slices.SortFunc(webhooks, func(a, b Webhook) int { return cmp.Compare(a.Id, b.Id) })
+	return webhooks, nil
+}
+func (s *memStore) DeleteWebhook(idMeetUp, id int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if w, ok := s.webhooks[id]; !ok || w.IdMeetUp != idMeetUp {
+		return ErrNotFound
+	}
+	delete(s.webhooks, id)
+	return nil
+}
+
+func (s *memStore) QueueDelivery(d *WebhookDelivery) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	d.Id = s.nextId()
+	s.deliveries[d.Id] = *d
+	return nil
+}
+func (s *memStore) GetDueDeliveries(now int64, limit int) ([]WebhookDelivery, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	deliveries := make([]WebhookDelivery, 0)
+	for _, d := range s.deliveries {
+		if d.NextAttempt <= now {
+			deliveries = append(deliveries, d)
+		}
+	}
+	slices.SortFunc(deliveries, func(a, b WebhookDelivery) int {
+		return cmp.Or(cmp.Compare(a.NextAttempt, b.NextAttempt), cmp.Compare(a.Id, b.Id))
+	})
+	if len(deliveries) > limit {
+		deliveries = deliveries[:limit]
+	}
+	return deliveries, nil
+}
+func (s *memStore) UpdateDelivery(d *WebhookDelivery) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if row, ok := s.deliveries[d.Id]; ok {
+		row.Attempts, row.NextAttempt, row.LastError = d.Attempts, d.NextAttempt, d.LastError
+		s.deliveries[d.Id] = row
+	}
+	return nil
+}
+func (s *memStore) DeleteDelivery(id int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.deliveries, id)
+	return nil
+}
+
+func (s *memStore) CreateMeetUpEvent(e *MeetUpEvent) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	e.Id = s.nextId()
+	e.Created = time.Now().UnixMilli()
+	row := *e
+	row.OldDates, row.NewDates = slices.Clone(nonNilDates(e.OldDates)), slices.Clone(nonNilDates(e.NewDates))
+	row.OldIfNeedBe, row.NewIfNeedBe = slices.Clone(nonNilDates(e.OldIfNeedBe)), slices.Clone(nonNilDates(e.NewIfNeedBe))
+	s.events[e.Id] = row
+	return nil
+}
+func (s *memStore) GetMeetUpEvents(idMeetUp int64) ([]MeetUpEvent, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	events := make([]MeetUpEvent, 0)
+	for _, e := range s.events {
+		if e.IdMeetUp == idMeetUp {
+			events = append(events, e)
+		}
+	}
+	slices.SortFunc(events, func(a, b MeetUpEvent) int { return cmp.Compare(b.Id, a.Id) })
+	return events, nil
+}
+
+// WithTx Runs fn with the store, after any other transaction finishes. If fn fails the store goes back to how it was,
+// which also undoes writes made outside of a transaction meanwhile.
+func (s *memStore) WithTx(fn func(tx Store) error) error {
+	s.txMu.Lock()
+	defer s.txMu.Unlock()
+
+	s.mu.Lock()
+	rows := s.copyRows()
+	s.mu.Unlock()
+
+	if err := fn(memTx{s}); err != nil {
+		s.mu.Lock()
+		s.memRows = rows
+		s.mu.Unlock()
+		return err
+	}
+	return nil
+}
+
+func (s *memStore) Close() error {
+	return nil
+}
+
+// memTx The Store given to a memStore WithTx function.
+type memTx struct {
+	*memStore
+}
+
+// WithTx Runs fn in the transaction already open.
+func (tx memTx) WithTx(fn func(tx Store) error) error {
+	return fn(tx)
+}
+
+// Returns copies of all the rows.
+func (s *memStore) copyRows() memRows {
+	meetUps := make(map[int64]*memMeetUp, len(s.meetUps))
+	for id, row := range s.meetUps {
+		meetUps[id] = &memMeetUp{MeetUp: row.MeetUp, options: slices.Clone(row.options)}
+	}
+	users := make(map[int64]*memUser, len(s.users))
+	for id, row := range s.users {
+		users[id] = &memUser{User: row.User, answers: maps.Clone(row.answers)}
+	}
+	return memRows{meetUps: meetUps, users: users, webhooks: maps.Clone(s.webhooks), deliveries: maps.Clone(s.deliveries), events: maps.Clone(s.events)}
+}
+
+// Deletes the meetup with its users and webhooks.
+func (s *memStore) purgeMeetUp(id int64) {
+	delete(s.meetUps, id)
+	for idUser, user := range s.users {
+		if user.IdMeetUp == id {
+			delete(s.users, idUser)
+		}
+	}
+	for idWebhook, webhook := range s.webhooks {
+		if webhook.IdMeetUp == id {
+			delete(s.webhooks, idWebhook)
+		}
+	}
+	for idEvent, event := range s.events {
+		if event.IdMeetUp == id {
+			delete(s.events, idEvent)
+		}
+	}
+}
+
+// Reports whether another user of the meetup has the user's name. Deleted users don't count.
+func (s *memStore) nameTaken(u *User) bool {
+	for id, row := range s.users {
+		if id != u.Id && row.IdMeetUp == u.IdMeetUp && row.Name == u.Name && row.DeletedAt == 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the first meetup that matches, with its users. Returns notFound if none do.
+func (s *memStore) getMeetUp(match func(m *memMeetUp) bool, notFound error) (MeetUp, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, row := range s.meetUps {
+		if match(row) {
+			m := row.read()
+			m.Users = s.readUsers(m.Id)
+			return m, nil
+		}
+	}
+	return MeetUp{}, notFound
+}
+
+// Copies the meetup into row, and makes the options match its Dates and Durations. The users' answers for removed
+// options are dropped. The hashes are kept, like the sqlite store only CreateMeetUp and
+// UpdateMeetUpHashes set them.
+func (s *memStore) writeMeetUp(row *memMeetUp, m *MeetUp) {
+	deletedAt, userHash, adminHash := row.DeletedAt, row.UserHash, row.AdminHash
+	row.MeetUp = *m
+	row.Dates, row.Durations, row.Users, row.ExpiryDate, row.DeletedAt = nil, nil, nil, 0, deletedAt
+	row.UserHash, row.AdminHash = userHash, adminHash
+
+	var options []meetUpOption
+	for i, date := range m.Dates {
+		if !slices.ContainsFunc(options, func(o meetUpOption) bool { return o.date == date }) {
+			options = append(options, meetUpOption{date: date, duration: m.duration(i)})
+		}
+	}
+	slices.SortFunc(options, func(a, b meetUpOption) int { return cmp.Compare(a.date, b.date) })
+	row.options = options
+
+	for _, user := range s.users {
+		if user.IdMeetUp != m.Id {
+			continue
+		}
+		for date := range user.answers {
+			if !row.hasOption(date) {
+				delete(user.answers, date)
+			}
+		}
+	}
+}
+
+// Copies the user into row, keeping the answers for dates that are options of the meetup. A date in both Dates and
+// IfNeedBe is a yes.
+func (s *memStore) writeUser(row *memUser, u *User) {
+	deletedAt := row.DeletedAt
+	row.User = *u
+	row.Dates, row.IfNeedBe, row.DeletedAt = nil, nil, deletedAt
+	row.answers = make(map[int64]Availability)
+
+	if meetUp, ok := s.meetUps[u.IdMeetUp]; ok {
+		for _, date := range u.IfNeedBe {
+			if meetUp.hasOption(date) {
+				row.answers[date] = AvailableIfNeedBe
+			}
+		}
+		for _, date := range u.Dates {
+			if meetUp.hasOption(date) {
+				row.answers[date] = AvailableYes
+			}
+		}
+	}
+	s.touch(u.IdMeetUp)
+}
+
+// Returns a copy of the user with Dates and IfNeedBe in date order.
+func (s *memStore) readUser(row *memUser) User {
+	u := row.User
+	u.Dates, u.IfNeedBe = make([]int64, 0), make([]int64, 0)
+	for _, option := range s.meetUps[u.IdMeetUp].options {
+		switch row.answers[option.date] {
+		case AvailableYes:
+			u.Dates = append(u.Dates, option.date)
+		case AvailableIfNeedBe:
+			u.IfNeedBe = append(u.IfNeedBe, option.date)
+		}
+	}
+	return u
+}
+
+// Returns the users of a meetup, in the order they were created.
+func (s *memStore) readUsers(idMeetUp int64) Users {
+	users := make(Users, 0)
+	for _, row := range s.users {
+		if row.IdMeetUp == idMeetUp && row.DeletedAt == 0 {
+			users = append(users, s.readUser(row))
+		}
+	}
+	slices.SortFunc(users, func(a, b User) int { return cmp.Compare(a.Id, b.Id) })
+	return users
+}
+
+// Sets the last modified time of the meetup to now, after one of its users changes.
+func (s *memStore) touch(idMeetUp int64) {
+	if row, ok := s.meetUps[idMeetUp]; ok {
+		row.Modified = time.Now().UnixMilli()
+	}
+}
+
+// Returns a copy of the meetup, without its users. Like the sqlite store, which only has its digest, it's without
+// the adminhash.
+func (m *memMeetUp) read() MeetUp {
+	meetUp := m.MeetUp
+	meetUp.AdminHash = ""
+	meetUp.Dates = make([]int64, len(m.options))
+	meetUp.Durations = make([]int64, len(m.options))
+	for i, option := range m.options {
+		meetUp.Dates[i] = option.date
+		meetUp.Durations[i] = option.duration
+	}
+	return meetUp
+}
+
+// Reports whether date is one of the meetup's options.
+func (m *memMeetUp) hasOption(date int64) bool {
+	return slices.ContainsFunc(m.options, func(o meetUpOption) bool { return o.date == date })
+}
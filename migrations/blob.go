@@ -0,0 +1,86 @@
+package migrations
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// Date blob encodings. The first byte of a blob is the version of its encoding. Legacy blobs, written before the
+// encoding was versioned, have no header and store every value in a fixed binary.MaxVarintLen64 byte slot.
+// Migration 7 reads the blobs, the dates now live in the meetup_option and user_availability tables.
+const (
+	blobVersionSorted = 1 // Sorted values, the first as a zigzag varint, the rest as uvarint deltas from the one before
+	blobVersionList   = 2 // Values in their original order, each as a zigzag varint
+)
+
+// convert blob []byte to []int64. Reads every version of the encoding, including legacy blobs.
+// Returns an error if the blob is corrupt.
+func convertBlobToDates(blobBytes []byte) ([]int64, error) {
+	var intSlice = make([]int64, 0)
+	if len(blobBytes) == 0 {
+		return intSlice, nil
+	}
+
+	switch blobBytes[0] {
+	case blobVersionSorted:
+		var prev int64
+		for i := 1; i < len(blobBytes); {
+			var n int
+			if i == 1 {
+				prev, n = binary.Varint(blobBytes[i:])
+			} else {
+				var delta uint64
+				delta, n = binary.Uvarint(blobBytes[i:])
+				prev = int64(uint64(prev) + delta)
+			}
+			if n <= 0 {
+				return nil, errors.New("corrupt date blob")
+			}
+			intSlice = append(intSlice, prev)
+			i += n
+		}
+	case blobVersionList:
+		for i := 1; i < len(blobBytes); {
+			value, n := binary.Varint(blobBytes[i:])
+			if n <= 0 {
+				return nil, errors.New("corrupt date blob")
+			}
+			intSlice = append(intSlice, value)
+			i += n
+		}
+	default:
+		if isLegacyBlob(blobBytes) == false {
+			return nil, errors.New("unknown date blob encoding")
+		}
+		for i := 0; i < len(blobBytes); i += binary.MaxVarintLen64 {
+			value, _ := binary.Varint(blobBytes[i : i+binary.MaxVarintLen64])
+			intSlice = append(intSlice, value)
+		}
+	}
+
+	return intSlice, nil
+}
+
+// Returns true if blobBytes is in the legacy layout without a header: a whole number of fixed size slots, each
+// holding one varint padded with zero bytes.
+func isLegacyBlob(blobBytes []byte) bool {
+	if len(blobBytes) == 0 || len(blobBytes)%binary.MaxVarintLen64 != 0 {
+		return false
+	} else if blobBytes[0] == blobVersionSorted || blobBytes[0] == blobVersionList {
+		return false
+	}
+
+	for i := 0; i < len(blobBytes); i += binary.MaxVarintLen64 {
+		slot := blobBytes[i : i+binary.MaxVarintLen64]
+		_, n := binary.Varint(slot)
+		if n <= 0 {
+			return false
+		}
+		for _, b := range slot[n:] {
+			if b != 0 {
+				return false
+			}
+		}
+	}
+	return true
+}
@@ -0,0 +1,122 @@
+package migrations
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+// Encodes dates in the sorted blob encoding, as written by older versions. The order of intSlice is not kept.
+func convertDatesToBlob(intSlice []int64) []byte {
+	dates := make([]int64, len(intSlice))
+	copy(dates, intSlice)
+	sort.Slice(dates, func(i, j int) bool {
+		return dates[i] < dates[j]
+	})
+
+	blobBytes := make([]byte, 0, 1+len(dates)*3)
+	blobBytes = append(blobBytes, blobVersionSorted)
+	for i, date := range dates {
+		if i == 0 {
+			blobBytes = binary.AppendVarint(blobBytes, date)
+		} else {
+			blobBytes = binary.AppendUvarint(blobBytes, uint64(date)-uint64(dates[i-1]))
+		}
+	}
+
+	return blobBytes
+}
+
+// Encodes durations in the list blob encoding, as written by older versions. The order is kept.
+func convertDurationsToBlob(intSlice []int64) []byte {
+	blobBytes := make([]byte, 0, 1+len(intSlice)*4)
+	blobBytes = append(blobBytes, blobVersionList)
+	for _, duration := range intSlice {
+		blobBytes = binary.AppendVarint(blobBytes, duration)
+	}
+
+	return blobBytes
+}
+
+// Encodes values in the legacy blob layout, one fixed size varint slot per value.
+func legacyDateBlob(values []int64) []byte {
+	var blobBytes []byte
+	for _, value := range values {
+		buf := make([]byte, binary.MaxVarintLen64)
+		binary.PutVarint(buf, value)
+		blobBytes = append(blobBytes, buf...)
+	}
+	return blobBytes
+}
+
+func TestConvertDatesToBlob(t *testing.T) {
+	var input = [][]int64{
+		{},
+		{1550401200000},
+		{1550574000000, 1550401200000, 1550487600000},
+		{1550401200000, 1550401200000},
+		{-1, 0, 1, math.MinInt64, math.MaxInt64},
+	}
+
+	for _, dates := range input {
+		blob := convertDatesToBlob(dates)
+		if blob[0] != blobVersionSorted {
+			t.Errorf("convertDatesToBlob(%v) has header %d, want: %d", dates, blob[0], blobVersionSorted)
+		}
+
+		sorted := append([]int64{}, dates...)
+		sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+
+		output, err := convertBlobToDates(blob)
+		if err != nil {
+			t.Errorf("convertBlobToDates(convertDatesToBlob(%v)) failed: %s", dates, err)
+		} else if reflect.DeepEqual(output, sorted) == false {
+			t.Errorf("convertBlobToDates(convertDatesToBlob(%v)) = %v", dates, output)
+		}
+	}
+
+	// Durations keep their order
+	durations := []int64{3600000, 0, 1800000}
+	if output, err := convertBlobToDates(convertDurationsToBlob(durations)); err != nil || reflect.DeepEqual(output, durations) == false {
+		t.Errorf("convertBlobToDates(convertDurationsToBlob(%v)) = %v, %v", durations, output, err)
+	}
+
+	// Much smaller than the legacy layout
+	dates := []int64{1550401200000, 1550487600000, 1550574000000, 1550660400000}
+	if newLen, legacyLen := len(convertDatesToBlob(dates)), len(legacyDateBlob(dates)); newLen*2 > legacyLen {
+		t.Errorf("convertDatesToBlob() is %d bytes long, legacy layout is %d bytes", newLen, legacyLen)
+	}
+}
+
+func TestConvertBlobToDates(t *testing.T) {
+	var input = []struct {
+		blob     []byte
+		expected []int64
+		err      error
+	}{
+		{nil, []int64{}, nil},
+		{[]byte{blobVersionSorted}, []int64{}, nil},
+		{legacyDateBlob([]int64{1550487600000, 1550401200000}), []int64{1550487600000, 1550401200000}, nil},
+		{legacyDateBlob([]int64{0, 3600000}), []int64{0, 3600000}, nil},
+		{[]byte{blobVersionSorted, 0x80}, nil, errors.New("corrupt date blob")},
+		{[]byte{blobVersionSorted, 0x02, 0xff}, nil, errors.New("corrupt date blob")},
+		{[]byte{blobVersionList, 0x80, 0x80}, nil, errors.New("corrupt date blob")},
+		{[]byte{blobVersionSorted, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x01}, nil, errors.New("corrupt date blob")},
+		{[]byte{0x7f}, nil, errors.New("unknown date blob encoding")},
+		{legacyDateBlob([]int64{1550401200000})[:9], nil, errors.New("unknown date blob encoding")},
+		{append(legacyDateBlob([]int64{1550401200000})[:9], 0x01), nil, errors.New("unknown date blob encoding")},
+	}
+
+	for _, test := range input {
+		output, err := convertBlobToDates(test.blob)
+
+		if (err == nil) != (test.err == nil) || (err != nil && err.Error() != test.err.Error()) {
+			t.Errorf("convertBlobToDates(%v) error = %v, want: %v", test.blob, err, test.err)
+		} else if err == nil && reflect.DeepEqual(output, test.expected) == false {
+			t.Errorf("convertBlobToDates(%v) = %v, want: %v", test.blob, output, test.expected)
+		}
+	}
+}
@@ -0,0 +1,60 @@
+package migrations
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+)
+
+// Returns the Go step of the migration that stores the meetup hashes as keyed digests, sqlite 16 and postgres 9. The
+// hashes are still in the renamed columns, the step replaces them with their digests and puts the encrypted userhash
+// in usersealed. update sets the three for an idmeetup, with the dialect's placeholders.
+func digestTokens(update string) func(tx *sql.Tx, env Env) error {
+	return func(tx *sql.Tx, env Env) error {
+		if env.DigestToken == nil || env.SealToken == nil {
+			return errors.New("the meetup hashes can't be migrated without the token key")
+		}
+
+		type hashRow struct {
+			id                  int64
+			userHash, adminHash string
+		}
+
+		// Reads all rows first, the same connection is used for the updates.
+		readHashRows := func() (hashRows []hashRow, retErr error) {
+			rows, retErr := tx.Query(`SELECT idmeetup, userdigest, admindigest FROM meetup`)
+			if retErr != nil {
+				return
+			}
+			defer func() {
+				if closeErr := rows.Close(); closeErr != nil {
+					retErr = fmt.Errorf("%s unable to close rows %s", retErr, closeErr)
+				}
+			}()
+
+			for rows.Next() {
+				var row hashRow
+				if retErr = rows.Scan(&row.id, &row.userHash, &row.adminHash); retErr != nil {
+					return
+				}
+				hashRows = append(hashRows, row)
+			}
+			return hashRows, rows.Err()
+		}
+
+		hashRows, err := readHashRows()
+		if err != nil {
+			return err
+		}
+		for _, row := range hashRows {
+			sealed, err := env.SealToken(row.userHash)
+			if err != nil {
+				return fmt.Errorf("meetup %d userhash: %w", row.id, err)
+			}
+			if _, err = tx.Exec(update, env.DigestToken(row.userHash), env.DigestToken(row.adminHash), sealed, row.id); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
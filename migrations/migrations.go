@@ -0,0 +1,172 @@
+// Package migrations creates the catherder database schema, and brings databases created by older versions up to
+// date.
+//
+// Each database engine is a Dialect with its own migrations, the numbered sql files in its directory, applied in
+// order. Each one runs in its own transaction, together with its Go step if it has one, and sets the database version
+// to its number. A schema change is a new file with the next number, for every dialect. Never edit a migration that
+// has been released.
+package migrations
+
+import (
+	"database/sql"
+	"embed"
+	"fmt"
+	"io/fs"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+//go:embed sqlite/*.sql postgres/*.sql
+var files embed.FS
+
+// Migration One schema version.
+type Migration struct {
+	Version int
+	Name    string
+	SQL     string
+	Go      func(tx *sql.Tx, env Env) error // Optional, runs after SQL. For data changes that can't be written in sql.
+}
+
+// Env What the Go steps need from the program, besides the database.
+type Env struct {
+	DigestToken func(token string) string          // The keyed digest a meetup hash is stored and looked up as
+	SealToken   func(token string) (string, error) // Encrypts a userhash, for the server to read it back
+}
+
+// Dialect The migrations of one database engine, and how it keeps the database version.
+type Dialect struct {
+	dir        string                                  // Directory of the migration files
+	goSteps    map[int]func(tx *sql.Tx, env Env) error // Go steps of the migrations, by version
+	version    func(db *sql.DB) (int, error)           // Returns 0 for an empty database
+	setVersion func(tx *sql.Tx, version int) error
+	lock       func(db *sql.DB) (unlock func() error, err error) // Optional, keeps other servers from migrating at the same time
+}
+
+// SQLite The migrations of a sqlite database. Also brings databases from before the migrations existed up to date.
+var SQLite = &Dialect{
+	dir:        "sqlite",
+	goSteps:    map[int]func(tx *sql.Tx, env Env) error{7: moveDates, 16: digestTokens(`UPDATE meetup SET userdigest = ?, admindigest = ?, usersealed = ? WHERE idmeetup = ?`)},
+	version:    sqliteVersion,
+	setVersion: sqliteSetVersion,
+}
+
+// Postgres The migrations of a PostgreSQL database.
+var Postgres = &Dialect{
+	dir:        "postgres",
+	goSteps:    map[int]func(tx *sql.Tx, env Env) error{9: digestTokens(`UPDATE meetup SET userdigest = $1, admindigest = $2, usersealed = $3 WHERE idmeetup = $4`)},
+	version:    postgresVersion,
+	setVersion: postgresSetVersion,
+	lock:       postgresLock,
+}
+
+// All Returns the migrations in order. Returns an error if the files aren't numbered 1, 2, 3, ...
+func (d *Dialect) All() ([]Migration, error) {
+	names, err := fs.Glob(files, d.dir+"/*.sql")
+	if err != nil {
+		return nil, err
+	}
+
+	var all []Migration
+	for _, file := range names {
+		number, name, found := strings.Cut(strings.TrimSuffix(path.Base(file), ".sql"), "_")
+		version, err := strconv.Atoi(number)
+		if found == false || err != nil {
+			return nil, fmt.Errorf("migration %q is not named <version>_<name>.sql", file)
+		}
+
+		sqlBytes, err := files.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		all = append(all, Migration{Version: version, Name: name, SQL: string(sqlBytes), Go: d.goSteps[version]})
+	}
+
+	sort.Slice(all, func(i, j int) bool {
+		return all[i].Version < all[j].Version
+	})
+	for i, migration := range all {
+		if migration.Version != i+1 {
+			return nil, fmt.Errorf("migration %d_%s is out of sequence, want version %d", migration.Version, migration.Name, i+1)
+		}
+	}
+	return all, nil
+}
+
+// Latest Returns the version of the newest migration.
+func (d *Dialect) Latest() (int, error) {
+	all, err := d.All()
+	if err != nil {
+		return 0, err
+	}
+	return len(all), nil
+}
+
+// Migrate Applies the migrations newer than the database version. An empty database gets the whole schema. The Go
+// steps get env. Returns the database version before and after.
+func (d *Dialect) Migrate(db *sql.DB, env Env) (from, to int, err error) {
+	all, err := d.All()
+	if err != nil {
+		return 0, 0, err
+	}
+
+	if d.lock != nil {
+		unlock, err := d.lock(db)
+		if err != nil {
+			return 0, 0, err
+		}
+		defer func() {
+			if unlockErr := unlock(); unlockErr != nil && err == nil {
+				err = unlockErr
+			}
+		}()
+	}
+
+	if from, err = d.Version(db); err != nil {
+		return 0, 0, err
+	}
+	if from > len(all) {
+		return from, from, fmt.Errorf("database version %d is newer than this program, latest migration is %d", from, len(all))
+	}
+
+	for _, migration := range all[from:] {
+		if err = d.apply(db, migration, env); err != nil {
+			return from, migration.Version - 1, fmt.Errorf("migration %d_%s failed: %w", migration.Version, migration.Name, err)
+		}
+	}
+	return from, len(all), nil
+}
+
+// Version Returns the schema version of the database, 0 for an empty database.
+func (d *Dialect) Version(db *sql.DB) (int, error) {
+	return d.version(db)
+}
+
+// Applies one migration in a transaction, and sets the database version to it.
+func (d *Dialect) apply(db *sql.DB, migration Migration, env Env) (retErr error) {
+	tx, retErr := db.Begin()
+	if retErr != nil {
+		return
+	}
+	defer func() {
+		if retErr != nil {
+			if rollbackErr := tx.Rollback(); rollbackErr != nil {
+				retErr = fmt.Errorf("%s unable to rollback %s", retErr, rollbackErr)
+			}
+		}
+	}()
+
+	if _, retErr = tx.Exec(migration.SQL); retErr != nil {
+		return
+	}
+	if migration.Go != nil {
+		if retErr = migration.Go(tx, env); retErr != nil {
+			return
+		}
+	}
+	if retErr = d.setVersion(tx, migration.Version); retErr != nil {
+		return
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,325 @@
+package migrations
+
+import (
+	"database/sql"
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// Opens a new empty database in a temporary directory. It gets closed when the test finishes.
+func openTestDb(t *testing.T) *sql.DB {
+	db, err := sql.Open("sqlite3", "file:"+filepath.Join(t.TempDir(), "test.sqlite")+"?_foreign_keys=1")
+	if err != nil {
+		t.Fatal("Failed to open database:", err)
+	}
+	t.Cleanup(func() {
+		db.Close()
+	})
+	return db
+}
+
+// Stands in for the token key of the program, its digests and sealed userhashes are easy to check.
+var testEnv = Env{
+	DigestToken: func(token string) string { return "digest:" + token },
+	SealToken:   func(token string) (string, error) { return "sealed:" + token, nil },
+}
+
+// Runs the statements, failing the test on error.
+func execAll(t *testing.T, db *sql.DB, statements ...string) {
+	for _, statement := range statements {
+		if _, err := db.Exec(statement); err != nil {
+			t.Fatalf("%s: %s", statement, err)
+		}
+	}
+}
+
+// Describes the schema as a sorted list of the tables' columns, foreign keys and indexes, independent of the order
+// and the sql text they were created with.
+func describeSchema(t *testing.T, db *sql.DB) []string {
+	var description []string
+	query := func(format string, args ...interface{}) {
+		label := fmt.Sprintf(format, args...)
+		rows, err := db.Query(label)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer rows.Close()
+
+		columns, err := rows.Columns()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for rows.Next() {
+			values := make([]interface{}, len(columns))
+			pointers := make([]interface{}, len(columns))
+			for i := range values {
+				pointers[i] = &values[i]
+			}
+			if err = rows.Scan(pointers...); err != nil {
+				t.Fatal(err)
+			}
+			description = append(description, fmt.Sprintf("%s: %v", label, values))
+		}
+	}
+
+	var tables []string
+	rows, err := db.Query(`SELECT name FROM sqlite_master WHERE type = 'table' AND name NOT LIKE 'sqlite_%'`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for rows.Next() {
+		var name string
+		if err = rows.Scan(&name); err != nil {
+			t.Fatal(err)
+		}
+		tables = append(tables, name)
+	}
+	rows.Close()
+
+	for _, table := range tables {
+		query(`SELECT name, type, "notnull", dflt_value, pk FROM pragma_table_info('%s')`, table)
+		query(`SELECT "table", "from", "to", on_delete FROM pragma_foreign_key_list('%s')`, table)
+		query(`SELECT l.name, l."unique", i.name FROM pragma_index_list('%s') l, pragma_index_info(l.name) i`, table)
+	}
+
+	sort.Strings(description)
+	return description
+}
+
+// Checks the database ends up at the latest version, with the same schema as a new database.
+func checkMigrated(t *testing.T, db *sql.DB, expectedFrom int) {
+	from, to, err := SQLite.Migrate(db, testEnv)
+	if err != nil {
+		t.Fatalf("Migrate() failed: %s", err)
+	}
+	latest, err := SQLite.Latest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if from != expectedFrom || to != latest {
+		t.Errorf("Migrate() went from version %d to %d, want: %d to %d", from, to, expectedFrom, latest)
+	}
+
+	fresh := openTestDb(t)
+	if _, _, err = SQLite.Migrate(fresh, testEnv); err != nil {
+		t.Fatalf("Migrate() of a new database failed: %s", err)
+	}
+	if freshSchema, upgradedSchema := describeSchema(t, fresh), describeSchema(t, db); reflect.DeepEqual(freshSchema, upgradedSchema) == false {
+		t.Errorf("upgraded schema is different to a new one.\nnew: %q\nupgraded: %q", freshSchema, upgradedSchema)
+	}
+
+	// Running again does nothing
+	if from, to, err = SQLite.Migrate(db, testEnv); err != nil || from != latest || to != latest {
+		t.Errorf("second Migrate() = %d, %d, %v, want: %d, %d, nil", from, to, err, latest, latest)
+	}
+}
+
+func TestAll(t *testing.T) {
+	for name, dialect := range map[string]*Dialect{"sqlite": SQLite, "postgres": Postgres} {
+		all, err := dialect.All()
+		if err != nil {
+			t.Fatalf("%s All() failed: %s", name, err)
+		}
+		for i, migration := range all {
+			if migration.Version != i+1 || migration.Name == "" || migration.SQL == "" {
+				t.Errorf("%s migration %d is invalid: %+v", name, i, migration)
+			}
+		}
+	}
+}
+
+func TestMigrate_NewDatabase(t *testing.T) {
+	checkMigrated(t, openTestDb(t), 0)
+}
+
+// Databases created before the migrations existed, by the schema files of the older versions. None of them set
+// user_version.
+func TestMigrate_LegacyDatabases(t *testing.T) {
+	var tests = []struct {
+		name       string
+		statements []string
+		version    int
+	}{
+		{"first release, dbSource.sql", []string{
+			`CREATE TABLE meetup (idmeetup INTEGER PRIMARY KEY ASC, userhash TEXT NOT NULL, adminhash TEXT NOT NULL, dates BLOB, description TEXT NOT NULL)`,
+			`CREATE TABLE "user" (iduser INTEGER PRIMARY KEY ASC NOT NULL, idmeetup INTEGER NOT NULL, name TEXT NOT NULL, dates BLOB, FOREIGN KEY (idmeetup) REFERENCES meetup (idmeetup) ON DELETE CASCADE)`,
+			`CREATE INDEX "user.fk_user_meetup_idx" ON "user" ("idmeetup")`,
+		}, 1},
+		{"edit tokens and slots", []string{
+			`CREATE TABLE meetup (idmeetup INTEGER PRIMARY KEY ASC, userhash TEXT NOT NULL, adminhash TEXT NOT NULL, dates BLOB NOT NULL, description TEXT NOT NULL)`,
+			`CREATE TABLE "user" (iduser INTEGER PRIMARY KEY ASC NOT NULL, idmeetup INTEGER NOT NULL, name TEXT NOT NULL, dates BLOB NOT NULL, FOREIGN KEY (idmeetup) REFERENCES meetup (idmeetup) ON DELETE CASCADE)`,
+			`CREATE INDEX "user.fk_user_meetup_idx" ON "user" ("idmeetup")`,
+			`ALTER TABLE "user" ADD COLUMN token TEXT NOT NULL DEFAULT ''`,
+			`ALTER TABLE meetup ADD COLUMN durations BLOB`,
+		}, 3},
+		{"last modified", []string{
+			`CREATE TABLE meetup (idmeetup INTEGER PRIMARY KEY ASC, userhash TEXT NOT NULL, adminhash TEXT NOT NULL, dates BLOB NOT NULL, durations BLOB, description TEXT NOT NULL, finaldate INTEGER NOT NULL DEFAULT 0, lastmodified INTEGER NOT NULL DEFAULT 0)`,
+			`CREATE TABLE "user" (iduser INTEGER PRIMARY KEY ASC NOT NULL, idmeetup INTEGER NOT NULL, name TEXT NOT NULL, token TEXT NOT NULL DEFAULT '', dates BLOB NOT NULL, ifneedbe BLOB, FOREIGN KEY (idmeetup) REFERENCES meetup (idmeetup) ON DELETE CASCADE)`,
+			`CREATE INDEX "user.fk_user_meetup_idx" ON "user" ("idmeetup")`,
+		}, 6},
+		{"date tables", []string{
+			`CREATE TABLE meetup (idmeetup INTEGER PRIMARY KEY ASC, userhash TEXT NOT NULL, adminhash TEXT NOT NULL, description TEXT NOT NULL, finaldate INTEGER NOT NULL DEFAULT 0, lastmodified INTEGER NOT NULL DEFAULT 0)`,
+			`CREATE TABLE "user" (iduser INTEGER PRIMARY KEY ASC NOT NULL, idmeetup INTEGER NOT NULL, name TEXT NOT NULL, token TEXT NOT NULL DEFAULT '', FOREIGN KEY (idmeetup) REFERENCES meetup (idmeetup) ON DELETE CASCADE)`,
+			`CREATE INDEX "user.fk_user_meetup_idx" ON "user" ("idmeetup")`,
+			`CREATE TABLE meetup_option (idoption INTEGER PRIMARY KEY ASC NOT NULL, idmeetup INTEGER NOT NULL, date INTEGER NOT NULL, duration INTEGER NOT NULL DEFAULT 0, UNIQUE (idmeetup, date), FOREIGN KEY (idmeetup) REFERENCES meetup (idmeetup) ON DELETE CASCADE)`,
+			`CREATE TABLE user_availability (iduser INTEGER NOT NULL, idoption INTEGER NOT NULL, availability TEXT NOT NULL CHECK (availability IN ('yes', 'ifneedbe')), PRIMARY KEY (iduser, idoption), FOREIGN KEY (iduser) REFERENCES "user" (iduser) ON DELETE CASCADE, FOREIGN KEY (idoption) REFERENCES meetup_option (idoption) ON DELETE CASCADE)`,
+			`CREATE INDEX "user_availability.fk_availability_option_idx" ON user_availability ("idoption")`,
+		}, 8},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			db := openTestDb(t)
+			execAll(t, db, test.statements...)
+			checkMigrated(t, db, test.version)
+		})
+	}
+}
+
+// The dates of a database from before the date tables get moved out of the blobs.
+func TestMigrate_MovesDates(t *testing.T) {
+	db := openTestDb(t)
+	execAll(t, db,
+		`CREATE TABLE meetup (idmeetup INTEGER PRIMARY KEY ASC, userhash TEXT NOT NULL, adminhash TEXT NOT NULL, dates BLOB NOT NULL, description TEXT NOT NULL)`,
+		`CREATE TABLE "user" (iduser INTEGER PRIMARY KEY ASC NOT NULL, idmeetup INTEGER NOT NULL, name TEXT NOT NULL, dates BLOB NOT NULL, FOREIGN KEY (idmeetup) REFERENCES meetup (idmeetup) ON DELETE CASCADE)`,
+		`CREATE INDEX "user.fk_user_meetup_idx" ON "user" ("idmeetup")`,
+		`ALTER TABLE "user" ADD COLUMN token TEXT NOT NULL DEFAULT ''`,
+		`ALTER TABLE meetup ADD COLUMN durations BLOB`,
+		`ALTER TABLE "user" ADD COLUMN ifneedbe BLOB`,
+	)
+
+	// Legacy and versioned blobs, with unsorted dates
+	if _, err := db.Exec(`INSERT INTO meetup(idmeetup, userhash, adminhash, dates, durations, description) values(1,'a','b',?,?,'c'), (2,'d','e',?,NULL,'f')`,
+		legacyDateBlob([]int64{1550574000000, 1550401200000, 1550487600000}), convertDurationsToBlob([]int64{0, 3600000, 0}),
+		convertDatesToBlob([]int64{1550401200000})); err != nil {
+		t.Fatal(err)
+	}
+	// 1550660400000 is not one of the meetup dates, and gets dropped
+	if _, err := db.Exec(`INSERT INTO "user"(iduser, idmeetup, name, dates, ifneedbe) values(1,1,'user1',?,?), (2,1,'user2',?,NULL), (3,2,'user3',?,?)`,
+		convertDatesToBlob([]int64{1550487600000, 1550660400000}), legacyDateBlob([]int64{1550401200000}),
+		legacyDateBlob([]int64{1550574000000}),
+		convertDatesToBlob([]int64{1550401200000}), convertDatesToBlob([]int64{1550401200000})); err != nil {
+		t.Fatal(err)
+	}
+
+	checkMigrated(t, db, 4)
+
+	var expected = []string{
+		"1 1550401200000 3600000", "1 1550487600000 0", "1 1550574000000 0", "2 1550401200000 0",
+	}
+	if options := queryStrings(t, db, `SELECT idmeetup || ' ' || date || ' ' || duration FROM meetup_option ORDER BY idmeetup, date`); reflect.DeepEqual(options, expected) == false {
+		t.Errorf("meetup options = %q, want: %q", options, expected)
+	}
+
+	expected = []string{
+		"1 1550401200000 ifneedbe", "1 1550487600000 yes", "2 1550574000000 yes", "3 1550401200000 yes",
+	}
+	if availability := queryStrings(t, db, `SELECT a.iduser || ' ' || o.date || ' ' || a.availability FROM user_availability a JOIN meetup_option o ON o.idoption = a.idoption ORDER BY a.iduser, o.date`); reflect.DeepEqual(availability, expected) == false {
+		t.Errorf("user availability = %q, want: %q", availability, expected)
+	}
+}
+
+// Users with the same name in a meetup, from before names were unique, get their id added to the name.
+func TestMigrate_DuplicateUserNames(t *testing.T) {
+	db := openTestDb(t)
+	execAll(t, db,
+		`CREATE TABLE meetup (idmeetup INTEGER PRIMARY KEY ASC, userhash TEXT NOT NULL, adminhash TEXT NOT NULL, description TEXT NOT NULL, finaldate INTEGER NOT NULL DEFAULT 0, lastmodified INTEGER NOT NULL DEFAULT 0)`,
+		`CREATE TABLE "user" (iduser INTEGER PRIMARY KEY ASC NOT NULL, idmeetup INTEGER NOT NULL, name TEXT NOT NULL, token TEXT NOT NULL DEFAULT '', FOREIGN KEY (idmeetup) REFERENCES meetup (idmeetup) ON DELETE CASCADE)`,
+		`CREATE INDEX "user.fk_user_meetup_idx" ON "user" ("idmeetup")`,
+		`CREATE TABLE meetup_option (idoption INTEGER PRIMARY KEY ASC NOT NULL, idmeetup INTEGER NOT NULL, date INTEGER NOT NULL, duration INTEGER NOT NULL DEFAULT 0, UNIQUE (idmeetup, date), FOREIGN KEY (idmeetup) REFERENCES meetup (idmeetup) ON DELETE CASCADE)`,
+		`CREATE TABLE user_availability (iduser INTEGER NOT NULL, idoption INTEGER NOT NULL, availability TEXT NOT NULL CHECK (availability IN ('yes', 'ifneedbe')), PRIMARY KEY (iduser, idoption), FOREIGN KEY (iduser) REFERENCES "user" (iduser) ON DELETE CASCADE, FOREIGN KEY (idoption) REFERENCES meetup_option (idoption) ON DELETE CASCADE)`,
+		`CREATE INDEX "user_availability.fk_availability_option_idx" ON user_availability ("idoption")`,
+		`INSERT INTO meetup(idmeetup, userhash, adminhash, description) values(1,'a','b','c'), (2,'d','e','f')`,
+		`INSERT INTO "user"(iduser, idmeetup, name) values(1,1,'bob'), (2,1,'bob'), (3,1,'alice'), (4,2,'bob'), (5,1,'bob')`,
+		// "bob (2)" is taken in meetup 1 and has a duplicate too, "bob (5)" is only taken in meetup 2
+		`INSERT INTO "user"(iduser, idmeetup, name) values(6,1,'bob (2)'), (7,1,'bob (2)'), (8,2,'bob (5)')`,
+	)
+
+	checkMigrated(t, db, 8)
+
+	var expected = []string{"1 bob", "1 bob (2-2)", "1 alice", "2 bob", "1 bob (5)", "1 bob (2)", "1 bob (2) (7)", "2 bob (5)"}
+	if names := queryStrings(t, db, `SELECT idmeetup || ' ' || name FROM "user" ORDER BY iduser`); reflect.DeepEqual(names, expected) == false {
+		t.Errorf("user names = %q, want: %q", names, expected)
+	}
+	if _, err := db.Exec(`INSERT INTO "user"(idmeetup, name) values(1,'alice')`); err == nil {
+		t.Errorf("a second alice was inserted, names aren't unique")
+	}
+}
+
+// A corrupt blob fails the migration, and leaves the database as it was.
+func TestMigrate_CorruptBlob(t *testing.T) {
+	db := openTestDb(t)
+	execAll(t, db,
+		`CREATE TABLE meetup (idmeetup INTEGER PRIMARY KEY ASC, userhash TEXT NOT NULL, adminhash TEXT NOT NULL, dates BLOB NOT NULL, durations BLOB, description TEXT NOT NULL, finaldate INTEGER NOT NULL DEFAULT 0, lastmodified INTEGER NOT NULL DEFAULT 0)`,
+		`CREATE TABLE "user" (iduser INTEGER PRIMARY KEY ASC NOT NULL, idmeetup INTEGER NOT NULL, name TEXT NOT NULL, token TEXT NOT NULL DEFAULT '', dates BLOB NOT NULL, ifneedbe BLOB, FOREIGN KEY (idmeetup) REFERENCES meetup (idmeetup) ON DELETE CASCADE)`,
+	)
+	if _, err := db.Exec(`INSERT INTO meetup(idmeetup, userhash, adminhash, dates, description) values(1,'a','b',?,'c')`, []byte{blobVersionSorted, 0x80}); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, to, err := SQLite.Migrate(db, testEnv); err == nil || to != 6 {
+		t.Errorf("Migrate() = %d, %v, want: 6 and an error", to, err)
+	}
+	if version, err := SQLite.Version(db); err != nil || version != 6 {
+		t.Errorf("Version() = %d, %v, want: 6", version, err)
+	}
+	if present, err := hasColumn(db, "meetup_option", ""); err != nil || present {
+		t.Errorf("meetup_option table was left behind")
+	}
+}
+
+// The hashes of the meetups are replaced by their digests, and the userhash is sealed.
+func TestMigrate_DigestsTokens(t *testing.T) {
+	var statements = []string{
+		`CREATE TABLE meetup (idmeetup INTEGER PRIMARY KEY ASC, userhash TEXT NOT NULL, adminhash TEXT NOT NULL, description TEXT NOT NULL, finaldate INTEGER NOT NULL DEFAULT 0, lastmodified INTEGER NOT NULL DEFAULT 0)`,
+		`CREATE TABLE "user" (iduser INTEGER PRIMARY KEY ASC NOT NULL, idmeetup INTEGER NOT NULL, name TEXT NOT NULL, token TEXT NOT NULL DEFAULT '', FOREIGN KEY (idmeetup) REFERENCES meetup (idmeetup) ON DELETE CASCADE)`,
+		`CREATE INDEX "user.fk_user_meetup_idx" ON "user" ("idmeetup")`,
+		`CREATE TABLE meetup_option (idoption INTEGER PRIMARY KEY ASC NOT NULL, idmeetup INTEGER NOT NULL, date INTEGER NOT NULL, duration INTEGER NOT NULL DEFAULT 0, UNIQUE (idmeetup, date), FOREIGN KEY (idmeetup) REFERENCES meetup (idmeetup) ON DELETE CASCADE)`,
+		`CREATE TABLE user_availability (iduser INTEGER NOT NULL, idoption INTEGER NOT NULL, availability TEXT NOT NULL CHECK (availability IN ('yes', 'ifneedbe')), PRIMARY KEY (iduser, idoption), FOREIGN KEY (iduser) REFERENCES "user" (iduser) ON DELETE CASCADE, FOREIGN KEY (idoption) REFERENCES meetup_option (idoption) ON DELETE CASCADE)`,
+		`CREATE INDEX "user_availability.fk_availability_option_idx" ON user_availability ("idoption")`,
+		`INSERT INTO meetup(idmeetup, userhash, adminhash, description) values(1,'a','b','c'), (2,'d','e','f')`,
+	}
+	db := openTestDb(t)
+	execAll(t, db, statements...)
+
+	checkMigrated(t, db, 8)
+
+	var expected = []string{"1 digest:a digest:b sealed:a", "2 digest:d digest:e sealed:d"}
+	if hashes := queryStrings(t, db, `SELECT idmeetup || ' ' || userdigest || ' ' || admindigest || ' ' || usersealed FROM meetup ORDER BY idmeetup`); reflect.DeepEqual(hashes, expected) == false {
+		t.Errorf("meetup hashes = %q, want: %q", hashes, expected)
+	}
+
+	// Without the token key the hashes can't be migrated, and stay as they are
+	db = openTestDb(t)
+	execAll(t, db, statements...)
+	if _, to, err := SQLite.Migrate(db, Env{}); err == nil || to != 15 {
+		t.Errorf("Migrate() without the token key = %d, %v, want: 15 and an error", to, err)
+	}
+	if present, err := hasColumn(db, "meetup", "userhash"); err != nil || present == false {
+		t.Errorf("the userhash column was renamed by the failed migration")
+	}
+}
+
+// Returns the first column of the query rows as strings.
+func queryStrings(t *testing.T, db *sql.DB, query string) []string {
+	rows, err := db.Query(query)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+
+	var values []string
+	for rows.Next() {
+		var value string
+		if err = rows.Scan(&value); err != nil {
+			t.Fatal(err)
+		}
+		values = append(values, value)
+	}
+	return values
+}
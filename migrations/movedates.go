@@ -0,0 +1,93 @@
+package migrations
+
+import (
+	"database/sql"
+	"fmt"
+)
+
+// The Go step of migration 7. Copies the dates out of the meetup and user blob columns into the meetup_option and
+// user_availability tables, which migration 8 then drops. Dates a user picked that are no longer meetup options are
+// dropped, a date that is both a yes and an if need be is a yes.
+func moveDates(tx *sql.Tx, _ Env) error {
+	type blobRow struct {
+		id, idMeetUp int64
+		blobA, blobB []byte
+	}
+
+	// Reads all rows of the query first, the same connection is used for the inserts.
+	readBlobRows := func(query string) (blobRows []blobRow, retErr error) {
+		rows, retErr := tx.Query(query)
+		if retErr != nil {
+			return
+		}
+		defer func() {
+			if closeErr := rows.Close(); closeErr != nil {
+				retErr = fmt.Errorf("%s unable to close rows %s", retErr, closeErr)
+			}
+		}()
+
+		for rows.Next() {
+			var row blobRow
+			if retErr = rows.Scan(&row.id, &row.idMeetUp, &row.blobA, &row.blobB); retErr != nil {
+				return
+			}
+			blobRows = append(blobRows, row)
+		}
+		return blobRows, rows.Err()
+	}
+
+	meetUpRows, err := readBlobRows(`SELECT idmeetup, idmeetup, dates, durations FROM meetup`)
+	if err != nil {
+		return err
+	}
+	userRows, err := readBlobRows(`SELECT iduser, idmeetup, dates, ifneedbe FROM "user"`)
+	if err != nil {
+		return err
+	}
+
+	for _, row := range meetUpRows {
+		dates, err := convertBlobToDates(row.blobA)
+		if err != nil {
+			return fmt.Errorf("meetup %d dates: %w", row.id, err)
+		}
+		durations, err := convertBlobToDates(row.blobB)
+		if err != nil {
+			return fmt.Errorf("meetup %d durations: %w", row.id, err)
+		}
+
+		for i, date := range dates {
+			var duration int64
+			if i < len(durations) {
+				duration = durations[i]
+			}
+			if _, err = tx.Exec(`INSERT OR IGNORE INTO meetup_option(idmeetup, date, duration) values(?,?,?)`, row.id, date, duration); err != nil {
+				return err
+			}
+		}
+	}
+
+	for _, row := range userRows {
+		yes, err := convertBlobToDates(row.blobA)
+		if err != nil {
+			return fmt.Errorf("user %d dates: %w", row.id, err)
+		}
+		ifNeedBe, err := convertBlobToDates(row.blobB)
+		if err != nil {
+			return fmt.Errorf("user %d ifneedbe: %w", row.id, err)
+		}
+
+		for _, answer := range []struct {
+			availability string
+			dates        []int64
+		}{{"yes", yes}, {"ifneedbe", ifNeedBe}} {
+			for _, date := range answer.dates {
+				if _, err = tx.Exec(`INSERT OR IGNORE INTO user_availability(iduser, idoption, availability) SELECT ?, idoption, ? FROM meetup_option WHERE idmeetup = ? AND date = ?`,
+					row.id, answer.availability, row.idMeetUp, date); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,54 @@
+package migrations
+
+import (
+	"context"
+	"database/sql"
+)
+
+// Key of the advisory lock held while migrating a PostgreSQL database.
+const postgresLockKey = 0x6361746865726472 // "catherdr"
+
+// A PostgreSQL database keeps its version in the one row of the schema_version table, which the first migration
+// creates.
+func postgresVersion(db *sql.DB) (int, error) {
+	var exists bool
+	if err := db.QueryRow(`SELECT to_regclass('schema_version') IS NOT NULL`).Scan(&exists); err != nil {
+		return 0, err
+	}
+	if exists == false {
+		return 0, nil
+	}
+
+	var version int
+	if err := db.QueryRow(`SELECT version FROM schema_version`).Scan(&version); err != nil {
+		return 0, err
+	}
+	return version, nil
+}
+
+func postgresSetVersion(tx *sql.Tx, version int) error {
+	_, err := tx.Exec(`UPDATE schema_version SET version = $1`, version)
+	return err
+}
+
+// Takes a session advisory lock on a connection of its own, so servers that share the database and start together
+// migrate one after the other. The lock is released when the connection closes, if unlock isn't reached.
+func postgresLock(db *sql.DB) (unlock func() error, err error) {
+	ctx := context.Background()
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = conn.ExecContext(ctx, `SELECT pg_advisory_lock($1)`, postgresLockKey); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return func() error {
+		_, err := conn.ExecContext(ctx, `SELECT pg_advisory_unlock($1)`, postgresLockKey)
+		if closeErr := conn.Close(); err == nil {
+			err = closeErr
+		}
+		return err
+	}, nil
+}
@@ -0,0 +1,49 @@
+-- The schema of the first release on PostgreSQL, the same as version 8 of the sqlite schema
+CREATE TABLE schema_version
+(
+    version INTEGER NOT NULL
+);
+INSERT INTO schema_version (version) VALUES (0);
+
+CREATE TABLE meetup
+(
+    idmeetup     BIGSERIAL PRIMARY KEY,
+    userhash     TEXT   NOT NULL,
+    adminhash    TEXT   NOT NULL,
+    description  TEXT   NOT NULL,
+    finaldate    BIGINT NOT NULL DEFAULT 0,
+    lastmodified BIGINT NOT NULL DEFAULT 0
+);
+
+CREATE TABLE "user"
+(
+    iduser   BIGSERIAL PRIMARY KEY,
+    idmeetup BIGINT NOT NULL,
+    name     TEXT   NOT NULL,
+    token    TEXT   NOT NULL DEFAULT '',
+    FOREIGN KEY (idmeetup) REFERENCES meetup (idmeetup) ON DELETE CASCADE
+);
+
+CREATE INDEX user_fk_user_meetup_idx ON "user" (idmeetup);
+
+CREATE TABLE meetup_option
+(
+    idoption BIGSERIAL PRIMARY KEY,
+    idmeetup BIGINT NOT NULL,
+    date     BIGINT NOT NULL,
+    duration BIGINT NOT NULL DEFAULT 0,
+    UNIQUE (idmeetup, date),
+    FOREIGN KEY (idmeetup) REFERENCES meetup (idmeetup) ON DELETE CASCADE
+);
+
+CREATE TABLE user_availability
+(
+    iduser       BIGINT NOT NULL,
+    idoption     BIGINT NOT NULL,
+    availability TEXT   NOT NULL CHECK (availability IN ('yes', 'ifneedbe')),
+    PRIMARY KEY (iduser, idoption),
+    FOREIGN KEY (iduser) REFERENCES "user" (iduser) ON DELETE CASCADE,
+    FOREIGN KEY (idoption) REFERENCES meetup_option (idoption) ON DELETE CASCADE
+);
+
+CREATE INDEX user_availability_fk_availability_option_idx ON user_availability (idoption);
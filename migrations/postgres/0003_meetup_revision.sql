@@ -0,0 +1,2 @@
+-- Counts the updates of a meetup, for optimistic concurrency
+ALTER TABLE meetup ADD COLUMN revision BIGINT NOT NULL DEFAULT 1;
@@ -0,0 +1,26 @@
+-- Webhook urls of a meetup, and the queue of payloads waiting to be POSTed to them. A delivery keeps its own url and
+-- secret, so the payload of a deleted meetup is still delivered after its webhooks are gone.
+CREATE TABLE webhook
+(
+    idwebhook BIGSERIAL PRIMARY KEY,
+    idmeetup  BIGINT NOT NULL,
+    url       TEXT   NOT NULL,
+    secret    TEXT   NOT NULL,
+    created   BIGINT NOT NULL,
+    FOREIGN KEY (idmeetup) REFERENCES meetup (idmeetup) ON DELETE CASCADE
+);
+
+CREATE INDEX webhook_fk_webhook_meetup_idx ON webhook (idmeetup);
+
+CREATE TABLE webhook_delivery
+(
+    iddelivery  BIGSERIAL PRIMARY KEY,
+    url         TEXT    NOT NULL,
+    secret      TEXT    NOT NULL,
+    payload     TEXT    NOT NULL,
+    attempts    INTEGER NOT NULL DEFAULT 0,
+    nextattempt BIGINT  NOT NULL,
+    lasterror   TEXT    NOT NULL DEFAULT ''
+);
+
+CREATE INDEX webhook_delivery_nextattempt_idx ON webhook_delivery (nextattempt);
@@ -0,0 +1,2 @@
+-- The organiser's address for email notifications, empty for none
+ALTER TABLE meetup ADD COLUMN email TEXT NOT NULL DEFAULT '';
@@ -0,0 +1,7 @@
+-- When the meetup or user was deleted, 0 if it isn't. Deleted rows can be restored until the janitor purges them.
+ALTER TABLE meetup ADD COLUMN deleted_at BIGINT NOT NULL DEFAULT 0;
+ALTER TABLE "user" ADD COLUMN deleted_at BIGINT NOT NULL DEFAULT 0;
+
+-- A deleted user's name can be taken by a new user
+ALTER TABLE "user" DROP CONSTRAINT user_idmeetup_name_key;
+CREATE UNIQUE INDEX user_idmeetup_name_key ON "user" (idmeetup, name) WHERE deleted_at = 0;
@@ -0,0 +1,18 @@
+-- The audit log of a meetup, appended to in the transaction of each change. The dates are json arrays. The client's
+-- IP address is only kept as a keyed hash.
+CREATE TABLE meetup_event
+(
+    idevent     BIGSERIAL PRIMARY KEY,
+    idmeetup    BIGINT NOT NULL,
+    action      TEXT   NOT NULL,
+    name        TEXT   NOT NULL,
+    olddates    TEXT   NOT NULL,
+    newdates    TEXT   NOT NULL,
+    oldifneedbe TEXT   NOT NULL,
+    newifneedbe TEXT   NOT NULL,
+    created     BIGINT NOT NULL,
+    iphash      TEXT   NOT NULL,
+    FOREIGN KEY (idmeetup) REFERENCES meetup (idmeetup) ON DELETE CASCADE
+);
+
+CREATE INDEX meetup_event_fk_meetup_event_meetup_idx ON meetup_event (idmeetup);
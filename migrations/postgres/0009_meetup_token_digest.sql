@@ -0,0 +1,9 @@
+-- The meetup hashes are stored as keyed digests, so a copy of the database can't be used to open the meetups. The
+-- userhash is also kept encrypted in usersealed, for the links the server hands out. The Go step replaces the hashes
+-- in the renamed columns.
+ALTER TABLE meetup RENAME COLUMN userhash TO userdigest;
+ALTER TABLE meetup RENAME COLUMN adminhash TO admindigest;
+ALTER TABLE meetup ADD COLUMN usersealed TEXT NOT NULL DEFAULT '';
+
+CREATE INDEX meetup_userdigest_idx ON meetup (userdigest);
+CREATE INDEX meetup_admindigest_idx ON meetup (admindigest);
@@ -0,0 +1,87 @@
+package migrations
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	_ "github.com/lib/pq"
+)
+
+// Opens a new empty schema in the PostgreSQL database at the CATHERDER_TEST_POSTGRES url, skips the test if it isn't
+// set. The schema is dropped when the test finishes.
+func openTestPostgresDb(t *testing.T) *sql.DB {
+	dsn := os.Getenv("CATHERDER_TEST_POSTGRES")
+	if dsn == "" {
+		t.Skip("CATHERDER_TEST_POSTGRES is not set")
+	}
+
+	admin, err := sql.Open("postgres", dsn)
+	if err != nil {
+		t.Fatal("Failed to open database:", err)
+	}
+	schema := fmt.Sprintf("catherder_test_%d", time.Now().UnixNano())
+	execAll(t, admin, `CREATE SCHEMA `+schema)
+	t.Cleanup(func() {
+		execAll(t, admin, `DROP SCHEMA `+schema+` CASCADE`)
+		admin.Close()
+	})
+
+	separator := "?"
+	if strings.Contains(dsn, "?") {
+		separator = "&"
+	}
+	db, err := sql.Open("postgres", dsn+separator+"search_path="+schema)
+	if err != nil {
+		t.Fatal("Failed to open database:", err)
+	}
+	t.Cleanup(func() {
+		db.Close()
+	})
+	return db
+}
+
+func TestPostgres_Migrate(t *testing.T) {
+	db := openTestPostgresDb(t)
+
+	latest, err := Postgres.Latest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if from, to, err := Postgres.Migrate(db, testEnv); err != nil || from != 0 || to != latest {
+		t.Errorf("Migrate() = %d, %d, %v, want: 0, %d, nil", from, to, err, latest)
+	}
+	if version, err := Postgres.Version(db); err != nil || version != latest {
+		t.Errorf("Version() = %d, %v, want: %d", version, err, latest)
+	}
+
+	// Running again does nothing
+	if from, to, err := Postgres.Migrate(db, testEnv); err != nil || from != latest || to != latest {
+		t.Errorf("second Migrate() = %d, %d, %v, want: %d, %d, nil", from, to, err, latest, latest)
+	}
+}
+
+// Both dialects end up with the same tables and columns.
+func TestPostgres_SameTables(t *testing.T) {
+	postgresDb := openTestPostgresDb(t)
+	if _, _, err := Postgres.Migrate(postgresDb, testEnv); err != nil {
+		t.Fatalf("Postgres Migrate() failed: %s", err)
+	}
+	sqliteDb := openTestDb(t)
+	if _, _, err := SQLite.Migrate(sqliteDb, testEnv); err != nil {
+		t.Fatalf("SQLite Migrate() failed: %s", err)
+	}
+
+	postgresColumns := queryStrings(t, postgresDb, `SELECT table_name || '.' || column_name FROM information_schema.columns WHERE table_schema = current_schema() AND table_name <> 'schema_version'`)
+	sqliteColumns := queryStrings(t, sqliteDb, `SELECT m.name || '.' || c.name FROM sqlite_master m, pragma_table_info(m.name) c WHERE m.type = 'table' AND m.name NOT LIKE 'sqlite_%'`)
+	sort.Strings(postgresColumns)
+	sort.Strings(sqliteColumns)
+	if reflect.DeepEqual(postgresColumns, sqliteColumns) == false {
+		t.Errorf("the postgres columns are different to the sqlite ones.\npostgres: %q\nsqlite: %q", postgresColumns, sqliteColumns)
+	}
+}
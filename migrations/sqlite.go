@@ -0,0 +1,88 @@
+package migrations
+
+import (
+	"database/sql"
+	"fmt"
+)
+
+// A sqlite database keeps its version in PRAGMA user_version.
+func sqliteVersion(db *sql.DB) (int, error) {
+	var version int
+	if err := db.QueryRow(`PRAGMA user_version`).Scan(&version); err != nil {
+		return 0, err
+	}
+	if version == 0 {
+		return legacyVersion(db)
+	}
+	return version, nil
+}
+
+func sqliteSetVersion(tx *sql.Tx, version int) error {
+	// PRAGMA doesn't take parameters
+	_, err := tx.Exec(fmt.Sprintf(`PRAGMA user_version = %d`, version))
+	return err
+}
+
+// Works out the version of a database created before the migrations existed, which all have user_version 0.
+// Older versions added columns on startup in the same order as migrations 2 to 6, and moved the dates into their
+// own tables as migrations 7 and 8 do.
+func legacyVersion(db *sql.DB) (int, error) {
+	var steps = []struct {
+		table, column string // An empty column checks the table exists
+	}{
+		{"meetup", ""},
+		{"user", "token"},
+		{"meetup", "durations"},
+		{"user", "ifneedbe"},
+		{"meetup", "finaldate"},
+		{"meetup", "lastmodified"},
+	}
+
+	hasOptions, err := hasColumn(db, "meetup_option", "")
+	if err != nil {
+		return 0, err
+	}
+	hasDates, err := hasColumn(db, "meetup", "dates")
+	if err != nil {
+		return 0, err
+	}
+	if hasOptions && hasDates == false {
+		return 8, nil
+	}
+
+	version := 0
+	for _, step := range steps {
+		present, err := hasColumn(db, step.table, step.column)
+		if err != nil {
+			return 0, err
+		} else if present == false {
+			break
+		}
+		version++
+	}
+	return version, nil
+}
+
+// Checks whether a table has a column with the given name, or whether the table exists if column is empty.
+func hasColumn(db *sql.DB, table, column string) (present bool, retErr error) {
+	rows, retErr := db.Query(`SELECT name FROM pragma_table_info(?)`, table)
+	if retErr != nil {
+		return
+	}
+	defer func() {
+		if closeErr := rows.Close(); closeErr != nil {
+			retErr = fmt.Errorf("%s unable to close rows %s", retErr, closeErr)
+		}
+	}()
+
+	for rows.Next() {
+		var name string
+		if retErr = rows.Scan(&name); retErr != nil {
+			return
+		}
+		if column == "" || name == column {
+			present = true
+		}
+	}
+	return present, rows.Err()
+}
@@ -1,11 +1,10 @@
-PRAGMA foreign_keys = ON;
-
+-- The schema of the first release
 CREATE TABLE IF NOT EXISTS meetup
 (
     idmeetup    INTEGER PRIMARY KEY ASC,
     userhash    TEXT    NOT NULL,
     adminhash   TEXT    NOT NULL,
-    dates       BLOB,
+    dates       BLOB    NOT NULL,
     description TEXT    NOT NULL
 );
 
@@ -14,7 +13,7 @@ CREATE TABLE IF NOT EXISTS "user"
     iduser   INTEGER PRIMARY KEY ASC NOT NULL,
     idmeetup INTEGER                 NOT NULL,
     name     TEXT                    NOT NULL,
-    dates    BLOB,
+    dates    BLOB                    NOT NULL,
     FOREIGN KEY (idmeetup) REFERENCES meetup (idmeetup) ON DELETE CASCADE
 );
 
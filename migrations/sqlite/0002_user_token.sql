@@ -0,0 +1,2 @@
+-- Secret edit token of each user
+ALTER TABLE "user" ADD COLUMN token TEXT NOT NULL DEFAULT '';
@@ -0,0 +1,2 @@
+-- Length of each meetup option, parallel to the dates blob
+ALTER TABLE meetup ADD COLUMN durations BLOB;
@@ -0,0 +1,2 @@
+-- Dates a user could make if they have to
+ALTER TABLE "user" ADD COLUMN ifneedbe BLOB;
@@ -0,0 +1,2 @@
+-- The date chosen by the admin, 0 while the meetup is open
+ALTER TABLE meetup ADD COLUMN finaldate INTEGER NOT NULL DEFAULT 0;
@@ -0,0 +1,2 @@
+-- When the meetup or any of its users last changed
+ALTER TABLE meetup ADD COLUMN lastmodified INTEGER NOT NULL DEFAULT 0;
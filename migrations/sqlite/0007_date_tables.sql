@@ -0,0 +1,22 @@
+-- Dates move out of the blob columns into their own tables. moveDates() copies the blobs into them.
+CREATE TABLE IF NOT EXISTS meetup_option
+(
+    idoption INTEGER PRIMARY KEY ASC NOT NULL,
+    idmeetup INTEGER                 NOT NULL,
+    date     INTEGER                 NOT NULL,
+    duration INTEGER                 NOT NULL DEFAULT 0,
+    UNIQUE (idmeetup, date),
+    FOREIGN KEY (idmeetup) REFERENCES meetup (idmeetup) ON DELETE CASCADE
+);
+
+CREATE TABLE IF NOT EXISTS user_availability
+(
+    iduser       INTEGER NOT NULL,
+    idoption     INTEGER NOT NULL,
+    availability TEXT    NOT NULL CHECK (availability IN ('yes', 'ifneedbe')),
+    PRIMARY KEY (iduser, idoption),
+    FOREIGN KEY (iduser) REFERENCES "user" (iduser) ON DELETE CASCADE,
+    FOREIGN KEY (idoption) REFERENCES meetup_option (idoption) ON DELETE CASCADE
+);
+
+CREATE INDEX IF NOT EXISTS "user_availability.fk_availability_option_idx" ON user_availability ("idoption");
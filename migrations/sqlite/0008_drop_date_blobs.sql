@@ -0,0 +1,5 @@
+-- The blob columns are replaced by the date tables
+ALTER TABLE meetup DROP COLUMN dates;
+ALTER TABLE meetup DROP COLUMN durations;
+ALTER TABLE "user" DROP COLUMN dates;
+ALTER TABLE "user" DROP COLUMN ifneedbe;
@@ -0,0 +1,16 @@
+-- A user name is unique within its meetup. Duplicates left by concurrent submissions get their id added to the name,
+-- "bob (12)", or "bob (12-2)", "bob (12-3)", ... if the meetup already has a user with that name.
+-- sqlite can't add a table constraint, the unique index is the same as UNIQUE (idmeetup, name).
+UPDATE "user"
+SET name = (
+    WITH RECURSIVE candidate(k, name) AS (
+        SELECT 1, "user".name || ' (' || "user".iduser || ')'
+        UNION ALL
+        SELECT k + 1, "user".name || ' (' || "user".iduser || '-' || (k + 1) || ')' FROM candidate
+        WHERE EXISTS (SELECT 1 FROM "user" other WHERE other.idmeetup = "user".idmeetup AND other.name = candidate.name)
+    )
+    SELECT name FROM candidate ORDER BY k DESC LIMIT 1
+)
+WHERE iduser NOT IN (SELECT min(iduser) FROM "user" GROUP BY idmeetup, name);
+
+CREATE UNIQUE INDEX IF NOT EXISTS "user.unique_meetup_name_idx" ON "user" (idmeetup, name);
@@ -0,0 +1,26 @@
+-- Webhook urls of a meetup, and the queue of payloads waiting to be POSTed to them. A delivery keeps its own url and
+-- secret, so the payload of a deleted meetup is still delivered after its webhooks are gone.
+CREATE TABLE IF NOT EXISTS webhook
+(
+    idwebhook INTEGER PRIMARY KEY ASC NOT NULL,
+    idmeetup  INTEGER                 NOT NULL,
+    url       TEXT                    NOT NULL,
+    secret    TEXT                    NOT NULL,
+    created   INTEGER                 NOT NULL,
+    FOREIGN KEY (idmeetup) REFERENCES meetup (idmeetup) ON DELETE CASCADE
+);
+
+CREATE INDEX IF NOT EXISTS "webhook.fk_webhook_meetup_idx" ON webhook ("idmeetup");
+
+CREATE TABLE IF NOT EXISTS webhook_delivery
+(
+    iddelivery  INTEGER PRIMARY KEY ASC NOT NULL,
+    url         TEXT                    NOT NULL,
+    secret      TEXT                    NOT NULL,
+    payload     TEXT                    NOT NULL,
+    attempts    INTEGER                 NOT NULL DEFAULT 0,
+    nextattempt INTEGER                 NOT NULL,
+    lasterror   TEXT                    NOT NULL DEFAULT ''
+);
+
+CREATE INDEX IF NOT EXISTS "webhook_delivery.nextattempt_idx" ON webhook_delivery ("nextattempt");
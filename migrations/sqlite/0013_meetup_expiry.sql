@@ -0,0 +1,5 @@
+-- When the meetup was created, taken to be its last change for the existing ones. lastmodified is its last activity.
+ALTER TABLE meetup ADD COLUMN created INTEGER NOT NULL DEFAULT 0;
+UPDATE meetup SET created = lastmodified;
+-- When the janitor deletes the meetup, 0 for the default after its last date
+ALTER TABLE meetup ADD COLUMN expires INTEGER NOT NULL DEFAULT 0;
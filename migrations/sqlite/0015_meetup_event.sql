@@ -0,0 +1,18 @@
+-- The audit log of a meetup, appended to in the transaction of each change. The dates are json arrays. The client's
+-- IP address is only kept as a keyed hash.
+CREATE TABLE IF NOT EXISTS meetup_event
+(
+    idevent     INTEGER PRIMARY KEY ASC NOT NULL,
+    idmeetup    INTEGER                 NOT NULL,
+    action      TEXT                    NOT NULL,
+    name        TEXT                    NOT NULL,
+    olddates    TEXT                    NOT NULL,
+    newdates    TEXT                    NOT NULL,
+    oldifneedbe TEXT                    NOT NULL,
+    newifneedbe TEXT                    NOT NULL,
+    created     INTEGER                 NOT NULL,
+    iphash      TEXT                    NOT NULL,
+    FOREIGN KEY (idmeetup) REFERENCES meetup (idmeetup) ON DELETE CASCADE
+);
+
+CREATE INDEX IF NOT EXISTS "meetup_event.fk_meetup_event_meetup_idx" ON meetup_event ("idmeetup");
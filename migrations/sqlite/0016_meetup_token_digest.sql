@@ -0,0 +1,10 @@
+-- The meetup hashes are stored as keyed digests, so a copy of the database can't be used to open the meetups. The
+-- userhash is also kept encrypted in usersealed, for the links the server hands out. The Go step replaces the hashes
+-- in the renamed columns. secure_delete overwrites the hashes in the file, rather than leaving them in free pages.
+PRAGMA secure_delete = ON;
+ALTER TABLE meetup RENAME COLUMN userhash TO userdigest;
+ALTER TABLE meetup RENAME COLUMN adminhash TO admindigest;
+ALTER TABLE meetup ADD COLUMN usersealed TEXT NOT NULL DEFAULT '';
+
+CREATE INDEX IF NOT EXISTS "meetup.userdigest_idx" ON meetup ("userdigest");
+CREATE INDEX IF NOT EXISTS "meetup.admindigest_idx" ON meetup ("admindigest");
@@ -0,0 +1,3 @@
+-- When the organiser confirmed the email address, 0 until they do. The digest is only sent to a confirmed address, the
+-- addresses saved before have to be confirmed too.
+ALTER TABLE meetup ADD COLUMN emailconfirmed INTEGER NOT NULL DEFAULT 0;
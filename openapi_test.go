@@ -0,0 +1,418 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"mime"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// Checks requests and responses of the api against openapi.json, and which of its operations were checked.
+type openApiChecker struct {
+	t       *testing.T
+	doc     map[string]interface{}
+	handler http.Handler
+	checked map[string]bool // "<method> <path>" of the operations
+	ctx     context.Context // The context of the requests, the default when nil
+}
+
+// Sends a request through the handler, and checks the request body and the response against the operation in the
+// document. Returns the response status and its decoded json, nil for other content.
+func (c *openApiChecker) request(method, target string, header http.Header, body interface{}) (int, map[string]interface{}) {
+	c.t.Helper()
+
+	var reqBody []byte
+	if body != nil {
+		var err error
+		if reqBody, err = json.Marshal(body); err != nil {
+			c.t.Fatal(err)
+		}
+	}
+	request := httptest.NewRequest(method, target, bytes.NewReader(reqBody))
+	if c.ctx != nil {
+		request = request.WithContext(c.ctx)
+	}
+	for key, values := range header {
+		request.Header[key] = values
+	}
+	w := httptest.NewRecorder()
+	c.handler.ServeHTTP(w, request)
+	name := method + " " + request.URL.Path
+
+	path, operation := c.operation(method, request.URL.Path)
+	if operation == nil {
+		c.t.Errorf("%s: not in openapi.json\n", name)
+		return w.Code, nil
+	}
+	c.checked[strings.ToUpper(method)+" "+path] = true
+
+	// The request, only sent bodies that are meant to be valid
+	if requestBody, ok := operation["requestBody"].(map[string]interface{}); ok && body != nil && w.Code < 400 {
+		schema := c.resolve(requestBody)["content"].(map[string]interface{})["application/json"].(map[string]interface{})["schema"]
+		if err := c.validate(schema, decodeJson(c.t, reqBody), "request"); err != nil {
+			c.t.Errorf("%s: %s\n", name, err)
+		}
+	}
+
+	// The response
+	responses := operation["responses"].(map[string]interface{})
+	response, ok := responses[strconv.Itoa(w.Code)]
+	if !ok {
+		c.t.Errorf("%s: status %d is not in openapi.json. body: %s\n", name, w.Code, w.Body)
+		return w.Code, nil
+	}
+	content, ok := c.resolve(response)["content"].(map[string]interface{})
+	if !ok {
+		if w.Body.Len() > 0 {
+			c.t.Errorf("%s: status %d has no content in openapi.json, but a body: %s\n", name, w.Code, w.Body)
+		}
+		return w.Code, nil
+	}
+
+	mediaType, _, _ := mime.ParseMediaType(w.Header().Get("Content-Type"))
+	media, ok := content[mediaType].(map[string]interface{})
+	if !ok {
+		c.t.Errorf("%s: status %d content type %q is not in openapi.json\n", name, w.Code, mediaType)
+		return w.Code, nil
+	} else if mediaType != "application/json" {
+		return w.Code, nil
+	}
+
+	value := decodeJson(c.t, w.Body.Bytes())
+	if err := c.validate(media["schema"], value, "response"); err != nil {
+		c.t.Errorf("%s: status %d %s. body: %s\n", name, w.Code, err, w.Body)
+	}
+	result, _ := value.(map[string]interface{})
+	return w.Code, result
+}
+
+func decodeJson(t *testing.T, js []byte) interface{} {
+	t.Helper()
+	var value interface{}
+	if err := json.Unmarshal(js, &value); err != nil {
+		t.Fatalf("invalid json %s: %s\n", js, err)
+	}
+	return value
+}
+
+// Returns the path template and operation of the document that match the request, nil if there are none.
+func (c *openApiChecker) operation(method, path string) (string, map[string]interface{}) {
+	for template, item := range c.doc["paths"].(map[string]interface{}) {
+		if matchPathTemplate(template, path) {
+			operation, _ := item.(map[string]interface{})[strings.ToLower(method)].(map[string]interface{})
+			return template, operation
+		}
+	}
+	return "", nil
+}
+
+// Returns true if the path matches the template, whose {parameters} each match one segment.
+func matchPathTemplate(template, path string) bool {
+	templateSegments, pathSegments := strings.Split(template, "/"), strings.Split(path, "/")
+	if len(templateSegments) != len(pathSegments) {
+		return false
+	}
+	for i, segment := range templateSegments {
+		if strings.HasPrefix(segment, "{") {
+			if pathSegments[i] == "" {
+				return false
+			}
+		} else if segment != pathSegments[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// Follows the $ref of a node of the document, if it has one.
+func (c *openApiChecker) resolve(node interface{}) map[string]interface{} {
+	object, _ := node.(map[string]interface{})
+	ref, ok := object["$ref"].(string)
+	if !ok {
+		return object
+	}
+
+	var target interface{} = c.doc
+	for _, key := range strings.Split(strings.TrimPrefix(ref, "#/"), "/") {
+		target = target.(map[string]interface{})[key]
+	}
+	if target == nil {
+		c.t.Fatalf("openapi.json: %s does not exist\n", ref)
+	}
+	return c.resolve(target)
+}
+
+// Validates the decoded json value against the schema. Knows the parts of json schema openapi.json uses.
+func (c *openApiChecker) validate(schemaNode interface{}, value interface{}, at string) error {
+	schema := c.resolve(schemaNode)
+
+	if value == nil {
+		if schema["nullable"] == true {
+			return nil
+		}
+		return fmt.Errorf("%s is null", at)
+	}
+
+	if oneOf, ok := schema["oneOf"].([]interface{}); ok {
+		var matches int
+		var errs []string
+		for _, option := range oneOf {
+			if err := c.validate(option, value, at); err != nil {
+				errs = append(errs, err.Error())
+			} else {
+				matches++
+			}
+		}
+		if matches != 1 {
+			return fmt.Errorf("%s matches %d of oneOf: %s", at, matches, strings.Join(errs, "; "))
+		}
+		return nil
+	}
+
+	if enum, ok := schema["enum"].([]interface{}); ok {
+		found := false
+		for _, option := range enum {
+			found = found || reflect.DeepEqual(option, value)
+		}
+		if !found {
+			return fmt.Errorf("%s is %v, not one of %v", at, value, enum)
+		}
+	}
+
+	switch schema["type"] {
+	case "object":
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("%s is not an object", at)
+		}
+		properties, _ := schema["properties"].(map[string]interface{})
+		required, _ := schema["required"].([]interface{})
+		for _, key := range required {
+			if _, found := object[key.(string)]; !found {
+				return fmt.Errorf("%s has no %s", at, key)
+			}
+		}
+		for key, property := range object {
+			if propertySchema, found := properties[key]; found {
+				if err := c.validate(propertySchema, property, at+"."+key); err != nil {
+					return err
+				}
+			} else if schema["additionalProperties"] == false {
+				return fmt.Errorf("%s.%s is not in the schema", at, key)
+			}
+		}
+	case "array":
+		array, ok := value.([]interface{})
+		if !ok {
+			return fmt.Errorf("%s is not an array", at)
+		}
+		for i, item := range array {
+			if err := c.validate(schema["items"], item, fmt.Sprintf("%s[%d]", at, i)); err != nil {
+				return err
+			}
+		}
+	case "string":
+		if _, ok := value.(string); !ok {
+			return fmt.Errorf("%s is not a string", at)
+		}
+	case "boolean":
+		if _, ok := value.(bool); !ok {
+			return fmt.Errorf("%s is not a boolean", at)
+		}
+	case "integer":
+		if number, ok := value.(float64); !ok || number != math.Trunc(number) {
+			return fmt.Errorf("%s is not an integer", at)
+		}
+	case "number":
+		if _, ok := value.(float64); !ok {
+			return fmt.Errorf("%s is not a number", at)
+		}
+	}
+	return nil
+}
+
+// The document must list exactly the routes of the server.
+func TestOpenApi_Routes(t *testing.T) {
+	var doc map[string]interface{}
+	if err := json.Unmarshal(openApiSpec, &doc); err != nil {
+		t.Fatalf("openapi.json is invalid json: %s\n", err)
+	}
+
+	var routes, documented []string
+	srv := newServer(newMemStore())
+	for path := range srv.apiRoutes() {
+		for method := range doc["paths"].(map[string]interface{})[path].(map[string]interface{}) {
+			if method != "parameters" { // Any method reaches a v1 route, each documented one counts
+				routes = append(routes, strings.ToUpper(method)+" "+path)
+			}
+		}
+	}
+	for pattern := range srv.apiV2Routes() {
+		routes = append(routes, pattern)
+	}
+	for path, item := range doc["paths"].(map[string]interface{}) {
+		for method := range item.(map[string]interface{}) {
+			if method != "parameters" {
+				documented = append(documented, strings.ToUpper(method)+" "+path)
+			}
+		}
+	}
+
+	sort.Strings(routes)
+	sort.Strings(documented)
+	if reflect.DeepEqual(routes, documented) == false {
+		t.Errorf("openapi.json operations:\n%v\nwant the routes:\n%v\n", documented, routes)
+	}
+}
+
+// Runs every operation of the api through the server, and checks the requests and responses against the document.
+func TestOpenApi_Responses(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store Store) {
+		srv := newServer(store)
+		handler, err := srv.routes()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		c := &openApiChecker{t: t, handler: handler, checked: map[string]bool{}}
+		if err := json.Unmarshal(openApiSpec, &c.doc); err != nil {
+			t.Fatalf("openapi.json is invalid json: %s\n", err)
+		}
+		c.request("GET", "/api/openapi.json", nil, nil)
+
+		dates := []int64{1550401200000, 1550487600000, 1550574000000}
+		result := func(response map[string]interface{}) map[string]interface{} {
+			t.Helper()
+			if response["error"] != "" {
+				t.Fatalf("error: %v\n", response["error"])
+			}
+			return response["result"].(map[string]interface{})
+		}
+
+		// The v1 api
+		_, response := c.request("POST", "/api/updatemeetup", nil, map[string]interface{}{"description": "a", "dates": dates, "durations": []int64{3600000, 0, 0}})
+		meetUp := result(response)
+		userHash, adminHash := meetUp["userhash"].(string), meetUp["adminhash"].(string)
+		c.request("POST", "/api/updatemeetup", nil, map[string]interface{}{"adminhash": adminHash, "revision": 1, "description": "b", "dates": dates})
+		c.request("POST", "/api/updatemeetup", http.Header{"If-Match": {`"1"`}}, map[string]interface{}{"adminhash": adminHash, "dates": dates})
+		c.request("POST", "/api/updatemeetup", nil, map[string]interface{}{"dates": []int64{}})
+		c.request("POST", "/api/addwebhook", nil, map[string]interface{}{"adminhash": adminHash, "url": "https://example.com/a"})
+		_, response = c.request("POST", "/api/addwebhook", nil, map[string]interface{}{"adminhash": adminHash, "url": "https://example.com/b"})
+		c.request("POST", "/api/addwebhook", nil, map[string]interface{}{"adminhash": adminHash, "url": "ftp://example.com"})
+		c.request("POST", "/api/deletewebhook", nil, map[string]interface{}{"adminhash": adminHash, "id": result(response)["id"]})
+		c.request("POST", "/api/deletewebhook", nil, map[string]interface{}{"adminhash": adminHash, "id": 0})
+		c.request("POST", "/api/getwebhooks", nil, map[string]interface{}{"adminhash": adminHash})
+		c.request("POST", "/api/getusermeetup", nil, map[string]interface{}{"userhash": userHash})
+		c.request("POST", "/api/getusermeetup", nil, map[string]interface{}{"userhash": adminHash})
+		c.request("POST", "/api/getadminmeetup", nil, map[string]interface{}{"adminhash": adminHash})
+		c.request("POST", "/api/summary", nil, map[string]interface{}{"userhash": userHash})
+
+		c.request("POST", "/api/updateuser", nil, map[string]interface{}{"userhash": userHash, "username": "alice", "dates": dates[:1], "ifneedbe": dates[1:2]})
+		c.request("POST", "/api/updateuser", nil, map[string]interface{}{"userhash": userHash, "username": "bob"})
+		c.request("POST", "/api/updateuser", nil, map[string]interface{}{"userhash": userHash, "username": "alice"})
+		c.request("POST", "/api/getusermeetup", nil, map[string]interface{}{"userhash": userHash})
+		c.request("POST", "/api/getadminmeetup", nil, map[string]interface{}{"adminhash": adminHash})
+		c.request("POST", "/api/summary", nil, map[string]interface{}{"adminhash": adminHash})
+
+		c.request("GET", "/api/ics?id="+userHash, nil, nil)
+		c.request("GET", "/api/ics?id=abc", nil, nil)
+		c.request("GET", "/api/ics?id="+adminHash, nil, nil)
+		c.request("GET", "/api/feed?id="+userHash+"&name=alice", nil, nil)
+		c.request("GET", "/api/feed?id="+userHash+"&name=carol", nil, nil)
+
+		// A disconnected client ends the event stream after its headers
+		var cancel context.CancelFunc
+		c.ctx, cancel = context.WithCancel(context.Background())
+		cancel()
+		c.request("GET", "/api/events?id="+userHash, nil, nil)
+		c.ctx = nil
+		c.request("GET", "/api/events?id=abc", nil, nil)
+		c.request("GET", "/api/events?id="+adminHash, nil, nil)
+
+		c.request("POST", "/api/finalisemeetup", nil, map[string]interface{}{"adminhash": adminHash, "date": dates[0]})
+		c.request("POST", "/api/deleteuser", nil, map[string]interface{}{"userhash": userHash, "username": "bob"})
+		c.request("POST", "/api/reopenmeetup", nil, map[string]interface{}{"adminhash": adminHash})
+		c.request("POST", "/api/deleteuser", nil, map[string]interface{}{"userhash": userHash, "username": "bob"})
+		c.request("POST", "/api/restoreuser", nil, map[string]interface{}{"userhash": userHash, "username": "bob"})
+		c.request("POST", "/api/restoreuser", nil, map[string]interface{}{"userhash": userHash, "username": "bob"})
+		c.request("POST", "/api/gethistory", nil, map[string]interface{}{"adminhash": adminHash})
+		c.request("POST", "/api/gethistory", nil, map[string]interface{}{"adminhash": userHash})
+		_, response = c.request("POST", "/api/rotatehashes", nil, map[string]interface{}{"adminhash": adminHash, "newuserhash": true})
+		adminHash, userHash = result(response)["adminhash"].(string), result(response)["userhash"].(string)
+		c.request("POST", "/api/rotatehashes", http.Header{"If-Match": {`"1"`}}, map[string]interface{}{"adminhash": adminHash})
+		c.request("POST", "/api/rotatehashes", nil, map[string]interface{}{"adminhash": userHash})
+		c.request("POST", "/api/deletemeetup", nil, map[string]interface{}{"adminhash": adminHash})
+		c.request("POST", "/api/restoremeetup", nil, map[string]interface{}{"adminhash": adminHash})
+		c.request("POST", "/api/restoremeetup", nil, map[string]interface{}{"adminhash": adminHash})
+		c.request("POST", "/api/deletemeetup", nil, map[string]interface{}{"adminhash": adminHash})
+
+		// The v2 api
+		_, response = c.request("POST", "/api/v2/meetups", nil, map[string]interface{}{"description": "a", "dates": dates})
+		meetUp = result(response)
+		meetUpUrl, admin := "/api/v2/meetups/"+meetUp["userhash"].(string), http.Header{"Authorization": {"Bearer " + meetUp["adminhash"].(string)}}
+		c.request("POST", "/api/v2/meetups", nil, map[string]interface{}{"dates": []int64{}})
+		_, response = c.request("POST", meetUpUrl+"/webhooks", admin, map[string]interface{}{"url": "https://example.com/a"})
+		webhookUrl := meetUpUrl + "/webhooks/" + strconv.FormatFloat(result(response)["id"].(float64), 'f', -1, 64)
+		c.request("POST", meetUpUrl+"/webhooks", admin, map[string]interface{}{"url": ""})
+		c.request("POST", meetUpUrl+"/webhooks", nil, map[string]interface{}{"url": "https://example.com/a"})
+		c.request("GET", meetUpUrl+"/webhooks", admin, nil)
+		c.request("GET", meetUpUrl+"/webhooks", http.Header{"Authorization": {"Bearer " + meetUp["userhash"].(string)}}, nil)
+		c.request("GET", meetUpUrl, nil, nil)
+		c.request("GET", "/api/v2/meetups/abc", nil, nil)
+		c.request("PUT", meetUpUrl, admin, map[string]interface{}{"description": "b", "dates": dates, "revision": 1})
+		c.request("PUT", meetUpUrl, nil, map[string]interface{}{"dates": dates})
+		c.request("PATCH", meetUpUrl, admin, map[string]interface{}{"durations": []int64{0, 3600000, 0}})
+		c.request("PATCH", meetUpUrl, http.Header{"Authorization": admin["Authorization"], "If-Match": {`"1"`}}, map[string]interface{}{"description": "c"})
+
+		participantUrl := meetUpUrl + "/participants/alice"
+		c.request("PUT", participantUrl, nil, map[string]interface{}{"dates": dates[:1]})
+		c.request("PUT", participantUrl, nil, map[string]interface{}{"dates": dates[1:]})
+		c.request("PUT", participantUrl, admin, map[string]interface{}{"ifneedbe": dates[1:]})
+		c.request("GET", participantUrl, nil, nil)
+		c.request("GET", meetUpUrl, nil, nil)
+		c.request("DELETE", participantUrl, admin, nil)
+		c.request("GET", participantUrl, nil, nil)
+		c.request("DELETE", participantUrl, admin, nil)
+		c.request("GET", meetUpUrl+"/history", admin, nil)
+		c.request("GET", meetUpUrl+"/history", nil, nil)
+		c.request("DELETE", webhookUrl, admin, nil)
+		c.request("DELETE", webhookUrl, admin, nil)
+		_, response = c.request("POST", meetUpUrl+"/rotate", admin, map[string]interface{}{})
+		admin = http.Header{"Authorization": {"Bearer " + result(response)["adminhash"].(string)}}
+		c.request("POST", meetUpUrl+"/rotate", http.Header{"Authorization": admin["Authorization"], "If-Match": {`"1"`}}, map[string]interface{}{})
+		c.request("DELETE", meetUpUrl, admin, nil)
+		c.request("POST", meetUpUrl+"/restore", nil, nil)
+		c.request("POST", meetUpUrl+"/restore", admin, nil)
+		c.request("POST", meetUpUrl+"/restore", admin, nil)
+
+		// Every operation was checked
+		for path, item := range c.doc["paths"].(map[string]interface{}) {
+			for method := range item.(map[string]interface{}) {
+				if operation := strings.ToUpper(method) + " " + path; method != "parameters" && c.checked[operation] == false {
+					t.Errorf("%s was not checked\n", operation)
+				}
+			}
+		}
+	})
+}
+
+// The document is served as it is embedded.
+func TestGetOpenApi(t *testing.T) {
+	w := httptest.NewRecorder()
+	getOpenApi(w, httptest.NewRequest("GET", "/api/openapi.json", nil))
+
+	body, _ := io.ReadAll(w.Result().Body)
+	if w.Result().Header.Get("Content-Type") != "application/json" || bytes.Equal(body, openApiSpec) == false {
+		t.Errorf("getOpenApi returned %s %d bytes, want: application/json %d bytes\n", w.Result().Header.Get("Content-Type"), len(body), len(openApiSpec))
+	}
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"github.com/lib/pq"
+	"mycode/catherder/migrations"
+	"strconv"
+	"strings"
+)
+
+// The PostgreSQL dialect.
+var postgresDialect = sqlDialect{
+	migrations: migrations.Postgres,
+	rebind:     postgresPlaceholders,
+	isUniqueViolation: func(err error) bool {
+		var pqErr *pq.Error
+		return errors.As(err, &pqErr) && pqErr.Code == "23505" // unique_violation
+	},
+}
+
+// openPostgresStore Opens the PostgreSQL database at dsn, brings its schema up to date and prepares the statements.
+// The meetup hashes are stored with tokens.
+func openPostgresStore(dsn string, tokens *tokenCipher) (*sqlStore, error) {
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		return nil, err
+	}
+
+	return newSqlStore(db, postgresDialect, tokens)
+}
+
+// postgresPlaceholders Numbers the ? placeholders of query $1, $2, ... as PostgreSQL wants them. The statements
+// have no ? in their strings.
+func postgresPlaceholders(query string) string {
+	var b strings.Builder
+	n := 0
+	for _, r := range query {
+		if r == '?' {
+			n++
+			b.WriteString("$" + strconv.Itoa(n))
+			continue
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
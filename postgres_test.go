@@ -0,0 +1,63 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Opens a store on a new schema of the PostgreSQL database at the CATHERDER_TEST_POSTGRES url, skips the test if it
+// isn't set. The store is closed and the schema dropped when the test finishes.
+func CreateTestPostgresStore(t *testing.T) *sqlStore {
+	dsn := os.Getenv("CATHERDER_TEST_POSTGRES")
+	if dsn == "" {
+		t.Skip("CATHERDER_TEST_POSTGRES is not set")
+	}
+
+	admin, err := sql.Open("postgres", dsn)
+	if err != nil {
+		t.Fatal("Failed to open database:", err)
+	}
+	schema := fmt.Sprintf("catherder_test_%d", time.Now().UnixNano())
+	if _, err = admin.Exec(`CREATE SCHEMA ` + schema); err != nil {
+		t.Fatal("Failed to create schema:", err)
+	}
+	t.Cleanup(func() {
+		if _, err := admin.Exec(`DROP SCHEMA ` + schema + ` CASCADE`); err != nil {
+			t.Error(err)
+		}
+		admin.Close()
+	})
+
+	separator := "?"
+	if strings.Contains(dsn, "?") {
+		separator = "&"
+	}
+	store, err := openPostgresStore(dsn+separator+"search_path="+schema, newTestTokenCipher(t))
+	if err != nil {
+		t.Fatal("Failed to open database:", err)
+	}
+	t.Cleanup(func() { store.Close() })
+
+	return store
+}
+
+func TestPostgresPlaceholders(t *testing.T) {
+	var tests = []struct {
+		query    string
+		expected string
+	}{
+		{`SELECT 1`, `SELECT 1`},
+		{`DELETE from meetup WHERE idmeetup = ?`, `DELETE from meetup WHERE idmeetup = $1`},
+		{`INSERT INTO meetup_option(idmeetup, date, duration) values(?,?,?) ON CONFLICT DO NOTHING`, `INSERT INTO meetup_option(idmeetup, date, duration) values($1,$2,$3) ON CONFLICT DO NOTHING`},
+	}
+
+	for _, test := range tests {
+		if query := postgresPlaceholders(test.query); query != test.expected {
+			t.Errorf("postgresPlaceholders(%q) = %q, want: %q", test.query, query, test.expected)
+		}
+	}
+}
@@ -2,6 +2,4 @@
 
 echo "removing old database ..."
 rm -f data.sqlite
-echo "finished. Creating new database."
-sqlite3 data.sqlite < dbSource.sql
-echo "finished."
+echo "finished. The server creates a new database on startup."
@@ -1,12 +1,17 @@
 "use strict";
 
 var editObj = new function(){
-	var errorArea, dateContainer, adminhash, descrElem;
+	var errorArea, dateContainer, adminhash, descrElem, emailElem, expiresElem, slotTimesElem, slotLengthElem;
+	var revision = 0; // Of the meetup as loaded, the save fails if someone else changed it since
 
 	this.init = function(){
 		errorArea = document.getElementById('errorArea');
 		dateContainer = document.getElementById('dateContainer');
 		descrElem = document.getElementById("description");
+		emailElem = document.getElementById("email");
+		expiresElem = document.getElementById("expires");
+		slotTimesElem = document.getElementById("slotTimes");
+		slotLengthElem = document.getElementById("slotLength");
 
 		var params = new URLSearchParams(window.location.search.substring(1));
 		adminhash = params.get("id");
@@ -17,7 +22,10 @@ var editObj = new function(){
 			dateTool.init(dateContainer, startDate.valueOf(), []);
 		} else{
 			getMeetUp();
+			getWebhooks();
+			getHistory();
 			document.getElementById("deleteButt").classList.remove("hidden");
+			document.getElementById("rotateArea").classList.remove("hidden");
 		}
 
 		document.getElementById('saveButt').addEventListener('click', function(){
@@ -28,6 +36,30 @@ var editObj = new function(){
 			deleteMeetUp();
 		});
 
+		document.getElementById("undoDeleteButt").addEventListener("click", function(){
+			restoreMeetUp();
+		});
+
+		document.getElementById("homeButt").addEventListener("click", function(){
+			window.location.href = window.location.origin;
+		});
+
+		document.getElementById("finaliseButt").addEventListener("click", function(){
+			setFinalDate("/api/finalisemeetup", {adminhash: adminhash, date: parseInt(document.getElementById("finalDate").value, 10)});
+		});
+
+		document.getElementById("reopenButt").addEventListener("click", function(){
+			setFinalDate("/api/reopenmeetup", {adminhash: adminhash});
+		});
+
+		document.getElementById("rotateButt").addEventListener("click", function(){
+			rotateHashes();
+		});
+
+		document.getElementById("addWebhookButt").addEventListener("click", function(){
+			addWebhook();
+		});
+
 		document.getElementById('cancelButt').addEventListener('click', function(){
 			window.location.href = window.location.origin
 		});
@@ -61,16 +93,145 @@ var editObj = new function(){
 			} else if(response.error !== ""){
 				showError(response.error);
 			} else{
+				revision = response.result.revision;
 				descrElem.value = response.result.description;
+				emailElem.value = response.result.email;
+				var days = slotsToDays(response.result.slots);
+				showFinalDate(response.result.slots, response.result.finaldate);
+				showExpiry(response.result.expires, response.result.expirydate);
 
-				if(response.result.dates.length === 0){
+				if(days.length === 0){
 					var startDate = new Date();
 					startDate.setHours(0, 0, 0, 0);
-					dateTool.init(dateContainer, startDate.valueOf(), response.result.dates);
+					dateTool.init(dateContainer, startDate.valueOf(), days);
 				} else{
-					dateTool.init(dateContainer, response.result.dates[0], response.result.dates);
+					dateTool.init(dateContainer, days[0], days);
+				}
+			}
+		});
+	}
+
+	/**
+	 * Fills the final choice select with the meetup options, and selects the final date if there is one.
+	 * @param {Array.<{start: number, end: number, allday: boolean}>} slots
+	 * @param {number} finalDate    0 when the meetup is open
+	 */
+	function showFinalDate(slots, finalDate){
+		var select = document.getElementById("finalDate");
+		select.innerHTML = "";
+
+		for(var i = 0; i < slots.length; i++){
+			var option = document.createElement("option");
+			var date = new Date(slots[i].start);
+			option.value = slots[i].start.toString(10);
+			option.textContent = date.toDateString() + (slots[i].allday ? "" : " " + formatTime(date) + "-" + formatTime(new Date(slots[i].end)));
+			option.selected = slots[i].start === finalDate;
+			select.appendChild(option);
+		}
+
+		document.getElementById("finaliseButt").textContent = finalDate === 0 ? "Finalise" : "Change final choice";
+		document.getElementById("reopenButt").classList.toggle("hidden", finalDate === 0);
+		document.getElementById("finaliseArea").classList.remove("hidden");
+	}
+
+	/**
+	 * Shows when the meetup is deleted, and the expiry the admin chose if any.
+	 * @param {number} expires       0 for the default
+	 * @param {number} expiryDate
+	 */
+	function showExpiry(expires, expiryDate){
+		document.getElementById("expiryDate").textContent = "This meetup and its answers are deleted on " + new Date(expiryDate).toDateString() + ".";
+
+		expiresElem.value = "";
+		if(expires !== 0){
+			var date = new Date(expires);
+			expiresElem.value = date.getFullYear().toString(10) + "-" + ("0" + (date.getMonth() + 1)).slice(-2) + "-" + ("0" + date.getDate()).slice(-2);
+		}
+		document.getElementById("expiryArea").classList.remove("hidden");
+	}
+
+	/**
+	 * Returns the expiry chosen in the date input, the end of that day. 0 for the default.
+	 * @return {number}
+	 */
+	function getExpires(){
+		if(expiresElem.value === ""){
+			return 0;
+		}
+		var parts = expiresElem.value.split("-");
+		return new Date(parseInt(parts[0], 10), parseInt(parts[1], 10) - 1, parseInt(parts[2], 10), 23, 59, 59).valueOf();
+	}
+
+	/**
+	 * Finalises or reopens the meetup, then reloads it.
+	 * @param {string} url
+	 * @param {object} args
+	 */
+	function setFinalDate(url, args){
+		clearError();
+
+		sendAjaxRequest(url, JSON.stringify(args), function(error, response){
+			if(error !== null){
+				showError(error.toString());
+			} else if(response.error !== ""){
+				showError(response.error);
+			} else{
+				getMeetUp();
+				getHistory();
+			}
+		});
+	}
+
+	/**
+	 * Returns the days the slots are on, and fills in the start time and length inputs for slots that are not all-day.
+	 * @param {Array.<{start: number, end: number, allday: boolean}>} slots
+	 * @returns {Array.<number>}    local midnight timestamps of the days
+	 */
+	function slotsToDays(slots){
+		var days = [];
+		var times = [];
+
+		for(var i = 0; i < slots.length; i++){
+			var date = new Date(slots[i].start);
+			if(slots[i].allday === false){
+				var time = formatTime(date);
+				if(times.indexOf(time) < 0){
+					times.push(time);
 				}
+				slotLengthElem.value = ((slots[i].end - slots[i].start) / 60000).toString(10);
+			}
+			date.setHours(0, 0, 0, 0);
+			if(days.indexOf(date.valueOf()) < 0){
+				days.push(date.valueOf());
 			}
+		}
+
+		slotTimesElem.value = times.sort().join(", ");
+		return days;
+	}
+
+	/**
+	 * Parses the comma separated start times into minutes after midnight. Throws an exception on invalid input.
+	 * @returns {Array.<number>}
+	 */
+	function parseSlotTimes(){
+		var times = [];
+		var parts = slotTimesElem.value.split(",");
+
+		for(var i = 0; i < parts.length; i++){
+			var part = parts[i].trim();
+			if(part === ""){
+				continue;
+			}
+			var match = /^(\d{1,2}):(\d{2})$/.exec(part);
+			if(match === null || parseInt(match[1], 10) > 23 || parseInt(match[2], 10) > 59){
+				throw "Invalid start time: " + part;
+			}
+			times.push(parseInt(match[1], 10) * 60 + parseInt(match[2], 10));
+		}
+
+		return times.sort(function(a, b){
+			return a - b;
 		});
 	}
 
@@ -80,10 +241,44 @@ var editObj = new function(){
 	function saveMeetUp(){
 		clearError();
 
+		var dates = dateTool.getDates();
+		var durations = [];
+		var times;
+		try{
+			times = parseSlotTimes();
+		} catch(e){
+			showError(e);
+			return;
+		}
+
+		// With start times, every selected day gets a slot at each time. Without, the days are all-day options.
+		if(times.length > 0){
+			var length = parseInt(slotLengthElem.value, 10);
+			if(Number.isInteger(length) === false || length <= 0){
+				showError("The length must be at least one minute.");
+				return;
+			}
+
+			var days = dates;
+			dates = [];
+			for(var i = 0; i < days.length; i++){
+				for(var j = 0; j < times.length; j++){
+					var start = new Date(days[i]);
+					start.setHours(0, times[j], 0, 0);
+					dates.push(start.valueOf());
+					durations.push(length * 60000);
+				}
+			}
+		}
+
 		var args = {
 			adminhash: adminhash,
+			revision: revision,
 			description: descrElem.value,
-			dates: dateTool.getDates(),
+			email: emailElem.value,
+			expires: getExpires(),
+			dates: dates,
+			durations: durations,
 			users: []
 		};
 
@@ -93,24 +288,190 @@ var editObj = new function(){
 			} else if(response.error !== ""){
 				showError(response.error);
 			} else{
-				var link = document.getElementById("userLink");
-				link.href = window.location.origin + "/view?id=" + encodeURIComponent(response.result.userhash);
-				link.textContent = window.location.origin + "/view?id=" + encodeURIComponent(response.result.userhash);
+				showLinks(response.result.userhash, response.result.adminhash);
+			}
+		});
+	}
 
-				link = document.getElementById("adminLink");
-				link.href = window.location.origin + "/edit?id=" + encodeURIComponent(response.result.adminhash);
-				link.textContent = window.location.origin + "/edit?id=" + encodeURIComponent(response.result.adminhash);
+	/**
+	 * Shows the links of the meetup in place of the edit area.
+	 * @param {string} userhash
+	 * @param {string} newAdminhash
+	 */
+	function showLinks(userhash, newAdminhash){
+		var link = document.getElementById("userLink");
+		link.href = window.location.origin + "/view?id=" + encodeURIComponent(userhash);
+		link.textContent = window.location.origin + "/view?id=" + encodeURIComponent(userhash);
 
-				document.getElementById("linkArea").classList.remove("hidden");
+		link = document.getElementById("adminLink");
+		link.href = window.location.origin + "/edit?id=" + encodeURIComponent(newAdminhash);
+		link.textContent = window.location.origin + "/edit?id=" + encodeURIComponent(newAdminhash);
 
-				// meetup created, remove the edit area just leaving the links.
-				document.body.removeChild(document.querySelector(".editArea"));
+		document.getElementById("linkArea").classList.remove("hidden");
+
+		// meetup saved, remove the edit area just leaving the links.
+		document.body.removeChild(document.querySelector(".editArea"));
+	}
+
+	/**
+	 * Replaces the admin link, and the participants' link if the checkbox is ticked, then shows the new links. The old
+	 * ones stop working.
+	 */
+	function rotateHashes(){
+		clearError();
+		var newUserHash = document.getElementById("newUserHash").checked;
+		var question = newUserHash ? "Replace both links? The participants will need the new one." : "Replace the admin link?";
+		if(window.confirm(question) === false){
+			return;
+		}
+
+		sendAjaxRequest("/api/rotatehashes", JSON.stringify({adminhash: adminhash, newuserhash: newUserHash}), function(error, response){
+			if(error !== null){
+				showError(error.toString());
+			} else if(response.error !== ""){
+				showError(response.error);
+			} else{
+				adminhash = response.result.adminhash;
+				// The old address doesn't work anymore, a reload needs the new one
+				window.history.replaceState(null, "", "/edit?id=" + encodeURIComponent(adminhash));
+				showLinks(response.result.userhash, adminhash);
 			}
 		});
 	}
 
 	/**
-	 * Deletes the meetup, and redirects the user to the home page.
+	 * Lists the webhooks of the meetup, each with a button to delete it.
+	 */
+	function getWebhooks(){
+		sendAjaxRequest("/api/getwebhooks", JSON.stringify({adminhash: adminhash}), function(error, response){
+			if(error !== null){
+				showError(error.toString());
+			} else if(response.error !== ""){
+				showError(response.error);
+			} else{
+				var list = document.getElementById("webhookList");
+				list.innerHTML = "";
+
+				response.result.forEach(function(webhook){
+					var item = document.createElement("li");
+					var deleteButt = document.createElement("button");
+					deleteButt.type = "button";
+					deleteButt.textContent = "Delete";
+					deleteButt.addEventListener("click", function(){
+						deleteWebhook(webhook.id);
+					});
+					item.appendChild(deleteButt);
+					item.appendChild(document.createTextNode(webhook.url));
+					list.appendChild(item);
+				});
+				document.getElementById("webhookArea").classList.remove("hidden");
+			}
+		});
+	}
+
+	/**
+	 * Lists the changes of the meetup and its users, the latest first.
+	 */
+	function getHistory(){
+		var actions = {
+			"meetup.created": "The meet up was created",
+			"meetup.edited": "The meet up was changed",
+			"meetup.finalised": "The final date was chosen",
+			"meetup.reopened": "The meet up was reopened",
+			"meetup.deleted": "The meet up was deleted",
+			"meetup.restored": "The meet up was restored",
+			"meetup.rotated": "The meet up links were regenerated",
+			"participant.added": " added their answers",
+			"participant.changed": " changed their answers",
+			"participant.removed": " was removed",
+			"participant.restored": " was restored"
+		};
+
+		sendAjaxRequest("/api/gethistory", JSON.stringify({adminhash: adminhash}), function(error, response){
+			if(error !== null){
+				showError(error.toString());
+			} else if(response.error !== ""){
+				showError(response.error);
+			} else{
+				var list = document.getElementById("historyList");
+				list.innerHTML = "";
+
+				response.result.forEach(function(entry){
+					var created = new Date(entry.created);
+					var text = created.toLocaleDateString() + " " + formatTime(created) + ": " + entry.name + (actions[entry.action] || entry.action);
+					if(entry.olddates.join() !== entry.newdates.join() || entry.oldifneedbe.join() !== entry.newifneedbe.join()){
+						text += ", " + formatHistoryDates(entry.olddates, entry.oldifneedbe) + " to " + formatHistoryDates(entry.newdates, entry.newifneedbe);
+					}
+					if(entry.iphash !== ""){
+						text += " (client " + entry.iphash.substring(0, 8) + ")";
+					}
+
+					var item = document.createElement("li");
+					item.textContent = text;
+					list.appendChild(item);
+				});
+				document.getElementById("historyArea").classList.remove("hidden");
+			}
+		});
+	}
+
+	/**
+	 * Formats the dates of a history entry, the if need be ones marked with a question mark.
+	 * @param {Array.<number>} dates
+	 * @param {Array.<number>} ifNeedBe
+	 * @returns {string}
+	 */
+	function formatHistoryDates(dates, ifNeedBe){
+		var formatted = dates.map(function(date){
+			return new Date(date).toLocaleDateString();
+		}).concat(ifNeedBe.map(function(date){
+			return new Date(date).toLocaleDateString() + "?";
+		}));
+		return formatted.length === 0 ? "none" : formatted.join(", ");
+	}
+
+	/**
+	 * Adds the webhook in the url input, and shows its secret. The secret can't be fetched again.
+	 */
+	function addWebhook(){
+		clearError();
+		var urlElem = document.getElementById("webhookUrl");
+
+		sendAjaxRequest("/api/addwebhook", JSON.stringify({adminhash: adminhash, url: urlElem.value}), function(error, response){
+			if(error !== null){
+				showError(error.toString());
+			} else if(response.error !== ""){
+				showError(response.error);
+			} else{
+				urlElem.value = "";
+				var secretElem = document.getElementById("webhookSecret");
+				secretElem.textContent = "The signing secret of " + response.result.url + " is " + response.result.secret + " - keep it, it won't be shown again.";
+				secretElem.classList.remove("hidden");
+				getWebhooks();
+			}
+		});
+	}
+
+	/**
+	 * Deletes the webhook with the id, then lists the webhooks again.
+	 * @param {number} id
+	 */
+	function deleteWebhook(id){
+		clearError();
+
+		sendAjaxRequest("/api/deletewebhook", JSON.stringify({adminhash: adminhash, id: id}), function(error, response){
+			if(error !== null){
+				showError(error.toString());
+			} else if(response.error !== ""){
+				showError(response.error);
+			} else{
+				getWebhooks();
+			}
+		});
+	}
+
+	/**
+	 * Deletes the meetup, and offers to undo it.
 	 */
 	function deleteMeetUp(){
 		sendAjaxRequest("/api/deletemeetup", JSON.stringify({adminhash: adminhash}), function(error, response){
@@ -119,7 +480,24 @@ var editObj = new function(){
 			} else if(response.error !== ""){
 				showError(response.error);
 			} else{
-				window.location.href = window.location.origin;
+				clearError();
+				document.getElementById("editArea").classList.add("hidden");
+				document.getElementById("undoArea").classList.remove("hidden");
+			}
+		});
+	}
+
+	/**
+	 * Undoes the deletion of the meetup, and shows it again.
+	 */
+	function restoreMeetUp(){
+		sendAjaxRequest("/api/restoremeetup", JSON.stringify({adminhash: adminhash}), function(error, response){
+			if(error !== null){
+				window.alert(error.toString());
+			} else if(response.error !== ""){
+				window.alert(response.error);
+			} else{
+				window.location.reload();
 			}
 		});
 	}
@@ -23,4 +23,15 @@ function sendAjaxRequest(url, data, callback) {
 	oReq.open("POST", url);
 	oReq.setRequestHeader("Content-Type", "application/json");
 	oReq.send(data);
+}
+
+/**
+ * Formats a date as a 24 hour HH:MM time string, in local time.
+ * @param {Date} date
+ * @returns {string}
+ */
+function formatTime(date) {
+	var hours = date.getHours().toString(10);
+	var minutes = date.getMinutes().toString(10);
+	return (hours.length < 2 ? "0" + hours : hours) + ":" + (minutes.length < 2 ? "0" + minutes : minutes);
 }
\ No newline at end of file
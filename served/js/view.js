@@ -3,6 +3,10 @@
 
 var viewObj = new function(){
 	var errorArea, userhash, columnCont;
+	var meetUpId = null;	// Id of the meetup from api/getusermeetup. Unlike userhash, it survives the admin replacing the hashes.
+	var editLink = null;	// The URL parameters, until the meetup is loaded to save the token of an edit link under its id and user.
+	var tokens = {};	// Edit tokens of the users created in this browser, keyed by user name.
+	var lastDeleted = null;	// The user deleted last, {name, token}, until it's undone.
 	var months = ["Jan", "Feb", "Mar", "Apr", "May", "Jun", "Jul", "Aug", "Sep", "Oct", "Nov", "Dec"];
 	var days = ["Sun", "Mon", "Tue", "Wed", "Thu", "Fri", "Sat"];
 
@@ -19,12 +23,19 @@ var viewObj = new function(){
 			showError("No id argument was found in the URL.");
 		} else{
 			document.querySelector(".shareLink").textContent = window.location.origin + "/view?id=" + encodeURIComponent(userhash);
+			document.getElementById("icsLink").href = "/api/ics?id=" + encodeURIComponent(userhash);
+			editLink = params;
+			listenForChanges();
 		}
 
 		document.getElementById("saveButt").addEventListener("click", function(){
 			addUser();
 		});
 
+		document.getElementById("undoDeleteButt").addEventListener("click", function(){
+			restoreUser();
+		});
+
 		refreshDateGrid();
 	};
 
@@ -45,6 +56,94 @@ var viewObj = new function(){
 		errorArea.classList.add("hidden");
 	}
 
+	/**
+	 * Loads the edit tokens saved for the meetup with id from local storage, the first time the meetup is loaded. Moves
+	 * the tokens saved under the userhash by older versions of this page.
+	 * @param {number} id
+	 */
+	function loadTokens(id){
+		if(meetUpId !== null){
+			return;
+		}
+		meetUpId = id;
+
+		try{
+			tokens = JSON.parse(window.localStorage.getItem("meetupTokens:" + meetUpId)) || {};
+			var oldTokens = JSON.parse(window.localStorage.getItem("tokens:" + userhash));
+			if(oldTokens !== null){
+				for(var name in oldTokens){
+					if(oldTokens.hasOwnProperty(name) && tokens[name] === undefined){
+						tokens[name] = oldTokens[name];
+					}
+				}
+				saveTokens();
+				window.localStorage.removeItem("tokens:" + userhash);
+			}
+		} catch(e){
+			tokens = {};
+		}
+	}
+
+	/**
+	 * Saves the edit tokens for this meetup to local storage.
+	 */
+	function saveTokens(){
+		try{
+			window.localStorage.setItem("meetupTokens:" + meetUpId, JSON.stringify(tokens));
+		} catch(e){
+			showError("Your edit token could not be saved, you will not be able to change your dates later.");
+		}
+	}
+
+	/**
+	 * Saves the edit token of the link from a confirmation email, and takes it out of the address bar. The link only
+	 * has the token, the name of its user is the one api/getusermeetup found for it. Older links have the name too.
+	 * @param {string} tokenUser
+	 */
+	function useEditLink(tokenUser){
+		if(editLink === null || editLink.get("token") === null){
+			return;
+		}
+		var name = editLink.get("name") || tokenUser;
+		var token = editLink.get("token");
+		editLink = null;
+
+		if(name === ""){
+			showError("The edit link is not for any of the users of this meetup.");
+			return;
+		}
+		tokens[name] = token;
+		saveTokens();
+		window.history.replaceState(null, "", "/view?id=" + encodeURIComponent(userhash));
+	}
+
+	/**
+	 * Refreshes the date grid when someone changes the meetup, from the api/events stream. Waits while a new user is
+	 * being filled in, so their answers aren't cleared.
+	 */
+	function listenForChanges(){
+		if(window.EventSource === undefined){
+			return;
+		}
+
+		var timer = null;
+		var onChange = function(){
+			clearTimeout(timer);
+			timer = setTimeout(function(){	// One refresh for a burst of changes
+				var nameInput = document.querySelector(".username");
+				if(nameInput !== null && nameInput.value !== ""){
+					onChange();
+				} else{
+					refreshDateGrid();
+				}
+			}, 250);
+		};
+
+		var source = new EventSource("/api/events?id=" + encodeURIComponent(userhash));
+		source.addEventListener("meetup", onChange);
+		source.addEventListener("user", onChange);
+	}
+
 	/**
 	 * Gets the username and checked checkboxes, and requests the backend add the user.
 	 */
@@ -52,16 +151,24 @@ var viewObj = new function(){
 		clearError();
 
 		var userName = document.querySelector(".username").value;
-		var checkedDates = document.querySelectorAll(".newuser:checked");
+		var answers = document.querySelectorAll(".newuser");
 		var dates = [];
-		for(var i = 0; i < checkedDates.length; i++){
-			dates.push(parseInt(checkedDates[i].name, 10))
+		var ifNeedBe = [];
+		for(var i = 0; i < answers.length; i++){
+			if(answers[i].value === "yes"){
+				dates.push(parseInt(answers[i].name, 10));
+			} else if(answers[i].value === "ifneedbe"){
+				ifNeedBe.push(parseInt(answers[i].name, 10));
+			}
 		}
 
 		var args = {
 			username: userName,
 			userhash: userhash,
-			dates: dates
+			token: tokens[userName] || "",
+			dates: dates,
+			ifneedbe: ifNeedBe,
+			email: document.getElementById("email").value
 		};
 
 		sendAjaxRequest("/api/updateuser", JSON.stringify(args), function(error, response){
@@ -70,6 +177,8 @@ var viewObj = new function(){
 			} else if(response.error !== ""){
 				showError(response.error);
 			} else{
+				tokens[userName] = response.result.token;
+				saveTokens();
 				refreshDateGrid();
 			}
 		});
@@ -81,13 +190,16 @@ var viewObj = new function(){
 	function refreshDateGrid(){
 		columnCont.innerHTML = '<div class="nameColumn"><div class="dummyBox"></div></div>';		// Reset container on each refresh
 
-		sendAjaxRequest("/api/getusermeetup", JSON.stringify({userhash: userhash}), function(error, response){
+		var args = {userhash: userhash, token: editLink !== null ? editLink.get("token") || "" : ""};
+		sendAjaxRequest("/api/getusermeetup", JSON.stringify(args), function(error, response){
 			if(error !== null){
 				showError(error.toString());
 			} else if(response.error !== ""){
 				showError(response.error);
 			} else{
 				clearError();
+				loadTokens(response.result.id);
+				useEditLink(response.result.username);
 				document.querySelector(".description").textContent = response.result.description;
 				var i;
 				var usersArray = response.result.users;
@@ -110,23 +222,32 @@ var viewObj = new function(){
 					nameColumn.appendChild(userDiv);
 				}
 				nameColumn.insertAdjacentHTML("beforeend", '<div class="row"><input class="username" type="text" name="username" placeholder="New user..."></div>');
+				showFeedLinks(usersArray);
 
 				/*
 				Create date columns
 				 */
 				var datesArray = response.result.dates;
+				var slotsArray = response.result.slots;
 
 				for(i = 0; i < datesArray.length; i++){
 					var dateColumn = document.createElement("div");
 					dateColumn.classList.add("dateColumn");
+					if(datesArray[i] === response.result.finaldate){
+						dateColumn.classList.add("finalColumn");
+					}
 
-					// Generate the Month/date/dayofweek header
-					dateColumn.innerHTML = '<div class="dateBox"><span></span><span class="date"></span><span></span></div>';
+					// Generate the Month/date/dayofweek header, and the time for slots that are not all-day
+					dateColumn.innerHTML = '<div class="dateBox"><span></span><span class="date"></span><span></span><span class="time"></span></div>';
 					var date = new Date(datesArray[i]);
 					var spans = dateColumn.querySelectorAll("span");
 					spans[0].textContent = months[date.getMonth()];
 					spans[1].textContent = date.getDate().toString(10);
 					spans[2].textContent = days[date.getDay()];
+					if(slotsArray[i].allday === false){
+						spans[3].textContent = formatTime(date) + "-" + formatTime(new Date(slotsArray[i].end));
+						columnCont.classList.add("hasTimes");
+					}
 
 
 					// Generate existing users checkbox rows
@@ -140,26 +261,98 @@ var viewObj = new function(){
 						checkbox.disabled = true;
 						checkbox.checked = false;
 
-						for(var dateIndex = 0; dateIndex < usersArray[usrIndex].dates.length; dateIndex++){
-							if(datesArray[i] === usersArray[usrIndex].dates[dateIndex]){
-								checkbox.checked = true;
-								row.classList.remove("rowUnavailable");
-								row.classList.add("rowAvailable");
-								break;
-							}
+						if(usersArray[usrIndex].dates.indexOf(datesArray[i]) >= 0){
+							checkbox.checked = true;
+							row.classList.remove("rowUnavailable");
+							row.classList.add("rowAvailable");
+						} else if(usersArray[usrIndex].ifneedbe.indexOf(datesArray[i]) >= 0){
+							checkbox.indeterminate = true;
+							row.classList.remove("rowUnavailable");
+							row.classList.add("rowIfNeedBe");
 						}
 
 						row.appendChild(checkbox);
 						dateColumn.appendChild(row);
 					}
 
-					dateColumn.insertAdjacentHTML("beforeend", '<div class="row"><input type="checkbox" class="newuser" name="' + datesArray[i] + '"></div></div>');
+					dateColumn.insertAdjacentHTML("beforeend", '<div class="row"><select class="newuser" name="' + datesArray[i] + '">' +
+						'<option value="no">No</option><option value="yes">Yes</option><option value="ifneedbe">If need be</option></select></div>');
 					columnCont.appendChild(dateColumn);
 				}
+
+				// A finalised meetup can't be changed, show the final choice instead of the best option
+				document.getElementById("saveButt").classList.toggle("hidden", response.result.finaldate !== 0);
+				if(response.result.finaldate !== 0){
+					showFinalDate(slotsArray[datesArray.indexOf(response.result.finaldate)]);
+				} else{
+					showBestOption();
+				}
 			}
 		});
 	}
 
+	/**
+	 * Shows calendar subscription links for the users created in this browser.
+	 * @param {Array.<{name: string}>} usersArray
+	 */
+	function showFeedLinks(usersArray){
+		var feedLinks = document.querySelector(".feedLinks");
+		feedLinks.innerHTML = "";
+
+		for(var i = 0; i < usersArray.length; i++){
+			if(tokens[usersArray[i].name] === undefined){
+				continue;
+			}
+
+			var link = document.createElement("a");
+			link.href = "webcal://" + window.location.host + "/api/feed?id=" + encodeURIComponent(userhash) + "&name=" + encodeURIComponent(usersArray[i].name);
+			link.textContent = "Subscribe to the dates of " + usersArray[i].name;
+			feedLinks.appendChild(link);
+		}
+	}
+
+	/**
+	 * Shows the final date chosen by the admin above the date grid.
+	 * @param {{start: number, end: number, allday: boolean}} slot
+	 */
+	function showFinalDate(slot){
+		var bestElem = document.querySelector(".bestOption");
+		var date = new Date(slot.start);
+		var text = "This meetup is closed. The final choice is " + days[date.getDay()] + " " + date.getDate().toString(10) + " " + months[date.getMonth()];
+		if(slot.allday === false){
+			text += " " + formatTime(date) + "-" + formatTime(new Date(slot.end));
+		}
+		bestElem.textContent = text;
+		bestElem.classList.remove("hidden");
+	}
+
+	/**
+	 * Shows the best ranked meetup option above the date grid.
+	 */
+	function showBestOption(){
+		var bestElem = document.querySelector(".bestOption");
+
+		sendAjaxRequest("/api/summary", JSON.stringify({userhash: userhash}), function(error, response){
+			if(error !== null || response.error !== "" || response.result.length === 0 || response.result[0].score === 0){
+				bestElem.classList.add("hidden");
+				return;
+			}
+
+			var best = response.result[0];
+			var date = new Date(best.start);
+			var text = "Best option so far: " + days[date.getDay()] + " " + date.getDate().toString(10) + " " + months[date.getMonth()];
+			if(best.allday === false){
+				text += " " + formatTime(date) + "-" + formatTime(new Date(best.end));
+			}
+			text += " (" + best.yes + " yes, " + best.ifneedbe + " if need be";
+			if(best.missing.length > 0){
+				text += ", missing " + best.missing.join(", ");
+			}
+			bestElem.textContent = text + ")";
+			bestElem.classList.remove("hidden");
+		});
+	}
+
 	/**
 	 * Deletes the user with username, then refreshes the grid.
 	 * @param username
@@ -167,13 +360,48 @@ var viewObj = new function(){
 	function deleteUser(username){
 		sendAjaxRequest("/api/deleteuser", JSON.stringify({
 			userhash: userhash,
-			username: username
+			username: username,
+			token: tokens[username] || ""
 		}), function(error, response){
 			if(error !== null){
 				showError(error.toString());
 			} else if(response.error !== ""){
 				showError(response.error);
 			} else{
+				lastDeleted = {name: username, token: tokens[username] || ""};
+				delete tokens[username];
+				saveTokens();
+				document.getElementById("undoText").textContent = username + " was deleted.";
+				document.getElementById("undoArea").classList.remove("hidden");
+				refreshDateGrid();
+			}
+		});
+	}
+
+	/**
+	 * Undoes the deletion of the user deleted last.
+	 */
+	function restoreUser(){
+		if(lastDeleted === null){
+			return;
+		}
+		var user = lastDeleted;
+		sendAjaxRequest("/api/restoreuser", JSON.stringify({
+			userhash: userhash,
+			username: user.name,
+			token: user.token
+		}), function(error, response){
+			if(error !== null){
+				showError(error.toString());
+			} else if(response.error !== ""){
+				showError(response.error);
+			} else{
+				lastDeleted = null;
+				if(user.token !== ""){
+					tokens[user.name] = user.token;
+					saveTokens();
+				}
+				document.getElementById("undoArea").classList.add("hidden");
 				refreshDateGrid();
 			}
 		});
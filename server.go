@@ -0,0 +1,52 @@
+package main
+
+import (
+	"io/fs"
+	"net/http"
+	"time"
+)
+
+// server Holds what the request handlers share. The api handlers are its methods.
+type server struct {
+	store     Store
+	api       map[string]http.HandlerFunc // The handlers of the v1 api, from apiRoutes
+	events    *eventHub                   // Meetup changes for the /api/events streams
+	webhooks  *webhookSender              // Sends the webhook deliveries queued by the changes, once run
+	mail      *mailNotifier               // Emails the organisers and participants, nil to send no email
+	heartbeat time.Duration               // How often an idle /api/events stream gets a heartbeat
+
+	expireAfter time.Duration // How long after its last date a meetup without its own expiry is deleted by runJanitor
+	deleteGrace time.Duration // How long a deleted meetup or user can be restored, before runJanitor purges it
+	auditKey    []byte        // Keys the hashes of the client IP addresses in the audit log
+}
+
+// newServer Returns a server that keeps its meetups in store.
+func newServer(store Store) *server {
+	s := &server{
+		store:       store,
+		events:      newEventHub(),
+		heartbeat:   eventsHeartbeat,
+		webhooks:    newWebhookSender(store),
+		expireAfter: defaultExpireAfter,
+		deleteGrace: defaultDeleteGrace,
+		auditKey:    newAuditKey(),
+	}
+	s.api = s.apiRoutes()
+	return s
+}
+
+// routes Returns the handler for all requests.
+func (s *server) routes() (http.Handler, error) {
+	servedDir, err := fs.Sub(served, "served")
+	if err != nil {
+		return nil, err
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/served/", http.StripPrefix("/served/", http.FileServer(http.FS(servedDir))))
+	mux.Handle("/api/v2/", s.apiV2Router())          // RESTful JSON api
+	mux.HandleFunc("/api/", s.apiRouter)             // JSON request/response handlers
+	mux.HandleFunc("/confirm", s.pageConfirmHandler) // The links confirming the organisers' addresses
+	mux.HandleFunc("/", defaultRouter)               // All non /served/ or /api/ requests
+	return mux, nil
+}
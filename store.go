@@ -0,0 +1,83 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Store Where the meetups, their options and their users are kept. The handlers only reach the database through it.
+//
+// A meetup's options are its Dates and Durations, they are written with the meetup. Dates are read back in order,
+// with the durations lined up. A user's Dates and IfNeedBe only keep the dates that are options of their meetup, a
+// date in both is a yes. Removing an option removes the users' answers for it.
+type Store interface {
+	CreateMeetUp(m *MeetUp) error                                     // Sets Id, Created, Modified and Revision
+	ReadMeetUp(id int64) (MeetUp, error)                              // Without the users
+	UpdateMeetUp(m *MeetUp) error                                     // Sets Modified, and increments Revision. Fails with errRevisionConflict if it's stale.
+	UpdateMeetUpHashes(m *MeetUp) error                               // Replaces the UserHash and AdminHash, the rest is kept. Like UpdateMeetUp otherwise.
+	ConfirmMeetUpEmail(id int64, email string, confirmed int64) error // Sets EmailConfirmed if Email is still email. Keeps Modified and Revision.
+	DeleteMeetUp(id int64) error                                      // Soft deletes it: the reads ignore it, until RestoreMeetUp or PurgeDeleted
+	RestoreMeetUp(id int64) error                                     // Undoes DeleteMeetUp, touches Modified
+	GetMeetUpByUserHash(userHash string) (MeetUp, error)
+	GetMeetUpByAdminHash(adminHash string) (MeetUp, error)
+	DeleteMeetUpByAdminHash(adminHash string) error
+	GetDeletedMeetUpByAdminHash(adminHash string) (MeetUp, error) // A soft deleted meetup, with DeletedAt and its users
+	PurgeDeleted(before int64) (meetUps, users int, err error)    // Deletes for good the meetups and users soft deleted at or before the time
+	GetExpiredMeetUpIds(now, defaultAfter int64) ([]int64, error) // The meetups whose MeetUp.Expiry(defaultAfter) <= now
+
+	CreateUser(u *User) error // Sets Id. Creating, updating or deleting a user touches the meetup's Modified.
+	ReadUser(id int64) (User, error)
+	UpdateUser(u *User) error
+	DeleteUser(u *User) error  // Soft deletes them and sets DeletedAt, see DeleteMeetUp
+	RestoreUser(u *User) error // Undoes DeleteUser. Returns errUserExists if the name was taken since.
+	GetUsersByMeetUpId(idMeetUp int64) (Users, error)
+	GetDeletedUsersByMeetUpId(idMeetUp int64) (Users, error) // The last deleted first
+
+	CreateWebhook(w *Webhook) error // Sets Id. Purging the meetup deletes its webhooks.
+	GetWebhooksByMeetUpId(idMeetUp int64) ([]Webhook, error)
+	DeleteWebhook(idMeetUp, id int64) error // Fails with ErrNotFound if the meetup has no webhook with the id
+
+	QueueDelivery(d *WebhookDelivery) error                           // Sets Id
+	GetDueDeliveries(now int64, limit int) ([]WebhookDelivery, error) // The deliveries with NextAttempt <= now, the oldest first
+	UpdateDelivery(d *WebhookDelivery) error                          // Writes Attempts, NextAttempt and LastError
+	DeleteDelivery(id int64) error
+
+	CreateMeetUpEvent(e *MeetUpEvent) error                // Sets Id and Created. The log is append-only, purging the meetup deletes it.
+	GetMeetUpEvents(idMeetUp int64) ([]MeetUpEvent, error) // The latest first
+
+	// WithTx Runs fn with a Store whose reads and writes are one transaction. The writes are kept if fn returns nil,
+	// undone otherwise. Concurrent transactions that write the same meetup don't interleave.
+	WithTx(fn func(tx Store) error) error
+
+	Close() error
+}
+
+// ErrNotFound Wrapped by the errors of the Store when the row asked for doesn't exist. Check with errors.Is.
+var ErrNotFound = errors.New("no rows")
+
+// ErrConflict Wrapped by the errors of the Store when a write conflicts with what is stored. Check with errors.Is.
+var ErrConflict = errors.New("conflict")
+
+// errRevisionConflict Returned by UpdateMeetUp when the meetup's revision isn't m.Revision, because it was changed or
+// deleted since it was read.
+var errRevisionConflict = fmt.Errorf("%w: the meetup was changed since it was read", ErrConflict)
+
+// errUserExists Returned by CreateUser and UpdateUser when the meetup already has a user with the name.
+var errUserExists = fmt.Errorf("%w: a user with that name already exists", ErrConflict)
+
+// openStore Opens the Store at dsn. A postgres:// or postgresql:// url is a PostgreSQL database, anything else is a
+// sqlite one. The meetup hashes are stored with tokens.
+func openStore(dsn string, tokens *tokenCipher) (Store, error) {
+	var store *sqlStore
+	var err error
+	if strings.HasPrefix(dsn, "postgres://") || strings.HasPrefix(dsn, "postgresql://") {
+		store, err = openPostgresStore(dsn, tokens)
+	} else {
+		store, err = openSqliteStore(dsn, tokens)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return store, nil
+}
@@ -0,0 +1,299 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// Runs test once for each Store implementation, with a new empty store each time. PostgreSQL is skipped unless
+// CATHERDER_TEST_POSTGRES is set.
+func forEachStore(t *testing.T, test func(t *testing.T, store Store)) {
+	var stores = []struct {
+		name string
+		open func(t *testing.T) Store
+	}{
+		{"sqlite", func(t *testing.T) Store { return CreateTestStore(t) }},
+		{"postgres", func(t *testing.T) Store { return CreateTestPostgresStore(t) }},
+		{"memory", func(t *testing.T) Store { return newMemStore() }},
+	}
+
+	for _, s := range stores {
+		t.Run(s.name, func(t *testing.T) {
+			test(t, s.open(t))
+		})
+	}
+}
+
+func TestOpenStore(t *testing.T) {
+	testDbName := MakeTestFile(t)
+	defer os.Remove(testDbName)
+
+	store, err := openStore("file:"+testDbName+"?_foreign_keys=1", newTestTokenCipher(t))
+	if err != nil {
+		t.Fatalf("openStore() failed: %s", err)
+	}
+	defer store.Close()
+	if _, ok := store.(*sqlStore); ok == false {
+		t.Errorf("openStore() of a sqlite file = %T, want: *sqlStore", store)
+	}
+
+	// Fails without connecting, the port is invalid
+	if store, err := openStore("postgres://localhost:0/catherder?connect_timeout=1", newTestTokenCipher(t)); err == nil || store != nil {
+		t.Errorf("openStore() of an unreachable postgres url = %v, %v, want: nil and an error", store, err)
+	}
+}
+
+// A dsn without options still gets the foreign keys, and transactions that write wait for each other
+func TestOpenSqliteStore_PlainDsn(t *testing.T) {
+	testDbName := MakeTestFile(t)
+	defer os.Remove(testDbName)
+
+	store, err := openSqliteStore("file:"+testDbName, newTestTokenCipher(t))
+	if err != nil {
+		t.Fatalf("openSqliteStore() failed: %s", err)
+	}
+	defer store.Close()
+
+	var foreignKeys int
+	if err = store.db.QueryRow("PRAGMA foreign_keys").Scan(&foreignKeys); err != nil || foreignKeys != 1 {
+		t.Errorf("PRAGMA foreign_keys = %d, %v, want: 1", foreignKeys, err)
+	}
+	if _, err = store.db.Exec(`INSERT INTO "user"(idmeetup, name) VALUES(1234, 'bob')`); err == nil {
+		t.Errorf("inserting a user of a missing meetup succeeded")
+	}
+
+	var meetUp = MeetUp{UserHash: "abc", AdminHash: "def", Dates: []int64{1550401200000}, Description: "meetUp description"}
+	if err = store.CreateMeetUp(&meetUp); err != nil {
+		t.Fatalf("CreateMeetUp() failed: %s\n", err)
+	}
+	const writers = 10
+	errs := make(chan error, writers)
+	var wg sync.WaitGroup
+	for i := 0; i < writers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs <- store.WithTx(func(tx Store) error {
+				// Reads before it writes, a deferred transaction can't upgrade its lock then
+				if _, err := tx.GetUsersByMeetUpId(meetUp.Id); err != nil {
+					return err
+				}
+				return tx.CreateUser(&User{IdMeetUp: meetUp.Id, Name: fmt.Sprintf("user %d", i)})
+			})
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Errorf("concurrent WithTx() failed: %s", err)
+		}
+	}
+}
+
+func TestSqliteDsn(t *testing.T) {
+	var tests = []struct{ dsn, want string }{
+		{"file:data.sqlite", "file:data.sqlite?_foreign_keys=1&_txlock=immediate"},
+		{"file:data.sqlite?_fk=0&_txlock=deferred&mode=rw", "file:data.sqlite?_foreign_keys=1&_txlock=immediate&mode=rw"},
+		{"data.sqlite?_foreign_keys=false", "data.sqlite?_foreign_keys=1&_txlock=immediate"},
+		{"file:data.sqlite?mode=%zz", "file:data.sqlite?mode=%zz"},
+	}
+	for _, test := range tests {
+		if got := sqliteDsn(test.dsn); got != test.want {
+			t.Errorf("sqliteDsn(%q) = %q, want: %q", test.dsn, got, test.want)
+		}
+	}
+}
+
+func TestStore_WithTx(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store Store) {
+		var meetUp = MeetUp{UserHash: "abc", AdminHash: "def", Dates: []int64{1550401200000, 1550487600000}, Description: "meetUp description"}
+		if err := store.CreateMeetUp(&meetUp); err != nil {
+			t.Fatalf("CreateMeetUp() failed: %s\n", err)
+		}
+
+		// A failed transaction leaves nothing behind
+		failure := errors.New("failure")
+		err := store.WithTx(func(tx Store) error {
+			if err := tx.CreateUser(&User{IdMeetUp: meetUp.Id, Name: "bob", Dates: []int64{1550401200000}}); err != nil {
+				return err
+			}
+			meetUp.Description = "changed"
+			if err := tx.UpdateMeetUp(&meetUp); err != nil {
+				return err
+			}
+			return failure
+		})
+		if err != failure {
+			t.Errorf("WithTx() = %v, want: %v", err, failure)
+		}
+		if dbMeetUp, err := store.GetMeetUpByUserHash(meetUp.UserHash); err != nil {
+			t.Fatalf("GetMeetUpByUserHash() failed: %s\n", err)
+		} else if len(dbMeetUp.Users) != 0 || dbMeetUp.Description != "meetUp description" {
+			t.Errorf("the failed transaction was kept: %+v", dbMeetUp)
+		}
+
+		// A successful one is kept, including a nested one
+		err = store.WithTx(func(tx Store) error {
+			return tx.WithTx(func(tx Store) error {
+				return tx.CreateUser(&User{IdMeetUp: meetUp.Id, Name: "alice", Dates: []int64{1550487600000}})
+			})
+		})
+		if err != nil {
+			t.Fatalf("WithTx() failed: %s\n", err)
+		}
+		if users, err := store.GetUsersByMeetUpId(meetUp.Id); err != nil {
+			t.Fatalf("GetUsersByMeetUpId() failed: %s\n", err)
+		} else if len(users) != 1 || users[0].Name != "alice" {
+			t.Errorf("users after the transaction = %+v, want: alice", users)
+		}
+	})
+}
+
+// Concurrent creates of a user with the same name make one user, the others get errUserExists.
+func TestStore_CreateUserUniqueName(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store Store) {
+		var meetUp = MeetUp{UserHash: "abc", AdminHash: "def", Dates: []int64{1550401200000}, Description: "meetUp description"}
+		if err := store.CreateMeetUp(&meetUp); err != nil {
+			t.Fatalf("CreateMeetUp() failed: %s\n", err)
+		}
+
+		const creates = 10
+		errs := make(chan error, creates)
+		var wg sync.WaitGroup
+		for i := 0; i < creates; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				errs <- store.CreateUser(&User{IdMeetUp: meetUp.Id, Name: "bob", Dates: []int64{1550401200000}})
+			}()
+		}
+		wg.Wait()
+		close(errs)
+
+		var created int
+		for err := range errs {
+			if err == nil {
+				created++
+			} else if errors.Is(err, errUserExists) == false {
+				t.Errorf("CreateUser() failed: %s", err)
+			}
+		}
+		if created != 1 {
+			t.Errorf("%d creates succeeded, want: 1", created)
+		}
+
+		// Renaming another user to the name fails too
+		var alice = User{IdMeetUp: meetUp.Id, Name: "alice"}
+		if err := store.CreateUser(&alice); err != nil {
+			t.Fatalf("CreateUser() failed: %s\n", err)
+		}
+		alice.Name = "bob"
+		if err := store.UpdateUser(&alice); errors.Is(err, errUserExists) == false {
+			t.Errorf("UpdateUser() to a taken name = %v, want: %v", err, errUserExists)
+		}
+
+		if users, err := store.GetUsersByMeetUpId(meetUp.Id); err != nil {
+			t.Fatalf("GetUsersByMeetUpId() failed: %s\n", err)
+		} else if len(users) != 2 || users[0].Name != "bob" || users[1].Name != "alice" {
+			t.Errorf("users = %+v, want: bob and alice", users)
+		}
+	})
+}
+
+// The sqlite file only has the digests of the hashes and the encrypted userhash. A database from before the digests
+// is migrated, its meetups are found by the same hashes.
+func TestSqlStore_TokenDigests(t *testing.T) {
+	testDbName := MakeTestFile(t)
+	defer os.Remove(testDbName)
+	dsn := "file:" + testDbName + "?_foreign_keys=1&_txlock=immediate"
+
+	// A database at version 8, with the hashes as they are
+	db, err := sql.Open("sqlite3", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, statement := range []string{
+		`CREATE TABLE meetup (idmeetup INTEGER PRIMARY KEY ASC, userhash TEXT NOT NULL, adminhash TEXT NOT NULL, description TEXT NOT NULL, finaldate INTEGER NOT NULL DEFAULT 0, lastmodified INTEGER NOT NULL DEFAULT 0)`,
+		`CREATE TABLE "user" (iduser INTEGER PRIMARY KEY ASC NOT NULL, idmeetup INTEGER NOT NULL, name TEXT NOT NULL, token TEXT NOT NULL DEFAULT '', FOREIGN KEY (idmeetup) REFERENCES meetup (idmeetup) ON DELETE CASCADE)`,
+		`CREATE INDEX "user.fk_user_meetup_idx" ON "user" ("idmeetup")`,
+		`CREATE TABLE meetup_option (idoption INTEGER PRIMARY KEY ASC NOT NULL, idmeetup INTEGER NOT NULL, date INTEGER NOT NULL, duration INTEGER NOT NULL DEFAULT 0, UNIQUE (idmeetup, date), FOREIGN KEY (idmeetup) REFERENCES meetup (idmeetup) ON DELETE CASCADE)`,
+		`CREATE TABLE user_availability (iduser INTEGER NOT NULL, idoption INTEGER NOT NULL, availability TEXT NOT NULL CHECK (availability IN ('yes', 'ifneedbe')), PRIMARY KEY (iduser, idoption), FOREIGN KEY (iduser) REFERENCES "user" (iduser) ON DELETE CASCADE, FOREIGN KEY (idoption) REFERENCES meetup_option (idoption) ON DELETE CASCADE)`,
+		`CREATE INDEX "user_availability.fk_availability_option_idx" ON user_availability ("idoption")`,
+	} {
+		if _, err = db.Exec(statement); err != nil {
+			t.Fatalf("%s: %s", statement, err)
+		}
+	}
+	old := MeetUp{UserHash: "6cf51863dcbd352c9da7fc0670a34a7173056413214ac0e22f0effd1015a7fa907399f9107fd48689d3800043ff12bbd33a24a433a6ede783bda3423c9820278", AdminHash: "a39f823a49a4fbdfc2906a4baf0dce97a216d8b5bf6b0ab83a31d04c2d84ae619a6e017368a434ecb7b09b54015d22455062ac199ec48aa5b1c0dea830c3ecb6"}
+	if _, err = db.Exec(`INSERT INTO meetup(idmeetup, userhash, adminhash, description) values(1,?,?,'old')`, old.UserHash, old.AdminHash); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	store, err := openSqliteStore(dsn, newTestTokenCipher(t))
+	if err != nil {
+		t.Fatalf("openSqliteStore() failed: %s", err)
+	}
+	defer store.Close()
+	if m, err := store.GetMeetUpByUserHash(old.UserHash); err != nil || m.Id != 1 || m.UserHash != old.UserHash || m.AdminHash != "" {
+		t.Errorf("GetMeetUpByUserHash() of the migrated meetup = %+v, %v\n", m, err)
+	}
+	if m, err := store.GetMeetUpByAdminHash(old.AdminHash); err != nil || m.Id != 1 || m.UserHash != old.UserHash || m.AdminHash != old.AdminHash {
+		t.Errorf("GetMeetUpByAdminHash() of the migrated meetup = %+v, %v\n", m, err)
+	}
+
+	meetUp := MeetUp{Dates: []int64{1550401200000}, Description: "new"}
+	if meetUp.UserHash, err = generateHash(); err != nil {
+		t.Fatal(err)
+	}
+	if meetUp.AdminHash, err = generateHash(); err != nil {
+		t.Fatal(err)
+	}
+	if err = store.CreateMeetUp(&meetUp); err != nil {
+		t.Fatalf("CreateMeetUp() failed: %s\n", err)
+	}
+	if m, err := store.GetMeetUpByAdminHash(meetUp.AdminHash); err != nil || m.Id != meetUp.Id || m.UserHash != meetUp.UserHash {
+		t.Errorf("GetMeetUpByAdminHash() = %+v, %v\n", m, err)
+	}
+
+	// None of the hashes is in the rows
+	rows, err := store.db.Query(`SELECT userdigest || admindigest || usersealed FROM meetup`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var row string
+		if err = rows.Scan(&row); err != nil {
+			t.Fatal(err)
+		}
+		for _, hash := range []string{old.UserHash, old.AdminHash, meetUp.UserHash, meetUp.AdminHash} {
+			if strings.Contains(row, hash) {
+				t.Errorf("the meetup row %q has the hash %q\n", row, hash)
+			}
+		}
+	}
+
+	// Nor anywhere in the file, the migration overwrote the old hashes
+	if data, err := os.ReadFile(testDbName); err != nil {
+		t.Fatal(err)
+	} else if strings.Contains(string(data), old.UserHash) || strings.Contains(string(data), old.AdminHash) {
+		t.Errorf("the database file still has the hashes from before the migration\n")
+	}
+
+	// Another key doesn't find the meetups
+	other, err := newTokenCipher(make([]byte, tokenKeyLen))
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.tokens = other
+	if _, err = store.GetMeetUpByUserHash(meetUp.UserHash); errors.Is(err, ErrNotFound) == false {
+		t.Errorf("GetMeetUpByUserHash() with another key = %v, want: ErrNotFound\n", err)
+	}
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"sort"
+)
+
+// Scores given to each answer when ranking the meetup options
+const (
+	yesScore      = 2
+	ifNeedBeScore = 1
+)
+
+// OptionSummary The answers of all the users for one meetup option.
+type OptionSummary struct {
+	Slot
+	Score    int      `json:"score"`
+	Yes      int      `json:"yes"`
+	IfNeedBe int      `json:"ifneedbe"`
+	No       int      `json:"no"`
+	Missing  []string `json:"missing"` // names of the users that can't make it
+}
+
+// Summary Scores each of the meetup options from the users' answers, and returns them best first.
+// Options are ranked by score, then by the number of yes answers, then by the earliest start.
+func (m *MeetUp) Summary() []OptionSummary {
+	slots := m.Slots()
+	summaries := make([]OptionSummary, len(slots))
+
+	for i, slot := range slots {
+		summaries[i] = OptionSummary{Slot: slot, Missing: make([]string, 0)}
+
+		for _, user := range m.Users {
+			switch user.Availability(slot.Start) {
+			case AvailableYes:
+				summaries[i].Yes++
+				summaries[i].Score += yesScore
+			case AvailableIfNeedBe:
+				summaries[i].IfNeedBe++
+				summaries[i].Score += ifNeedBeScore
+			default:
+				summaries[i].No++
+				summaries[i].Missing = append(summaries[i].Missing, user.Name)
+			}
+		}
+	}
+
+	sort.SliceStable(summaries, func(i, j int) bool {
+		if summaries[i].Score != summaries[j].Score {
+			return summaries[i].Score > summaries[j].Score
+		} else if summaries[i].Yes != summaries[j].Yes {
+			return summaries[i].Yes > summaries[j].Yes
+		}
+		return summaries[i].Start < summaries[j].Start
+	})
+
+	return summaries
+}
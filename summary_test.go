@@ -0,0 +1,50 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestMeetUp_Summary(t *testing.T) {
+	var meetUp = MeetUp{
+		Dates: []int64{1550401200000, 1550487600000, 1550574000000, 1550660400000},
+		Users: Users{
+			{Name: "user1", Dates: []int64{1550401200000, 1550487600000}, IfNeedBe: []int64{1550574000000}},
+			{Name: "user2", Dates: []int64{1550487600000}, IfNeedBe: []int64{1550401200000}},
+			{Name: "user3", Dates: []int64{1550574000000}, IfNeedBe: []int64{1550401200000}},
+		},
+	}
+
+	summaries := meetUp.Summary()
+
+	var expected = []struct {
+		start                    int64
+		score, yes, ifNeedBe, no int
+		missing                  []string
+	}{
+		{1550487600000, 4, 2, 0, 1, []string{"user3"}}, // Equal scores get ranked by the most yes answers
+		{1550401200000, 4, 1, 2, 0, []string{}},
+		{1550574000000, 3, 1, 1, 1, []string{"user2"}},
+		{1550660400000, 0, 0, 0, 3, []string{"user1", "user2", "user3"}},
+	}
+
+	if len(summaries) != len(expected) {
+		t.Fatalf("Summary() returned %d options, want: %d", len(summaries), len(expected))
+	}
+
+	for i, exp := range expected {
+		sum := summaries[i]
+		if sum.Start != exp.start || sum.Score != exp.score || sum.Yes != exp.yes || sum.IfNeedBe != exp.ifNeedBe || sum.No != exp.no || reflect.DeepEqual(sum.Missing, exp.missing) == false {
+			t.Errorf("Summary()[%d] = %+v, want: %+v", i, sum, exp)
+		}
+	}
+}
+
+func TestMeetUp_SummaryNoUsers(t *testing.T) {
+	var meetUp = MeetUp{Dates: []int64{1550487600000, 1550401200000}, Durations: []int64{3600000, 3600000}, Users: Users{}}
+
+	summaries := meetUp.Summary()
+	if len(summaries) != 2 || summaries[0].Start != 1550401200000 || summaries[0].End != 1550404800000 || summaries[0].Missing == nil {
+		t.Errorf("Summary() = %+v", summaries)
+	}
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"mycode/catherder/migrations"
+	"os"
+	"strings"
+)
+
+const tokenKeyLen = 32 // The length of the token key, random bytes
+
+// tokenCipher Turns the meetup hashes into what the database stores. Both hashes are stored as their keyed digest,
+// which the meetup is looked up by, so a copy of the database can't be used to open or change a meetup. The userhash
+// is also stored encrypted, for the links to the meetup the server hands out. The adminhash can't be recovered.
+type tokenCipher struct {
+	digestKey []byte
+	userHash  cipher.AEAD
+}
+
+// newTokenCipher Returns the tokenCipher of the key. The digests and the encryption each use their own key derived
+// from it, see deriveKey.
+func newTokenCipher(key []byte) (*tokenCipher, error) {
+	if len(key) < tokenKeyLen {
+		return nil, fmt.Errorf("the token key is %d bytes, want at least %d", len(key), tokenKeyLen)
+	}
+
+	block, err := aes.NewCipher(deriveKey(key, "catherder userhash"))
+	if err != nil {
+		return nil, err
+	}
+	userHash, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &tokenCipher{digestKey: deriveKey(key, "catherder digest"), userHash: userHash}, nil
+}
+
+// deriveKey Returns the key for the purpose derived from the token key, so each use of it has its own key.
+func deriveKey(key []byte, purpose string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(purpose))
+	return mac.Sum(nil)
+}
+
+// digest Returns the keyed digest of a meetup hash, as hex.
+func (c *tokenCipher) digest(token string) string {
+	mac := hmac.New(sha256.New, c.digestKey)
+	mac.Write([]byte(token))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// seal Returns the userhash encrypted, as hex. Each call has its own nonce.
+func (c *tokenCipher) seal(userHash string) (string, error) {
+	nonce := make([]byte, c.userHash.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(c.userHash.Seal(nonce, nonce, []byte(userHash), nil)), nil
+}
+
+// open Returns the userhash that seal encrypted. Fails if it was sealed with another key or was changed.
+func (c *tokenCipher) open(sealed string) (string, error) {
+	data, err := hex.DecodeString(sealed)
+	if err != nil {
+		return "", err
+	}
+	if len(data) < c.userHash.NonceSize() {
+		return "", errors.New("the sealed userhash is too short")
+	}
+	userHash, err := c.userHash.Open(nil, data[:c.userHash.NonceSize()], data[c.userHash.NonceSize():], nil)
+	if err != nil {
+		return "", fmt.Errorf("the userhash can't be decrypted, is it the same token key? %w", err)
+	}
+	return string(userHash), nil
+}
+
+// migrationEnv Returns what the migrations need to convert the hashes of an existing database.
+func (c *tokenCipher) migrationEnv() migrations.Env {
+	return migrations.Env{DigestToken: c.digest, SealToken: c.seal}
+}
+
+// loadTokenKey Reads the token key from the hex file at path. Creates the file with a random key if it doesn't exist.
+// The meetups can't be found with another key, the file has to be kept as long as the database. It's backed up
+// apart from the database, or a copy of both can open the meetups again.
+func loadTokenKey(path string) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if err == nil {
+		return hex.DecodeString(strings.TrimSpace(string(data)))
+	} else if errors.Is(err, fs.ErrNotExist) == false {
+		return nil, err
+	}
+
+	key := make([]byte, tokenKeyLen)
+	if _, err = rand.Read(key); err != nil {
+		return nil, err
+	}
+	// O_EXCL so a key another server just created isn't overwritten
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = file.WriteString(hex.EncodeToString(key) + "\n"); err != nil {
+		file.Close()
+		return nil, err
+	}
+	if err = file.Close(); err != nil {
+		return nil, err
+	}
+	log.Printf("Created a new token key at %s. The meetups can't be opened without it, back it up apart from the database.", path)
+	return key, nil
+}
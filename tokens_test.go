@@ -0,0 +1,84 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Returns a tokenCipher with a fixed key, for the sql stores of the tests.
+func newTestTokenCipher(t *testing.T) *tokenCipher {
+	tokens, err := newTokenCipher(bytes.Repeat([]byte{7}, tokenKeyLen))
+	if err != nil {
+		t.Fatalf("newTokenCipher() failed: %s\n", err)
+	}
+	return tokens
+}
+
+func TestTokenCipher(t *testing.T) {
+	tokens := newTestTokenCipher(t)
+	userHash, err := generateHash()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The digest is the same for the same key, and doesn't give the hash away
+	digest := tokens.digest(userHash)
+	if digest != tokens.digest(userHash) || digest == tokens.digest(userHash[1:]) || strings.Contains(digest, userHash[:16]) {
+		t.Errorf("digest(%q) = %q\n", userHash, digest)
+	}
+	other, err := newTokenCipher(bytes.Repeat([]byte{8}, tokenKeyLen))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if other.digest(userHash) == digest {
+		t.Errorf("another key has the same digest %q\n", digest)
+	}
+
+	// Sealing twice gives different ciphertexts, that open to the hash with the same key only
+	sealed, err := tokens.seal(userHash)
+	if err != nil {
+		t.Fatalf("seal() failed: %s\n", err)
+	}
+	if again, _ := tokens.seal(userHash); again == sealed || strings.Contains(sealed, userHash) {
+		t.Errorf("seal(%q) = %q, then %q\n", userHash, sealed, again)
+	}
+	if opened, err := tokens.open(sealed); err != nil || opened != userHash {
+		t.Errorf("open() = %q, %v, want: %q\n", opened, err, userHash)
+	}
+	if _, err = other.open(sealed); err == nil {
+		t.Errorf("open() with another key succeeded\n")
+	}
+	if _, err = tokens.open(sealed[:len(sealed)-2] + "00"); err == nil {
+		t.Errorf("open() of a changed ciphertext succeeded\n")
+	}
+
+	if _, err = newTokenCipher([]byte("short")); err == nil {
+		t.Errorf("newTokenCipher() of a short key succeeded\n")
+	}
+}
+
+func TestLoadTokenKey(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "token.key")
+
+	// The first start creates the key, the next ones read it
+	key, err := loadTokenKey(path)
+	if err != nil || len(key) != tokenKeyLen {
+		t.Fatalf("loadTokenKey() = %x, %v\n", key, err)
+	}
+	if info, err := os.Stat(path); err != nil || info.Mode().Perm() != 0600 {
+		t.Errorf("the key file is %v, %v, want: -rw-------\n", info, err)
+	}
+	if again, err := loadTokenKey(path); err != nil || bytes.Equal(again, key) == false {
+		t.Errorf("loadTokenKey() again = %x, %v, want: %x\n", again, err, key)
+	}
+
+	if err = os.WriteFile(path, []byte("not hex\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = loadTokenKey(path); err == nil {
+		t.Errorf("loadTokenKey() of an invalid file succeeded\n")
+	}
+}
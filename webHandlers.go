@@ -1,8 +1,12 @@
 package main
 
 import (
+	"crypto/hmac"
+	"errors"
 	"log"
 	"net/http"
+	"strconv"
+	"time"
 )
 
 // Routes all non /api/... requests
@@ -81,3 +85,65 @@ func pageViewHandler(w http.ResponseWriter, r *http.Request) {
 		log.Println(err)
 	}
 }
+
+// errConfirmLink Returned by confirmEmail when the link isn't one the server sent, or the address changed since.
+var errConfirmLink = errors.New("the link is invalid, or the meetup's address changed since it was sent")
+
+// Creates the page for https://host/confirm?meetup=id&code=code, the link confirming an organiser's address. Opening
+// it only shows a button, which POSTs the form back to confirm, so a mail scanner opening the link doesn't confirm it.
+func (s *server) pageConfirmHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Security-Policy", "default-src 'none'; script-src 'self'; connect-src 'self'; img-src 'self'; style-src 'self'; form-action 'self';")
+	w.Header().Set("Strict-Transport-Security", "max-age=31536000; includeSubDomains")
+	t, httpCode := templateJobber("/confirm", nil)
+	if httpCode > 0 {
+		http.Error(w, http.StatusText(httpCode), httpCode)
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, maxShortJsonBytesLen)
+	data := struct {
+		MeetUp    string
+		Code      string
+		Ask       bool // Shows the button
+		Confirmed bool
+	}{MeetUp: r.FormValue("meetup"), Code: r.FormValue("code"), Ask: r.Method != http.MethodPost}
+
+	if r.Method == http.MethodPost {
+		if err := s.confirmEmail(data.MeetUp, data.Code); err == nil {
+			data.Confirmed = true
+		} else if errors.Is(err, errConfirmLink) == false {
+			log.Printf("pageConfirmHandler failed: %s\n", err)
+			http.Error(w, "database error.", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	if err := t.ExecuteTemplate(w, "confirm.gohtml", data); err != nil {
+		log.Println(err)
+	}
+}
+
+// confirmEmail Confirms the email of the meetup with the id, if code is the one of its link. Returns errConfirmLink
+// if it isn't. It's not a change of the meetup: the revision the admin page has stays valid and nothing is notified.
+func (s *server) confirmEmail(rawId, code string) error {
+	id, err := strconv.ParseInt(rawId, 10, 64)
+	if err != nil || s.mail == nil {
+		return errConfirmLink
+	}
+
+	return s.store.WithTx(func(tx Store) error {
+		meetUp, err := tx.ReadMeetUp(id)
+		if errors.Is(err, ErrNotFound) {
+			return errConfirmLink
+		} else if err != nil {
+			return err
+		}
+		if meetUp.Email == "" || hmac.Equal([]byte(code), []byte(s.mail.emailCode(meetUp.Id, meetUp.Email))) == false {
+			return errConfirmLink
+		} else if meetUp.EmailConfirmed != 0 {
+			return nil
+		}
+
+		return tx.ConfirmMeetUpEmail(meetUp.Id, meetUp.Email, time.Now().UnixMilli())
+	})
+}
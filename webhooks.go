@@ -0,0 +1,348 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// The events a webhook is POSTed for, the event field of its payload.
+const (
+	webhookParticipantAdded   = "participant.added"
+	webhookParticipantChanged = "participant.changed"
+	webhookParticipantRemoved = "participant.removed"
+	webhookMeetUpEdited       = "meetup.edited" // Also when it's finalised or reopened
+	webhookMeetUpDeleted      = "meetup.deleted"
+	webhookMeetUpRestored     = "meetup.restored" // Its deletion was undone
+	webhookMeetUpRotated      = "meetup.rotated"  // Its hashes were replaced, the payload has the new userhash
+)
+
+const maxWebhooks = 10       // The most webhooks a meetup can have
+const maxWebhookUrlLen = 512 // The longest webhook url
+
+// webhookPayload The json body POSTed to a webhook.
+type webhookPayload struct {
+	Event       string   `json:"event"`
+	Timestamp   int64    `json:"timestamp"` // When it happened, UNIX timestamp in milliseconds
+	MeetUp      meetUpV2 `json:"meetup"`    // After the change, before it for meetup.deleted
+	Participant *User    `json:"participant,omitempty"`
+}
+
+// queueWebhooks Queues a delivery of the event to each webhook of the meetup, in the transaction of the change so
+// it is only sent if the change is kept. participant is the one added, changed or removed, nil for meetup events.
+// Call notify on the server's webhookSender once the transaction is committed.
+func queueWebhooks(tx Store, idMeetUp int64, event string, participant *User) error {
+	webhooks, err := tx.GetWebhooksByMeetUpId(idMeetUp)
+	if err != nil || len(webhooks) == 0 {
+		return err
+	}
+
+	meetUp, err := tx.ReadMeetUp(idMeetUp)
+	if err != nil {
+		return err
+	}
+	if meetUp.Users, err = tx.GetUsersByMeetUpId(idMeetUp); err != nil {
+		return err
+	}
+
+	now := time.Now().UnixMilli()
+	payload, err := json.Marshal(webhookPayload{event, now, newMeetUpV2(meetUp), participant})
+	if err != nil {
+		return err
+	}
+
+	for _, webhook := range webhooks {
+		delivery := WebhookDelivery{Url: webhook.Url, Secret: webhook.Secret, Payload: payload, NextAttempt: now}
+		if err = tx.QueueDelivery(&delivery); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// signPayload Returns the X-Catherder-Signature header of a payload: sha256= and the hex HMAC-SHA256 of it, keyed
+// with the webhook secret.
+func signPayload(secret string, payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(payload)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Validates the url of a new webhook, an absolute http or https url of a public host. allowPrivate lets it be a
+// loopback or private address.
+func validateWebhookUrl(rawUrl string, allowPrivate bool) error {
+	u, err := url.Parse(rawUrl)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return invalidField("url", "The webhook url must be an http or https url.")
+	} else if len(rawUrl) > maxWebhookUrlLen {
+		return invalidField("url", "The webhook url is too long.")
+	}
+
+	// Only the addresses that are obviously internal, the sender checks the ones a name resolves to when it dials
+	host := strings.TrimSuffix(strings.ToLower(u.Hostname()), ".")
+	addr, err := netip.ParseAddr(host)
+	if !allowPrivate && (host == "localhost" || strings.HasSuffix(host, ".localhost") || (err == nil && isPublicAddr(addr) == false)) {
+		return invalidField("url", "The webhook url must be a public address.")
+	}
+	return nil
+}
+
+// nonPublicPrefixes The ranges isPublicAddr rejects on top of the loopback, private, link-local, multicast and
+// unspecified addresses.
+var nonPublicPrefixes = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),      // This network
+	netip.MustParsePrefix("100.64.0.0/10"),  // Carrier-grade NAT
+	netip.MustParsePrefix("192.0.0.0/24"),   // IETF protocol assignments
+	netip.MustParsePrefix("198.18.0.0/15"),  // Benchmarking
+	netip.MustParsePrefix("240.0.0.0/4"),    // Reserved, and the broadcast address
+	netip.MustParsePrefix("64:ff9b::/96"),   // NAT64, could reach any of the IPv4 ones
+	netip.MustParsePrefix("64:ff9b:1::/48"), // Local NAT64
+}
+
+// isPublicAddr Reports whether a webhook can be sent to the address. The server's own network isn't reachable
+// through webhooks, as anyone can add one.
+func isPublicAddr(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	if addr.IsLoopback() || addr.IsPrivate() || addr.IsLinkLocalUnicast() || addr.IsLinkLocalMulticast() ||
+		addr.IsInterfaceLocalMulticast() || addr.IsMulticast() || addr.IsUnspecified() {
+		return false
+	}
+	for _, prefix := range nonPublicPrefixes {
+		if prefix.Contains(addr) {
+			return false
+		}
+	}
+	return true
+}
+
+// errPrivateAddress Returned when a webhook url resolves to an address that isn't public.
+var errPrivateAddress = errors.New("the webhook address isn't public")
+
+// newWebhookResult The json of a webhook when it's added, the only time its secret is sent.
+type newWebhookResult struct {
+	Webhook
+	Secret string `json:"secret"`
+}
+
+// Adds a webhook with the url to the meetup of read, with a new secret.
+func (s *server) createWebhook(read func(tx Store) (MeetUp, error), rawUrl string) (webhook Webhook, err error) {
+	if err = validateWebhookUrl(rawUrl, s.webhooks.allowPrivate); err != nil {
+		return webhook, err
+	}
+
+	webhook = Webhook{Url: rawUrl, Created: time.Now().UnixMilli()}
+	if webhook.Secret, err = generateHash(); err != nil {
+		log.Printf("createWebhook failed: error reading random bytes for the secret. %s\n", err)
+		return webhook, newApiError(http.StatusInternalServerError, codeInternalError, "Error reading random bytes.")
+	}
+
+	err = s.store.WithTx(func(tx Store) error {
+		meetUp, err := read(tx)
+		if err != nil {
+			return err
+		}
+
+		webhooks, err := tx.GetWebhooksByMeetUpId(meetUp.Id)
+		if err != nil {
+			return err
+		} else if len(webhooks) >= maxWebhooks {
+			return newApiError(http.StatusBadRequest, codeInvalidRequest, fmt.Sprintf("A meetup can't have more than %d webhooks.", maxWebhooks))
+		}
+
+		webhook.IdMeetUp = meetUp.Id
+		return tx.CreateWebhook(&webhook)
+	})
+	return webhook, err
+}
+
+// Returns the webhooks of the meetup of read.
+func (s *server) listWebhooks(read func(tx Store) (MeetUp, error)) (webhooks []Webhook, err error) {
+	err = s.store.WithTx(func(tx Store) error {
+		meetUp, err := read(tx)
+		if err != nil {
+			return err
+		}
+
+		webhooks, err = tx.GetWebhooksByMeetUpId(meetUp.Id)
+		return err
+	})
+	return
+}
+
+// errWebhookNotFound Returned by removeWebhook when the meetup has no webhook with the id.
+var errWebhookNotFound = newApiError(http.StatusNotFound, codeNotFound, "The webhook was not found.")
+
+// Deletes the webhook with the id from the meetup of read. Its deliveries still queued are sent.
+func (s *server) removeWebhook(read func(tx Store) (MeetUp, error), id int64) error {
+	return s.store.WithTx(func(tx Store) error {
+		meetUp, err := read(tx)
+		if err != nil {
+			return err
+		}
+
+		if err = tx.DeleteWebhook(meetUp.Id, id); errors.Is(err, ErrNotFound) {
+			return errWebhookNotFound
+		}
+		return err
+	})
+}
+
+// webhookSender POSTs the queued webhook deliveries, and retries the failed ones with exponential backoff until
+// maxAttempts. The queue is in the Store, so deliveries survive a restart. Only one sender should run per database.
+type webhookSender struct {
+	store        Store
+	client       *http.Client
+	wake         chan struct{} // Signalled by notify
+	pollInterval time.Duration // How often run looks for deliveries that are due without being notified
+	retryDelay   time.Duration // The delay after the first failure, doubled after each one after it
+	maxDelay     time.Duration
+	maxAttempts  int
+	allowPrivate bool // Lets the webhooks reach loopback and private addresses, only for the tests' receivers
+}
+
+// newWebhookSender Returns a sender of the deliveries queued in store. The addresses are checked as the connection is
+// made, after the name is resolved, so a name that resolves to a public address when the webhook is added and to a
+// private one later can't reach the server's network. No proxy is used, it would be the address checked.
+func newWebhookSender(store Store) *webhookSender {
+	d := &webhookSender{
+		store:        store,
+		wake:         make(chan struct{}, 1),
+		pollInterval: 15 * time.Second,
+		retryDelay:   30 * time.Second,
+		maxDelay:     6 * time.Hour,
+		maxAttempts:  12,
+	}
+
+	dialer := &net.Dialer{Timeout: 10 * time.Second, KeepAlive: 30 * time.Second, Control: d.checkAddress}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = nil
+	transport.DialContext = dialer.DialContext
+	d.client = &http.Client{
+		Transport: transport,
+		Timeout:   10 * time.Second,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse // A redirect is a failed delivery
+		},
+	}
+	return d
+}
+
+// checkAddress The net.Dialer Control of the sender's connections, fails those to an address that isn't public.
+func (d *webhookSender) checkAddress(network, address string, _ syscall.RawConn) error {
+	addrPort, err := netip.ParseAddrPort(address)
+	if err != nil {
+		return err
+	}
+	if !d.allowPrivate && isPublicAddr(addrPort.Addr()) == false {
+		return fmt.Errorf("%w: %s", errPrivateAddress, addrPort.Addr())
+	}
+	return nil
+}
+
+// notify Wakes run to send new deliveries. Never blocks.
+func (d *webhookSender) notify() {
+	select {
+	case d.wake <- struct{}{}:
+	default:
+	}
+}
+
+// run Sends the deliveries as they become due, until ctx is done.
+func (d *webhookSender) run(ctx context.Context) {
+	ticker := time.NewTicker(d.pollInterval)
+	defer ticker.Stop()
+
+	for {
+		d.sendDue(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-d.wake:
+		case <-ticker.C:
+		}
+	}
+}
+
+// sendDue Sends every delivery that is due. A delivered one is removed from the queue, a failed one is put back
+// with a later NextAttempt, or dropped and logged after maxAttempts.
+func (d *webhookSender) sendDue(ctx context.Context) {
+	const batchLen = 20
+
+	for ctx.Err() == nil {
+		deliveries, err := d.store.GetDueDeliveries(time.Now().UnixMilli(), batchLen)
+		if err != nil {
+			log.Printf("webhookSender: error reading the queue: %s\n", err)
+			return
+		}
+
+		for _, delivery := range deliveries {
+			if err = d.send(ctx, delivery); err == nil {
+				err = d.store.DeleteDelivery(delivery.Id)
+			} else if delivery.Attempts+1 >= d.maxAttempts {
+				log.Printf("webhookSender: giving up on delivery %d to %s after %d attempts: %s\n", delivery.Id, delivery.Url, delivery.Attempts+1, err)
+				err = d.store.DeleteDelivery(delivery.Id)
+			} else {
+				delivery.Attempts++
+				delivery.LastError = err.Error()
+				delivery.NextAttempt = time.Now().Add(d.backoff(delivery.Attempts)).UnixMilli()
+				err = d.store.UpdateDelivery(&delivery)
+			}
+			if err != nil {
+				log.Printf("webhookSender: error writing the queue: %s\n", err)
+				return
+			}
+		}
+
+		if len(deliveries) < batchLen {
+			return
+		}
+	}
+}
+
+// backoff Returns the delay before the next attempt, after attempts failed ones.
+func (d *webhookSender) backoff(attempts int) time.Duration {
+	delay := d.retryDelay
+	for i := 1; i < attempts && delay < d.maxDelay; i++ {
+		delay *= 2
+	}
+	return min(delay, d.maxDelay)
+}
+
+// send POSTs the payload of the delivery. Any response but a 2xx is a failure.
+func (d *webhookSender) send(ctx context.Context, delivery WebhookDelivery) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, delivery.Url, bytes.NewReader(delivery.Payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "catherder-webhook")
+	req.Header.Set("X-Catherder-Delivery", strconv.FormatInt(delivery.Id, 10))
+	req.Header.Set("X-Catherder-Signature", signPayload(delivery.Secret, delivery.Payload))
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 4096)) // Lets the connection be reused
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("response status %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,314 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// A webhook receiver, records the payloads POSTed to it. Responds with the statuses in order, then 200.
+type webhookReceiver struct {
+	*httptest.Server
+	mu       sync.Mutex
+	statuses []int
+	payloads []webhookTestPayload
+	received chan struct{} // Gets a value for each request
+}
+
+// The parts of a webhook payload the tests check, and whether its signature was valid.
+type webhookTestPayload struct {
+	Event       string `json:"event"`
+	MeetUp      meetUpV2
+	Participant *struct {
+		Name string `json:"name"`
+	} `json:"participant"`
+	signed bool
+}
+
+func newWebhookReceiver(t *testing.T, secret *string, statuses ...int) *webhookReceiver {
+	rec := &webhookReceiver{statuses: statuses, received: make(chan struct{}, 100)}
+	rec.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			t.Errorf("receiver: %s\n", err)
+		}
+
+		rec.mu.Lock()
+		status := http.StatusOK
+		if len(rec.statuses) > 0 {
+			status, rec.statuses = rec.statuses[0], rec.statuses[1:]
+		}
+		var payload webhookTestPayload
+		if err = json.Unmarshal(body, &payload); err != nil {
+			t.Errorf("receiver: invalid json %s: %s\n", body, err)
+		}
+		payload.signed = r.Header.Get("X-Catherder-Signature") == signPayload(*secret, body) &&
+			r.Header.Get("Content-Type") == "application/json" && r.Header.Get("X-Catherder-Delivery") != ""
+		if status == http.StatusOK {
+			rec.payloads = append(rec.payloads, payload)
+		}
+		rec.mu.Unlock()
+
+		w.WriteHeader(status)
+		rec.received <- struct{}{}
+	}))
+	t.Cleanup(rec.Close)
+	return rec
+}
+
+// Returns the payloads received so far.
+func (rec *webhookReceiver) received200() []webhookTestPayload {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	return append([]webhookTestPayload(nil), rec.payloads...)
+}
+
+// Adds a webhook to the meetup through the api, returns it with its secret.
+func addTestWebhook(t *testing.T, srv *server, adminHash, url string) newWebhookResult {
+	response := postApiRequest(t, srv.addWebhook, "/api/addwebhook", map[string]interface{}{"adminhash": adminHash, "url": url})
+	if response.Error != "" {
+		t.Fatalf("addWebhook error: %s\n", response.Error)
+	}
+	var webhook newWebhookResult
+	if err := json.Unmarshal(response.Result, &webhook); err != nil {
+		t.Fatal(err)
+	}
+	return webhook
+}
+
+func TestWebhooks_Events(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store Store) {
+		srv := newServer(store)
+		srv.webhooks.allowPrivate = true // The receiver is on the loopback address
+		meetUp := createApiTestMeetUp(t, store)
+		var secret string
+		rec := newWebhookReceiver(t, &secret)
+		secret = addTestWebhook(t, srv, meetUp.AdminHash, rec.URL).Secret
+
+		var requests = []struct {
+			handler http.HandlerFunc
+			body    map[string]interface{}
+		}{
+			{srv.updateUser, map[string]interface{}{"userhash": meetUp.UserHash, "username": "alice", "dates": meetUp.Dates[:1]}},
+			{srv.updateUser, map[string]interface{}{"userhash": meetUp.UserHash, "username": "alice", "adminhash": meetUp.AdminHash}},
+			{srv.deleteUser, map[string]interface{}{"userhash": meetUp.UserHash, "username": "alice", "adminhash": meetUp.AdminHash}},
+			{srv.updateMeetUp, map[string]interface{}{"adminhash": meetUp.AdminHash, "description": "b", "dates": meetUp.Dates}},
+			{srv.finaliseMeetUp, map[string]interface{}{"adminhash": meetUp.AdminHash, "date": meetUp.Dates[0]}},
+			{srv.updateUser, map[string]interface{}{"userhash": meetUp.UserHash, "username": "bob"}}, // Fails, the meetup is closed
+			{srv.deleteMeetUp, map[string]interface{}{"adminhash": meetUp.AdminHash}},
+		}
+		for _, request := range requests {
+			postApiRequest(t, request.handler, "/api/", request.body)
+		}
+
+		srv.webhooks.sendDue(context.Background())
+
+		payloads := rec.received200()
+		wantEvents := []string{webhookParticipantAdded, webhookParticipantChanged, webhookParticipantRemoved, webhookMeetUpEdited, webhookMeetUpEdited, webhookMeetUpDeleted}
+		if len(payloads) != len(wantEvents) {
+			t.Fatalf("received %d payloads, want: %d. %+v\n", len(payloads), len(wantEvents), payloads)
+		}
+		for i, payload := range payloads {
+			if payload.Event != wantEvents[i] || payload.signed == false || payload.MeetUp.UserHash != meetUp.UserHash {
+				t.Errorf("payload %d = %+v, want: a signed %s\n", i, payload, wantEvents[i])
+			}
+		}
+		if payloads[0].Participant == nil || payloads[0].Participant.Name != "alice" || len(payloads[0].MeetUp.Users) != 1 {
+			t.Errorf("participant.added payload = %+v\n", payloads[0])
+		} else if len(payloads[2].MeetUp.Users) != 0 {
+			t.Errorf("participant.removed payload lists the removed user\n")
+		} else if payloads[4].MeetUp.FinalDate != meetUp.Dates[0] || payloads[5].MeetUp.Description != "b" {
+			t.Errorf("meetup payloads = %+v\n", payloads[3:])
+		}
+
+		// The queue is empty
+		if deliveries, err := store.GetDueDeliveries(time.Now().UnixMilli(), 10); err != nil || len(deliveries) != 0 {
+			t.Errorf("GetDueDeliveries() = %v, %v after sending, want none\n", deliveries, err)
+		}
+	})
+}
+
+func TestWebhookSender_Retry(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store Store) {
+		srv := newServer(store)
+		srv.webhooks.retryDelay = time.Millisecond
+		srv.webhooks.maxAttempts = 3
+		srv.webhooks.allowPrivate = true
+		meetUp := createApiTestMeetUp(t, store)
+		var secret string
+		rec := newWebhookReceiver(t, &secret, http.StatusInternalServerError, http.StatusNotFound)
+		secret = addTestWebhook(t, srv, meetUp.AdminHash, rec.URL).Secret
+		postApiRequest(t, srv.updateUser, "/api/updateuser", map[string]interface{}{"userhash": meetUp.UserHash, "username": "alice"})
+
+		// The failure is recorded, and the delivery is put back for later
+		srv.webhooks.sendDue(context.Background())
+		deliveries, err := store.GetDueDeliveries(time.Now().Add(time.Hour).UnixMilli(), 10)
+		if err != nil || len(deliveries) != 1 {
+			t.Fatalf("GetDueDeliveries() = %v, %v, want one delivery\n", deliveries, err)
+		} else if deliveries[0].Attempts != 1 || deliveries[0].LastError == "" || deliveries[0].NextAttempt <= time.Now().Add(-time.Second).UnixMilli() {
+			t.Errorf("the failed delivery is %+v\n", deliveries[0])
+		}
+
+		for i := 0; i < 2; i++ {
+			time.Sleep(10 * time.Millisecond)
+			srv.webhooks.sendDue(context.Background())
+		}
+		if payloads := rec.received200(); len(payloads) != 1 || payloads[0].Event != webhookParticipantAdded {
+			t.Errorf("received %+v after the retries, want the participant.added payload\n", payloads)
+		}
+
+		// A delivery that keeps failing is dropped after maxAttempts
+		rec.mu.Lock()
+		rec.statuses = []int{500, 500, 500, 500}
+		rec.mu.Unlock()
+		postApiRequest(t, srv.deleteUser, "/api/deleteuser", map[string]interface{}{"userhash": meetUp.UserHash, "username": "alice", "adminhash": meetUp.AdminHash})
+		for i := 0; i < 3; i++ {
+			srv.webhooks.sendDue(context.Background())
+			time.Sleep(10 * time.Millisecond)
+		}
+		if deliveries, err = store.GetDueDeliveries(time.Now().Add(time.Hour).UnixMilli(), 10); err != nil || len(deliveries) != 0 {
+			t.Errorf("GetDueDeliveries() = %v, %v after maxAttempts, want none\n", deliveries, err)
+		}
+		if len(rec.received) != 6 {
+			t.Errorf("the receiver got %d requests, want: 6\n", len(rec.received))
+		}
+	})
+}
+
+func TestWebhookSender_Backoff(t *testing.T) {
+	d := newWebhookSender(newMemStore())
+	d.retryDelay, d.maxDelay = time.Second, 10*time.Second
+
+	for attempts, want := range map[int]time.Duration{1: time.Second, 2: 2 * time.Second, 3: 4 * time.Second, 4: 8 * time.Second, 5: 10 * time.Second, 60: 10 * time.Second} {
+		if got := d.backoff(attempts); got != want {
+			t.Errorf("backoff(%d) = %s, want: %s\n", attempts, got, want)
+		}
+	}
+}
+
+func TestWebhookSender_Run(t *testing.T) {
+	srv := newServer(newMemStore())
+	srv.webhooks.pollInterval = time.Hour // Only notify wakes it
+	srv.webhooks.allowPrivate = true
+	meetUp := createApiTestMeetUp(t, srv.store)
+	var secret string
+	rec := newWebhookReceiver(t, &secret)
+	secret = addTestWebhook(t, srv, meetUp.AdminHash, rec.URL).Secret
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		srv.webhooks.run(ctx)
+		close(done)
+	}()
+
+	postApiRequest(t, srv.updateUser, "/api/updateuser", map[string]interface{}{"userhash": meetUp.UserHash, "username": "alice"})
+	select {
+	case <-rec.received:
+	case <-time.After(5 * time.Second):
+		t.Error("the change wasn't delivered")
+	}
+
+	cancel()
+	<-done
+}
+
+// A webhook that reaches a private address anyway, like a name that resolves to one, fails when it's sent.
+func TestWebhookSender_PrivateAddress(t *testing.T) {
+	srv := newServer(newMemStore())
+	srv.webhooks.maxAttempts = 2
+	meetUp := createApiTestMeetUp(t, srv.store)
+	var secret string
+	rec := newWebhookReceiver(t, &secret)
+	if err := srv.store.CreateWebhook(&Webhook{IdMeetUp: meetUp.Id, Url: rec.URL, Secret: "secret", Created: 1550401200000}); err != nil {
+		t.Fatal(err)
+	}
+	postApiRequest(t, srv.updateUser, "/api/updateuser", map[string]interface{}{"userhash": meetUp.UserHash, "username": "alice"})
+
+	srv.webhooks.sendDue(context.Background())
+	deliveries, err := srv.store.GetDueDeliveries(time.Now().Add(time.Hour).UnixMilli(), 10)
+	if err != nil || len(deliveries) != 1 {
+		t.Fatalf("GetDueDeliveries() = %v, %v, want one delivery\n", deliveries, err)
+	} else if strings.Contains(deliveries[0].LastError, errPrivateAddress.Error()) == false {
+		t.Errorf("the delivery failed with %q, want: %s\n", deliveries[0].LastError, errPrivateAddress)
+	}
+	if len(rec.received) != 0 {
+		t.Errorf("the receiver on the loopback address got %d requests\n", len(rec.received))
+	}
+}
+
+func TestIsPublicAddr(t *testing.T) {
+	for address, want := range map[string]bool{
+		"93.184.215.14": true, "2606:2800:21f:cb07:6820:80da:af6b:8b2c": true,
+		"127.0.0.1": false, "127.1.2.3": false, "::1": false, "10.1.2.3": false, "172.16.0.1": false, "192.168.0.1": false,
+		"169.254.169.254": false, "fe80::1": false, "fd00::1": false, "0.0.0.0": false, "::": false, "100.64.0.1": false,
+		"::ffff:10.0.0.1": false, "64:ff9b::a00:1": false, "224.0.0.1": false, "255.255.255.255": false,
+	} {
+		if got := isPublicAddr(netip.MustParseAddr(address)); got != want {
+			t.Errorf("isPublicAddr(%s) = %t, want: %t\n", address, got, want)
+		}
+	}
+}
+
+func TestWebhookApi(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store Store) {
+		srv := newServer(store)
+		meetUp := createApiTestMeetUp(t, store)
+		webhook := addTestWebhook(t, srv, meetUp.AdminHash, "https://example.com/hook")
+		if webhook.Secret == "" || webhook.Url != "https://example.com/hook" {
+			t.Errorf("addWebhook returned %+v\n", webhook)
+		}
+
+		// The list leaves out the secret
+		response := postApiRequest(t, srv.getWebhooks, "/api/getwebhooks", map[string]interface{}{"adminhash": meetUp.AdminHash})
+		var webhooks []map[string]interface{}
+		if err := json.Unmarshal(response.Result, &webhooks); err != nil || len(webhooks) != 1 {
+			t.Fatalf("getWebhooks returned %s, %v\n", response.Result, err)
+		} else if _, found := webhooks[0]["secret"]; found || webhooks[0]["id"] != float64(webhook.Id) {
+			t.Errorf("getWebhooks returned %v\n", webhooks)
+		}
+
+		var tests = []struct {
+			name     string
+			handler  http.HandlerFunc
+			request  map[string]interface{}
+			wantCode string
+		}{
+			{"not a url", srv.addWebhook, map[string]interface{}{"adminhash": meetUp.AdminHash, "url": "example.com"}, codeInvalidRequest},
+			{"not http", srv.addWebhook, map[string]interface{}{"adminhash": meetUp.AdminHash, "url": "file:///etc/passwd"}, codeInvalidRequest},
+			{"loopback", srv.addWebhook, map[string]interface{}{"adminhash": meetUp.AdminHash, "url": "http://127.0.0.1:8080/hook"}, codeInvalidRequest},
+			{"loopback ipv6", srv.addWebhook, map[string]interface{}{"adminhash": meetUp.AdminHash, "url": "http://[::1]/hook"}, codeInvalidRequest},
+			{"mapped loopback", srv.addWebhook, map[string]interface{}{"adminhash": meetUp.AdminHash, "url": "http://[::ffff:127.0.0.1]/hook"}, codeInvalidRequest},
+			{"localhost", srv.addWebhook, map[string]interface{}{"adminhash": meetUp.AdminHash, "url": "http://LocalHost./hook"}, codeInvalidRequest},
+			{"private", srv.addWebhook, map[string]interface{}{"adminhash": meetUp.AdminHash, "url": "https://192.168.1.1/hook"}, codeInvalidRequest},
+			{"metadata", srv.addWebhook, map[string]interface{}{"adminhash": meetUp.AdminHash, "url": "http://169.254.169.254/latest/meta-data"}, codeInvalidRequest},
+			{"unspecified", srv.addWebhook, map[string]interface{}{"adminhash": meetUp.AdminHash, "url": "http://0.0.0.0/hook"}, codeInvalidRequest},
+			{"user hash", srv.addWebhook, map[string]interface{}{"adminhash": meetUp.UserHash, "url": "https://example.com"}, codeNotFound},
+			{"invalid hash", srv.getWebhooks, map[string]interface{}{"adminhash": "abc"}, codeInvalidHash},
+			{"delete unknown", srv.deleteWebhook, map[string]interface{}{"adminhash": meetUp.AdminHash, "id": webhook.Id + 1}, codeNotFound},
+			{"delete", srv.deleteWebhook, map[string]interface{}{"adminhash": meetUp.AdminHash, "id": webhook.Id}, ""},
+			{"delete again", srv.deleteWebhook, map[string]interface{}{"adminhash": meetUp.AdminHash, "id": webhook.Id}, codeNotFound},
+		}
+		for _, test := range tests {
+			if response := postApiRequest(t, test.handler, "/api/", test.request); response.Code != test.wantCode {
+				t.Errorf("%s: code = %q, want: %q. error: %s\n", test.name, response.Code, test.wantCode, response.Error)
+			}
+		}
+
+		// At most maxWebhooks
+		for i := 0; i < maxWebhooks; i++ {
+			addTestWebhook(t, srv, meetUp.AdminHash, "https://example.com/hook")
+		}
+		response = postApiRequest(t, srv.addWebhook, "/api/addwebhook", map[string]interface{}{"adminhash": meetUp.AdminHash, "url": "https://example.com/hook"})
+		if response.Code != codeInvalidRequest {
+			t.Errorf("adding more than maxWebhooks: code = %q, want: %q\n", response.Code, codeInvalidRequest)
+		}
+	})
+}